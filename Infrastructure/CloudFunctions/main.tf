@@ -32,10 +32,16 @@ resource "google_cloudfunctions2_function" "function" {
   }
   service_config {
     min_instance_count             = 1
-    available_memory               = "256Mi"
+    max_instance_count             = each.value.max_instances
+    max_instance_request_concurrency = each.value.concurrency
+    available_cpu                  = each.value.cpu
+    available_memory               = each.value.memory
     timeout_seconds                = 120
     all_traffic_on_latest_revision = false
     service_account_email          = "capstone-takeoff@capstore-takeoff.iam.gserviceaccount.com"
+    environment_variables = {
+      PUSH_AUDIENCE = var.push_audience
+    }
   }
   #  lifecycle {
   #   prevent_destroy = true
@@ -6,6 +6,12 @@ variable "region" {
   default = "us-central1"
 }
 
+# Audience the internal endpoints accept push tokens for; the same as
+# push_audience of PubSub and common.PushAudience
+variable "push_audience" {
+  default = "capstore-takeoff-push"
+}
+
 variable "functions" {
   type = map(object({
     zip        = string
@@ -14,6 +20,11 @@ variable "functions" {
     runtime    = string
     entrypoint = string
       iam_member = string
+    # Service settings that differ from the defaults of main.tf
+    max_instances = optional(number)
+    concurrency   = optional(number)
+    cpu           = optional(string)
+    memory        = optional(string, "256Mi")
   }))
 
   default = {
@@ -114,5 +125,27 @@ variable "functions" {
      iam_member = "serviceAccount:pubsub-pushsubscription@capstore-takeoff.iam.gserviceaccount.com"
 
     }
+    "image-cleanup" : {
+      zip        = "ImageCleanup.zip"
+      name       = "image-cleanup"
+      trigger    = "http-trigger"
+      runtime    = "go121"
+      entrypoint = "DeleteReplacedImages"
+      iam_member = "serviceAccount:pubsub-pushsubscription@capstore-takeoff.iam.gserviceaccount.com"
+    }
+    "searchservice" : {
+      zip        = "SearchService.zip"
+      name       = "searchservice"
+      trigger    = "http-trigger"
+      runtime    = "go121"
+      entrypoint = "SearchService"
+      iam_member   = "serviceAccount:api-gateway-service-acc@capstore-takeoff.iam.gserviceaccount.com"
+      # A single instance holds the search index for every caller, so the
+      # catalog is loaded once rather than by every instance
+      max_instances = 1
+      concurrency   = 80
+      cpu           = "1"
+      memory        = "1Gi"
+    }
    }
 }
\ No newline at end of file
@@ -0,0 +1,28 @@
+# Composite indexes of the Groceries collection. A listing orders by its sort
+# field then by id, and filters with = or in on any number of fields, which
+# Firestore merges from the index of each field with the same order. Every
+# index also serves the reverse order.
+locals {
+  sort_indexes = {
+    for field in var.order_fields : field => [field, "id"]
+  }
+  filter_indexes = {
+    for pair in setproduct(var.equality_fields, concat(["id"], var.order_fields)) :
+    "${pair[0]}-${pair[1]}" => pair[1] == "id" ? [pair[0], "id"] : [pair[0], pair[1], "id"]
+    if pair[0] != pair[1]
+  }
+}
+
+resource "google_firestore_index" "groceries" {
+  for_each   = merge(local.sort_indexes, local.filter_indexes)
+  project    = var.project_id
+  collection = "Groceries"
+
+  dynamic "fields" {
+    for_each = each.value
+    content {
+      field_path = fields.value
+      order      = "ASCENDING"
+    }
+  }
+}
@@ -0,0 +1,30 @@
+variable "project_id" {
+  default = "capstore-takeoff"
+}
+
+# Fields ViewAllGroceries, exports and facet counts filter on with = or in
+variable "equality_fields" {
+  type = list(string)
+  default = [
+    "productname",
+    "category",
+    "brand",
+    "manufacturer",
+    "countryoforigin",
+    "packageinformation",
+    "vegetarian",
+  ]
+}
+
+# Fields listings are sorted by, and the number fields counts take a range
+# on. Items with the same value are ordered by id.
+variable "order_fields" {
+  type = list(string)
+  default = [
+    "price",
+    "productname",
+    "createdAt",
+    "weight",
+    "itempackagequantity",
+  ]
+}
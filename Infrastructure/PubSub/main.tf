@@ -13,6 +13,12 @@ resource "google_pubsub_subscription" "subscriptions" {
 
   ack_deadline_seconds = each.value.ack_deadline_seconds
 
+  # A push the endpoint fails is delivered again, waiting longer each time
+  retry_policy {
+    minimum_backoff = "10s"
+    maximum_backoff = "600s"
+  }
+
   push_config {
     push_endpoint = each.value.push_endpoint
 
@@ -20,8 +26,10 @@ resource "google_pubsub_subscription" "subscriptions" {
       write_metadata = false
     }
 
+    # The internal endpoints check tokens against PUSH_AUDIENCE, not their URL
     oidc_token {
       service_account_email = "pubsub-pushsubscription@capstore-takeoff.iam.gserviceaccount.com"
+      audience              = var.push_audience
     }
   }
 }
@@ -1,5 +1,11 @@
 # variables.tf
 
+# Audience of the push tokens; the same as push_audience of CloudFunctions and
+# common.PushAudience
+variable "push_audience" {
+  default = "capstore-takeoff-push"
+}
+
 variable "topics_and_subscriptions" {
   type = map(object({
     topic_name        = string
@@ -26,6 +32,12 @@ variable "topics_and_subscriptions" {
       subscription_name = "Thumbnail_Subscription"
        push_endpoint = "https://us-central1-capstore-takeoff.cloudfunctions.net/thumbnail-generation"
        ack_deadline_seconds = 30
+    },
+    "Image_Cleanup_Topic" : {
+      topic_name        = "Image_Cleanup_Topic"
+      subscription_name = "Image_Cleanup_Subscription"
+      push_endpoint = "https://us-central1-capstore-takeoff.cloudfunctions.net/image-cleanup"
+      ack_deadline_seconds = 30
     }
   }
 }
@@ -0,0 +1,154 @@
+// Package apierror describes why a request failed, for every endpoint to
+// answer with the same JSON envelope:
+//
+//	{"error": {"code": "NOT_FOUND", "message": "Grocery item not found", "requestId": "..."}}
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Code tells clients why a request failed, independently of the message.
+type Code string
+
+const (
+	// CodeValidationFailed is a request that is malformed or holds invalid
+	// values.
+	CodeValidationFailed Code = "VALIDATION_FAILED"
+	// CodeNotFound is a request for a resource that does not exist.
+	CodeNotFound Code = "NOT_FOUND"
+	// CodeDuplicateProduct is a grocery item given the product name of
+	// another.
+	CodeDuplicateProduct Code = "DUPLICATE_PRODUCT"
+	// CodeConflict is a request the resource's current state does not allow.
+	CodeConflict Code = "CONFLICT"
+	// CodeIdempotencyKeyReused is an idempotency key sent with a request other
+	// than the one it was first used for.
+	CodeIdempotencyKeyReused Code = "IDEMPOTENCY_KEY_REUSED"
+	// CodeMethodNotAllowed is a request with a method the endpoint does not
+	// serve.
+	CodeMethodNotAllowed Code = "METHOD_NOT_ALLOWED"
+	// CodeUnauthenticated is a request without valid credentials.
+	CodeUnauthenticated Code = "UNAUTHENTICATED"
+	// CodePermissionDenied is a request whose credentials do not allow it.
+	CodePermissionDenied Code = "PERMISSION_DENIED"
+	// CodeInternal is a failure of the service; its cause is logged, not
+	// returned.
+	CodeInternal Code = "INTERNAL"
+)
+
+// Status returns the HTTP status of a response failed with code.
+func (c Code) Status() int {
+	switch c {
+	case CodeValidationFailed:
+		return http.StatusBadRequest
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeDuplicateProduct, CodeConflict:
+		return http.StatusConflict
+	case CodeIdempotencyKeyReused:
+		return http.StatusUnprocessableEntity
+	case CodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case CodePermissionDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// FieldError is what is wrong with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is a failed request.
+type Error struct {
+	Code    Code
+	Message string
+	Details []FieldError
+	// cause is what made an internal error, for the log
+	cause error
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.cause)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// New returns an error with the given code.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Validation returns a VALIDATION_FAILED error, with the fields at fault.
+func Validation(message string, details ...FieldError) *Error {
+	return &Error{Code: CodeValidationFailed, Message: message, Details: details}
+}
+
+// InvalidField returns a VALIDATION_FAILED error for one field.
+func InvalidField(field string, message string) *Error {
+	return Validation(message, FieldError{Field: field, Message: message})
+}
+
+// NotFound returns a NOT_FOUND error.
+func NotFound(message string) *Error {
+	return New(CodeNotFound, message)
+}
+
+// DuplicateProduct returns a DUPLICATE_PRODUCT error for productName.
+func DuplicateProduct(productName string) *Error {
+	message := fmt.Sprintf("A grocery item named '%s' already exists", productName)
+	return &Error{
+		Code:    CodeDuplicateProduct,
+		Message: message,
+		Details: []FieldError{{Field: "productname", Message: message}},
+	}
+}
+
+// Conflict returns a CONFLICT error.
+func Conflict(message string) *Error {
+	return New(CodeConflict, message)
+}
+
+// Internal returns an INTERNAL error. Clients see only message, which should
+// say what failed without the details of cause.
+func Internal(message string, cause error) *Error {
+	return &Error{Code: CodeInternal, Message: message, cause: cause}
+}
+
+// From returns err as an *Error, for a client to see. An *Error in err's
+// chain keeps its code, with the message of the whole chain, which only
+// holds text of this service since the *Error has no cause. Firestore
+// failures are mapped by their gRPC code, and anything else is an INTERNAL
+// error whose message does not repeat err.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == CodeInternal || apiErr == err {
+			return apiErr
+		}
+		return &Error{Code: apiErr.Code, Message: err.Error(), Details: apiErr.Details}
+	}
+	switch status.Code(err) {
+	case codes.NotFound:
+		return &Error{Code: CodeNotFound, Message: "Not found", cause: err}
+	case codes.AlreadyExists, codes.Aborted:
+		return &Error{Code: CodeConflict, Message: "Changed by another request at the same time; try again", cause: err}
+	}
+	return Internal("Internal error", err)
+}
@@ -0,0 +1,72 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCodeStatus(t *testing.T) {
+	tests := []struct {
+		code Code
+		want int
+	}{
+		{CodeValidationFailed, http.StatusBadRequest},
+		{CodeNotFound, http.StatusNotFound},
+		{CodeDuplicateProduct, http.StatusConflict},
+		{CodeConflict, http.StatusConflict},
+		{CodeIdempotencyKeyReused, http.StatusUnprocessableEntity},
+		{CodeMethodNotAllowed, http.StatusMethodNotAllowed},
+		{CodeUnauthenticated, http.StatusUnauthorized},
+		{CodePermissionDenied, http.StatusForbidden},
+		{CodeInternal, http.StatusInternalServerError},
+		{Code("UNKNOWN"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := test.code.Status(); got != test.want {
+			t.Errorf("%s.Status() = %d, want %d", test.code, got, test.want)
+		}
+	}
+}
+
+func TestFrom(t *testing.T) {
+	duplicate := DuplicateProduct("Milk")
+	if got := From(duplicate); got != duplicate {
+		t.Errorf("From(*Error) = %v, want it unchanged", got)
+	}
+
+	wrapped := From(fmt.Errorf("row 3: %w", duplicate))
+	if wrapped.Code != CodeDuplicateProduct || wrapped.Message != "row 3: "+duplicate.Message || len(wrapped.Details) != 1 {
+		t.Errorf("From(wrapped) = %+v, want the code and details with the chain's message", wrapped)
+	}
+
+	internal := Internal("Failed to read grocery items", errors.New("connection reset"))
+	if got := From(fmt.Errorf("list: %w", internal)); got != internal {
+		t.Errorf("From(wrapped internal) = %v, want the internal error", got)
+	}
+
+	tests := []struct {
+		err     error
+		code    Code
+		message string
+	}{
+		{status.Error(codes.NotFound, "no document projects/p/documents/x"), CodeNotFound, "Not found"},
+		{status.Error(codes.AlreadyExists, "document exists"), CodeConflict, "Changed by another request at the same time; try again"},
+		{status.Error(codes.Aborted, "transaction aborted"), CodeConflict, "Changed by another request at the same time; try again"},
+		{status.Error(codes.Unavailable, "backend down"), CodeInternal, "Internal error"},
+		{errors.New("connection reset"), CodeInternal, "Internal error"},
+	}
+	for _, test := range tests {
+		got := From(test.err)
+		if got.Code != test.code || got.Message != test.message {
+			t.Errorf("From(%v) = %s %q, want %s %q", test.err, got.Code, got.Message, test.code, test.message)
+		}
+		if !errors.Is(got, test.err) {
+			t.Errorf("From(%v) lost its cause", test.err)
+		}
+	}
+}
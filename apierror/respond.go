@@ -0,0 +1,83 @@
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the ID of a request, sent by the client or given
+// by Middleware, and is returned with the response.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// Envelope is the body of a failed response.
+type Envelope struct {
+	Error Body `json:"error"`
+}
+
+// Body describes a failed request.
+type Body struct {
+	Code      Code         `json:"code"`
+	Message   string       `json:"message"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId"`
+}
+
+// Write answers r with err, turned into an *Error by From. The cause of an
+// internal error is logged with the request ID rather than returned.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := From(err)
+	requestID := RequestID(w, r)
+	if apiErr.Code == CodeInternal {
+		log.Printf("Request %s failed: %v", requestID, apiErr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Code.Status())
+	json.NewEncoder(w).Encode(Envelope{Error: Body{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Details:   apiErr.Details,
+		RequestID: requestID,
+	}})
+}
+
+// RequestID returns the ID of r, giving it one when Middleware did not run.
+func RequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = w.Header().Get(RequestIDHeader)
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// Middleware gives every request an ID, the one in its X-Request-ID header
+// when the client sent one, and returns it in the response's.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+			c.Request.Header.Set(RequestIDHeader, id)
+		}
+		c.Writer.Header().Set(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Failed to generate request ID: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
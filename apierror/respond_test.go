@@ -0,0 +1,91 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/CreateGrocery", nil)
+	r.Header.Set(RequestIDHeader, "request-1")
+	w := httptest.NewRecorder()
+	Write(w, r, InvalidField("price", "price must be positive"))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := w.Header().Get(RequestIDHeader); got != "request-1" {
+		t.Errorf("%s = %q, want the request's", RequestIDHeader, got)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	want := Body{
+		Code:      CodeValidationFailed,
+		Message:   "price must be positive",
+		Details:   []FieldError{{Field: "price", Message: "price must be positive"}},
+		RequestID: "request-1",
+	}
+	if got := envelope.Error; got.Code != want.Code || got.Message != want.Message || got.RequestID != want.RequestID || len(got.Details) != 1 || got.Details[0] != want.Details[0] {
+		t.Errorf("body = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteHidesInternalCause(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/ViewAllGroceries", nil)
+	w := httptest.NewRecorder()
+	Write(w, r, errors.New("rpc error: projects/secret-project"))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret-project") {
+		t.Errorf("body %s holds the cause", w.Body.String())
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Error.Code != CodeInternal || envelope.Error.Message != "Internal error" {
+		t.Errorf("body = %+v", envelope.Error)
+	}
+	if envelope.Error.RequestID == "" || envelope.Error.RequestID != w.Header().Get(RequestIDHeader) {
+		t.Errorf("request ID %q, header %q", envelope.Error.RequestID, w.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RequestIDHeader, "from-client")
+	w := httptest.NewRecorder()
+	if got := RequestID(w, r); got != "from-client" || w.Header().Get(RequestIDHeader) != "from-client" {
+		t.Errorf("RequestID() = %q, want the request header", got)
+	}
+
+	// Given by Middleware to the response only
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	w = httptest.NewRecorder()
+	w.Header().Set(RequestIDHeader, "from-middleware")
+	if got := RequestID(w, r); got != "from-middleware" {
+		t.Errorf("RequestID() = %q, want the response header", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(RequestIDHeader, strings.Repeat("x", maxRequestIDLength+1))
+	w = httptest.NewRecorder()
+	got := RequestID(w, r)
+	if len(got) != 32 || w.Header().Get(RequestIDHeader) != got {
+		t.Errorf("RequestID() = %q, want a new ID in place of one too long", got)
+	}
+	if again := RequestID(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)); again == got {
+		t.Errorf("RequestID() gave %q twice", got)
+	}
+}
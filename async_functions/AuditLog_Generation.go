@@ -8,6 +8,7 @@ import (
 	"net/http"
 
 	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
 )
 
 // ProcessPubSubMessages is an HTTP handler that processes Pub/Sub push messages.
@@ -15,20 +16,19 @@ func ProcessPubSubMessages(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		apierror.Write(w, r, apierror.New(apierror.CodeMethodNotAllowed, "Invalid request method"))
 		return
 	}
 
 	var data map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Failed to decode message", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.Validation("Failed to decode message"))
 		return
 	}
 	log.Printf("Received message data: %+v", data)
 
 	if err := storeInFirestore(ctx, data); err != nil {
-		log.Printf("Failed to store message in Firestore: %v", err)
-		http.Error(w, "Failed to process message", http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to process message", err))
 		return
 	}
 	log.Print("Audit Log Added Successfully")
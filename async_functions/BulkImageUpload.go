@@ -0,0 +1,185 @@
+package async_functions
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/takeoff-capstone/common"
+)
+
+// imageUploads tracks the product images stored during a ZIP import, so that
+// thumbnails are only requested for products that were written and the images
+// of products that failed to write are removed again.
+type imageUploads struct {
+	mu      sync.Mutex
+	urls    map[int]string // image URL by manifest row
+	written []bulkimport.RowResult
+	next    func(bulkimport.RowResult)
+}
+
+func newImageUploads(next func(bulkimport.RowResult)) *imageUploads {
+	return &imageUploads{urls: make(map[int]string), next: next}
+}
+
+func (u *imageUploads) add(row int, imageURL string) {
+	u.mu.Lock()
+	u.urls[row] = imageURL
+	u.mu.Unlock()
+}
+
+// onResult is the writer's OnResult callback.
+func (u *imageUploads) onResult(result bulkimport.RowResult) {
+	u.mu.Lock()
+	imageURL, ok := u.urls[result.Row]
+	if ok && result.Error == "" {
+		u.written = append(u.written, result)
+	} else if ok {
+		delete(u.urls, result.Row)
+	}
+	u.mu.Unlock()
+
+	if ok && result.Error != "" {
+		if err := common.DeleteImageFromStorage(context.Background(), imageURL, common.BucketName); err != nil {
+			log.Printf("Failed to delete image of row %d: %v", result.Row, err)
+		}
+	}
+	if u.next != nil {
+		u.next(result)
+	}
+}
+
+// queueThumbnails publishes a thumbnail request for every product that was
+// written, through the same topic CreateGrocery uses.
+func (u *imageUploads) queueThumbnails() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, result := range u.written {
+		thumbnail_data := map[string]interface{}{
+			"fileURL":    u.urls[result.Row],
+			"documentId": result.DocID,
+			"collection": collectionName,
+		}
+		err := common.PublishToPubSub(common.Thumbnail_Topic, common.Thumbnail_Topic_subscription, common.Thumbnail_Endpoint, thumbnail_data)
+		if err != nil {
+			log.Printf("Failed to queue thumbnail for row %d: %v", result.Row, err)
+			logToGCP(fmt.Sprintf("Failed to queue thumbnail for row %d: %v", result.Row, err))
+		}
+	}
+	log.Printf("Queued %d thumbnails", len(u.written))
+}
+
+// uploadZIP imports the products listed in the manifest of a ZIP file. Each
+// product's image is validated, stored in the images bucket and linked to the
+// product before the row is written; rows whose image is missing or invalid
+// are rejected.
+func uploadZIP(content io.Reader, template *bulkimport.MappingTemplate, writer *bulkimport.Writer, images *imageUploads) error {
+	// ZIP needs random access
+	zipPath, err := bulkimport.SpoolToTempFile(content, "import-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(zipPath)
+
+	archive, err := bulkimport.OpenImageArchive(zipPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	log.Printf("ZIP manifest is %s with %d images", archive.ManifestFormat(), archive.ImageCount())
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create Cloud Storage client: %v", err)
+	}
+	defer client.Close()
+
+	return archive.ReadManifest(func(row bulkimport.ManifestRow) error {
+		if writer.Skipping() {
+			// Done by an earlier run; don't store its image again
+			return writer.Write(bulkimport.Row{Number: row.Number})
+		}
+		item, err := processManifestRow(row, template)
+		if err != nil {
+			log.Printf("Error processing row %d: %v", row.Number, err)
+			logToGCP(fmt.Sprintf("Error processing row %d: %v", row.Number, err))
+			writer.Reject(row.Number, err)
+			return nil
+		}
+
+		data, contentType, err := archive.Image(row.Image)
+		if err != nil {
+			writer.Reject(row.Number, err)
+			return nil
+		}
+		imageURL, err := storeProductImage(ctx, client, row.Image, data, contentType)
+		if err != nil {
+			log.Printf("Failed to store image of row %d: %v", row.Number, err)
+			writer.Reject(row.Number, fmt.Errorf("failed to store image %s", row.Image))
+			return nil
+		}
+
+		item["image"] = imageURL
+		images.add(row.Number, imageURL)
+		return writer.Write(bulkimport.Row{Number: row.Number, Data: item})
+	})
+}
+
+// processManifestRow applies the template to a manifest row and checks the
+// price the same way a CSV row is checked.
+func processManifestRow(row bulkimport.ManifestRow, template *bulkimport.MappingTemplate) (map[string]interface{}, error) {
+	if row.Err != nil {
+		return nil, row.Err
+	}
+	if row.Image == "" {
+		return nil, fmt.Errorf("no image file given")
+	}
+	item := row.Item
+	if template != nil {
+		mapped, err := template.Apply(item)
+		if err != nil {
+			return nil, err
+		}
+		item = mapped
+	}
+	if price, ok := item["price"].(string); ok {
+		if err := processColumn("price", price, item); err != nil {
+			return nil, fmt.Errorf("error processing column price: %v", err)
+		}
+	}
+	return item, nil
+}
+
+// storeProductImage uploads an image to the grocery images bucket under a
+// unique name, the same way CreateGrocery stores an uploaded image, and
+// returns its public URL.
+func storeProductImage(ctx context.Context, client *storage.Client, name string, data []byte, contentType string) (string, error) {
+	fileName := strings.ReplaceAll(path.Base(strings.ReplaceAll(name, "\\", "/")), " ", "_")
+	uniqueFilename := fmt.Sprintf("%d_%s", time.Now().UnixNano(), fileName)
+	object := client.Bucket(common.BucketName).Object(uniqueFilename)
+
+	wc := object.NewWriter(ctx)
+	wc.ContentType = contentType
+	if _, err := io.Copy(wc, bytes.NewReader(data)); err != nil {
+		wc.Close()
+		return "", fmt.Errorf("failed to copy image to Cloud Storage: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		return "", fmt.Errorf("failed to close Cloud Storage writer: %v", err)
+	}
+	if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+		return "", fmt.Errorf("failed to set ACL for Cloud Storage object: %v", err)
+	}
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", common.BucketName, uniqueFilename), nil
+}
@@ -1,19 +1,24 @@
 package async_functions
 
 import (
+	"bufio"
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"sync"
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/logging"
+	"cloud.google.com/go/storage"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
 )
 
 const (
@@ -24,6 +29,22 @@ const (
 
 type FileContent struct {
 	FileURL string `json:"fileURL"`
+	// Format detected at upload time; the importer detects it again from the
+	// content and only logs a mismatch
+	Format string `json:"format,omitempty"`
+	// Sheet and header row of an XLSX workbook
+	Sheet     string `json:"sheet,omitempty"`
+	HeaderRow int    `json:"headerRow,omitempty"`
+	// Optional ID of the column mapping template the upload was checked against
+	TemplateID string `json:"templateId,omitempty"`
+	// FromExport marks a file written by ExportGroceries; its id column is
+	// dropped, since every row is imported as a new item
+	FromExport bool `json:"fromExport,omitempty"`
+	// ID of the import job record; derived from the file URL when missing
+	ImportID string `json:"importId,omitempty"`
+	// Optional tuning of the import writer; package defaults are used when zero
+	Workers   int `json:"workers,omitempty"`
+	BatchSize int `json:"batchSize,omitempty"`
 }
 
 var (
@@ -35,181 +56,455 @@ func init() {
 	var err error
 	logger, err = logging.NewClient(context.Background(), projectID)
 	if err != nil {
-		log.Fatalf("Failed to create logging client: %v", err)
+		// logToGCP falls back to the standard log
+		log.Printf("Failed to create logging client: %v", err)
 	}
 }
 
 func DownloadCSV(w http.ResponseWriter, r *http.Request) {
 	var fileContent FileContent
 	if err := json.NewDecoder(r.Body).Decode(&fileContent); err != nil {
-		http.Error(w, "Failed to decode message", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.Validation("Failed to decode message"))
 		return
 	}
-	log.Println("Downloading Csv/JSON and saving Data to the Firestore")
-	var isCSV bool
+	log.Println("Downloading bulk file and saving Data to the Firestore")
+	logToGCP("Bulk file received: " + fileContent.FileURL)
+
+	summary, err := importFile(fileContent)
+	if err == bulkimport.ErrJobFinished {
+		// A copy of a message whose import is done, cancelled or rolled back
+		log.Printf("Import of %s is already finished", fileContent.FileURL)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err == bulkimport.ErrJobRunning {
+		// Not acknowledged, so the message comes back and resumes the import
+		// if the instance running it dies
+		apierror.Write(w, r, apierror.Conflict("Import is already running"))
+		return
+	}
+	var badFile *badFileError
+	if errors.As(err, &badFile) {
+		// Delivering the message again would fail the same way, so the job is
+		// marked failed and the message acknowledged
+		log.Printf("Import of %s failed: %v", fileContent.FileURL, err)
+		logToGCP(fmt.Sprintf("Import of %s failed: %v", fileContent.FileURL, err))
+		failImport(fileContent, badFile)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		logAndHTTPError(w, r, "failed to fetch and upload file to Firestore", err)
+		return
+	}
+	log.Printf("File content fetched and uploaded to Firestore: %v", summary.Stats)
+	logToGCP(fmt.Sprintf("Import of %s finished: %v", fileContent.FileURL, summary.Stats))
+
+	// Rows that failed are reported in the body; the message itself was
+	// handled, so it is acknowledged with 200 and not redelivered
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summary)
+}
+
+// badFileError is an import that fails the same way however often it is
+// retried, because the file or its mapping template is missing or malformed.
+type badFileError struct {
+	err error
+}
+
+func (e *badFileError) Error() string {
+	return e.err.Error()
+}
 
-	// Check if the FileURL ends with '.csv' indicating it's a CSV file
-	if strings.HasSuffix(strings.ToLower(fileContent.FileURL), ".csv") {
-		isCSV = true
+func (e *badFileError) Unwrap() error {
+	return e.err
+}
+
+// failImport records a bad file on the import's job, so that its status tells
+// why nothing was imported.
+func failImport(fileContent FileContent, badFile *badFileError) {
+	importID := fileContent.ImportID
+	if importID == "" {
+		importID = bulkimport.JobID(fileContent.FileURL)
 	}
-	if isCSV {
-		// It's CSV data, process it accordingly
-		// FetchAndUploadToFirestore function for CSV processing
-		if err := FetchAndUploadCSVToFirestore(fileContent.FileURL); err != nil {
-			logAndHTTPError(w, http.StatusInternalServerError, "failed to fetch and upload CSV to Firestore", err)
-			return
-		}
-	} else {
-		// It's assumed to be JSON data, process it accordingly
-		log.Printf("File Content (JSON): %v", fileContent)
-		// Log file content to GCP
-		logToGCP("File content fetched (JSON): " + fileContent.FileURL)
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		log.Printf("Failed to create Firestore client: %v", err)
+		return
+	}
+	defer client.Close()
+	if err := bulkimport.FailJob(ctx, client, importID, fileContent.FileURL, badFile.Error()); err != nil {
+		log.Printf("Failed to mark import %s failed: %v", importID, err)
+	}
+}
 
-		if err := FetchAndUploadJSONToFirestore(fileContent.FileURL); err != nil {
-			logAndHTTPError(w, http.StatusInternalServerError, "failed to fetch and upload JSON to Firestore", err)
-			return
-		}
+// importFile loads the mapping template a bulk file message refers to and runs
+// the import.
+func importFile(fileContent FileContent) (bulkimport.Summary, error) {
+	config := bulkimport.WriterConfig{
+		Workers:   fileContent.Workers,
+		BatchSize: fileContent.BatchSize,
 	}
-	log.Println("File content fetched and uploaded to Firestore successfully")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "File content fetched and uploaded to Firestore successfully")
+	template, err := loadTemplate(fileContent.TemplateID)
+	if errors.Is(err, bulkimport.ErrTemplateNotFound) {
+		return bulkimport.Summary{}, &badFileError{fmt.Errorf("mapping template %s not found", fileContent.TemplateID)}
+	}
+	if err != nil {
+		return bulkimport.Summary{}, fmt.Errorf("failed to load mapping template: %v", err)
+	}
+	return FetchAndUploadToFirestore(fileContent, template, config)
 }
 
-func FetchAndUploadCSVToFirestore(uploadedFileURL string) error {
+// FetchAndUploadToFirestore downloads the bulk file, works out its format from
+// the content, undoing gzip compression if needed, and streams its rows into
+// the import writer. The template may be nil when the file already uses the
+// grocery field names.
+func FetchAndUploadToFirestore(fileContent FileContent, template *bulkimport.MappingTemplate, config bulkimport.WriterConfig) (bulkimport.Summary, error) {
 	// Fetch the file from the URL
-	resp, err := http.Get(uploadedFileURL)
+	file, err := openBulkFile(fileContent.FileURL)
 	if err != nil {
-		return fmt.Errorf("failed to fetch file from URL: %v", err)
+		return bulkimport.Summary{}, err
 	}
-	defer resp.Body.Close()
+	defer file.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-OK response: %v", resp.Status)
+	body := bufio.NewReaderSize(file, bulkimport.SniffLength)
+	format, compressed, err := bulkimport.Sniff(body)
+	if err != nil {
+		return bulkimport.Summary{}, &badFileError{err}
 	}
-
-	// Read the file content
-	csvData, err := ioutil.ReadAll(resp.Body)
+	if fileContent.Format != "" && fileContent.Format != format {
+		log.Printf("File was uploaded as %s but its content is %s", fileContent.Format, format)
+	}
+	content, err := bulkimport.Decompress(body, compressed)
 	if err != nil {
-		return fmt.Errorf("failed to read file content: %v", err)
+		return bulkimport.Summary{}, &badFileError{err}
 	}
+	log.Printf("Importing %s file (gzip: %t)", format, compressed)
 
 	ctx := context.Background()
 	client, err := firestore.NewClient(ctx, projectID)
 	if err != nil {
-		return fmt.Errorf("failed to create Firestore client: %v", err)
+		return bulkimport.Summary{}, fmt.Errorf("failed to create Firestore client: %v", err)
 	}
 	defer client.Close()
 
-	// Parse CSV data
-	reader := csv.NewReader(strings.NewReader(string(csvData)))
-	records, err := reader.ReadAll()
+	// Claim the job record; a redelivered or restarted import carries on from
+	// its checkpoint and writes to the same document IDs
+	importID := fileContent.ImportID
+	if importID == "" {
+		importID = bulkimport.JobID(fileContent.FileURL)
+	}
+	job, err := bulkimport.StartJob(ctx, client, importID, fileContent.FileURL, format, collectionName)
 	if err != nil {
-		return fmt.Errorf("failed to read CSV records: %v", err)
+		return bulkimport.Summary{}, err
 	}
+	if job.Checkpoint > 0 {
+		log.Printf("Resuming import %s after %d rows", job.ID, job.Checkpoint)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if len(records) == 0 {
-		return fmt.Errorf("no records found in CSV data")
+	var images *imageUploads
+	if format == bulkimport.FormatZIP {
+		images = newImageUploads(config.OnResult)
+		config.OnResult = images.onResult
+	}
+	tracker := bulkimport.NewJobTracker(client, job, cancel, config.OnResult)
+	config.OnResult = tracker.OnResult
+	config.Skip = job.Checkpoint
+	config.DocIDPrefix = job.ID
+	if fileContent.FromExport {
+		config.OmitFields = []string{"id"}
+	}
+	writer := bulkimport.NewWriter(ctx, client, collectionName, config)
+	tracker.Start(writer)
+	switch format {
+	case bulkimport.FormatCSV:
+		err = uploadCSV(content, template, writer)
+	case bulkimport.FormatJSON:
+		err = uploadJSON(content, template, writer)
+	case bulkimport.FormatNDJSON:
+		err = uploadNDJSON(content, template, writer)
+	case bulkimport.FormatXLSX:
+		options := bulkimport.XLSXOptions{Sheet: fileContent.Sheet, HeaderRow: fileContent.HeaderRow}
+		err = uploadXLSX(content, options, template, writer)
+	case bulkimport.FormatZIP:
+		err = uploadZIP(content, template, writer, images)
 	}
 
-	headers := records[0]
+	// Rows already queued are still written when the file turns out to be
+	// malformed further down
+	summary := writer.Close()
+	if images != nil {
+		images.queueThumbnails()
+	}
+	if ctx.Err() != nil {
+		// Cancelled through the job; what was written stays until rollback
+		log.Printf("Import %s cancelled after %d rows", job.ID, writer.Checkpoint())
+		err = nil
+	}
+	if saveErr := tracker.Finish(err); saveErr != nil {
+		log.Printf("Failed to save import job %s: %v", job.ID, saveErr)
+	}
+	return summary, err
+}
 
-	var wg sync.WaitGroup
-	for _, record := range records[1:] {
-		wg.Add(1)
+// openBulkFile opens a bulk file by its public URL, or by a gs://bucket/object
+// URL for objects that are not public, such as files dropped into the bucket
+// directly.
+func openBulkFile(fileURL string) (io.ReadCloser, error) {
+	if objectPath, ok := strings.CutPrefix(fileURL, "gs://"); ok {
+		bucket, object, found := strings.Cut(objectPath, "/")
+		if !found {
+			return nil, &badFileError{fmt.Errorf("invalid storage URL: %s", fileURL)}
+		}
+		if storageClient == nil {
+			return nil, fmt.Errorf("Cloud Storage client is not available")
+		}
+		reader, err := storageClient.Bucket(bucket).Object(object).NewReader(context.Background())
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, &badFileError{fmt.Errorf("file %s does not exist", fileURL)}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file from storage: %v", err)
+		}
+		return reader, nil
+	}
 
-		// Use a goroutine for parallel processing
-		go func(record []string) {
-			defer wg.Done()
+	resp, err := http.Get(fileURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch file from URL: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		// A missing or forbidden file stays that way; a server error may not
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, &badFileError{fmt.Errorf("non-OK response: %v", resp.Status)}
+		}
+		return nil, fmt.Errorf("non-OK response: %v", resp.Status)
+	}
+	return resp.Body, nil
+}
 
-			// Process record and add to Firestore
-			if err := processCSVRecord(ctx, client, collectionName, headers, record); err != nil {
-				log.Printf("Error processing record: %v", err)
-				// Handle error as needed
-			}
-		}(record)
+// uploadCSV reads the CSV one record at a time and queues every valid row.
+func uploadCSV(content io.Reader, template *bulkimport.MappingTemplate, writer *bulkimport.Writer) error {
+	reader := csv.NewReader(content)
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return &badFileError{fmt.Errorf("no records found in CSV data")}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CSV headers: %v", err)
+	}
+
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// The reader carries on at the next record
+			log.Printf("Error reading row %d: %v", row, err)
+			writer.Reject(row, parseErr.Err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CSV record at row %d: %v", row, err)
+		}
+
+		item, err := processCSVRecord(headers, record, template)
+		if err != nil {
+			log.Printf("Error processing row %d: %v", row, err)
+			logToGCP(fmt.Sprintf("Error processing row %d: %v", row, err))
+			writer.Reject(row, err)
+			continue
+		}
+		if err := writer.Write(bulkimport.Row{Number: row, Data: item}); err != nil {
+			return err
+		}
+	}
+}
+
+// uploadXLSX imports the selected sheet through the same row processing as a
+// CSV file.
+func uploadXLSX(content io.Reader, options bulkimport.XLSXOptions, template *bulkimport.MappingTemplate, writer *bulkimport.Writer) error {
+	// XLSX is a zip archive and needs random access
+	path, err := bulkimport.SpoolToTempFile(content, "import-*.xlsx")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(path)
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+	sheet, err := bulkimport.OpenXLSX(path, options, template)
+	if err != nil {
+		return err
+	}
+	defer sheet.Close()
 
-	return nil
+	headers := sheet.Headers()
+	for {
+		record, row, err := sheet.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read XLSX row %d: %v", row, err)
+		}
 
+		item, err := processCSVRecord(headers, record, template)
+		if err != nil {
+			log.Printf("Error processing row %d: %v", row, err)
+			logToGCP(fmt.Sprintf("Error processing row %d: %v", row, err))
+			writer.Reject(row, err)
+			continue
+		}
+		if err := writer.Write(bulkimport.Row{Number: row, Data: item}); err != nil {
+			return err
+		}
+	}
 }
 
+// uploadJSON decodes the top-level array one element at a time instead of
+// unmarshalling the whole file.
+func uploadJSON(content io.Reader, template *bulkimport.MappingTemplate, writer *bulkimport.Writer) error {
+	decoder := json.NewDecoder(content)
+	if err := expectDelim(decoder, '['); err != nil {
+		return fmt.Errorf("failed to decode JSON data: %v", err)
+	}
+
+	// Items are numbered from 1, like the lines of CSV and NDJSON files
+	for number := 1; decoder.More(); number++ {
+		var item map[string]interface{}
+		if err := decoder.Decode(&item); err != nil {
+			return fmt.Errorf("failed to decode JSON item %d: %v", number, err)
+		}
+		if template != nil {
+			mapped, err := template.Apply(item)
+			if err != nil {
+				writer.Reject(number, err)
+				continue
+			}
+			item = mapped
+		}
+		if err := writer.Write(bulkimport.Row{Number: number, Data: item}); err != nil {
+			return err
+		}
+	}
+
+	if err := expectDelim(decoder, ']'); err != nil {
+		return fmt.Errorf("failed to decode JSON data: %v", err)
+	}
+	return nil
+}
+
+// uploadNDJSON imports one grocery item per line. A line that does not parse
+// is rejected on its own and the rest of the file is still imported.
+func uploadNDJSON(content io.Reader, template *bulkimport.MappingTemplate, writer *bulkimport.Writer) error {
+	reader := bulkimport.NewNDJSONReader(content)
+	for {
+		item, line, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var lineErr *bulkimport.LineError
+		if errors.As(err, &lineErr) {
+			log.Printf("Error processing %v", lineErr)
+			writer.Reject(line, lineErr.Err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read NDJSON at line %d: %v", line, err)
+		}
+
+		if template != nil {
+			mapped, err := template.Apply(item)
+			if err != nil {
+				writer.Reject(line, err)
+				continue
+			}
+			item = mapped
+		}
+		if err := writer.Write(bulkimport.Row{Number: line, Data: item}); err != nil {
+			return err
+		}
+	}
+}
 
 func logToGCP(message string) {
+	if logger == nil {
+		log.Println(message)
+		return
+	}
 	logger.Logger(logName).Log(logging.Entry{Payload: message})
 }
 
-func logAndHTTPError(w http.ResponseWriter, statusCode int, message string, err error) {
-	log.Printf("%s: %v", message, err)
+func logAndHTTPError(w http.ResponseWriter, r *http.Request, message string, err error) {
 	logToGCP(fmt.Sprintf("%s: %v", message, err))
-	http.Error(w, message, statusCode)
+	apierror.Write(w, r, apierror.Internal(message, err))
 }
-func FetchAndUploadJSONToFirestore(jsonFileURL string) error {
-	// Fetch the JSON file from the URL
-	resp, err := http.Get(jsonFileURL)
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
 	if err != nil {
-		return fmt.Errorf("failed to fetch JSON file from URL: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	// Check if the response status code is OK (200)
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-OK response while fetching JSON file: %v", resp.Status)
+	if token != delim {
+		return fmt.Errorf("expected '%v' but found '%v'", delim, token)
 	}
+	return nil
+}
 
-	// Read the file content
-	jsonData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read JSON file content: %v", err)
+// loadTemplate reads the mapping template with the given ID, or returns nil
+// when no template was used.
+func loadTemplate(templateID string) (*bulkimport.MappingTemplate, error) {
+	if templateID == "" {
+		return nil, nil
 	}
-
-	// Initialize Firestore client
 	ctx := context.Background()
 	client, err := firestore.NewClient(ctx, projectID)
 	if err != nil {
-		return fmt.Errorf("failed to create Firestore client: %v", err)
+		return nil, fmt.Errorf("failed to create Firestore client: %v", err)
 	}
 	defer client.Close()
 
-	// Define your Firestore collection name
-	collection := client.Collection(collectionName)
+	return bulkimport.LoadTemplate(ctx, client, templateID)
+}
 
-	// Unmarshal JSON data
-	var items []map[string]interface{}
-	if err := json.Unmarshal(jsonData, &items); err != nil {
-		return fmt.Errorf("failed to unmarshal JSON data: %v", err)
-	}
+// processCSVRecord turns a CSV record into a grocery item, validating each
+// column individually. With a template the columns are mapped onto grocery
+// fields first.
+func processCSVRecord(headers []string, record []string, template *bulkimport.MappingTemplate) (map[string]interface{}, error) {
+	item := make(map[string]interface{})
 
-	// Upload JSON data to Firestore
-	for _, item := range items {
-		if _, _, err := collection.Add(ctx, item); err != nil {
-			return fmt.Errorf("failed to upload item to Firestore: %v", err)
+	if template != nil {
+		values := make(map[string]interface{}, len(headers))
+		for i, header := range headers {
+			values[header] = record[i]
+		}
+		mapped, err := template.Apply(values)
+		if err != nil {
+			return nil, err
+		}
+		if price, ok := mapped["price"].(string); ok {
+			if err := processColumn("price", price, mapped); err != nil {
+				return nil, fmt.Errorf("error processing column price: %v", err)
+			}
 		}
+		return mapped, nil
 	}
 
-	return nil
-}
-func processCSVRecord(ctx context.Context, client *firestore.Client, collectionName string, headers []string, record []string) error {
-	item := make(map[string]interface{})
-
-	// Validate and process each column individually
+	// If there's an error in any column, the entire row is skipped
 	for i, header := range headers {
 		if err := processColumn(header, record[i], item); err != nil {
-			log.Printf("Error processing column %s: %v", header, err)
-			logToGCP(fmt.Sprintf("Error processing column %s: %v", header, err))
-
-			// If there's an error in any column, skip the entire row
-			return nil
+			return nil, fmt.Errorf("error processing column %s: %v", header, err)
 		}
 	}
 
-	// Add the item to Firestore
-	_, _, err := client.Collection(collectionName).Add(ctx, item)
-	return err
+	return item, nil
 }
-
 func processColumn(header, value string, item map[string]interface{}) error {
 	// Handle special processing for specific columns (e.g., "price")
 	switch header {
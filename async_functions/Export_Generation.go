@@ -0,0 +1,94 @@
+package async_functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/catalog"
+)
+
+// ExportMessage is the Pub/Sub message ExportGroceries publishes for an export
+// that is too large to stream.
+type ExportMessage struct {
+	ExportID string `json:"exportId"`
+}
+
+// GenerateExport writes the export file of an export job to the bulk data
+// bucket and records the object on the job.
+func GenerateExport(w http.ResponseWriter, r *http.Request) {
+	var message ExportMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil || message.ExportID == "" {
+		apierror.Write(w, r, apierror.Validation("Failed to decode message"))
+		return
+	}
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		logAndHTTPError(w, r, "failed to create Firestore client", err)
+		return
+	}
+	defer client.Close()
+
+	job, err := catalog.StartExportJob(ctx, client, message.ExportID)
+	switch err {
+	case nil:
+	case catalog.ErrExportFinished, catalog.ErrExportNotFound:
+		// Nothing to do for this message; acknowledge it
+		log.Printf("Export %s: %v", message.ExportID, err)
+		w.WriteHeader(http.StatusOK)
+		return
+	case catalog.ErrExportRunning:
+		apierror.Write(w, r, apierror.Conflict("Export is already running"))
+		return
+	default:
+		logAndHTTPError(w, r, "failed to start export job", err)
+		return
+	}
+	logToGCP(fmt.Sprintf("Export %s of %d groceries as %s started", job.ID, job.Expected, job.Format))
+
+	runErr := writeExport(ctx, client, job)
+	if err := catalog.FinishExportJob(ctx, client, job, runErr); err != nil {
+		log.Printf("Failed to record outcome of export %s: %v", job.ID, err)
+	}
+	if runErr != nil {
+		// The job records the failure; the message is acknowledged so that
+		// the export is asked for again rather than retried forever
+		log.Printf("Export %s failed: %v", job.ID, runErr)
+		logToGCP(fmt.Sprintf("Export %s failed: %v", job.ID, runErr))
+	} else {
+		logToGCP(fmt.Sprintf("Export %s finished with %d rows: gs://%s/%s", job.ID, job.Rows, catalog.ExportBucket, job.Object))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+// writeExport streams the export into its storage object. The object stays
+// private; GetExportJob hands out signed links to it.
+func writeExport(ctx context.Context, client *firestore.Client, job *catalog.ExportJob) error {
+	if storageClient == nil {
+		return fmt.Errorf("Cloud Storage client is not available")
+	}
+	job.Object = job.ExportObjectName()
+	object := storageClient.Bucket(catalog.ExportBucket).Object(job.Object)
+
+	wc := object.NewWriter(ctx)
+	wc.ContentType = catalog.ContentType(job.Format)
+	rows, err := catalog.Export(ctx, client, job.Filters, job.Format, wc)
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("failed to close Cloud Storage writer: %v", err)
+	}
+	job.Rows = rows
+	return nil
+}
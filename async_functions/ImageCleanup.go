@@ -0,0 +1,49 @@
+package async_functions
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/common"
+)
+
+// ImageCleanupMessage is the Pub/Sub message UpdateGrocery publishes for the
+// image and thumbnail an update replaced.
+type ImageCleanupMessage struct {
+	ID           string `json:"id"`
+	Image        string `json:"image,omitempty"`
+	ThumbnailURL string `json:"thumbnailURL,omitempty"`
+}
+
+// DeleteReplacedImages deletes the images of an ImageCleanupMessage. It
+// answers 500 when one of them could not be deleted, so that Pub/Sub delivers
+// the message again; images already gone count as deleted.
+func DeleteReplacedImages(w http.ResponseWriter, r *http.Request) {
+	var message ImageCleanupMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		apierror.Write(w, r, apierror.Validation("Failed to decode message"))
+		return
+	}
+
+	ctx := context.Background()
+	for _, image := range []struct {
+		url    string
+		bucket string
+	}{
+		{message.Image, common.BucketName},
+		{message.ThumbnailURL, common.ThumbnailBucketName},
+	} {
+		if image.url == "" {
+			continue
+		}
+		if err := common.DeleteImageWithRetries(ctx, image.url, image.bucket, 1); err != nil {
+			apierror.Write(w, r, apierror.Internal("Failed to delete replaced image", err))
+			return
+		}
+		log.Printf("Deleted replaced image %s of item %s", image.url, message.ID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
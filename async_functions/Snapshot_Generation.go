@@ -0,0 +1,88 @@
+package async_functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/snapshot"
+)
+
+// SnapshotRequest is the optional body of a snapshot request. Cloud Scheduler
+// can send it to override the default retention.
+type SnapshotRequest struct {
+	Retention *snapshot.Retention `json:"retention,omitempty"`
+}
+
+// SnapshotResult reports a snapshot and the snapshots retention removed.
+type SnapshotResult struct {
+	Snapshot *snapshot.Info `json:"snapshot"`
+	Pruned   []string       `json:"pruned"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// TakeSnapshot dumps the Groceries and Audit_Logs collections to the snapshot
+// bucket and then deletes the snapshots the retention policy no longer keeps.
+// It is meant to be called by Cloud Scheduler, e.g. daily:
+//
+//	gcloud scheduler jobs create http catalog-snapshot --schedule="0 2 * * *" \
+//	  --uri=https://us-central1-capstore-takeoff.cloudfunctions.net/snapshot-generation \
+//	  --http-method=POST --oidc-service-account-email=capstone-takeoff@capstore-takeoff.iam.gserviceaccount.com
+func TakeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, r, apierror.New(apierror.CodeMethodNotAllowed, "Invalid request method"))
+		return
+	}
+	var request SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		apierror.Write(w, r, apierror.Validation("Failed to decode snapshot request"))
+		return
+	}
+	retention := snapshot.DefaultRetention
+	if request.Retention != nil {
+		retention = *request.Retention
+	}
+	if storageClient == nil {
+		apierror.Write(w, r, apierror.Internal("Cloud Storage client is not available", nil))
+		return
+	}
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		logAndHTTPError(w, r, "failed to create Firestore client", err)
+		return
+	}
+	defer client.Close()
+
+	info, err := snapshot.Take(ctx, client, storageClient, time.Now())
+	if err != nil {
+		logAndHTTPError(w, r, "failed to take snapshot", err)
+		return
+	}
+	log.Printf("Snapshot %s written: %v", info.Name, info.Counts)
+	logToGCP(fmt.Sprintf("Snapshot %s written (%d bytes): %v", info.Name, info.Size, info.Counts))
+
+	result := SnapshotResult{Snapshot: info, Pruned: []string{}}
+	deleted, err := snapshot.Prune(ctx, storageClient, retention)
+	for _, expired := range deleted {
+		result.Pruned = append(result.Pruned, expired.Name)
+	}
+	if err != nil {
+		// The snapshot is written; pruning is tried again next time
+		log.Printf("Failed to prune snapshots: %v", err)
+		result.Error = "Failed to prune snapshots; expired snapshots are pruned next time"
+	} else if len(deleted) > 0 {
+		logToGCP(fmt.Sprintf("Pruned %d snapshots", len(deleted)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
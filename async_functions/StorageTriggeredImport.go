@@ -0,0 +1,254 @@
+package async_functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
+)
+
+const (
+	// Bucket the ERP drops its files into
+	watchedBucket = "bulk_data_bucket"
+	// Prefix watched when WATCHED_PREFIX is not set
+	defaultWatchedPrefix = "incoming/"
+	donePrefix           = "done/"
+	failedPrefix         = "failed/"
+)
+
+// StorageObject is the part of a Cloud Storage object-finalize event this
+// package needs.
+type StorageObject struct {
+	Bucket      string `json:"bucket"`
+	Name        string `json:"name"`
+	Generation  string `json:"generation"`
+	ContentType string `json:"contentType"`
+	// Custom metadata carries the import options, using the same names as
+	// the bulk file message: templateId, sheet, headerRow, fromExport, workers,
+	// batchSize
+	Metadata map[string]string `json:"metadata"`
+}
+
+// StorageImportResult tells what happened to a file.
+type StorageImportResult struct {
+	File     string              `json:"file"`
+	Status   string              `json:"status"`
+	MovedTo  string              `json:"movedTo,omitempty"`
+	ImportID string              `json:"importId,omitempty"`
+	Summary  *bulkimport.Summary `json:"summary,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// Outcomes of a storage-triggered import.
+const (
+	StorageImportIgnored  = "ignored"
+	StorageImportDone     = "done"
+	StorageImportFailed   = "failed"
+	StorageImportRunning  = "running"
+	StorageImportFinished = "alreadyFinished"
+)
+
+func init() {
+	functions.CloudEvent("ImportFromStorage", ImportFromStorageEvent)
+}
+
+// ImportFromStorageEvent is the entry point for the
+// google.cloud.storage.object.v1.finalized event of the bulk data bucket.
+// Returning an error makes a function with retries enabled get the event again,
+// which is only wanted while another instance still runs the import.
+func ImportFromStorageEvent(ctx context.Context, e event.Event) error {
+	var object StorageObject
+	if err := e.DataAs(&object); err != nil {
+		return fmt.Errorf("failed to decode storage event: %v", err)
+	}
+	result := importStorageObject(ctx, object)
+	if result.Status == StorageImportRunning {
+		return fmt.Errorf("import of %s is already running", result.File)
+	}
+	return nil
+}
+
+// ImportFromStorage runs the same import from an HTTP request whose body is the
+// storage object of a finalize event, so the flow can be tried locally by
+// posting a simulated event:
+//
+//	curl -X POST localhost:8084/api/importFromStorage \
+//	  -d '{"bucket":"bulk_data_bucket","name":"incoming/erp.csv","generation":"1","metadata":{"templateId":"abc"}}'
+func ImportFromStorage(w http.ResponseWriter, r *http.Request) {
+	var object StorageObject
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		apierror.Write(w, r, apierror.Validation("Failed to decode storage event"))
+		return
+	}
+
+	result := importStorageObject(context.Background(), object)
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status == StorageImportRunning {
+		// Not acknowledged, so a push delivery is retried
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// watchedPrefix returns the object prefix imports are started for.
+func watchedPrefix() string {
+	prefix := os.Getenv("WATCHED_PREFIX")
+	if prefix == "" {
+		return defaultWatchedPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// importStorageObject imports a file that landed under the watched prefix and
+// then moves it to done/ or failed/, keeping its path below the prefix. Files
+// elsewhere in the bucket, including the ones moved, are ignored.
+func importStorageObject(ctx context.Context, object StorageObject) StorageImportResult {
+	result := StorageImportResult{File: fmt.Sprintf("gs://%s/%s", object.Bucket, object.Name), Status: StorageImportIgnored}
+	prefix := watchedPrefix()
+	if object.Bucket != watchedBucket || !strings.HasPrefix(object.Name, prefix) || strings.HasSuffix(object.Name, "/") {
+		return result
+	}
+	log.Printf("Storage import of %s started", result.File)
+	logToGCP("Storage import of " + result.File + " started")
+
+	fileContent, err := fileContentFromObject(object)
+	if err != nil {
+		// Options that cannot be read would fail on every delivery
+		return moveImportedObject(ctx, object, prefix, result, nil, err)
+	}
+	result.ImportID = fileContent.ImportID
+
+	summary, err := importFile(fileContent)
+	switch err {
+	case bulkimport.ErrJobRunning:
+		result.Status = StorageImportRunning
+		return result
+	case bulkimport.ErrJobFinished:
+		// Usually a redelivered event of a file that was moved already. A
+		// file still in place is moved, so it does not pile up in the prefix
+		if objectExists(ctx, object) {
+			moved := moveImportedObject(ctx, object, prefix, result, nil, nil)
+			result.MovedTo, result.Error = moved.MovedTo, moved.Error
+		}
+		result.Status = StorageImportFinished
+		return result
+	}
+	return moveImportedObject(ctx, object, prefix, result, &summary, err)
+}
+
+// fileContentFromObject builds the bulk file message for an object from its
+// metadata. The import ID is derived from the object's generation, so a
+// replaced file is a new import but a redelivered event resumes the old one.
+func fileContentFromObject(object StorageObject) (FileContent, error) {
+	fileURL := fmt.Sprintf("gs://%s/%s", object.Bucket, object.Name)
+	fileContent := FileContent{
+		FileURL:    fileURL,
+		Format:     object.Metadata["format"],
+		Sheet:      object.Metadata["sheet"],
+		TemplateID: object.Metadata["templateId"],
+		FromExport: object.Metadata["fromExport"] == "true",
+		ImportID:   bulkimport.JobID(fileURL + "#" + object.Generation),
+	}
+	for key, target := range map[string]*int{
+		"headerRow": &fileContent.HeaderRow,
+		"workers":   &fileContent.Workers,
+		"batchSize": &fileContent.BatchSize,
+	} {
+		value, ok := object.Metadata[key]
+		if !ok || value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number <= 0 {
+			return fileContent, fmt.Errorf("metadata %s must be a positive number", key)
+		}
+		*target = number
+	}
+	return fileContent, nil
+}
+
+// moveImportedObject moves the file to done/ when the import ran, even if some
+// rows were rejected, and to failed/ when the file could not be imported. The
+// outcome is added to the moved object's metadata.
+func moveImportedObject(ctx context.Context, object StorageObject, prefix string, result StorageImportResult, summary *bulkimport.Summary, importErr error) StorageImportResult {
+	result.Summary = summary
+	target := donePrefix
+	result.Status = StorageImportDone
+	metadata := map[string]string{"importId": result.ImportID}
+	if importErr != nil {
+		target = failedPrefix
+		result.Status = StorageImportFailed
+		result.Error = importErr.Error()
+		metadata["importError"] = importErr.Error()
+		log.Printf("Storage import of %s failed: %v", result.File, importErr)
+		logToGCP(fmt.Sprintf("Storage import of %s failed: %v", result.File, importErr))
+	} else if summary != nil {
+		metadata["rowsWritten"] = strconv.Itoa(summary.Stats.Written)
+		metadata["rowsFailed"] = strconv.Itoa(summary.Stats.Failed)
+		logToGCP(fmt.Sprintf("Storage import of %s finished: %v", result.File, summary.Stats))
+	}
+	for key, value := range object.Metadata {
+		if _, ok := metadata[key]; !ok {
+			metadata[key] = value
+		}
+	}
+
+	destination := target + strings.TrimPrefix(object.Name, prefix)
+	if err := moveObject(ctx, object, destination, metadata); err != nil {
+		log.Printf("Failed to move %s to %s: %v", result.File, destination, err)
+		result.Error = strings.TrimPrefix(result.Error+"; ", "; ") + err.Error()
+		return result
+	}
+	result.MovedTo = fmt.Sprintf("gs://%s/%s", object.Bucket, destination)
+	return result
+}
+
+// objectExists reports whether the object is still in the bucket. It is
+// assumed to be when that cannot be found out.
+func objectExists(ctx context.Context, object StorageObject) bool {
+	if storageClient == nil {
+		return false
+	}
+	_, err := storageClient.Bucket(object.Bucket).Object(object.Name).Attrs(ctx)
+	return !errors.Is(err, storage.ErrObjectNotExist)
+}
+
+// moveObject copies the object to its new name and deletes the original. The
+// copy only happens if the original is still the generation that was imported.
+func moveObject(ctx context.Context, object StorageObject, destination string, metadata map[string]string) error {
+	if storageClient == nil {
+		return fmt.Errorf("Cloud Storage client is not available")
+	}
+	bucket := storageClient.Bucket(object.Bucket)
+	source := bucket.Object(object.Name)
+	if generation, err := strconv.ParseInt(object.Generation, 10, 64); err == nil && generation > 0 {
+		source = source.If(storage.Conditions{GenerationMatch: generation})
+	}
+
+	copier := bucket.Object(destination).CopierFrom(source)
+	copier.ContentType = object.ContentType
+	copier.Metadata = metadata
+	if _, err := copier.Run(ctx); err != nil {
+		return fmt.Errorf("failed to copy object: %v", err)
+	}
+	if err := source.Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
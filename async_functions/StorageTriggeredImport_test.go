@@ -0,0 +1,105 @@
+package async_functions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/takeoff-capstone/bulkimport"
+)
+
+func TestFileContentFromObject(t *testing.T) {
+	object := StorageObject{
+		Bucket:     watchedBucket,
+		Name:       "incoming/erp.xlsx",
+		Generation: "7",
+		Metadata: map[string]string{
+			"templateId": "supplier",
+			"sheet":      "Products",
+			"headerRow":  "3",
+			"workers":    "2",
+			"fromExport": "true",
+		},
+	}
+	fileContent, err := fileContentFromObject(object)
+	if err != nil {
+		t.Fatalf("fileContentFromObject() = %v", err)
+	}
+	if fileContent.FileURL != "gs://bulk_data_bucket/incoming/erp.xlsx" {
+		t.Errorf("FileURL = %s", fileContent.FileURL)
+	}
+	if fileContent.TemplateID != "supplier" || fileContent.Sheet != "Products" || fileContent.HeaderRow != 3 || fileContent.Workers != 2 || fileContent.BatchSize != 0 || !fileContent.FromExport {
+		t.Errorf("options = %+v", fileContent)
+	}
+	if fileContent.ImportID != bulkimport.JobID(fileContent.FileURL+"#7") {
+		t.Errorf("ImportID = %s, want the ID of generation 7", fileContent.ImportID)
+	}
+
+	// A replaced file is a new import
+	object.Generation = "8"
+	replaced, _ := fileContentFromObject(object)
+	if replaced.ImportID == fileContent.ImportID {
+		t.Error("a new generation kept the import ID")
+	}
+}
+
+func TestFileContentFromObjectRejectsInvalidNumbers(t *testing.T) {
+	for _, value := range []string{"0", "-1", "two", "1.5"} {
+		object := StorageObject{Bucket: watchedBucket, Name: "incoming/erp.csv", Metadata: map[string]string{"batchSize": value}}
+		if _, err := fileContentFromObject(object); err == nil {
+			t.Errorf("batchSize %q was accepted", value)
+		}
+	}
+}
+
+// A simulated finalize event, posted as the curl example in
+// ImportFromStorage does, for objects the import leaves alone.
+func TestImportFromStorageIgnoresOtherObjects(t *testing.T) {
+	for _, object := range []StorageObject{
+		{Bucket: "other_bucket", Name: "incoming/erp.csv", Generation: "1"},
+		{Bucket: watchedBucket, Name: "done/erp.csv", Generation: "1"},
+		{Bucket: watchedBucket, Name: "incoming/", Generation: "1"},
+	} {
+		body, _ := json.Marshal(object)
+		req := httptest.NewRequest(http.MethodPost, "/api/importFromStorage", strings.NewReader(string(body)))
+		res := httptest.NewRecorder()
+		ImportFromStorage(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Errorf("%s/%s: status = %d, want 200", object.Bucket, object.Name, res.Code)
+		}
+		var result StorageImportResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatalf("decoding result: %v", err)
+		}
+		if result.Status != StorageImportIgnored {
+			t.Errorf("%s/%s: status = %s, want %s", object.Bucket, object.Name, result.Status, StorageImportIgnored)
+		}
+	}
+}
+
+func TestImportFromStorageRejectsMalformedEvent(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/importFromStorage", strings.NewReader("{"))
+	res := httptest.NewRecorder()
+	ImportFromStorage(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", res.Code)
+	}
+}
+
+func TestImportFromStorageEventIgnoresOtherObjects(t *testing.T) {
+	e := event.New()
+	e.SetType("google.cloud.storage.object.v1.finalized")
+	e.SetSource("//storage.googleapis.com/projects/_/buckets/other_bucket")
+	e.SetID("1")
+	if err := e.SetData("application/json", StorageObject{Bucket: "other_bucket", Name: "incoming/erp.csv"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportFromStorageEvent(context.Background(), e); err != nil {
+		t.Errorf("ImportFromStorageEvent() = %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/storage"
 	"github.com/disintegration/imaging"
+	"github.com/takeoff-capstone/apierror"
 )
 
 const (
@@ -27,6 +28,23 @@ const (
 type ThumbnailFileContent struct {
 	FileURL string `json:"fileURL"`
 	DocId   int    `json:"ID"`
+	// Set for bulk imported products, which have string IDs and live in the
+	// bulk import collection
+	DocumentID string `json:"documentId,omitempty"`
+	Collection string `json:"collection,omitempty"`
+}
+
+// document returns the collection and ID of the product the thumbnail
+// belongs to.
+func (f ThumbnailFileContent) document() (string, string) {
+	collection := f.Collection
+	if collection == "" {
+		collection = "Groceries"
+	}
+	if f.DocumentID != "" {
+		return collection, f.DocumentID
+	}
+	return collection, strconv.Itoa(f.DocId)
 }
 
 var (
@@ -54,7 +72,7 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -63,7 +81,7 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 
 	var fileContent ThumbnailFileContent
 	if err := json.NewDecoder(r.Body).Decode(&fileContent); err != nil {
-		http.Error(w, "Failed to decode message", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.Validation("Failed to decode message"))
 		return
 	}
 
@@ -79,7 +97,7 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 			Payload:  fmt.Sprintf("Error during FetchAndResizeImage: %v", err.Error()),
 			Severity: logging.Error,
 		})
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to fetch and resize image", err))
 		log.Println(err.Error())
 		return
 	} else {
@@ -97,7 +115,7 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 			Payload:  fmt.Sprintf("Error during EncodeImageToJpg: %v", err.Error()),
 			Severity: logging.Error,
 		})
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to encode thumbnail", err))
 		log.Println(err.Error())
 		return
 	} else {
@@ -108,7 +126,8 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 		log.Println("encoding done")
 	}
 
-	uniqueFilename := fmt.Sprintf("%d_%s_%d", time.Now().UnixNano(), "thumbnail", fileContent.DocId)
+	collection, docID := fileContent.document()
+	uniqueFilename := fmt.Sprintf("%d_%s_%s", time.Now().UnixNano(), "thumbnail", docID)
 
 	object := storageClient.Bucket(bucketName).Object(uniqueFilename)
 	thumbnailWC := object.NewWriter(ctx)
@@ -118,7 +137,7 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 			Severity: logging.Error,
 		})
 		fmt.Println(err)
-		http.Error(w, "Failed to copy file content to Cloud Storage", http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to copy file content to Cloud Storage", err))
 		return
 	} else {
 		loggers.Log(logging.Entry{
@@ -130,12 +149,12 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := thumbnailWC.Close(); err != nil {
 		fmt.Println(err)
-		http.Error(w, "Failed to close Cloud Storage writer", http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to close Cloud Storage writer", err))
 		return
 	}
 	if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
 		fmt.Println(err)
-		http.Error(w, "Failed to set ACL for Cloud Storage object", http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to set ACL for Cloud Storage object", err))
 		return
 	}
 	uploadedFileURL := fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucketName, uniqueFilename)
@@ -144,13 +163,12 @@ func GenerateThumbnail(w http.ResponseWriter, r *http.Request) {
 		Payload:  uploadedFileURL,
 		Severity: logging.Info,
 	})
-	if err := StoreToFirestore(ctx, uploadedFileURL, fileContent.DocId); err != nil {
+	if err := StoreToFirestore(ctx, uploadedFileURL, collection, docID); err != nil {
 		loggers.Log(logging.Entry{
 			Payload:  fmt.Sprintf("Error while updating Firestore document: %v", err.Error()),
 			Severity: logging.Error,
 		})
-		log.Println(err)
-		http.Error(w, "Failed to update Firestore document", http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to update Firestore document", err))
 		return
 	} else {
 		loggers.Log(logging.Entry{
@@ -195,14 +213,14 @@ func FetchAndResizeImage(p string) (*image.Image, error) {
 	return &dst, nil
 }
 
-func StoreToFirestore(ctx context.Context, uploadedFileURL string, docID int) error {
+func StoreToFirestore(ctx context.Context, uploadedFileURL string, collection string, docID string) error {
 	firestoreClient, _ := firestore.NewClient(ctx, "capstore-takeoff")
 	// if err != nil {
 	// 	log.Fatalf("Failed to create Firestore client: %v", err)
 	// }
 	defer firestoreClient.Close()
 
-	docRef := firestoreClient.Collection("Groceries").Doc(strconv.Itoa(docID))
+	docRef := firestoreClient.Collection(collection).Doc(docID)
 
 	_, err := docRef.Set(ctx, map[string]interface{}{
 		"thumbnailURL": uploadedFileURL,
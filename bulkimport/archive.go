@@ -0,0 +1,323 @@
+package bulkimport
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// MaxImageSize is the largest product image accepted from an archive, the same
+// limit CreateGrocery puts on a single upload.
+const MaxImageSize = 10 << 20
+
+// manifestFormats maps the file names recognised as an archive manifest to
+// their format.
+var manifestFormats = map[string]string{
+	"manifest.csv":    FormatCSV,
+	"manifest.json":   FormatJSON,
+	"manifest.ndjson": FormatNDJSON,
+	"manifest.jsonl":  FormatNDJSON,
+}
+
+// imageColumns are the normalized manifest headers that name a product's image
+// file.
+var imageColumns = []string{"image", "imagefile", "imagefilename", "imagename", "picture", "photo"}
+
+// ImageArchive is an uploaded ZIP holding a product manifest in CSV, JSON or
+// NDJSON together with the image files the manifest refers to by name.
+type ImageArchive struct {
+	zip      *zip.ReadCloser
+	manifest *zip.File
+	format   string
+	// images by lowercased path and by lowercased file name; a file name
+	// shared by several images maps to nil
+	byPath map[string]*zip.File
+	byName map[string]*zip.File
+}
+
+// OpenImageArchive opens the ZIP at path and finds its manifest. The manifest
+// is manifest.csv, manifest.json or manifest.ndjson, or else the only CSV or
+// JSON file in the archive; every other file is treated as an image.
+func OpenImageArchive(path string) (*ImageArchive, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ZIP file: %v", err)
+	}
+
+	a := &ImageArchive{
+		zip:    reader,
+		byPath: make(map[string]*zip.File),
+		byName: make(map[string]*zip.File),
+	}
+	var named, candidates []*zip.File
+	for _, file := range reader.File {
+		if skipArchiveEntry(file) {
+			continue
+		}
+		if _, ok := manifestFormats[strings.ToLower(baseName(file.Name))]; ok {
+			named = append(named, file)
+			continue
+		}
+		if manifestFormat(file.Name) != "" {
+			candidates = append(candidates, file)
+			continue
+		}
+		a.addImage(file)
+	}
+
+	switch {
+	case len(named) == 1:
+		a.manifest = named[0]
+	case len(named) > 1:
+		reader.Close()
+		return nil, fmt.Errorf("ZIP file contains more than one manifest")
+	case len(candidates) == 1:
+		a.manifest = candidates[0]
+	default:
+		reader.Close()
+		return nil, fmt.Errorf("ZIP file must contain a manifest.csv, manifest.json or manifest.ndjson")
+	}
+	a.format = manifestFormat(a.manifest.Name)
+	return a, nil
+}
+
+// skipArchiveEntry reports whether a ZIP entry is a directory or metadata
+// added by the archiver, such as macOS resource forks.
+func skipArchiveEntry(file *zip.File) bool {
+	if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "__MACOSX/") {
+		return true
+	}
+	return strings.HasPrefix(baseName(file.Name), ".")
+}
+
+func (a *ImageArchive) addImage(file *zip.File) {
+	a.byPath[strings.ToLower(file.Name)] = file
+	name := strings.ToLower(baseName(file.Name))
+	if _, ok := a.byName[name]; ok {
+		a.byName[name] = nil
+		return
+	}
+	a.byName[name] = file
+}
+
+func manifestFormat(name string) string {
+	if format, ok := manifestFormats[strings.ToLower(baseName(name))]; ok {
+		return format
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		return FormatCSV
+	case ".json":
+		return FormatJSON
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+func baseName(name string) string {
+	return path.Base(strings.ReplaceAll(name, "\\", "/"))
+}
+
+// ManifestFormat returns the format of the manifest.
+func (a *ImageArchive) ManifestFormat() string {
+	return a.format
+}
+
+// ImageCount returns the number of files in the archive besides the manifest.
+func (a *ImageArchive) ImageCount() int {
+	return len(a.byPath)
+}
+
+// OpenManifest opens the manifest for reading.
+func (a *ImageArchive) OpenManifest() (io.ReadCloser, error) {
+	manifest, err := a.manifest.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %v", a.manifest.Name, err)
+	}
+	return manifest, nil
+}
+
+// Image reads the image with the given name, matched against the file's path
+// in the archive or just its file name, ignoring case. Only JPEG and PNG
+// images are accepted; the detected content type is returned with the data.
+func (a *ImageArchive) Image(name string) ([]byte, string, error) {
+	key := strings.ToLower(strings.TrimPrefix(strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"), "./"))
+	file, ok := a.byPath[key]
+	if !ok {
+		file, ok = a.byName[key]
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("image '%s' not found in ZIP file", name)
+	}
+	if file == nil {
+		return nil, "", fmt.Errorf("image name '%s' is ambiguous; use its path in the ZIP file", name)
+	}
+	if file.UncompressedSize64 > MaxImageSize {
+		return nil, "", fmt.Errorf("image '%s' is larger than %d MB", name, MaxImageSize>>20)
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image '%s': %v", name, err)
+	}
+	defer reader.Close()
+	// The size in the directory is not trusted
+	data, err := io.ReadAll(io.LimitReader(reader, MaxImageSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image '%s': %v", name, err)
+	}
+	if len(data) > MaxImageSize {
+		return nil, "", fmt.Errorf("image '%s' is larger than %d MB", name, MaxImageSize>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, "", fmt.Errorf("image '%s' is not a JPG or PNG file", name)
+	}
+	return data, contentType, nil
+}
+
+// Close closes the archive.
+func (a *ImageArchive) Close() error {
+	return a.zip.Close()
+}
+
+// ImageColumn returns the index of the manifest header that names the image
+// file, or -1 if there is none.
+func ImageColumn(headers []string) int {
+	for i, header := range headers {
+		if isImageColumn(header) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ImageName returns the image file named by a manifest item, looking at the
+// same keys ImageColumn accepts as headers.
+func ImageName(item map[string]interface{}) string {
+	for key, value := range item {
+		if name, ok := value.(string); ok && isImageColumn(key) {
+			return strings.TrimSpace(name)
+		}
+	}
+	return ""
+}
+
+func isImageColumn(header string) bool {
+	normalized := normalizeHeader(header)
+	for _, column := range imageColumns {
+		if normalized == column {
+			return true
+		}
+	}
+	return false
+}
+
+// ManifestRow is one product read from an archive manifest.
+type ManifestRow struct {
+	// Number is the CSV row, JSON array index or NDJSON line of the product
+	Number int
+	// Item holds the product keyed by the manifest's column names; CSV values
+	// are strings
+	Item map[string]interface{}
+	// Image is the image file the row refers to, empty when it names none
+	Image string
+	// Err is set for a row that could not be parsed; the rest of the
+	// manifest can still be read
+	Err error
+}
+
+// ReadManifest calls fn for every product in the manifest, in order. It stops
+// early if fn returns an error, and returns that error.
+func (a *ImageArchive) ReadManifest(fn func(ManifestRow) error) error {
+	manifest, err := a.OpenManifest()
+	if err != nil {
+		return err
+	}
+	defer manifest.Close()
+
+	switch a.format {
+	case FormatCSV:
+		return readCSVManifest(manifest, fn)
+	case FormatJSON:
+		return readJSONManifest(manifest, fn)
+	default:
+		return readNDJSONManifest(manifest, fn)
+	}
+}
+
+func readCSVManifest(manifest io.Reader, fn func(ManifestRow) error) error {
+	reader := csv.NewReader(manifest)
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("manifest is empty")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read manifest headers: %v", err)
+	}
+	for i, header := range headers {
+		headers[i] = strings.TrimSpace(strings.TrimPrefix(header, "\ufeff"))
+	}
+
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("malformed manifest at row %d: %v", row, err)
+		}
+		item := make(map[string]interface{}, len(headers))
+		for i, header := range headers {
+			item[header] = record[i]
+		}
+		if err := fn(ManifestRow{Number: row, Item: item, Image: ImageName(item)}); err != nil {
+			return err
+		}
+	}
+}
+
+func readJSONManifest(manifest io.Reader, fn func(ManifestRow) error) error {
+	decoder := json.NewDecoder(manifest)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return fmt.Errorf("manifest must be a JSON array of grocery items")
+	}
+	for index := 0; decoder.More(); index++ {
+		var item map[string]interface{}
+		if err := decoder.Decode(&item); err != nil {
+			return fmt.Errorf("failed to decode manifest item %d: %v", index, err)
+		}
+		if err := fn(ManifestRow{Number: index, Item: item, Image: ImageName(item)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readNDJSONManifest(manifest io.Reader, fn func(ManifestRow) error) error {
+	reader := NewNDJSONReader(manifest)
+	for {
+		item, line, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		row := ManifestRow{Number: line, Item: item, Image: ImageName(item)}
+		var lineErr *LineError
+		if errors.As(err, &lineErr) {
+			row.Err = lineErr.Err
+		} else if err != nil {
+			return fmt.Errorf("failed to read manifest at line %d: %v", line, err)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package bulkimport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// File formats accepted by the bulk importer.
+const (
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatXLSX   = "xlsx"
+	// FormatZIP is an archive with a manifest and product images
+	FormatZIP = "zip"
+)
+
+// SniffLength is how many leading bytes DetectFormat needs.
+const SniffLength = 512
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// DetectFormat works out the format of a bulk file from its first bytes, so
+// the part Content-Type a client declares is not trusted. A JSON array is
+// JSON; a file starting with an object is newline-delimited JSON.
+func DetectFormat(head []byte) (string, error) {
+	if len(head) == 0 {
+		return "", fmt.Errorf("file is empty or could not be read")
+	}
+	// XLSX workbooks are zip archives too
+	if bytes.HasPrefix(head, zipMagic) {
+		if isWorkbook(head) {
+			return FormatXLSX, nil
+		}
+		return FormatZIP, nil
+	}
+
+	text := bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	text = bytes.TrimLeft(text, " \t\r\n")
+	if len(text) > 0 && text[0] == '[' {
+		return FormatJSON, nil
+	}
+	if len(text) > 0 && text[0] == '{' {
+		return FormatNDJSON, nil
+	}
+
+	if contentType := http.DetectContentType(head); bytes.HasPrefix([]byte(contentType), []byte("text/plain")) {
+		return FormatCSV, nil
+	}
+	return "", fmt.Errorf("Unsupported file type. Only CSV, JSON, NDJSON, XLSX or ZIP files are allowed, optionally gzip compressed")
+}
+
+// isWorkbook tells an XLSX workbook from other zip archives by the name of the
+// first entry, which in an Office Open XML package is one of its parts.
+func isWorkbook(head []byte) bool {
+	// The name follows the 30-byte local file header
+	if len(head) < 30 {
+		return false
+	}
+	nameLength := int(binary.LittleEndian.Uint16(head[26:28]))
+	if 30+nameLength > len(head) {
+		return false
+	}
+	name := string(head[30 : 30+nameLength])
+	for _, prefix := range []string{"[Content_Types].xml", "_rels/", "docProps/", "xl/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sniff peeks at the start of r without consuming it and returns the format
+// of the content, looking inside gzip compression.
+func Sniff(r *bufio.Reader) (format string, compressed bool, err error) {
+	head, _ := r.Peek(SniffLength)
+	if !bytes.HasPrefix(head, gzipMagic) {
+		format, err = DetectFormat(head)
+		return format, false, err
+	}
+
+	// Decompress only what was peeked; a truncated stream is expected here
+	gz, err := gzip.NewReader(bytes.NewReader(head))
+	if err != nil {
+		return "", true, fmt.Errorf("invalid gzip file: %v", err)
+	}
+	inner := make([]byte, SniffLength)
+	n, _ := io.ReadFull(gz, inner)
+	format, err = DetectFormat(inner[:n])
+	return format, true, err
+}
+
+// Decompress returns a reader for the content of r, undoing gzip compression
+// when compressed is set.
+func Decompress(r io.Reader, compressed bool) (io.Reader, error) {
+	if !compressed {
+		return r, nil
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip file: %v", err)
+	}
+	return gz, nil
+}
+
+// LineError reports an NDJSON line that is not a JSON object. Reading can
+// continue with the next line.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// NDJSONReader reads newline-delimited JSON, one grocery item per line.
+// Blank lines are skipped.
+type NDJSONReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewNDJSONReader(r io.Reader) *NDJSONReader {
+	return &NDJSONReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next item and its 1-based line number. A malformed line
+// yields a *LineError; any other error, including io.EOF, ends the file.
+func (n *NDJSONReader) Read() (map[string]interface{}, int, error) {
+	for {
+		data, err := n.r.ReadBytes('\n')
+		if len(data) == 0 && err != nil {
+			return nil, n.line, err
+		}
+		n.line++
+		if n.line == 1 {
+			data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			if err != nil {
+				return nil, n.line, err
+			}
+			continue
+		}
+
+		var item map[string]interface{}
+		if jsonErr := json.Unmarshal(data, &item); jsonErr != nil {
+			return nil, n.line, &LineError{Line: n.line, Err: jsonErr}
+		}
+		if item == nil {
+			return nil, n.line, &LineError{Line: n.line, Err: fmt.Errorf("expected a JSON object")}
+		}
+		return item, n.line, nil
+	}
+}
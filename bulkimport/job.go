@@ -0,0 +1,558 @@
+package bulkimport
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// JobCollection holds one record per import. The IDs of the documents an
+// import wrote are kept in its Documents subcollection.
+const (
+	JobCollection         = "Import_Jobs"
+	jobDocumentCollection = "Documents"
+)
+
+// Import job states.
+const (
+	JobPending     = "pending"
+	JobRunning     = "running"
+	JobCompleted   = "completed"
+	JobFailed      = "failed"
+	JobCancelling  = "cancelling"
+	JobCancelled   = "cancelled"
+	JobRollingBack = "rollingBack"
+	JobRolledBack  = "rolledBack"
+)
+
+const (
+	// A running import renews its lease at every checkpoint; a copy of the
+	// message delivered meanwhile is turned away until the lease runs out
+	jobLease           = time.Minute
+	checkpointInterval = 5 * time.Second
+	// Written document IDs are stored in chunks, well under the document
+	// size limit
+	documentChunkSize   = 5000
+	maxRecordedFailures = 100
+)
+
+var (
+	ErrJobNotFound = errors.New("import job not found")
+	// ErrJobRunning means another instance is processing the import.
+	ErrJobRunning = errors.New("import job is already running")
+	// ErrJobFinished means the import completed, was cancelled or was rolled
+	// back, so there is nothing left to do.
+	ErrJobFinished = errors.New("import job is finished")
+)
+
+// JobStateError means the job's state does not allow what was asked of it.
+type JobStateError struct {
+	message string
+}
+
+func (e *JobStateError) Error() string {
+	return e.message
+}
+
+// ImportJob is the record of one bulk import.
+type ImportJob struct {
+	ID         string `json:"id" firestore:"-"`
+	FileURL    string `json:"fileURL" firestore:"fileURL"`
+	Format     string `json:"format,omitempty" firestore:"format,omitempty"`
+	Collection string `json:"collection" firestore:"collection"`
+	Status     string `json:"status" firestore:"status"`
+	// Checkpoint is the number of leading rows of the file that are done
+	Checkpoint int `json:"checkpoint" firestore:"checkpoint"`
+	// Runs counts how many times the import was started or resumed
+	Runs     int         `json:"runs" firestore:"runs"`
+	Stats    Stats       `json:"stats" firestore:"stats"`
+	Failed   []RowResult `json:"failed,omitempty" firestore:"failed,omitempty"`
+	Error    string      `json:"error,omitempty" firestore:"error,omitempty"`
+	Written  int         `json:"written" firestore:"written"`
+	Deleted  int         `json:"deleted,omitempty" firestore:"deleted,omitempty"`
+	Created  time.Time   `json:"createdAt" firestore:"createdAt"`
+	Updated  time.Time   `json:"updatedAt" firestore:"updatedAt"`
+	LeaseEnd time.Time   `json:"-" firestore:"leaseEnd"`
+}
+
+// Finished reports whether the job reached a state it does not leave on its
+// own.
+func (j *ImportJob) Finished() bool {
+	switch j.Status {
+	case JobCompleted, JobCancelled, JobRolledBack:
+		return true
+	}
+	return false
+}
+
+// JobID derives the job ID for a file, for messages that do not carry one.
+// The same file always maps to the same job, so a redelivered message resumes
+// it.
+func JobID(fileURL string) string {
+	sum := sha1.Sum([]byte(fileURL))
+	return hex.EncodeToString(sum[:])[:20]
+}
+
+// CreateJob stores a new pending job. The upload handler creates it before
+// publishing the file, so the import can be cancelled before it starts.
+func CreateJob(ctx context.Context, client *firestore.Client, job *ImportJob) error {
+	if job.ID == "" {
+		job.ID = client.Collection(JobCollection).NewDoc().ID
+	}
+	job.Status = JobPending
+	job.Created = time.Now()
+	job.Updated = job.Created
+	if _, err := client.Collection(JobCollection).Doc(job.ID).Create(ctx, job); err != nil {
+		return fmt.Errorf("failed to save import job: %v", err)
+	}
+	return nil
+}
+
+// LoadJob reads the job with the given ID.
+func LoadJob(ctx context.Context, client *firestore.Client, id string) (*ImportJob, error) {
+	docSnapshot, err := client.Collection(JobCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import job: %v", err)
+	}
+	return jobFromSnapshot(docSnapshot)
+}
+
+func jobFromSnapshot(docSnapshot *firestore.DocumentSnapshot) (*ImportJob, error) {
+	var job ImportJob
+	if err := docSnapshot.DataTo(&job); err != nil {
+		return nil, fmt.Errorf("failed to decode import job: %v", err)
+	}
+	job.ID = docSnapshot.Ref.ID
+	return &job, nil
+}
+
+// StartJob claims the job for this run, creating it if the upload did not. It
+// returns ErrJobRunning while another run holds the lease and ErrJobFinished
+// when there is nothing left to do. The returned job's Checkpoint tells the
+// run where to carry on.
+func StartJob(ctx context.Context, client *firestore.Client, id string, fileURL string, format string, collection string) (*ImportJob, error) {
+	ref := client.Collection(JobCollection).Doc(id)
+	var job *ImportJob
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnapshot, err := tx.Get(ref)
+		now := time.Now()
+		switch {
+		case status.Code(err) == codes.NotFound:
+			job = &ImportJob{ID: id, FileURL: fileURL, Created: now}
+		case err != nil:
+			return err
+		default:
+			if job, err = jobFromSnapshot(docSnapshot); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case job.Finished():
+			return ErrJobFinished
+		case job.Status == JobCancelling:
+			// The run that was asked to stop is gone
+			job.Status = JobCancelled
+			job.Updated = now
+			if err := tx.Set(ref, job); err != nil {
+				return err
+			}
+			return ErrJobFinished
+		case job.Status == JobRollingBack:
+			return ErrJobFinished
+		case job.Status == JobRunning && now.Before(job.LeaseEnd):
+			return ErrJobRunning
+		}
+
+		job.Status = JobRunning
+		job.Format = format
+		job.Collection = collection
+		job.Error = ""
+		job.Runs++
+		job.Updated = now
+		job.LeaseEnd = now.Add(jobLease)
+		return tx.Set(ref, job)
+	})
+	if err != nil {
+		if err == ErrJobRunning || err == ErrJobFinished {
+			return job, err
+		}
+		return nil, fmt.Errorf("failed to start import job: %v", err)
+	}
+	return job, nil
+}
+
+// FailJob marks a job failed without running it, creating it if the upload did
+// not, for an import that would fail the same way on every attempt. A job
+// that is finished or held by another run is left as it is.
+func FailJob(ctx context.Context, client *firestore.Client, id string, fileURL string, reason string) error {
+	ref := client.Collection(JobCollection).Doc(id)
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnapshot, err := tx.Get(ref)
+		now := time.Now()
+		var job *ImportJob
+		switch {
+		case status.Code(err) == codes.NotFound:
+			job = &ImportJob{ID: id, FileURL: fileURL, Created: now}
+		case err != nil:
+			return err
+		default:
+			if job, err = jobFromSnapshot(docSnapshot); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case job.Finished(), job.Status == JobCancelling, job.Status == JobRollingBack:
+			return nil
+		case job.Status == JobRunning && now.Before(job.LeaseEnd):
+			return nil
+		}
+		job.Status = JobFailed
+		job.Error = reason
+		job.Updated = now
+		return tx.Set(ref, job)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save import job: %v", err)
+	}
+	return nil
+}
+
+// RequestCancel asks a job to stop. A pending job is cancelled at once; a
+// running one stops at its next checkpoint. Rows already written stay until
+// the job is rolled back.
+func RequestCancel(ctx context.Context, client *firestore.Client, id string) (*ImportJob, error) {
+	return updateJob(ctx, client, id, func(job *ImportJob) error {
+		switch job.Status {
+		case JobPending, JobFailed:
+			job.Status = JobCancelled
+		case JobRunning:
+			job.Status = JobCancelling
+		case JobCancelling, JobCancelled:
+		default:
+			return &JobStateError{fmt.Sprintf("an import that is %s cannot be cancelled", job.Status)}
+		}
+		return nil
+	})
+}
+
+// updateJob changes a job in a transaction. An error from change is returned
+// as is and leaves the job untouched.
+func updateJob(ctx context.Context, client *firestore.Client, id string, change func(*ImportJob) error) (*ImportJob, error) {
+	ref := client.Collection(JobCollection).Doc(id)
+	var job *ImportJob
+	var changeErr error
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if job, err = jobFromSnapshot(docSnapshot); err != nil {
+			return err
+		}
+		if changeErr = change(job); changeErr != nil {
+			return changeErr
+		}
+		job.Updated = time.Now()
+		return tx.Set(ref, job)
+	})
+	if err == ErrJobNotFound || (changeErr != nil && err == changeErr) {
+		return job, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update import job: %v", err)
+	}
+	return job, nil
+}
+
+// JobTracker saves a running import's progress: every few seconds it stores
+// the writer's checkpoint, the IDs of newly written documents and renews the
+// lease. It cancels the import when the job is asked to stop.
+type JobTracker struct {
+	client *firestore.Client
+	ref    *firestore.DocumentRef
+	job    *ImportJob
+	cancel context.CancelFunc
+	writer *Writer
+	next   func(RowResult)
+
+	mu      sync.Mutex
+	written []string
+	failed  []RowResult
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewJobTracker prepares tracking for a job that StartJob returned. cancel
+// stops the import's context. Its OnResult method must be installed as the
+// writer's callback; next, if set, is called after it.
+func NewJobTracker(client *firestore.Client, job *ImportJob, cancel context.CancelFunc, next func(RowResult)) *JobTracker {
+	return &JobTracker{
+		client: client,
+		ref:    client.Collection(JobCollection).Doc(job.ID),
+		job:    job,
+		cancel: cancel,
+		next:   next,
+		failed: job.Failed,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// OnResult records written documents and failed rows. It is the writer's
+// OnResult callback.
+func (t *JobTracker) OnResult(result RowResult) {
+	t.mu.Lock()
+	if result.Error == "" {
+		t.written = append(t.written, result.DocID)
+	} else if len(t.failed) < maxRecordedFailures {
+		t.failed = append(t.failed, result)
+	}
+	t.mu.Unlock()
+	if t.next != nil {
+		t.next(result)
+	}
+}
+
+// Start begins saving checkpoints for the writer.
+func (t *JobTracker) Start(writer *Writer) {
+	t.writer = writer
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				if err := t.save(context.Background(), "", nil); err != nil {
+					log.Printf("Failed to save checkpoint of import %s: %v", t.job.ID, err)
+				}
+			}
+		}
+	}()
+}
+
+// Finish stops the checkpoints and stores the final state of the job. A nil
+// runErr completes the job unless it was cancelled.
+func (t *JobTracker) Finish(runErr error) error {
+	close(t.stop)
+	<-t.done
+	final := JobCompleted
+	if runErr != nil {
+		final = JobFailed
+	}
+	return t.save(context.Background(), final, runErr)
+}
+
+// save flushes the written IDs and stores the progress. With final set the
+// job leaves the running state.
+func (t *JobTracker) save(ctx context.Context, final string, runErr error) error {
+	t.mu.Lock()
+	written := t.written
+	t.written = nil
+	failed := append([]RowResult(nil), t.failed...)
+	t.mu.Unlock()
+
+	if err := t.recordDocuments(ctx, written); err != nil {
+		// Keep them for the next attempt
+		t.mu.Lock()
+		t.written = append(written, t.written...)
+		t.mu.Unlock()
+		return err
+	}
+
+	checkpoint, stats := t.writer.Checkpoint(), t.writer.Stats()
+	cancelled := false
+	_, err := updateJob(ctx, t.client, t.job.ID, func(job *ImportJob) error {
+		if job.Status == JobCancelling || job.Status == JobCancelled {
+			cancelled = true
+		}
+		job.Checkpoint = checkpoint
+		job.Stats = stats
+		job.Failed = failed
+		job.Written += len(written)
+		job.LeaseEnd = time.Now().Add(jobLease)
+		if runErr != nil && !cancelled {
+			job.Error = runErr.Error()
+		}
+		switch {
+		case final == "":
+		case cancelled:
+			job.Status = JobCancelled
+		default:
+			job.Status = final
+		}
+		return nil
+	})
+	if cancelled && final == "" {
+		log.Printf("Import %s was cancelled", t.job.ID)
+		t.cancel()
+	}
+	return err
+}
+
+// recordDocuments appends document IDs to the job's Documents subcollection.
+func (t *JobTracker) recordDocuments(ctx context.Context, ids []string) error {
+	for start := 0; start < len(ids); start += documentChunkSize {
+		end := start + documentChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		_, err := t.ref.Collection(jobDocumentCollection).NewDoc().Set(ctx, map[string]interface{}{
+			"ids":       ids[start:end],
+			"createdAt": time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record written documents: %v", err)
+		}
+	}
+	return nil
+}
+
+// Rollback deletes every document the job wrote and marks it rolled back.
+// A running job has to be cancelled first. beforeDelete, if set, is called with
+// the data of each document before it is deleted, so that files it refers to
+// can be removed too. Rolling back again after a failure picks up what is
+// left.
+func Rollback(ctx context.Context, client *firestore.Client, id string, beforeDelete func(map[string]interface{})) (*ImportJob, error) {
+	job, err := updateJob(ctx, client, id, func(job *ImportJob) error {
+		switch job.Status {
+		case JobRunning, JobCancelling:
+			if time.Now().Before(job.LeaseEnd) {
+				return &JobStateError{"import is still running; cancel it first"}
+			}
+		case JobRolledBack:
+			return ErrJobFinished
+		}
+		job.Status = JobRollingBack
+		return nil
+	})
+	if err != nil {
+		return job, err
+	}
+
+	ids, err := jobDocumentIDs(ctx, client, job)
+	if err != nil {
+		return job, err
+	}
+	collection := client.Collection(job.Collection)
+	deleted := 0
+	for start := 0; start < len(ids); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		refs := make([]*firestore.DocumentRef, 0, end-start)
+		for _, docID := range ids[start:end] {
+			refs = append(refs, collection.Doc(docID))
+		}
+		docSnapshots, err := client.GetAll(ctx, refs)
+		if err != nil {
+			return job, fmt.Errorf("failed to read documents to roll back: %v", err)
+		}
+
+		bulkWriter := client.BulkWriter(ctx)
+		var jobs []*firestore.BulkWriterJob
+		for _, docSnapshot := range docSnapshots {
+			if !docSnapshot.Exists() {
+				continue
+			}
+			if beforeDelete != nil {
+				beforeDelete(docSnapshot.Data())
+			}
+			deleteJob, err := bulkWriter.Delete(docSnapshot.Ref)
+			if err != nil {
+				bulkWriter.End()
+				return job, fmt.Errorf("failed to delete document %s: %v", docSnapshot.Ref.ID, err)
+			}
+			jobs = append(jobs, deleteJob)
+		}
+		bulkWriter.End()
+		for _, deleteJob := range jobs {
+			if _, err := deleteJob.Results(); err != nil {
+				return job, fmt.Errorf("failed to delete document: %v", err)
+			}
+			deleted++
+		}
+	}
+
+	return updateJob(ctx, client, id, func(job *ImportJob) error {
+		job.Status = JobRolledBack
+		job.Deleted += deleted
+		return nil
+	})
+}
+
+// jobDocumentIDs lists the documents a job wrote: the recorded IDs, plus any
+// document carrying the job's ID prefix whose ID was not recorded before the
+// run stopped.
+func jobDocumentIDs(ctx context.Context, client *firestore.Client, job *ImportJob) ([]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+
+	chunks := client.Collection(JobCollection).Doc(job.ID).Collection(jobDocumentCollection).Documents(ctx)
+	defer chunks.Stop()
+	for {
+		docSnapshot, err := chunks.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recorded documents: %v", err)
+		}
+		var chunk struct {
+			IDs []string `firestore:"ids"`
+		}
+		if err := docSnapshot.DataTo(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode recorded documents: %v", err)
+		}
+		for _, id := range chunk.IDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	// IDs are "<job ID>-<row>", and '.' sorts right after '-'
+	collection := client.Collection(job.Collection)
+	prefixed := collection.OrderBy(firestore.DocumentID, firestore.Asc).
+		StartAt(collection.Doc(job.ID + "-")).
+		EndBefore(collection.Doc(job.ID + ".")).
+		Select().
+		Documents(ctx)
+	defer prefixed.Stop()
+	for {
+		docSnapshot, err := prefixed.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list documents of the import: %v", err)
+		}
+		if !seen[docSnapshot.Ref.ID] {
+			seen[docSnapshot.Ref.ID] = true
+			ids = append(ids, docSnapshot.Ref.ID)
+		}
+	}
+	return ids, nil
+}
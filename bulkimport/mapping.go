@@ -0,0 +1,481 @@
+package bulkimport
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TemplateCollection holds the saved column mapping templates.
+const TemplateCollection = "Mapping_Templates"
+
+// RequiredFields are the grocery fields every imported row must provide.
+var RequiredFields = []string{"productname", "price", "category", "weight", "brand", "itempackagequantity", "packageinformation", "manufacturer", "countryoforigin"}
+
+// GroceryFields are the fields a source column can be mapped to.
+var GroceryFields = append([]string{"vegetarian"}, RequiredFields...)
+
+// Transform types supported in a column mapping.
+const (
+	TransformTrim      = "trim"
+	TransformLowercase = "lowercase"
+	TransformUppercase = "uppercase"
+	TransformNumber    = "number"
+	TransformUnit      = "unit"
+	TransformDefault   = "default"
+	TransformLookup    = "lookup"
+)
+
+// ErrTemplateNotFound is returned by LoadTemplate for an unknown template ID.
+var ErrTemplateNotFound = fmt.Errorf("mapping template not found")
+
+// MappingTemplate maps the columns of a supplier file onto grocery fields.
+type MappingTemplate struct {
+	ID      string          `json:"id" firestore:"id"`
+	Name    string          `json:"name" firestore:"name"`
+	Columns []ColumnMapping `json:"columns" firestore:"columns"`
+	// Defaults fill grocery fields that no column provides
+	Defaults map[string]interface{} `json:"defaults,omitempty" firestore:"defaults,omitempty"`
+}
+
+// ColumnMapping maps one source column onto a grocery field. Transforms are
+// applied in order.
+type ColumnMapping struct {
+	Source     string      `json:"source" firestore:"source"`
+	Field      string      `json:"field" firestore:"field"`
+	Transforms []Transform `json:"transforms,omitempty" firestore:"transforms,omitempty"`
+}
+
+// Transform changes a column value before it is stored.
+//
+//	trim, lowercase, uppercase, number  no options
+//	unit     From and To units, e.g. "g" to "kg"; a unit in the value wins over From
+//	default  Value is used when the cell is empty
+//	lookup   Table maps source values to stored values, matched case-insensitively
+type Transform struct {
+	Type  string            `json:"type" firestore:"type"`
+	From  string            `json:"from,omitempty" firestore:"from,omitempty"`
+	To    string            `json:"to,omitempty" firestore:"to,omitempty"`
+	Value interface{}       `json:"value,omitempty" firestore:"value,omitempty"`
+	Table map[string]string `json:"table,omitempty" firestore:"table,omitempty"`
+}
+
+// unitFactors converts a unit to its base unit (grams or millilitres).
+var unitFactors = map[string]struct {
+	dimension string
+	factor    float64
+}{
+	"mg": {"mass", 0.001},
+	"g":  {"mass", 1},
+	"kg": {"mass", 1000},
+	"oz": {"mass", 28.349523125},
+	"lb": {"mass", 453.59237},
+	"ml": {"volume", 1},
+	"cl": {"volume", 10},
+	"l":  {"volume", 1000},
+}
+
+// Validate checks that the template only uses known fields, transforms and units.
+func (t *MappingTemplate) Validate() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return fmt.Errorf("template name is required")
+	}
+	if len(t.Columns) == 0 {
+		return fmt.Errorf("template must map at least one column")
+	}
+	sources := make(map[string]bool)
+	for _, column := range t.Columns {
+		if strings.TrimSpace(column.Source) == "" {
+			return fmt.Errorf("column source is required")
+		}
+		key := normalizeHeader(column.Source)
+		if sources[key] {
+			return fmt.Errorf("column '%s' is mapped more than once", column.Source)
+		}
+		sources[key] = true
+		if !isGroceryField(column.Field) {
+			return fmt.Errorf("column '%s' maps to unknown field '%s'", column.Source, column.Field)
+		}
+		for _, transform := range column.Transforms {
+			if err := transform.validate(); err != nil {
+				return fmt.Errorf("column '%s': %v", column.Source, err)
+			}
+		}
+	}
+	for field := range t.Defaults {
+		if !isGroceryField(field) {
+			return fmt.Errorf("default given for unknown field '%s'", field)
+		}
+	}
+	return nil
+}
+
+func (tr Transform) validate() error {
+	switch tr.Type {
+	case TransformTrim, TransformLowercase, TransformUppercase, TransformNumber:
+		return nil
+	case TransformUnit:
+		to, ok := unitFactors[strings.ToLower(tr.To)]
+		if !ok {
+			return fmt.Errorf("unknown target unit '%s'", tr.To)
+		}
+		if tr.From == "" {
+			return nil
+		}
+		from, ok := unitFactors[strings.ToLower(tr.From)]
+		if !ok {
+			return fmt.Errorf("unknown source unit '%s'", tr.From)
+		}
+		if from.dimension != to.dimension {
+			return fmt.Errorf("cannot convert %s to %s", tr.From, tr.To)
+		}
+		return nil
+	case TransformDefault:
+		if tr.Value == nil {
+			return fmt.Errorf("default transform needs a value")
+		}
+		return nil
+	case TransformLookup:
+		if len(tr.Table) == 0 {
+			return fmt.Errorf("lookup transform needs a table")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown transform '%s'", tr.Type)
+}
+
+// MissingFields returns the required fields that neither a header nor a
+// default of the template provides.
+func (t *MappingTemplate) MissingFields(headers []string) []string {
+	present := make(map[string]bool)
+	for _, h := range headers {
+		present[normalizeHeader(h)] = true
+	}
+	covered := make(map[string]bool)
+	for _, column := range t.Columns {
+		if present[normalizeHeader(column.Source)] || column.hasDefault() {
+			covered[column.Field] = true
+		}
+	}
+	for field := range t.Defaults {
+		covered[field] = true
+	}
+
+	var missing []string
+	for _, field := range RequiredFields {
+		if !covered[field] {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+func (c ColumnMapping) hasDefault() bool {
+	for _, transform := range c.Transforms {
+		if transform.Type == TransformDefault {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply maps a source row, keyed by column header, onto grocery fields.
+// Columns the template does not mention are dropped.
+func (t *MappingTemplate) Apply(row map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(row))
+	for key, value := range row {
+		values[normalizeHeader(key)] = value
+	}
+
+	item := make(map[string]interface{})
+	for _, column := range t.Columns {
+		value, ok := values[normalizeHeader(column.Source)]
+		if !ok {
+			value = nil
+		}
+		for _, transform := range column.Transforms {
+			var err error
+			value, err = transform.apply(value)
+			if err != nil {
+				return nil, fmt.Errorf("column '%s': %v", column.Source, err)
+			}
+		}
+		if value != nil {
+			item[column.Field] = value
+		}
+	}
+	for field, value := range t.Defaults {
+		if isEmpty(item[field]) {
+			item[field] = value
+		}
+	}
+	return item, nil
+}
+
+func (tr Transform) apply(value interface{}) (interface{}, error) {
+	switch tr.Type {
+	case TransformTrim:
+		if s, ok := value.(string); ok {
+			return strings.TrimSpace(s), nil
+		}
+	case TransformLowercase:
+		if s, ok := value.(string); ok {
+			return strings.ToLower(s), nil
+		}
+	case TransformUppercase:
+		if s, ok := value.(string); ok {
+			return strings.ToUpper(s), nil
+		}
+	case TransformNumber:
+		if isEmpty(value) {
+			return value, nil
+		}
+		number, _, err := parseQuantity(value)
+		return number, err
+	case TransformUnit:
+		if isEmpty(value) {
+			return value, nil
+		}
+		return convertUnit(value, tr.From, tr.To)
+	case TransformDefault:
+		if isEmpty(value) {
+			return tr.Value, nil
+		}
+	case TransformLookup:
+		if value == nil {
+			return value, nil
+		}
+		key := strings.TrimSpace(fmt.Sprintf("%v", value))
+		if mapped, ok := tr.Table[key]; ok {
+			return mapped, nil
+		}
+		for from, to := range tr.Table {
+			if strings.EqualFold(from, key) {
+				return to, nil
+			}
+		}
+	}
+	return value, nil
+}
+
+// convertUnit converts values such as "500", 500 or "500 g" into the target
+// unit. A unit written in the value takes precedence over the configured one.
+func convertUnit(value interface{}, from, to string) (interface{}, error) {
+	number, unit, err := parseQuantity(value)
+	if err != nil {
+		return nil, err
+	}
+	if unit == "" {
+		unit = strings.ToLower(from)
+	}
+	if unit == "" {
+		return nil, fmt.Errorf("value '%v' has no unit to convert from", value)
+	}
+	source, ok := unitFactors[unit]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit '%s' in value '%v'", unit, value)
+	}
+	target := unitFactors[strings.ToLower(to)]
+	if source.dimension != target.dimension {
+		return nil, fmt.Errorf("cannot convert %s to %s", unit, to)
+	}
+	return number * source.factor / target.factor, nil
+}
+
+// parseQuantity splits "1.5kg" or "1.5 kg" into its number and unit.
+func parseQuantity(value interface{}) (float64, string, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, "", nil
+	case int:
+		return float64(v), "", nil
+	case int64:
+		return float64(v), "", nil
+	}
+	s := strings.TrimSpace(fmt.Sprintf("%v", value))
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !(unicode.IsDigit(r) || r == '.' || r == '-' || r == '+')
+	})
+	numberPart, unit := s, ""
+	if end >= 0 {
+		numberPart, unit = s[:end], strings.ToLower(strings.TrimSpace(s[end:]))
+	}
+	number, err := strconv.ParseFloat(numberPart, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("'%s' is not a number", s)
+	}
+	return number, unit, nil
+}
+
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	s, ok := value.(string)
+	return ok && strings.TrimSpace(s) == ""
+}
+
+func isGroceryField(field string) bool {
+	for _, f := range GroceryFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHeader lowercases a header and drops everything except letters and
+// digits, so "Net Wt." and "net_wt" compare equal.
+func normalizeHeader(header string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(header) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// headerSynonyms lists common supplier spellings for each grocery field, in
+// normalized form.
+var headerSynonyms = map[string][]string{
+	"productname":         {"productname", "name", "product", "itemname", "item", "title", "description", "productdescription"},
+	"price":               {"price", "mrp", "sellingprice", "sp", "rate", "unitprice", "cost", "amount"},
+	"category":            {"category", "cat", "department", "dept", "section", "producttype"},
+	"weight":              {"weight", "netwt", "netweight", "wt", "grossweight", "grosswt"},
+	"brand":               {"brand", "brandname", "make"},
+	"itempackagequantity": {"itempackagequantity", "packqty", "packquantity", "packsize", "qty", "quantity", "unitsperpack", "casesize"},
+	"packageinformation":  {"packageinformation", "packinfo", "packaging", "packagetype", "pack", "packagedetails"},
+	"manufacturer":        {"manufacturer", "mfr", "mfg", "manufacturedby", "maker", "producer"},
+	"countryoforigin":     {"countryoforigin", "origin", "country", "coo", "madein"},
+	"vegetarian":          {"vegetarian", "veg", "isveg", "vegnonveg", "vegetarianflag"},
+}
+
+// Suggestion is a proposed mapping for one source column.
+type Suggestion struct {
+	Source     string  `json:"source"`
+	Field      string  `json:"field"`
+	Confidence float64 `json:"confidence"`
+}
+
+// MappingSuggestion is the result of Suggest: a draft template that can be
+// reviewed, named and saved, plus what could not be matched.
+type MappingSuggestion struct {
+	Template      MappingTemplate `json:"template"`
+	Suggestions   []Suggestion    `json:"suggestions"`
+	Unmatched     []string        `json:"unmatched"`
+	MissingFields []string        `json:"missingFields"`
+}
+
+// Suggest proposes a mapping from the headers of a sample file. Exact field
+// names win over synonyms, which win over partial matches, and every grocery
+// field is used at most once.
+func Suggest(headers []string) MappingSuggestion {
+	var candidates []Suggestion
+	for _, header := range headers {
+		normalized := normalizeHeader(header)
+		if normalized == "" {
+			continue
+		}
+		for field, synonyms := range headerSynonyms {
+			if confidence := matchConfidence(normalized, field, synonyms); confidence > 0 {
+				candidates = append(candidates, Suggestion{Source: header, Field: field, Confidence: confidence})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+
+	usedSources := make(map[string]bool)
+	usedFields := make(map[string]bool)
+	result := MappingSuggestion{Template: MappingTemplate{Name: "Suggested mapping"}}
+	for _, candidate := range candidates {
+		if usedSources[candidate.Source] || usedFields[candidate.Field] {
+			continue
+		}
+		usedSources[candidate.Source] = true
+		usedFields[candidate.Field] = true
+		result.Suggestions = append(result.Suggestions, candidate)
+	}
+	// Keep the suggestions in file column order
+	order := make(map[string]int, len(headers))
+	for i, header := range headers {
+		order[header] = i
+	}
+	sort.SliceStable(result.Suggestions, func(i, j int) bool {
+		return order[result.Suggestions[i].Source] < order[result.Suggestions[j].Source]
+	})
+
+	for _, suggestion := range result.Suggestions {
+		result.Template.Columns = append(result.Template.Columns, ColumnMapping{
+			Source:     suggestion.Source,
+			Field:      suggestion.Field,
+			Transforms: []Transform{{Type: TransformTrim}},
+		})
+	}
+	for _, header := range headers {
+		if !usedSources[header] {
+			result.Unmatched = append(result.Unmatched, header)
+		}
+	}
+	result.MissingFields = result.Template.MissingFields(headers)
+	return result
+}
+
+func matchConfidence(normalized, field string, synonyms []string) float64 {
+	if normalized == field {
+		return 1
+	}
+	for _, synonym := range synonyms {
+		if normalized == synonym {
+			return 0.9
+		}
+	}
+	for _, synonym := range synonyms {
+		if len(synonym) >= 4 && strings.Contains(normalized, synonym) {
+			return 0.6
+		}
+	}
+	return 0
+}
+
+// SaveTemplate validates and stores a template, assigning it an ID when it
+// has none.
+func SaveTemplate(ctx context.Context, client *firestore.Client, template *MappingTemplate) error {
+	if err := template.Validate(); err != nil {
+		return err
+	}
+	collection := client.Collection(TemplateCollection)
+	if template.ID == "" {
+		template.ID = collection.NewDoc().ID
+	}
+	if _, err := collection.Doc(template.ID).Set(ctx, template); err != nil {
+		return fmt.Errorf("failed to save mapping template: %v", err)
+	}
+	return nil
+}
+
+// LoadTemplate reads a saved template by ID.
+func LoadTemplate(ctx context.Context, client *firestore.Client, id string) (*MappingTemplate, error) {
+	snapshot, err := client.Collection(TemplateCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mapping template: %v", err)
+	}
+	var template MappingTemplate
+	if err := snapshot.DataTo(&template); err != nil {
+		return nil, fmt.Errorf("failed to read mapping template: %v", err)
+	}
+	template.ID = snapshot.Ref.ID
+	return &template, nil
+}
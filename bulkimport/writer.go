@@ -0,0 +1,345 @@
+package bulkimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultWorkers   = 4
+	DefaultBatchSize = 100
+	// Firestore accepts at most 500 writes in one commit
+	maxBatchSize = 500
+)
+
+// WriterConfig controls how an import is written to Firestore. Zero values are
+// replaced with the package defaults.
+type WriterConfig struct {
+	Workers   int
+	BatchSize int
+	// OnResult, when set, is called once for every row as soon as it has been
+	// written, rejected or has failed. It may be called from several goroutines.
+	OnResult func(RowResult)
+	// Skip is the checkpoint of an earlier run of the same import: that many
+	// leading rows passed to Write or Reject are ignored.
+	Skip int
+	// DocIDPrefix, when set, makes document IDs "<prefix>-<position in file>"
+	// instead of random, so that running an import again overwrites the
+	// documents it wrote before rather than duplicating them.
+	DocIDPrefix string
+	// OmitFields are removed from every row before it is written, such as the
+	// id column of an exported file, which names the document it came from.
+	OmitFields []string
+}
+
+// Row is a single grocery item waiting to be written.
+type Row struct {
+	// Number identifies the row in the source file, counted from 1 (CSV line,
+	// position in a JSON array...)
+	Number int
+	// DocID is the document ID to write to. A random ID is used when empty.
+	DocID string
+	Data  map[string]interface{}
+	seq   int
+}
+
+// RowResult is the outcome of writing one row.
+type RowResult struct {
+	Row   int    `json:"row" firestore:"row"`
+	DocID string `json:"id,omitempty" firestore:"id,omitempty"`
+	Error string `json:"error,omitempty" firestore:"error,omitempty"`
+	// position of the row in the file, counting from 1
+	seq int
+}
+
+// Stats describes the throughput of an import.
+type Stats struct {
+	Rows          int     `json:"rows" firestore:"rows"`
+	Skipped       int     `json:"skipped" firestore:"skipped"`
+	Written       int     `json:"written" firestore:"written"`
+	Failed        int     `json:"failed" firestore:"failed"`
+	Batches       int     `json:"batches" firestore:"batches"`
+	DurationMs    int64   `json:"durationMs" firestore:"durationMs"`
+	RowsPerSecond float64 `json:"rowsPerSecond" firestore:"rowsPerSecond"`
+}
+
+// Summary is returned when the writer is closed. Only failed rows are kept
+// here so that memory stays bounded for large files; use OnResult to see every
+// row.
+type Summary struct {
+	Stats  Stats       `json:"stats"`
+	Failed []RowResult `json:"failed"`
+}
+
+// Writer writes rows to a Firestore collection in batches using a fixed pool
+// of workers. Batches are sent through a BulkWriter, which retries rows that
+// fail with a contention or quota error itself. Write, Reject and Close are
+// meant to be called from the goroutine reading the file.
+type Writer struct {
+	ctx        context.Context
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+	config     WriterConfig
+
+	batches chan []Row
+	pending []Row
+	wg      sync.WaitGroup
+	start   time.Time
+	// position of the last row passed to Write or Reject
+	seq int
+
+	mu     sync.Mutex
+	stats  Stats
+	failed []RowResult
+	// rows finished out of order, by position, and the position up to which
+	// every row has finished
+	finished   map[int]bool
+	checkpoint int
+	closed     bool
+	summary    Summary
+}
+
+// NewWriter starts the worker pool for the given collection.
+func NewWriter(ctx context.Context, client *firestore.Client, collection string, config WriterConfig) *Writer {
+	if config.Workers <= 0 {
+		config.Workers = DefaultWorkers
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.BatchSize > maxBatchSize {
+		config.BatchSize = maxBatchSize
+	}
+
+	w := &Writer{
+		ctx:        ctx,
+		client:     client,
+		collection: client.Collection(collection),
+		config:     config,
+		batches:    make(chan []Row, config.Workers),
+		start:      time.Now(),
+		finished:   make(map[int]bool),
+		checkpoint: config.Skip,
+	}
+	for i := 0; i < config.Workers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	return w
+}
+
+// Write queues a row. It blocks while all workers are busy, which keeps the
+// number of rows held in memory bounded. It returns the context's error once
+// the import has been cancelled, and the caller should stop reading the file.
+func (w *Writer) Write(row Row) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if w.next() {
+		return nil
+	}
+	row.seq = w.seq
+	for _, field := range w.config.OmitFields {
+		delete(row.Data, field)
+	}
+	if row.DocID == "" && w.config.DocIDPrefix != "" {
+		row.DocID = fmt.Sprintf("%s-%d", w.config.DocIDPrefix, row.seq)
+	} else if row.DocID == "" {
+		// Pick the ID now so that retries overwrite the same document
+		row.DocID = w.collection.NewDoc().ID
+	}
+
+	w.pending = append(w.pending, row)
+	if len(w.pending) >= w.config.BatchSize {
+		select {
+		case w.batches <- w.pending:
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+		w.pending = nil
+	}
+	return nil
+}
+
+// Reject records a row that could not be parsed or validated, so that it shows
+// up in the results next to the rows that failed to write. The message of err
+// is returned to the client, so it should say what is wrong with the row.
+func (w *Writer) Reject(rowNumber int, err error) {
+	if w.next() {
+		return
+	}
+	w.finish(RowResult{Row: rowNumber, Error: err.Error(), seq: w.seq})
+}
+
+// Skipping reports whether the next row will be ignored because an earlier
+// run of the import already handled it. Callers check it before doing work
+// with side effects for a row.
+func (w *Writer) Skipping() bool {
+	return w.seq < w.config.Skip
+}
+
+// next advances to the next row and reports whether it is skipped.
+func (w *Writer) next() bool {
+	skip := w.Skipping()
+	w.seq++
+	w.mu.Lock()
+	if skip {
+		w.stats.Skipped++
+	} else {
+		w.stats.Rows++
+	}
+	w.mu.Unlock()
+	return skip
+}
+
+// Checkpoint returns the number of leading rows that have been written,
+// rejected or have failed for good. A later run of the same import passes it
+// as WriterConfig.Skip to carry on from there.
+func (w *Writer) Checkpoint() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.checkpoint
+}
+
+// Stats returns the statistics so far.
+func (w *Writer) Stats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	stats := w.stats
+	elapsed := time.Since(w.start)
+	stats.DurationMs = elapsed.Milliseconds()
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		stats.RowsPerSecond = float64(stats.Written) / seconds
+	}
+	return stats
+}
+
+// Close flushes the remaining rows, waits for the workers and returns the
+// summary. Calling Close more than once returns the same summary.
+func (w *Writer) Close() Summary {
+	w.mu.Lock()
+	if w.closed {
+		defer w.mu.Unlock()
+		return w.summary
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	if len(w.pending) > 0 && w.ctx.Err() == nil {
+		w.batches <- w.pending
+	} else {
+		for _, row := range w.pending {
+			w.finish(RowResult{Row: row.Number, DocID: row.DocID, Error: writeErrorMessage(w.ctx.Err()), seq: row.seq})
+		}
+	}
+	w.pending = nil
+	close(w.batches)
+	w.wg.Wait()
+
+	stats := w.Stats()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.summary = Summary{Stats: stats, Failed: w.failed}
+	return w.summary
+}
+
+func (w *Writer) work() {
+	defer w.wg.Done()
+	for batch := range w.batches {
+		w.commit(batch)
+	}
+}
+
+// commit writes a batch. The BulkWriter retries the writes that fail with a
+// retryable error, so a row that still fails has failed for good.
+func (w *Writer) commit(batch []Row) {
+	w.mu.Lock()
+	w.stats.Batches++
+	w.mu.Unlock()
+
+	bulkWriter := w.client.BulkWriter(w.ctx)
+	jobs := make([]*firestore.BulkWriterJob, len(batch))
+	for i, row := range batch {
+		job, err := bulkWriter.Set(w.collection.Doc(row.DocID), row.Data)
+		if err != nil {
+			w.fail(row, err)
+			continue
+		}
+		jobs[i] = job
+	}
+	bulkWriter.End()
+
+	for i, job := range jobs {
+		if job == nil {
+			continue
+		}
+		row := batch[i]
+		if _, err := job.Results(); err != nil {
+			w.fail(row, err)
+			continue
+		}
+		w.finish(RowResult{Row: row.Number, DocID: row.DocID, seq: row.seq})
+	}
+}
+
+// fail records a row that could not be written. The error is logged; the
+// result only says what kind of failure it was.
+func (w *Writer) fail(row Row, err error) {
+	log.Printf("Failed to write row %d as %s: %v", row.Number, row.DocID, err)
+	w.finish(RowResult{Row: row.Number, DocID: row.DocID, Error: writeErrorMessage(err), seq: row.seq})
+}
+
+func (w *Writer) finish(result RowResult) {
+	w.mu.Lock()
+	if result.Error == "" {
+		w.stats.Written++
+	} else {
+		w.stats.Failed++
+		w.failed = append(w.failed, result)
+	}
+	// A row that failed because the import was cancelled is not done; a
+	// resumed run has to write it again
+	if result.Error == "" || w.ctx.Err() == nil {
+		w.finished[result.seq] = true
+		for w.finished[w.checkpoint+1] {
+			delete(w.finished, w.checkpoint+1)
+			w.checkpoint++
+		}
+	}
+	w.mu.Unlock()
+
+	if w.config.OnResult != nil {
+		w.config.OnResult(result)
+	}
+}
+
+// writeErrorMessage describes a failed write without the details of err.
+func writeErrorMessage(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "import was cancelled"
+	}
+	switch status.Code(err) {
+	case codes.Canceled:
+		return "import was cancelled"
+	case codes.InvalidArgument:
+		return "grocery item is not valid for Firestore"
+	case codes.Aborted, codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return "Firestore was too busy to write the grocery item"
+	default:
+		return "failed to write grocery item"
+	}
+}
+
+// String makes the stats readable in log lines.
+func (s Stats) String() string {
+	return fmt.Sprintf("%d rows, %d skipped, %d written, %d failed in %dms (%.1f rows/s)",
+		s.Rows, s.Skipped, s.Written, s.Failed, s.DurationMs, s.RowsPerSecond)
+}
@@ -0,0 +1,340 @@
+package bulkimport
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Number of rows searched for the header row when it is not given
+const maxHeaderScanRows = 20
+
+// XLSXOptions selects what part of a workbook is imported.
+type XLSXOptions struct {
+	// Sheet is a sheet name or a 1-based sheet number; the first sheet is used
+	// when empty
+	Sheet string `json:"sheet,omitempty"`
+	// HeaderRow is the 1-based row holding the column headers; it is detected
+	// when zero
+	HeaderRow int `json:"headerRow,omitempty"`
+}
+
+// XLSXReader reads the rows of one worksheet as strings, in the same shape the
+// CSV path produces, so both go through the same validation and import.
+// Numbers are written without their display format, dates as ISO 8601 and
+// booleans as "true"/"false".
+type XLSXReader struct {
+	file      *excelize.File
+	raw       *excelize.Rows
+	formatted *excelize.Rows
+	sheet     string
+	headers   []string
+	row       int
+	// data rows read ahead while looking for the header
+	buffered []bufferedRow
+}
+
+type bufferedRow struct {
+	number int
+	record []string
+}
+
+// OpenXLSX opens the workbook at path and positions the reader after the
+// header row. XLSX is a zip archive and cannot be read as a stream, so callers
+// spool uploads to a temporary file first; worksheets themselves are still
+// iterated without loading them into memory.
+func OpenXLSX(path string, options XLSXOptions, template *MappingTemplate) (*XLSXReader, error) {
+	file, err := excelize.OpenFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open XLSX file: %v", err)
+	}
+
+	sheet, err := selectSheet(file, options.Sheet)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	x := &XLSXReader{file: file, sheet: sheet}
+	if x.raw, err = file.Rows(sheet); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read sheet '%s': %v", sheet, err)
+	}
+	if x.formatted, err = file.Rows(sheet); err != nil {
+		x.Close()
+		return nil, fmt.Errorf("failed to read sheet '%s': %v", sheet, err)
+	}
+
+	if err := x.findHeaders(options.HeaderRow, template); err != nil {
+		x.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+func selectSheet(file *excelize.File, sheet string) (string, error) {
+	sheets := file.GetSheetList()
+	if len(sheets) == 0 {
+		return "", fmt.Errorf("workbook has no sheets")
+	}
+	if sheet == "" {
+		return sheets[0], nil
+	}
+	for _, name := range sheets {
+		if strings.EqualFold(name, sheet) {
+			return name, nil
+		}
+	}
+	if index, err := strconv.Atoi(sheet); err == nil && index >= 1 && index <= len(sheets) {
+		return sheets[index-1], nil
+	}
+	return "", fmt.Errorf("sheet '%s' not found; the workbook has %s", sheet, strings.Join(sheets, ", "))
+}
+
+// findHeaders advances to the header row. Without an explicit row number it
+// picks the row, among the first few, whose cells look most like grocery field
+// names or the template's source columns; title rows and blank lines above the
+// table are skipped.
+func (x *XLSXReader) findHeaders(headerRow int, template *MappingTemplate) error {
+	if headerRow > 0 {
+		for x.row < headerRow {
+			record, err := x.next()
+			if err == io.EOF {
+				return fmt.Errorf("sheet '%s' has no row %d", x.sheet, headerRow)
+			}
+			if err != nil {
+				return err
+			}
+			x.headers = record
+		}
+		return x.checkHeaders()
+	}
+
+	known := knownHeaders(template)
+	best, bestScore := 0, 0
+	for len(x.buffered) < maxHeaderScanRows {
+		record, err := x.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+		x.buffered = append(x.buffered, bufferedRow{number: x.row, record: record})
+
+		score := 0
+		for _, cell := range record {
+			if known[normalizeHeader(cell)] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = len(x.buffered)-1, score
+			// Every required field found; the header cannot get any better
+			if score >= len(RequiredFields) {
+				break
+			}
+		}
+	}
+	if len(x.buffered) == 0 {
+		return fmt.Errorf("sheet '%s' is empty", x.sheet)
+	}
+
+	// Rows scanned after the header are data and are replayed by Read
+	x.headers = x.buffered[best].record
+	x.buffered = x.buffered[best+1:]
+	return x.checkHeaders()
+}
+
+func (x *XLSXReader) checkHeaders() error {
+	for len(x.headers) > 0 && strings.TrimSpace(x.headers[len(x.headers)-1]) == "" {
+		x.headers = x.headers[:len(x.headers)-1]
+	}
+	if len(x.headers) == 0 {
+		return fmt.Errorf("sheet '%s' has no header row", x.sheet)
+	}
+	for i, header := range x.headers {
+		x.headers[i] = strings.TrimSpace(header)
+	}
+	return nil
+}
+
+func knownHeaders(template *MappingTemplate) map[string]bool {
+	known := make(map[string]bool)
+	for _, synonyms := range headerSynonyms {
+		for _, synonym := range synonyms {
+			known[synonym] = true
+		}
+	}
+	if template != nil {
+		for _, column := range template.Columns {
+			known[normalizeHeader(column.Source)] = true
+		}
+	}
+	return known
+}
+
+// Sheet returns the name of the sheet being read.
+func (x *XLSXReader) Sheet() string {
+	return x.sheet
+}
+
+// Headers returns the header row.
+func (x *XLSXReader) Headers() []string {
+	return x.headers
+}
+
+// Read returns the next non-blank data row, padded or cut to the number of
+// headers, together with its 1-based row number in the sheet. It returns
+// io.EOF after the last row.
+func (x *XLSXReader) Read() ([]string, int, error) {
+	for {
+		var record []string
+		number := 0
+		if len(x.buffered) > 0 {
+			record, number = x.buffered[0].record, x.buffered[0].number
+			x.buffered = x.buffered[1:]
+		} else {
+			var err error
+			if record, err = x.next(); err != nil {
+				return nil, x.row, err
+			}
+			number = x.row
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+
+		fields := make([]string, len(x.headers))
+		copy(fields, record)
+		return fields, number, nil
+	}
+}
+
+// next reads one sheet row and converts its cells to their typed form.
+func (x *XLSXReader) next() ([]string, error) {
+	if !x.raw.Next() || !x.formatted.Next() {
+		if err := x.raw.Error(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	x.row++
+
+	raw, err := x.raw.Columns(excelize.Options{RawCellValue: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read row %d: %v", x.row, err)
+	}
+	formatted, err := x.formatted.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read row %d: %v", x.row, err)
+	}
+
+	record := make([]string, len(raw))
+	for i := range raw {
+		display := ""
+		if i < len(formatted) {
+			display = formatted[i]
+		}
+		record[i] = typedCellValue(raw[i], display)
+	}
+	return record, nil
+}
+
+// typedCellValue picks a plain representation of a cell from its stored value
+// and the text Excel displays for it.
+func typedCellValue(raw, display string) string {
+	switch strings.ToUpper(display) {
+	case "TRUE":
+		return "true"
+	case "FALSE":
+		return "false"
+	}
+	// Text cells, including digit strings such as "00123", are kept as typed
+	if raw == display {
+		return strings.TrimSpace(display)
+	}
+	number, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return strings.TrimSpace(display)
+	}
+	// A stored number shown with date separators is a date serial
+	if looksLikeDate(display) {
+		if t, err := excelize.ExcelDateToTime(number, false); err == nil {
+			if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+				return t.Format("2006-01-02")
+			}
+			return t.Format("2006-01-02T15:04:05")
+		}
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+// looksLikeDate reports whether Excel displays a number as a date or time,
+// e.g. "02/01/2024", "2024-01-02", "2-Jan-24" or "10:30".
+func looksLikeDate(display string) bool {
+	if !strings.ContainsAny(display, "0123456789") {
+		return false
+	}
+	if _, err := strconv.ParseFloat(display, 64); err == nil {
+		return false
+	}
+	if strings.ContainsAny(display, "/:") || strings.Count(display, "-") >= 2 {
+		return true
+	}
+	lower := strings.ToLower(display)
+	for _, month := range monthNames {
+		if strings.Contains(lower, month) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBlankRecord(record []string) bool {
+	for _, cell := range record {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Close releases the workbook and its temporary files.
+func (x *XLSXReader) Close() error {
+	if x.raw != nil {
+		x.raw.Close()
+	}
+	if x.formatted != nil {
+		x.formatted.Close()
+	}
+	return x.file.Close()
+}
+
+// SpoolToTempFile copies r into a temporary file, for formats that need random
+// access. The caller removes the file when done.
+func SpoolToTempFile(r io.Reader, pattern string) (string, error) {
+	tempFile, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	if _, err := io.Copy(tempFile, r); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	return tempFile.Name(), nil
+}
@@ -0,0 +1,215 @@
+package catalog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SortFields are the fields a listing can be sorted by. Firestore leaves out
+// of a sorted listing the items that do not have the field.
+var SortFields = []string{"id", "price", "productname", "createdAt", "weight"}
+
+// Errors returned by DecodeCursor.
+var (
+	ErrInvalidCursor  = errors.New("invalid page token")
+	ErrCursorMismatch = errors.New("page token was issued for other filters or another sort")
+)
+
+// unsignedWarning logs once that page tokens are not signed.
+var unsignedWarning sync.Once
+
+// Sort is the order of a listing. Items with the same value are ordered by
+// id, in the same direction.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSort reads a sort parameter: a field, "-field" or "field:desc" for
+// descending order, or "field:asc". An empty parameter sorts by id.
+func ParseSort(text string) (Sort, error) {
+	sort := Sort{Field: strings.TrimSpace(text)}
+	if sort.Field == "" {
+		return Sort{Field: "id"}, nil
+	}
+	if strings.HasPrefix(sort.Field, "-") {
+		sort.Field, sort.Desc = sort.Field[1:], true
+	} else if field, direction, ok := strings.Cut(sort.Field, ":"); ok {
+		switch strings.ToLower(direction) {
+		case "asc":
+		case "desc":
+			sort.Desc = true
+		default:
+			return sort, fmt.Errorf("invalid sort direction %q. Use 'asc' or 'desc'", direction)
+		}
+		sort.Field = field
+	}
+	for _, field := range SortFields {
+		if field == sort.Field {
+			return sort, nil
+		}
+	}
+	return sort, fmt.Errorf("cannot sort by %q; sortable fields are %s", sort.Field, strings.Join(SortFields, ", "))
+}
+
+// String returns the sort in the form ParseSort reads.
+func (s Sort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// Cursor is the position a page token points at: the sort key values of an
+// item, id last, for the sort and filters of the listing it came from.
+type Cursor struct {
+	Sort   string `json:"s"`
+	Filter string `json:"f"`
+	// Before is set for the token of the previous page, which ends before
+	// the item rather than starting after it
+	Before bool `json:"b,omitempty"`
+	// Inclusive is set when the page starts at the item rather than after
+	// it, for the way back from an empty page
+	Inclusive bool          `json:"i,omitempty"`
+	Keys      []interface{} `json:"-"`
+}
+
+// cursorValue keeps the Firestore type of a sort key through JSON.
+type cursorValue struct {
+	Int    *int64     `json:"i,omitempty"`
+	Number *float64   `json:"n,omitempty"`
+	Text   *string    `json:"s,omitempty"`
+	Time   *time.Time `json:"t,omitempty"`
+}
+
+type cursorPayload struct {
+	Cursor
+	Keys []cursorValue `json:"k"`
+}
+
+// FilterHash identifies a set of filters, so a page token is only used with
+// the filters it was issued for.
+func FilterHash(filters Filters) string {
+	data, _ := json.Marshal(filters)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// CursorKeys returns the sort key values of an item for a sort: the sorted
+// field, then the id.
+func CursorKeys(data map[string]interface{}, sort Sort) ([]interface{}, error) {
+	fields := []string{sort.Field}
+	if sort.Field != "id" {
+		fields = append(fields, "id")
+	}
+	keys := make([]interface{}, len(fields))
+	for i, field := range fields {
+		value, ok := data[field]
+		if !ok || value == nil {
+			return nil, fmt.Errorf("item has no %s to continue from", field)
+		}
+		keys[i] = value
+	}
+	return keys, nil
+}
+
+// EncodeCursor returns the signed page token of a cursor.
+func EncodeCursor(cursor Cursor) (string, error) {
+	payload := cursorPayload{Cursor: cursor, Keys: make([]cursorValue, len(cursor.Keys))}
+	for i, key := range cursor.Keys {
+		switch key := key.(type) {
+		case int64:
+			payload.Keys[i].Int = &key
+		case int:
+			number := int64(key)
+			payload.Keys[i].Int = &number
+		case float64:
+			payload.Keys[i].Number = &key
+		case string:
+			payload.Keys[i].Text = &key
+		case time.Time:
+			payload.Keys[i].Time = &key
+		default:
+			return "", fmt.Errorf("cannot continue from a sort key of type %T", key)
+		}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(data)
+	mac, signed := signCursor(body)
+	if !signed {
+		return body, nil
+	}
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// DecodeCursor checks the signature of a page token and that it was issued
+// for the given sort and filters, and returns its cursor.
+func DecodeCursor(token string, sort Sort, filters Filters) (Cursor, error) {
+	body, signature, hasSignature := strings.Cut(token, ".")
+	if expected, signed := signCursor(body); signed {
+		mac, err := base64.RawURLEncoding.DecodeString(signature)
+		if !hasSignature || err != nil || !hmac.Equal(mac, expected) {
+			return Cursor{}, ErrInvalidCursor
+		}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var payload cursorPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	if payload.Sort != sort.String() || payload.Filter != FilterHash(filters) {
+		return Cursor{}, ErrCursorMismatch
+	}
+
+	cursor := payload.Cursor
+	cursor.Keys = make([]interface{}, len(payload.Keys))
+	for i, key := range payload.Keys {
+		switch {
+		case key.Int != nil:
+			cursor.Keys[i] = *key.Int
+		case key.Number != nil:
+			cursor.Keys[i] = *key.Number
+		case key.Text != nil:
+			cursor.Keys[i] = *key.Text
+		case key.Time != nil:
+			cursor.Keys[i] = *key.Time
+		default:
+			return Cursor{}, ErrInvalidCursor
+		}
+	}
+	return cursor, nil
+}
+
+// signCursor signs page tokens with PAGE_TOKEN_SECRET. Every instance has to
+// share the secret, since the next page is often served by another one, so
+// there is no fallback to a key of the instance. Without the secret, signed
+// is false: tokens are then neither signed nor checked, which lets a client
+// edit the sort keys of a token but still not use it with other filters.
+func signCursor(body string) (mac []byte, signed bool) {
+	secret := os.Getenv("PAGE_TOKEN_SECRET")
+	if secret == "" {
+		unsignedWarning.Do(func() {
+			log.Printf("PAGE_TOKEN_SECRET is not set; page tokens are not signed")
+		})
+		return nil, false
+	}
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write([]byte(body))
+	return hash.Sum(nil), true
+}
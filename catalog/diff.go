@@ -0,0 +1,286 @@
+package catalog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/takeoff-capstone/bulkimport"
+)
+
+// Item statuses in a diff.
+const (
+	ItemAdded   = "added"
+	ItemRemoved = "removed"
+	ItemChanged = "changed"
+)
+
+// Number of price changes listed in a diff summary
+const topPriceChanges = 10
+
+// Item is one catalog item read from a diff source.
+type Item struct {
+	ID   string
+	Data map[string]interface{}
+}
+
+// ItemSource yields the items of one side of a diff. Next returns io.EOF after
+// the last item.
+type ItemSource interface {
+	Next() (*Item, error)
+	Close() error
+}
+
+// DiffOptions selects the fields a diff compares. The grocery fields are
+// compared when Fields is empty.
+type DiffOptions struct {
+	From   string
+	To     string
+	Fields []string
+}
+
+// FieldChange is one field that differs between the two sides.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// PriceChange is the change of an item's price. Percent is missing when the
+// old price is zero.
+type PriceChange struct {
+	From    float64  `json:"from"`
+	To      float64  `json:"to"`
+	Delta   float64  `json:"delta"`
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+// ItemDiff is one item that was added, removed or changed.
+type ItemDiff struct {
+	ID          string        `json:"id"`
+	Status      string        `json:"status"`
+	ProductName string        `json:"productname,omitempty"`
+	Fields      []FieldChange `json:"fields,omitempty"`
+	Price       *PriceChange  `json:"price,omitempty"`
+}
+
+// DiffSummary counts what changed between the two sides.
+type DiffSummary struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Added     int    `json:"added"`
+	Removed   int    `json:"removed"`
+	Changed   int    `json:"changed"`
+	Unchanged int    `json:"unchanged"`
+	// FieldChanges counts changed items per field
+	FieldChanges   map[string]int `json:"fieldChanges"`
+	PriceIncreases int            `json:"priceIncreases"`
+	PriceDecreases int            `json:"priceDecreases"`
+	// AveragePriceChange is the mean percentage over the price changes that
+	// have one
+	AveragePriceChange float64 `json:"averagePriceChangePercent"`
+	// LargestPriceChanges are the price changes with the largest percentage,
+	// up or down
+	LargestPriceChanges []ItemDiff `json:"largestPriceChanges"`
+}
+
+// DiffReport is the result of a diff: the summary and every item that
+// differs, ordered by ID.
+type DiffReport struct {
+	Summary DiffSummary `json:"summary"`
+	Items   []ItemDiff  `json:"items"`
+}
+
+// Diff compares two catalog sources by document ID. The from side is held in
+// memory; the to side is streamed. Values are compared by their text form, so
+// an export file, whose cells are text, compares equal to the stored values it
+// was written from.
+func Diff(from, to ItemSource, options DiffOptions) (*DiffReport, error) {
+	fields := options.Fields
+	if len(fields) == 0 {
+		fields = append(append([]string{}, bulkimport.RequiredFields...), "vegetarian")
+	}
+
+	before := make(map[string]map[string]interface{})
+	for {
+		item, err := from.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", options.From, err)
+		}
+		before[item.ID] = item.Data
+	}
+
+	report := &DiffReport{
+		Summary: DiffSummary{From: options.From, To: options.To, FieldChanges: make(map[string]int)},
+		Items:   []ItemDiff{},
+	}
+	for {
+		item, err := to.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", options.To, err)
+		}
+		old, ok := before[item.ID]
+		if !ok {
+			report.Items = append(report.Items, ItemDiff{ID: item.ID, Status: ItemAdded, ProductName: CellText(item.Data["productname"])})
+			report.Summary.Added++
+			continue
+		}
+		delete(before, item.ID)
+
+		diff := compareItems(item.ID, old, item.Data, fields)
+		if len(diff.Fields) == 0 {
+			report.Summary.Unchanged++
+			continue
+		}
+		report.Items = append(report.Items, diff)
+		report.Summary.Changed++
+		for _, change := range diff.Fields {
+			report.Summary.FieldChanges[change.Field]++
+		}
+	}
+	for id, data := range before {
+		report.Items = append(report.Items, ItemDiff{ID: id, Status: ItemRemoved, ProductName: CellText(data["productname"])})
+		report.Summary.Removed++
+	}
+
+	sort.Slice(report.Items, func(i, j int) bool {
+		return report.Items[i].ID < report.Items[j].ID
+	})
+	summarizePrices(report)
+	return report, nil
+}
+
+// compareItems lists the fields that differ between two versions of an item
+// and works out the price change.
+func compareItems(id string, old, current map[string]interface{}, fields []string) ItemDiff {
+	diff := ItemDiff{ID: id, Status: ItemChanged, ProductName: CellText(current["productname"])}
+	for _, field := range fields {
+		if sameCell(old[field], current[field]) {
+			continue
+		}
+		diff.Fields = append(diff.Fields, FieldChange{Field: field, From: old[field], To: current[field]})
+		if field != "price" {
+			continue
+		}
+		oldPrice, oldOK := numberValue(old[field])
+		newPrice, newOK := numberValue(current[field])
+		if oldOK && newOK && oldPrice != newPrice {
+			change := &PriceChange{From: oldPrice, To: newPrice, Delta: round2(newPrice - oldPrice)}
+			if oldPrice != 0 {
+				percent := round2((newPrice - oldPrice) / oldPrice * 100)
+				change.Percent = &percent
+			}
+			diff.Price = change
+		}
+	}
+	return diff
+}
+
+// summarizePrices counts the price changes and picks the largest ones.
+func summarizePrices(report *DiffReport) {
+	var withPercent []ItemDiff
+	total := 0.0
+	for _, item := range report.Items {
+		if item.Price == nil {
+			continue
+		}
+		// A change that rounds to no change counts as neither
+		if item.Price.Delta > 0 {
+			report.Summary.PriceIncreases++
+		} else if item.Price.Delta < 0 {
+			report.Summary.PriceDecreases++
+		}
+		if item.Price.Percent != nil {
+			withPercent = append(withPercent, item)
+			total += *item.Price.Percent
+		}
+	}
+	if len(withPercent) > 0 {
+		report.Summary.AveragePriceChange = round2(total / float64(len(withPercent)))
+	}
+	sort.SliceStable(withPercent, func(i, j int) bool {
+		return math.Abs(*withPercent[i].Price.Percent) > math.Abs(*withPercent[j].Price.Percent)
+	})
+	if len(withPercent) > topPriceChanges {
+		withPercent = withPercent[:topPriceChanges]
+	}
+	report.Summary.LargestPriceChanges = withPercent
+	if report.Summary.LargestPriceChanges == nil {
+		report.Summary.LargestPriceChanges = []ItemDiff{}
+	}
+}
+
+// sameCell reports whether two values read the same. Numbers are compared by
+// value, so "12.50" in a file equals a stored 12.5.
+func sameCell(a, b interface{}) bool {
+	if CellText(a) == CellText(b) {
+		return true
+	}
+	numberA, okA := numberValue(a)
+	numberB, okB := numberValue(b)
+	return okA && okB && numberA == numberB
+}
+
+// numberValue reads a number stored as such or, by bulk imports and in export
+// files, as text.
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// WriteDiffCSV writes the detail report of a diff as CSV: one line per
+// changed field, and one line for each added or removed item.
+func WriteDiffCSV(w io.Writer, report *DiffReport) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "productname", "status", "field", "from", "to", "priceDelta", "pricePercent"})
+	for _, item := range report.Items {
+		if len(item.Fields) == 0 {
+			out.Write([]string{item.ID, item.ProductName, item.Status, "", "", "", "", ""})
+			continue
+		}
+		for _, change := range item.Fields {
+			delta, percent := "", ""
+			if change.Field == "price" && item.Price != nil {
+				delta = CellText(item.Price.Delta)
+				if item.Price.Percent != nil {
+					percent = fmt.Sprintf("%+.2f%%", *item.Price.Percent)
+				}
+			}
+			out.Write([]string{item.ID, item.ProductName, item.Status, change.Field, CellText(change.From), CellText(change.To), delta, percent})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// DiffReportName names the detail report of a diff.
+func DiffReportName(at time.Time) string {
+	return fmt.Sprintf("catalog_diff_%s.csv", at.UTC().Format("20060102_150405"))
+}
@@ -0,0 +1,234 @@
+package catalog
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/takeoff-capstone/snapshot"
+	"google.golang.org/api/iterator"
+)
+
+// SnapshotItems reads the catalog items of a snapshot. The reader is closed
+// with the source.
+func SnapshotItems(reader *snapshot.Reader) ItemSource {
+	return &snapshotSource{reader: reader}
+}
+
+type snapshotSource struct {
+	reader *snapshot.Reader
+}
+
+func (s *snapshotSource) Next() (*Item, error) {
+	for {
+		doc, err := s.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if doc.Collection != Collection {
+			continue
+		}
+		data, err := doc.Decode(nil)
+		if err != nil {
+			return nil, fmt.Errorf("document %s: %v", doc.ID, err)
+		}
+		return &Item{ID: doc.ID, Data: data}, nil
+	}
+}
+
+func (s *snapshotSource) Close() error {
+	return s.reader.Close()
+}
+
+// LiveItems reads the catalog as it is now.
+func LiveItems(ctx context.Context, client *firestore.Client) ItemSource {
+	return &liveSource{docs: client.Collection(Collection).Documents(ctx)}
+}
+
+type liveSource struct {
+	docs *firestore.DocumentIterator
+}
+
+func (l *liveSource) Next() (*Item, error) {
+	doc, err := l.docs.Next()
+	if err == iterator.Done {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Item{ID: doc.Ref.ID, Data: doc.Data()}, nil
+}
+
+func (l *liveSource) Close() error {
+	l.docs.Stop()
+	return nil
+}
+
+// snapshotPrefix starts the header line of a snapshot file.
+const snapshotPrefix = `{"snapshot":`
+
+// ExportItems reads an export file in any of the export formats, compressed
+// or not. Items are keyed by the id column; rows without one are skipped
+// since they cannot be matched.
+func ExportItems(r io.Reader) (ItemSource, error) {
+	format, content, err := openDump(r)
+	if err != nil {
+		return nil, err
+	}
+	return exportItems(format, content)
+}
+
+// DumpItems reads a catalog dump that may be a snapshot file or an export
+// file, such as one uploaded or saved from a synchronous export.
+func DumpItems(r io.Reader) (ItemSource, error) {
+	format, content, err := openDump(r)
+	if err != nil {
+		return nil, err
+	}
+	if format == bulkimport.FormatNDJSON {
+		buffered := bufio.NewReader(content)
+		if head, _ := buffered.Peek(len(snapshotPrefix)); string(head) == snapshotPrefix {
+			reader, err := snapshot.NewUncompressedReader(buffered)
+			if err != nil {
+				return nil, err
+			}
+			return SnapshotItems(reader), nil
+		}
+		content = buffered
+	}
+	return exportItems(format, content)
+}
+
+// openDump works out the format of a dump and undoes its compression.
+func openDump(r io.Reader) (string, io.Reader, error) {
+	body := bufio.NewReaderSize(r, bulkimport.SniffLength)
+	format, compressed, err := bulkimport.Sniff(body)
+	if err != nil {
+		return "", nil, err
+	}
+	content, err := bulkimport.Decompress(body, compressed)
+	if err != nil {
+		return "", nil, err
+	}
+	return format, content, nil
+}
+
+func exportItems(format string, content io.Reader) (ItemSource, error) {
+	switch format {
+	case bulkimport.FormatCSV:
+		reader := csv.NewReader(content)
+		reader.FieldsPerRecord = -1
+		headers, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export header: %v", err)
+		}
+		if len(headers) > 0 {
+			headers[0] = strings.TrimPrefix(headers[0], "\ufeff")
+		}
+		return &recordSource{headers: headers, read: func() ([]string, error) { return reader.Read() }}, nil
+	case bulkimport.FormatNDJSON:
+		ndjson := bulkimport.NewNDJSONReader(content)
+		return &objectSource{read: func() (map[string]interface{}, error) {
+			item, _, err := ndjson.Read()
+			return item, err
+		}}, nil
+	case bulkimport.FormatJSON:
+		decoder := json.NewDecoder(content)
+		if _, err := decoder.Token(); err != nil {
+			return nil, fmt.Errorf("export is not a JSON array: %v", err)
+		}
+		return &objectSource{read: func() (map[string]interface{}, error) {
+			if !decoder.More() {
+				return nil, io.EOF
+			}
+			var item map[string]interface{}
+			err := decoder.Decode(&item)
+			return item, err
+		}}, nil
+	case bulkimport.FormatXLSX:
+		path, err := bulkimport.SpoolToTempFile(content, "diff-*.xlsx")
+		if err != nil {
+			return nil, err
+		}
+		workbook, err := bulkimport.OpenXLSX(path, bulkimport.XLSXOptions{HeaderRow: 1}, nil)
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		return &recordSource{
+			headers: workbook.Headers(),
+			read: func() ([]string, error) {
+				record, _, err := workbook.Read()
+				return record, err
+			},
+			close: func() error {
+				defer os.Remove(path)
+				return workbook.Close()
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+// recordSource reads items from rows of text cells under a header row.
+type recordSource struct {
+	headers []string
+	read    func() ([]string, error)
+	close   func() error
+}
+
+func (s *recordSource) Next() (*Item, error) {
+	for {
+		record, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		data := make(map[string]interface{}, len(s.headers))
+		for i, header := range s.headers {
+			if i < len(record) && record[i] != "" {
+				data[header] = record[i]
+			}
+		}
+		if id, ok := data["id"].(string); ok {
+			delete(data, "id")
+			return &Item{ID: id, Data: data}, nil
+		}
+	}
+}
+
+func (s *recordSource) Close() error {
+	if s.close != nil {
+		return s.close()
+	}
+	return nil
+}
+
+// objectSource reads items from JSON objects.
+type objectSource struct {
+	read func() (map[string]interface{}, error)
+}
+
+func (s *objectSource) Next() (*Item, error) {
+	for {
+		item, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := item["id"].(string); ok && id != "" {
+			delete(item, "id")
+			return &Item{ID: id, Data: item}, nil
+		}
+	}
+}
+
+func (s *objectSource) Close() error {
+	return nil
+}
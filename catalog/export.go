@@ -0,0 +1,324 @@
+package catalog
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/xuri/excelize/v2"
+	"google.golang.org/api/iterator"
+)
+
+// ExportColumns are the columns of an export. They are the bulk import
+// headers, led by the document ID, so an exported file can be edited and sent
+// back through BulkCreate or as a BulkUpdate change sheet.
+var ExportColumns = append(append([]string{"id"}, bulkimport.RequiredFields...), "vegetarian")
+
+// exportSheet is the worksheet an XLSX export is written to.
+const exportSheet = "Groceries"
+
+// ExportFormats lists the formats an export can be written in.
+var ExportFormats = []string{bulkimport.FormatCSV, bulkimport.FormatJSON, bulkimport.FormatNDJSON, bulkimport.FormatXLSX}
+
+// ValidExportFormat reports whether the catalog can be exported in format.
+func ValidExportFormat(format string) bool {
+	for _, f := range ExportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType returns the media type of an export format.
+func ContentType(format string) string {
+	switch format {
+	case bulkimport.FormatJSON:
+		return "application/json"
+	case bulkimport.FormatNDJSON:
+		return "application/x-ndjson"
+	case bulkimport.FormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv"
+}
+
+// ExportFileName names an export file after the time it was made.
+func ExportFileName(format string, at time.Time) string {
+	return fmt.Sprintf("groceries_%s.%s", at.UTC().Format("20060102_150405"), format)
+}
+
+// Count returns how many catalog items match the filters, using an
+// aggregation query so no documents are read unless part of the filters has
+// to be checked in memory. A listing sorted by sortField leaves out the items
+// without it, and so does the count; sortField is empty for an unsorted
+// read such as an export.
+//
+// When part of the filters is checked in memory, at most scanLimit documents
+// are read and exact is false if that was not all of them: the count is then
+// only the number of matches among them, a lower bound.
+func Count(ctx context.Context, client *firestore.Client, filters Filters, sortField string, scanLimit int) (count int64, exact bool, err error) {
+	plan, err := filters.Plan(sortField)
+	if err != nil {
+		return 0, false, err
+	}
+	query := plan.Query(client.Collection(Collection).Query)
+	if sortField != "" {
+		// Ordering by the field is what leaves out the items without it
+		query = query.OrderBy(sortField, firestore.Asc)
+	}
+	if plan.InMemory() {
+		return countInMemory(ctx, query, plan, scanLimit)
+	}
+	results, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to count groceries: %v", err)
+	}
+	value, ok := results["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, false, fmt.Errorf("count missing from aggregation result")
+	}
+	return value.GetIntegerValue(), true, nil
+}
+
+func countInMemory(ctx context.Context, query firestore.Query, plan *Plan, scanLimit int) (int64, bool, error) {
+	// One document past the limit tells whether there are more
+	docs := query.Select(plan.Fields()...).Limit(scanLimit + 1).Documents(ctx)
+	defer docs.Stop()
+	var count int64
+	for scanned := 0; ; scanned++ {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			return count, true, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to count groceries: %v", err)
+		}
+		if scanned == scanLimit {
+			return count, false, nil
+		}
+		if plan.Matches(doc.Data()) {
+			count++
+		}
+	}
+}
+
+// recordWriter writes the exported items in one format.
+type recordWriter interface {
+	write(id string, data map[string]interface{}) error
+	close() error
+}
+
+// Export writes every catalog item matching the filters to w and returns how
+// many were written. Items are streamed as they are read, except for XLSX,
+// which is spooled to a temporary file by the workbook writer.
+func Export(ctx context.Context, client *firestore.Client, filters Filters, format string, w io.Writer) (int, error) {
+	out, err := newRecordWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+
+	plan, err := filters.Plan("")
+	if err != nil {
+		return 0, err
+	}
+	docs := plan.Query(client.Collection(Collection).Query).Documents(ctx)
+	defer docs.Stop()
+	count := 0
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to iterate over groceries: %v", err)
+		}
+		data := doc.Data()
+		if !plan.Matches(data) {
+			continue
+		}
+		if err := out.write(doc.Ref.ID, data); err != nil {
+			return count, fmt.Errorf("failed to write grocery %s: %v", doc.Ref.ID, err)
+		}
+		count++
+	}
+	if err := out.close(); err != nil {
+		return count, fmt.Errorf("failed to finish %s export: %v", format, err)
+	}
+	return count, nil
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	switch format {
+	case bulkimport.FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(ExportColumns); err != nil {
+			return nil, err
+		}
+		return &csvRecordWriter{writer: writer}, nil
+	case bulkimport.FormatJSON, bulkimport.FormatNDJSON:
+		return &jsonRecordWriter{w: bufio.NewWriter(w), array: format == bulkimport.FormatJSON}, nil
+	case bulkimport.FormatXLSX:
+		return newXLSXRecordWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+type csvRecordWriter struct {
+	writer *csv.Writer
+}
+
+func (c *csvRecordWriter) write(id string, data map[string]interface{}) error {
+	record := make([]string, len(ExportColumns))
+	for i, column := range ExportColumns {
+		record[i] = CellText(exportValue(id, data, column))
+	}
+	return c.writer.Write(record)
+}
+
+func (c *csvRecordWriter) close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// jsonRecordWriter writes a JSON array, or one object per line for NDJSON.
+// Objects only carry the export columns the item has.
+type jsonRecordWriter struct {
+	w     *bufio.Writer
+	array bool
+	count int
+}
+
+func (j *jsonRecordWriter) write(id string, data map[string]interface{}) error {
+	item := make(map[string]interface{}, len(ExportColumns))
+	for _, column := range ExportColumns {
+		if value := exportValue(id, data, column); value != nil {
+			item[column] = value
+		}
+	}
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	separator := "\n"
+	if j.array {
+		separator = ",\n"
+		if j.count == 0 {
+			separator = "[\n"
+		}
+	} else if j.count == 0 {
+		separator = ""
+	}
+	j.count++
+	if _, err := j.w.WriteString(separator); err != nil {
+		return err
+	}
+	_, err = j.w.Write(encoded)
+	return err
+}
+
+func (j *jsonRecordWriter) close() error {
+	closing := "\n"
+	if j.array {
+		closing = "\n]\n"
+		if j.count == 0 {
+			closing = "[]\n"
+		}
+	} else if j.count == 0 {
+		closing = ""
+	}
+	if _, err := j.w.WriteString(closing); err != nil {
+		return err
+	}
+	return j.w.Flush()
+}
+
+type xlsxRecordWriter struct {
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	w      io.Writer
+	row    int
+}
+
+func newXLSXRecordWriter(w io.Writer) (*xlsxRecordWriter, error) {
+	file := excelize.NewFile()
+	if err := file.SetSheetName("Sheet1", exportSheet); err != nil {
+		return nil, err
+	}
+	stream, err := file.NewStreamWriter(exportSheet)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]interface{}, len(ExportColumns))
+	for i, column := range ExportColumns {
+		header[i] = column
+	}
+	if err := stream.SetRow("A1", header); err != nil {
+		return nil, err
+	}
+	return &xlsxRecordWriter{file: file, stream: stream, w: w, row: 1}, nil
+}
+
+func (x *xlsxRecordWriter) write(id string, data map[string]interface{}) error {
+	row := make([]interface{}, len(ExportColumns))
+	for i, column := range ExportColumns {
+		switch value := exportValue(id, data, column).(type) {
+		case int64, float64, bool, string, nil:
+			row[i] = value
+		default:
+			row[i] = CellText(value)
+		}
+	}
+	x.row++
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	return x.stream.SetRow(cell, row)
+}
+
+func (x *xlsxRecordWriter) close() error {
+	defer x.file.Close()
+	if err := x.stream.Flush(); err != nil {
+		return err
+	}
+	return x.file.Write(x.w)
+}
+
+// exportValue returns the value of a column for an item. The id column is the
+// document ID, which is what BulkUpdate looks items up by.
+func exportValue(id string, data map[string]interface{}, column string) interface{} {
+	if column == "id" {
+		return id
+	}
+	return data[column]
+}
+
+// CellText formats a value for a text cell. Numbers are written without an
+// exponent so they read back the same way.
+func CellText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,167 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ExportJobCollection holds one record per asynchronous export.
+	ExportJobCollection = "Export_Jobs"
+	// ExportBucket and ExportPrefix are where asynchronous exports are
+	// written.
+	ExportBucket = "bulk_data_bucket"
+	ExportPrefix = "exports/"
+	// An export that has not finished within its lease is taken to have
+	// died with its instance and may be started again
+	exportLease = 10 * time.Minute
+	// ExportLinkLifetime is how long a download link of an export works
+	ExportLinkLifetime = 15 * time.Minute
+)
+
+// Export job states.
+const (
+	ExportPending   = "pending"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+)
+
+var (
+	ErrExportNotFound = errors.New("export job not found")
+	// ErrExportRunning means another instance is writing the export.
+	ErrExportRunning = errors.New("export job is already running")
+	// ErrExportFinished means the export file was already written.
+	ErrExportFinished = errors.New("export job is finished")
+)
+
+// ExportJob is the record of one asynchronous export.
+type ExportJob struct {
+	ID      string  `json:"id" firestore:"-"`
+	Format  string  `json:"format" firestore:"format"`
+	Filters Filters `json:"filters" firestore:"filters"`
+	Status  string  `json:"status" firestore:"status"`
+	// Expected is the number of matching items when the export was asked
+	// for, or 0 when they were too many to count in memory
+	Expected int64 `json:"expected" firestore:"expected"`
+	Rows     int   `json:"rows" firestore:"rows"`
+	// Object is the export file in ExportBucket, which is not public.
+	// DownloadURL is a signed link to it, made whenever the job is read and
+	// valid for ExportLinkLifetime
+	Object      string    `json:"object,omitempty" firestore:"object,omitempty"`
+	DownloadURL string    `json:"downloadURL,omitempty" firestore:"-"`
+	Error       string    `json:"error,omitempty" firestore:"error,omitempty"`
+	Created     time.Time `json:"createdAt" firestore:"createdAt"`
+	Updated     time.Time `json:"updatedAt" firestore:"updatedAt"`
+}
+
+// ExportObjectName returns the storage object an export job writes to.
+func (j *ExportJob) ExportObjectName() string {
+	return ExportPrefix + j.ID + "/" + ExportFileName(j.Format, j.Created)
+}
+
+// SignDownloadURL sets DownloadURL to a link to the export file that expires
+// after ExportLinkLifetime. Jobs that have not completed get none.
+func (j *ExportJob) SignDownloadURL(storageClient *storage.Client) error {
+	j.DownloadURL = ""
+	if j.Status != ExportCompleted || j.Object == "" {
+		return nil
+	}
+	url, err := storageClient.Bucket(ExportBucket).SignedURL(j.Object, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(ExportLinkLifetime),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sign download link: %v", err)
+	}
+	j.DownloadURL = url
+	return nil
+}
+
+// CreateExportJob stores a new pending export job.
+func CreateExportJob(ctx context.Context, client *firestore.Client, job *ExportJob) error {
+	if job.ID == "" {
+		job.ID = client.Collection(ExportJobCollection).NewDoc().ID
+	}
+	job.Status = ExportPending
+	job.Created = time.Now()
+	job.Updated = job.Created
+	if _, err := client.Collection(ExportJobCollection).Doc(job.ID).Create(ctx, job); err != nil {
+		return fmt.Errorf("failed to save export job: %v", err)
+	}
+	return nil
+}
+
+// LoadExportJob reads the export job with the given ID.
+func LoadExportJob(ctx context.Context, client *firestore.Client, id string) (*ExportJob, error) {
+	docSnapshot, err := client.Collection(ExportJobCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export job: %v", err)
+	}
+	return exportJobFromSnapshot(docSnapshot)
+}
+
+func exportJobFromSnapshot(docSnapshot *firestore.DocumentSnapshot) (*ExportJob, error) {
+	var job ExportJob
+	if err := docSnapshot.DataTo(&job); err != nil {
+		return nil, fmt.Errorf("failed to decode export job: %v", err)
+	}
+	job.ID = docSnapshot.Ref.ID
+	return &job, nil
+}
+
+// StartExportJob claims a pending or failed export job for this run. It
+// returns ErrExportRunning while another run is within its lease and
+// ErrExportFinished once the file was written.
+func StartExportJob(ctx context.Context, client *firestore.Client, id string) (*ExportJob, error) {
+	var job *ExportJob
+	docRef := client.Collection(ExportJobCollection).Doc(id)
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnapshot, err := tx.Get(docRef)
+		if status.Code(err) == codes.NotFound {
+			return ErrExportNotFound
+		}
+		if err != nil {
+			return err
+		}
+		job, err = exportJobFromSnapshot(docSnapshot)
+		if err != nil {
+			return err
+		}
+		switch {
+		case job.Status == ExportCompleted:
+			return ErrExportFinished
+		case job.Status == ExportRunning && time.Since(job.Updated) < exportLease:
+			return ErrExportRunning
+		}
+		job.Status = ExportRunning
+		job.Error = ""
+		job.Updated = time.Now()
+		return tx.Set(docRef, job)
+	})
+	return job, err
+}
+
+// FinishExportJob records the outcome of a run.
+func FinishExportJob(ctx context.Context, client *firestore.Client, job *ExportJob, runErr error) error {
+	job.Status = ExportCompleted
+	if runErr != nil {
+		job.Status = ExportFailed
+		job.Error = runErr.Error()
+	}
+	job.Updated = time.Now()
+	if _, err := client.Collection(ExportJobCollection).Doc(job.ID).Set(ctx, job); err != nil {
+		return fmt.Errorf("failed to save export job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Types of the fields a filter expression can use.
+const (
+	textField   = "text"
+	numberField = "number"
+	boolField   = "boolean"
+	dateField   = "date"
+)
+
+// FilterFields are the grocery fields a filter expression can use and their
+// types. createdAt and updatedAt are set by the create and update handlers.
+var FilterFields = map[string]string{
+	"productname":         textField,
+	"category":            textField,
+	"brand":               textField,
+	"manufacturer":        textField,
+	"countryoforigin":     textField,
+	"packageinformation":  textField,
+	"price":               numberField,
+	"weight":              numberField,
+	"itempackagequantity": numberField,
+	"vegetarian":          boolField,
+	"createdAt":           dateField,
+	"updatedAt":           dateField,
+}
+
+const (
+	// Longest in list and largest number of conditions of an expression
+	maxListValues = 100
+	maxConditions = 50
+)
+
+// Expr is a parsed filter expression.
+type Expr interface {
+	// Match reports whether a grocery item passes the expression.
+	Match(data map[string]interface{}) bool
+}
+
+type andExpr []Expr
+
+type orExpr []Expr
+
+// condition compares a field with a value, or with a list of values for in.
+// Values have the Go type Firestore returns for the field type: string,
+// float64, bool or time.Time.
+type condition struct {
+	field  string
+	op     string
+	value  interface{}
+	values []interface{}
+}
+
+func (e andExpr) Match(data map[string]interface{}) bool {
+	for _, part := range e {
+		if !part.Match(data) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e orExpr) Match(data map[string]interface{}) bool {
+	for _, part := range e {
+		if part.Match(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match compares the way Firestore does: a missing field never matches, and
+// values of another type only match !=.
+func (c *condition) Match(data map[string]interface{}) bool {
+	stored, ok := data[c.field]
+	if !ok || stored == nil {
+		return false
+	}
+	switch c.op {
+	case "in":
+		for _, value := range c.values {
+			if equalValue(stored, value) {
+				return true
+			}
+		}
+		return false
+	case "==":
+		return equalValue(stored, c.value)
+	case "!=":
+		return !equalValue(stored, c.value)
+	}
+	order, ok := compareValue(stored, c.value)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+func equalValue(stored, value interface{}) bool {
+	order, ok := compareValue(stored, value)
+	return ok && order == 0
+}
+
+// compareValue orders a stored value against a condition value of the same
+// type, reporting false when the types differ.
+func compareValue(stored, value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case float64:
+		number, ok := storedNumber(stored)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case number < value:
+			return -1, true
+		case number > value:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		text, ok := stored.(string)
+		return strings.Compare(text, value), ok
+	case bool:
+		flag, ok := stored.(bool)
+		if flag != value {
+			return 1, ok
+		}
+		return 0, ok
+	case time.Time:
+		at, ok := stored.(time.Time)
+		return at.Compare(value), ok
+	}
+	return 0, false
+}
+
+// storedNumber returns a value when it is stored as a number, the only case
+// Firestore compares with a number.
+func storedNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+// ParseExpression parses a filter expression such as
+//
+//	category in ("Dairy", "Bakery") and price between 1.5 and 10
+//	brand = 'Amul' or (vegetarian = true and createdAt >= 2024-01-01)
+//
+// Conditions compare a field with =, !=, <, <=, > or >=, test it against an
+// in list, or a range with between, which includes both ends. They combine
+// with and, which binds tighter, or, and parentheses. Text may be quoted with
+// single or double quotes; dates are YYYY-MM-DD or RFC 3339.
+func ParseExpression(text string) (Expr, error) {
+	tokens, err := lexExpression(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, p.errorf("unexpected %s", p.peek())
+	}
+	if p.conditions > maxConditions {
+		return nil, fmt.Errorf("filter: at most %d conditions are allowed", maxConditions)
+	}
+	return expr, nil
+}
+
+type exprToken struct {
+	text string
+	// quoted is set for quoted text, which is never a keyword or operator
+	quoted bool
+	pos    int
+	// end stands for the end of the expression
+	end bool
+}
+
+func (t exprToken) String() string {
+	switch {
+	case t.end:
+		return "end of filter"
+	case t.quoted:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q at position %d", t.text, t.pos+1)
+}
+
+// is reports whether the token is a keyword or punctuation.
+func (t exprToken) is(keyword string) bool {
+	return !t.quoted && !t.end && strings.EqualFold(t.text, keyword)
+}
+
+// lexExpression splits an expression into words, quoted text, operators and
+// punctuation.
+func lexExpression(text string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(text[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("filter: unterminated text starting at position %d", i+1)
+			}
+			tokens = append(tokens, exprToken{text: text[i+1 : i+1+end], quoted: true, pos: i})
+			i += end + 2
+		case strings.IndexByte("()[],", c) >= 0:
+			tokens = append(tokens, exprToken{text: text[i : i+1], pos: i})
+			i++
+		case strings.IndexByte("=!<>", c) >= 0:
+			op := text[i : i+1]
+			if i+1 < len(text) && text[i+1] == '=' {
+				op = text[i : i+2]
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("filter: unexpected \"!\" at position %d", i+1)
+			}
+			tokens = append(tokens, exprToken{text: op, pos: i})
+			i += len(op)
+		default:
+			start := i
+			for i < len(text) && !unicode.IsSpace(rune(text[i])) && strings.IndexByte("()[],=!<>'\"", text[i]) < 0 {
+				i++
+			}
+			tokens = append(tokens, exprToken{text: text[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens     []exprToken
+	next       int
+	conditions int
+}
+
+func (p *exprParser) done() bool {
+	return p.next >= len(p.tokens)
+}
+
+func (p *exprParser) peek() exprToken {
+	if p.done() {
+		return exprToken{end: true}
+	}
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) take() exprToken {
+	token := p.peek()
+	p.next++
+	return token
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filter: "+format, args...)
+}
+
+func (p *exprParser) expect(text string) error {
+	if token := p.take(); !token.is(text) {
+		return p.errorf("expected %q, found %s", text, token)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (Expr, error) {
+	var parts orExpr
+	for {
+		part, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+		if !p.peek().is("or") {
+			break
+		}
+		p.take()
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts, nil
+}
+
+func (p *exprParser) parseAnd() (Expr, error) {
+	var parts andExpr
+	for {
+		part, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		// between gives an and of two conditions, kept flat
+		if and, ok := part.(andExpr); ok {
+			parts = append(parts, and...)
+		} else {
+			parts = append(parts, part)
+		}
+		if !p.peek().is("and") {
+			break
+		}
+		p.take()
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts, nil
+}
+
+func (p *exprParser) parseTerm() (Expr, error) {
+	if p.peek().is("(") {
+		p.take()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *exprParser) parseCondition() (Expr, error) {
+	fieldToken := p.take()
+	if fieldToken.end {
+		return nil, p.errorf("expected a condition, found end of filter")
+	}
+	fieldType, ok := FilterFields[fieldToken.text]
+	if fieldToken.quoted || !ok {
+		return nil, p.errorf("unknown field %s; filterable fields are %s", fieldToken, strings.Join(filterFieldNames(), ", "))
+	}
+	field := fieldToken.text
+	opToken := p.take()
+	op := strings.ToLower(opToken.text)
+	if op == "=" {
+		op = "=="
+	}
+	if opToken.quoted || opToken.end {
+		op = ""
+	}
+
+	switch op {
+	case "in":
+		values, err := p.parseList(field, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		p.conditions++
+		return newCondition(field, fieldType, "in", nil, values)
+	case "between":
+		low, err := p.parseValue(field, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		if !p.take().is("and") {
+			return nil, p.errorf("expected and between the bounds of %s", field)
+		}
+		high, err := p.parseValue(field, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		from, err := newCondition(field, fieldType, ">=", low, nil)
+		if err != nil {
+			return nil, err
+		}
+		to, err := newCondition(field, fieldType, "<=", high, nil)
+		if err != nil {
+			return nil, err
+		}
+		p.conditions += 2
+		return andExpr{from, to}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		value, err := p.parseValue(field, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		p.conditions++
+		return newCondition(field, fieldType, op, value, nil)
+	}
+	return nil, p.errorf("expected an operator after %s, found %s; use =, !=, <, <=, >, >=, in or between", field, opToken)
+}
+
+func (p *exprParser) parseList(field, fieldType string) ([]interface{}, error) {
+	open := p.take()
+	closing := map[string]string{"(": ")", "[": "]"}[open.text]
+	if open.quoted || open.end || closing == "" {
+		return nil, p.errorf("expected a list in parentheses after %s in, found %s", field, open)
+	}
+	var values []interface{}
+	for {
+		value, err := p.parseValue(field, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if len(values) > maxListValues {
+			return nil, p.errorf("in lists are limited to %d values", maxListValues)
+		}
+		token := p.take()
+		if token.is(closing) {
+			return values, nil
+		}
+		if !token.is(",") {
+			return nil, p.errorf("expected \",\" or %q in the list of %s, found %s", closing, field, token)
+		}
+	}
+}
+
+// parseValue reads a value and converts it to the type of the field.
+func (p *exprParser) parseValue(field, fieldType string) (interface{}, error) {
+	token := p.take()
+	if token.end || !token.quoted && strings.ContainsAny(token.text, "()[],=!<>") {
+		return nil, p.errorf("expected a value for %s, found %s", field, token)
+	}
+	switch fieldType {
+	case numberField:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, p.errorf("%s is a number, found %s", field, token)
+		}
+		return number, nil
+	case boolField:
+		flag, err := strconv.ParseBool(token.text)
+		if err != nil {
+			return nil, p.errorf("%s is true or false, found %s", field, token)
+		}
+		return flag, nil
+	case dateField:
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if at, err := time.Parse(layout, token.text); err == nil {
+				return at, nil
+			}
+		}
+		return nil, p.errorf("%s is a date, YYYY-MM-DD or RFC 3339, found %s", field, token)
+	}
+	return token.text, nil
+}
+
+// newCondition checks that the operator suits the field type.
+func newCondition(field, fieldType, op string, value interface{}, values []interface{}) (Expr, error) {
+	switch {
+	case fieldType == textField && op != "==" && op != "!=" && op != "in":
+		return nil, fmt.Errorf("filter: %s is text and only supports =, != and in", field)
+	case fieldType == boolField && op != "==" && op != "!=":
+		return nil, fmt.Errorf("filter: %s is true or false and only supports = and !=", field)
+	case fieldType == dateField && op == "in":
+		return nil, fmt.Errorf("filter: %s is a date and does not support in; use between", field)
+	}
+	if fieldType == boolField {
+		// Items created through the API store a boolean, imported items the
+		// text of the sheet cell, so both are matched
+		flag := value.(bool)
+		if op == "!=" {
+			flag = !flag
+		}
+		return &condition{field: field, op: "in", values: []interface{}{flag, strconv.FormatBool(flag)}}, nil
+	}
+	return &condition{field: field, op: op, value: value, values: values}, nil
+}
+
+func filterFieldNames() []string {
+	names := make([]string, 0, len(FilterFields))
+	for name := range FilterFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,200 @@
+package catalog
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describe writes an expression with every and and or in parentheses, so
+// tests can check how it was grouped.
+func describe(expr Expr) string {
+	switch expr := expr.(type) {
+	case nil:
+		return ""
+	case andExpr:
+		return "(" + describeParts(expr, " and ") + ")"
+	case orExpr:
+		return "(" + describeParts(expr, " or ") + ")"
+	case *condition:
+		if expr.op == "in" {
+			return fmt.Sprintf("%s in %s", expr.field, describeValue(expr.values))
+		}
+		return fmt.Sprintf("%s %s %s", expr.field, expr.op, describeValue(expr.value))
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+func describeParts(parts []Expr, separator string) string {
+	texts := make([]string, len(parts))
+	for i, part := range parts {
+		texts[i] = describe(part)
+	}
+	return strings.Join(texts, separator)
+}
+
+func describeValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case time.Time:
+		return value.Format(time.RFC3339)
+	case []interface{}:
+		texts := make([]string, len(value))
+		for i, v := range value {
+			texts[i] = describeValue(v)
+		}
+		return "[" + strings.Join(texts, " ") + "]"
+	}
+	return fmt.Sprint(value)
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"single condition", "price > 10", "price > 10"},
+		{"equals is ==", "brand = Amul", `brand == "Amul"`},
+		{"and binds tighter than or", "brand = A or brand = B and price < 5", `(brand == "A" or (brand == "B" and price < 5))`},
+		{"and before or", "brand = A and price < 5 or brand = B", `((brand == "A" and price < 5) or brand == "B")`},
+		{"parentheses group first", "(brand = A or brand = B) and price < 5", `((brand == "A" or brand == "B") and price < 5)`},
+		{"ands stay flat", "price > 1 and price < 9 and weight = 2", "(price > 1 and price < 9 and weight == 2)"},
+		{"between includes both ends", "price between 1.5 and 10", "(price >= 1.5 and price <= 10)"},
+		{"between joins the surrounding and", "brand = A and price between 1 and 2", `(brand == "A" and price >= 1 and price <= 2)`},
+		{"in list", `category in ("Dairy", 'Bakery')`, `category in ["Dairy" "Bakery"]`},
+		{"in with brackets", "itempackagequantity in [1, 6]", "itempackagequantity in [1 6]"},
+		{"keywords ignore case", "brand = A OR price BETWEEN 1 AND 2", `(brand == "A" or (price >= 1 and price <= 2))`},
+		{"operators need no spaces", "price>=2", "price >= 2"},
+		{"booleans match text too", "vegetarian = true", `vegetarian in [true "true"]`},
+		{"not a boolean is the other one", "vegetarian != true", `vegetarian in [false "false"]`},
+		{"date", "createdAt >= 2024-01-01", "createdAt >= 2024-01-01T00:00:00Z"},
+		{"RFC 3339 date", "updatedAt < 2024-01-01T10:00:00+02:00", "updatedAt < 2024-01-01T10:00:00+02:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expr, err := ParseExpression(test.text)
+			if err != nil {
+				t.Fatalf("ParseExpression(%q) = %v", test.text, err)
+			}
+			if got := describe(expr); got != test.want {
+				t.Errorf("ParseExpression(%q) = %s, want %s", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExpressionQuoting(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`productname = "Brown Rice"`, `productname == "Brown Rice"`},
+		{`productname = 'Brown Rice'`, `productname == "Brown Rice"`},
+		// Quoted text is never a keyword, operator or punctuation
+		{`brand = 'and'`, `brand == "and"`},
+		{`brand = "A, B (C) <= D"`, `brand == "A, B (C) <= D"`},
+		{`brand = "Ben's"`, `brand == "Ben's"`},
+		{`brand = 'Say "hi"'`, `brand == "Say \"hi\""`},
+		{`brand = ''`, `brand == ""`},
+		// Unquoted numbers are text for a text field
+		{`brand = 7up`, `brand == "7up"`},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpression(test.text)
+		if err != nil {
+			t.Errorf("ParseExpression(%q) = %v", test.text, err)
+			continue
+		}
+		if got := describe(expr); got != test.want {
+			t.Errorf("ParseExpression(%q) = %s, want %s", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParseExpressionRejectsInvalidInput(t *testing.T) {
+	tooMany := strings.TrimSuffix(strings.Repeat("price > 1 and ", maxConditions+1), " and ")
+	longList := "price in (" + strings.TrimSuffix(strings.Repeat("1, ", maxListValues+1), ", ") + ")"
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"empty", "", "expected a condition"},
+		{"unknown field", "colour = red", "unknown field"},
+		{"quoted field", `"price" > 1`, "unknown field"},
+		{"missing operator", "price", "expected an operator"},
+		{"unknown operator", "price like 1", "expected an operator"},
+		{"lone bang", "price ! 1", `unexpected "!"`},
+		{"missing value", "price >", "expected a value"},
+		{"operator as value", "price > >", "expected a value"},
+		{"not a number", "price > cheap", "price is a number"},
+		{"not a boolean", "vegetarian = maybe", "vegetarian is true or false"},
+		{"not a date", "createdAt > yesterday", "createdAt is a date"},
+		{"range on text", "brand > A", "only supports =, != and in"},
+		{"range on boolean", "vegetarian < true", "only supports = and !="},
+		{"in on date", "createdAt in (2024-01-01)", "does not support in"},
+		{"unterminated text", "brand = 'Amul", "unterminated text"},
+		{"unclosed parenthesis", "(price > 1", `expected ")"`},
+		{"extra parenthesis", "price > 1)", "unexpected"},
+		{"trailing and", "price > 1 and", "expected a condition"},
+		{"between without and", "price between 1 or 2", "expected and between"},
+		{"in without list", "brand in Amul", "expected a list"},
+		{"mismatched list", "brand in (A, B]", `expected "," or ")"`},
+		{"too many conditions", tooMany, "conditions are allowed"},
+		{"too long list", longList, "limited to"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expr, err := ParseExpression(test.text)
+			if err == nil {
+				t.Fatalf("ParseExpression(%q) = %s, want an error", test.text, describe(expr))
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ParseExpression(%q) = %v, want an error with %q", test.text, err, test.want)
+			}
+		})
+	}
+}
+
+func TestExprMatch(t *testing.T) {
+	item := map[string]interface{}{
+		"brand":               "Amul",
+		"price":               12.5,
+		"itempackagequantity": int64(6),
+		"weight":              "0.5",
+		"vegetarian":          "true",
+		"createdAt":           time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"price between 10 and 12.5", true},
+		{"price > 12.5", false},
+		{"itempackagequantity = 6", true},
+		{"brand in ('Nestle', 'Amul')", true},
+		{"brand = Amul and price < 10 or itempackagequantity >= 6", true},
+		{"brand = Amul and (price < 10 or itempackagequantity > 6)", false},
+		{"createdAt >= 2024-01-01", true},
+		// Imported items keep the text of the sheet cell
+		{"vegetarian = true", true},
+		{"vegetarian = false", false},
+		// Like Firestore, a number stored as text is not a number and a
+		// missing field never matches
+		{"weight < 1", false},
+		{"weight != 1", true},
+		{"manufacturer != Amul", false},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpression(test.text)
+		if err != nil {
+			t.Fatalf("ParseExpression(%q) = %v", test.text, err)
+		}
+		if got := expr.Match(item); got != test.want {
+			t.Errorf("%s matched %t, want %t", test.text, got, test.want)
+		}
+	}
+}
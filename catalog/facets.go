@@ -0,0 +1,376 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FacetFields are the grocery fields facet counts are given for, besides the
+// price buckets.
+var FacetFields = []string{"category", "brand", "manufacturer", "countryoforigin", "vegetarian"}
+
+// DefaultPriceBuckets are the bounds of the price buckets when the request
+// does not give any: under 10, 10 to 25, 25 to 50, 50 to 100 and 100 or more.
+var DefaultPriceBuckets = []float64{10, 25, 50, 100}
+
+const maxPriceBuckets = 20
+
+// FacetCount is the number of matching items with a value of a field.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// PriceBucket is the number of matching items priced from Min, included, to
+// Max, excluded. The first bucket has no Min and the last no Max.
+type PriceBucket struct {
+	Label string   `json:"label"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+// Facets are the facet counts of a filtered view of the catalog. The counts
+// of each facet use every filter except the facet's own, so selecting a
+// category still shows how many items the other categories have.
+type Facets struct {
+	Fields map[string][]FacetCount `json:"fields"`
+	Price  []PriceBucket           `json:"price"`
+	// AsOf is when the counts were taken from Firestore
+	AsOf time.Time `json:"asOf"`
+	// IsLowerBound is set when more items matched than were read to count
+	// the values of category, brand, manufacturer and country of origin,
+	// which are then counts among the items read
+	IsLowerBound bool `json:"isLowerBound,omitempty"`
+}
+
+// ParsePriceBuckets reads comma separated bucket bounds, e.g. "5,10,20". An
+// empty string gives DefaultPriceBuckets.
+func ParsePriceBuckets(text string) ([]float64, error) {
+	if strings.TrimSpace(text) == "" {
+		return DefaultPriceBuckets, nil
+	}
+	parts := strings.Split(text, ",")
+	if len(parts) > maxPriceBuckets {
+		return nil, fmt.Errorf("at most %d price buckets are allowed", maxPriceBuckets)
+	}
+	bounds := make([]float64, len(parts))
+	for i, part := range parts {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price bucket bound %q", part)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return nil, fmt.Errorf("price bucket bounds must be in increasing order")
+		}
+		bounds[i] = bound
+	}
+	return bounds, nil
+}
+
+// FacetCounter counts the facets of the items added to it.
+type FacetCounter struct {
+	bounds []float64
+	fields []map[string]int
+	prices []int
+	// filter of each facet field, then of the price, without the
+	// conditions on the facet's own field
+	filters []Expr
+}
+
+// NewFacetCounter returns a counter for the given filters and price bucket
+// bounds. Only top-level and conditions on a facet's field are left out of
+// its counts; conditions inside an or apply to every facet.
+func NewFacetCounter(filters Filters, bounds []float64) (*FacetCounter, error) {
+	expr, err := filters.Expression()
+	if err != nil {
+		return nil, err
+	}
+	counter := &FacetCounter{
+		bounds:  bounds,
+		fields:  make([]map[string]int, len(FacetFields)),
+		prices:  make([]int, len(bounds)+1),
+		filters: make([]Expr, len(FacetFields)+1),
+	}
+	for i, field := range FacetFields {
+		counter.fields[i] = make(map[string]int)
+		counter.filters[i] = without(expr, field)
+	}
+	counter.filters[len(FacetFields)] = without(expr, "price")
+	return counter, nil
+}
+
+// Add counts a grocery item in the facets whose other filters it passes.
+func (c *FacetCounter) Add(data map[string]interface{}) {
+	for i, field := range FacetFields {
+		value := facetValue(data[field], field)
+		if value == "" || !c.matches(i, data) {
+			continue
+		}
+		c.fields[i][value]++
+	}
+	price, ok := storedNumber(data["price"])
+	if ok && c.matches(len(FacetFields), data) {
+		c.prices[sort.Search(len(c.bounds), func(i int) bool { return c.bounds[i] > price })]++
+	}
+}
+
+func (c *FacetCounter) matches(facet int, data map[string]interface{}) bool {
+	return c.filters[facet] == nil || c.filters[facet].Match(data)
+}
+
+// Facets returns the counts, the values of each field most frequent first.
+// Each field gives at most limit values.
+func (c *FacetCounter) Facets(limit int) Facets {
+	facets := Facets{Fields: make(map[string][]FacetCount, len(FacetFields))}
+	for i, field := range FacetFields {
+		facets.Fields[field] = sortFacetCounts(c.fields[i], limit)
+	}
+
+	for i, count := range c.prices {
+		bucket := PriceBucket{Count: count}
+		if i > 0 {
+			bucket.Min = &c.bounds[i-1]
+		}
+		if i < len(c.bounds) {
+			bucket.Max = &c.bounds[i]
+		}
+		switch {
+		case bucket.Min == nil && bucket.Max == nil:
+			bucket.Label = "all"
+		case bucket.Min == nil:
+			bucket.Label = "<" + formatBound(*bucket.Max)
+		case bucket.Max == nil:
+			bucket.Label = formatBound(*bucket.Min) + "+"
+		default:
+			bucket.Label = formatBound(*bucket.Min) + "-" + formatBound(*bucket.Max)
+		}
+		facets.Price = append(facets.Price, bucket)
+	}
+	return facets
+}
+
+// sortFacetCounts returns the values with a count, most frequent first, and
+// at most limit of them.
+func sortFacetCounts(values map[string]int, limit int) []FacetCount {
+	counts := make([]FacetCount, 0, len(values))
+	for value, count := range values {
+		if count > 0 {
+			counts = append(counts, FacetCount{value, count})
+		}
+	}
+	sort.Slice(counts, func(a, b int) bool {
+		if counts[a].Count != counts[b].Count {
+			return counts[a].Count > counts[b].Count
+		}
+		return counts[a].Value < counts[b].Value
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// CountFacets counts the facets of the catalog items matching filters when
+// it is called. The price buckets and the vegetarian values are counted with
+// aggregation queries, so no documents are read for them, unless Firestore
+// cannot run their filter. The values of the other fields are not known
+// beforehand: they are counted from the matching items, reading only the
+// fields needed and at most scanLimit items; IsLowerBound is set when there
+// were more.
+func CountFacets(ctx context.Context, client *firestore.Client, filters Filters, bounds []float64, limit int, scanLimit int) (Facets, error) {
+	expr, err := filters.Expression()
+	if err != nil {
+		return Facets{}, err
+	}
+	counter, err := NewFacetCounter(filters, bounds)
+	if err != nil {
+		return Facets{}, err
+	}
+	asOf := time.Now()
+	collection := client.Collection(Collection).Query
+
+	vegetarian := make(map[string]int)
+	vegetarianCounted, err := countAll(ctx, collection, vegetarianExprs(expr), func(value string, count int) {
+		vegetarian[value] = count
+	})
+	if err != nil {
+		return Facets{}, err
+	}
+	prices := make([]int, len(bounds)+1)
+	pricesCounted, err := countAll(ctx, collection, priceBucketExprs(expr, bounds), func(bucket string, count int) {
+		i, _ := strconv.Atoi(bucket)
+		prices[i] = count
+	})
+	if err != nil {
+		return Facets{}, err
+	}
+
+	// The other facets are counted from the items
+	var scanned []string
+	for _, field := range FacetFields {
+		if field != "vegetarian" || !vegetarianCounted {
+			scanned = append(scanned, field)
+		}
+	}
+	if !pricesCounted {
+		scanned = append(scanned, "price")
+	}
+	exact, err := scanFacets(ctx, collection, expr, scanned, counter, scanLimit)
+	if err != nil {
+		return Facets{}, err
+	}
+
+	facets := counter.Facets(limit)
+	if vegetarianCounted {
+		facets.Fields["vegetarian"] = sortFacetCounts(vegetarian, limit)
+	}
+	if pricesCounted {
+		for i := range facets.Price {
+			facets.Price[i].Count = prices[i]
+		}
+	}
+	facets.AsOf = asOf
+	facets.IsLowerBound = !exact
+	return facets, nil
+}
+
+// vegetarianExprs returns the filter of each vegetarian facet value.
+func vegetarianExprs(expr Expr) map[string]Expr {
+	exprs := make(map[string]Expr, 2)
+	for _, flag := range []bool{true, false} {
+		// Matches the boolean and the text form, as the vegetarian filter does
+		value, _ := newCondition("vegetarian", boolField, "==", flag, nil)
+		exprs[strconv.FormatBool(flag)] = and(without(expr, "vegetarian"), value)
+	}
+	return exprs
+}
+
+// priceBucketExprs returns the filter of each price bucket, keyed by the
+// bucket's index.
+func priceBucketExprs(expr Expr, bounds []float64) map[string]Expr {
+	if len(bounds) == 0 {
+		// A single bucket has no bound to select the priced items by
+		return nil
+	}
+	exprs := make(map[string]Expr, len(bounds)+1)
+	for i := 0; i <= len(bounds); i++ {
+		bucket := without(expr, "price")
+		if i > 0 {
+			bucket = and(bucket, &condition{field: "price", op: ">=", value: bounds[i-1]})
+		}
+		if i < len(bounds) {
+			bucket = and(bucket, &condition{field: "price", op: "<", value: bounds[i]})
+		}
+		exprs[strconv.Itoa(i)] = bucket
+	}
+	return exprs
+}
+
+// and adds part to the top-level and conditions of expr, which may be nil.
+func and(expr Expr, part Expr) Expr {
+	switch expr := expr.(type) {
+	case nil:
+		return part
+	case andExpr:
+		return append(expr[:len(expr):len(expr)], part)
+	}
+	return andExpr{expr, part}
+}
+
+// countAll counts the items matching each of exprs with aggregation queries
+// and passes the counts to set. It reports false, setting nothing, when
+// Firestore cannot run one of exprs, or has no index for it.
+func countAll(ctx context.Context, collection firestore.Query, exprs map[string]Expr, set func(key string, count int)) (bool, error) {
+	if len(exprs) == 0 {
+		return false, nil
+	}
+	for _, expr := range exprs {
+		if NewPlan(expr, "").InMemory() {
+			return false, nil
+		}
+	}
+	counts := make(map[string]int, len(exprs))
+	for key, expr := range exprs {
+		query := NewPlan(expr, "").Query(collection)
+		results, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+		if status.Code(err) == codes.FailedPrecondition {
+			log.Printf("Counting facets from the items, as Firestore cannot count them: %v", err)
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to count facets: %w", err)
+		}
+		value, ok := results["count"].(*firestorepb.Value)
+		if !ok {
+			return false, fmt.Errorf("count missing from aggregation result")
+		}
+		counts[key] = int(value.GetIntegerValue())
+	}
+	for key, count := range counts {
+		set(key, count)
+	}
+	return true, nil
+}
+
+// scanFacets adds the items matching expr, but for its conditions on the
+// fields, to counter, reading at most scanLimit of them. It reports whether
+// they were all read.
+func scanFacets(ctx context.Context, collection firestore.Query, expr Expr, fields []string, counter *FacetCounter, scanLimit int) (bool, error) {
+	shared := expr
+	for _, field := range fields {
+		shared = without(shared, field)
+	}
+	plan := NewPlan(shared, "")
+	// Every facet's filter is checked on the items read
+	selected := append(fields[:len(fields):len(fields)], exprFields(expr)...)
+
+	// One document past the limit tells whether there are more
+	docs := plan.Query(collection).Select(selected...).Limit(scanLimit + 1).Documents(ctx)
+	defer docs.Stop()
+	for scanned := 0; ; scanned++ {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read groceries for facets: %w", err)
+		}
+		if scanned == scanLimit {
+			return false, nil
+		}
+		data := doc.Data()
+		if plan.Matches(data) {
+			counter.Add(data)
+		}
+	}
+}
+
+// facetValue is the text a field value is counted under. Vegetarian flags are
+// stored as booleans or as sheet text, and only the forms the vegetarian
+// filter selects are counted.
+func facetValue(value interface{}, field string) string {
+	if value == nil {
+		return ""
+	}
+	text := CellText(value)
+	if field == "vegetarian" && text != "true" && text != "false" {
+		return ""
+	}
+	return text
+}
+
+func formatBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
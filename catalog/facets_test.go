@@ -0,0 +1,82 @@
+package catalog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFacetCounterLeavesOutOwnFilter(t *testing.T) {
+	counter, err := NewFacetCounter(Filters{Category: "Dairy", Brand: "Amul"}, []float64{10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []map[string]interface{}{
+		{"category": "Dairy", "brand": "Amul", "price": 5.0, "vegetarian": true},
+		{"category": "Dairy", "brand": "Nestle", "price": 12.0, "vegetarian": "false"},
+		{"category": "Bakery", "brand": "Amul", "price": 3.0},
+	} {
+		counter.Add(item)
+	}
+	facets := counter.Facets(10)
+
+	if got, want := facets.Fields["category"], []FacetCount{{"Bakery", 1}, {"Dairy", 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("category = %v, want %v", got, want)
+	}
+	if got, want := facets.Fields["brand"], []FacetCount{{"Amul", 1}, {"Nestle", 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("brand = %v, want %v", got, want)
+	}
+	if got, want := facets.Fields["vegetarian"], []FacetCount{{"true", 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("vegetarian = %v, want %v", got, want)
+	}
+	if len(facets.Price) != 2 || facets.Price[0].Count != 1 || facets.Price[1].Count != 0 {
+		t.Errorf("price = %+v", facets.Price)
+	}
+}
+
+func TestPriceBucketExprs(t *testing.T) {
+	expr, err := Filters{Brand: "Amul", PriceFilter: "gt:1"}.Expression()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exprs := priceBucketExprs(expr, []float64{10, 25})
+	want := map[string]string{
+		"0": `(brand == "Amul" and price < 10)`,
+		"1": `(brand == "Amul" and price >= 10 and price < 25)`,
+		"2": `(brand == "Amul" and price >= 25)`,
+	}
+	if len(exprs) != len(want) {
+		t.Fatalf("%d buckets, want %d", len(exprs), len(want))
+	}
+	for key, text := range want {
+		if got := describe(exprs[key]); got != text {
+			t.Errorf("bucket %s = %s, want %s", key, got, text)
+		}
+		// Aggregation queries need Firestore to run the whole filter
+		if NewPlan(exprs[key], "").InMemory() {
+			t.Errorf("bucket %s is not counted by Firestore", key)
+		}
+	}
+	if priceBucketExprs(expr, nil) != nil {
+		t.Error("buckets without bounds are counted by Firestore")
+	}
+
+	// A range on another field leaves the price buckets to be counted from
+	// the items
+	ranged, _ := ParseExpression("weight > 1")
+	for key, bucket := range priceBucketExprs(ranged, []float64{10}) {
+		if !NewPlan(bucket, "").InMemory() {
+			t.Errorf("bucket %s with a weight range runs in Firestore", key)
+		}
+	}
+}
+
+func TestVegetarianExprs(t *testing.T) {
+	expr, _ := Filters{Category: "Dairy", Vegetarian: "true"}.Expression()
+	exprs := vegetarianExprs(expr)
+	if got, want := describe(exprs["true"]), `(category == "Dairy" and vegetarian in [true "true"])`; got != want {
+		t.Errorf("true = %s, want %s", got, want)
+	}
+	if got, want := describe(exprs["false"]), `(category == "Dairy" and vegetarian in [false "false"])`; got != want {
+		t.Errorf("false = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,84 @@
+package catalog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StoredFields are the fields a read can be limited to with a fields
+// parameter: the filterable fields, the id and the image URLs.
+var StoredFields = storedFields()
+
+func storedFields() []string {
+	fields := []string{"id", "image", "thumbnailURL"}
+	for field := range FilterFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// ParseFields reads a comma-separated fields parameter. It returns nil, all
+// fields, when text is empty.
+func ParseFields(text string) ([]string, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	var fields []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || seen[field] {
+			continue
+		}
+		if !isStoredField(field) {
+			return nil, fmt.Errorf("unknown field %q; fields are %s", field, strings.Join(StoredFields, ", "))
+		}
+		seen[field] = true
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func isStoredField(field string) bool {
+	i := sort.SearchStrings(StoredFields, field)
+	return i < len(StoredFields) && StoredFields[i] == field
+}
+
+// SelectFields returns the fields a query has to read to return fields: they
+// and the extra fields the handler needs, such as the sort keys. It returns
+// nil when fields is nil.
+func SelectFields(fields []string, extra ...string) []string {
+	if fields == nil {
+		return nil
+	}
+	selected := append([]string(nil), fields...)
+	for _, field := range extra {
+		found := false
+		for _, have := range selected {
+			if have == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			selected = append(selected, field)
+		}
+	}
+	return selected
+}
+
+// Project returns data limited to fields, or data itself when fields is nil.
+func Project(data map[string]interface{}, fields []string) map[string]interface{} {
+	if fields == nil {
+		return data
+	}
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, ok := data[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
@@ -0,0 +1,130 @@
+package catalog
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Collection holds the grocery catalog.
+const Collection = "Groceries"
+
+// priceOperators maps the priceFilter operators to Firestore operators.
+var priceOperators = map[string]string{
+	"gt": ">",
+	"eq": "==",
+	"lt": "<",
+}
+
+// Filters are the catalog filters ViewAllGroceries takes as query parameters.
+// They are kept in their query parameter form so they can be stored with an
+// export job and applied again by the function that runs it.
+type Filters struct {
+	ProductName     string `json:"productname,omitempty" firestore:"productname,omitempty"`
+	Category        string `json:"category,omitempty" firestore:"category,omitempty"`
+	Brand           string `json:"brand,omitempty" firestore:"brand,omitempty"`
+	Manufacturer    string `json:"manufacturer,omitempty" firestore:"manufacturer,omitempty"`
+	CountryOfOrigin string `json:"countryoforigin,omitempty" firestore:"countryoforigin,omitempty"`
+	// Vegetarian is "true" or "false"
+	Vegetarian string `json:"vegetarian,omitempty" firestore:"vegetarian,omitempty"`
+	// PriceFilter is "gt:100", "eq:50" or "lt:99.5"
+	PriceFilter string `json:"priceFilter,omitempty" firestore:"priceFilter,omitempty"`
+	// Filter is a filter expression, see ParseExpression. It is combined
+	// with the other filters by and.
+	Filter string `json:"filter,omitempty" firestore:"filter,omitempty"`
+}
+
+// ParseFilters reads the filters from query parameters and checks them.
+func ParseFilters(values url.Values) (Filters, error) {
+	filters := Filters{
+		ProductName:     values.Get("productname"),
+		Category:        values.Get("category"),
+		Brand:           values.Get("brand"),
+		Manufacturer:    values.Get("manufacturer"),
+		CountryOfOrigin: values.Get("countryoforigin"),
+		Vegetarian:      values.Get("vegetarian"),
+		PriceFilter:     values.Get("priceFilter"),
+		Filter:          values.Get("filter"),
+	}
+	if _, err := filters.Expression(); err != nil {
+		return filters, err
+	}
+	return filters, nil
+}
+
+// Expression returns the filters as one expression, nil when there are none.
+func (f Filters) Expression() (Expr, error) {
+	var parts andExpr
+	for _, field := range [][2]string{
+		{"productname", f.ProductName},
+		{"category", f.Category},
+		{"brand", f.Brand},
+		{"manufacturer", f.Manufacturer},
+		{"countryoforigin", f.CountryOfOrigin},
+	} {
+		if field[1] != "" {
+			parts = append(parts, &condition{field: field[0], op: "==", value: field[1]})
+		}
+	}
+	if f.Vegetarian != "" {
+		vegetarian, err := strconv.ParseBool(f.Vegetarian)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vegetarian value %q. Use 'true' or 'false'", f.Vegetarian)
+		}
+		part, _ := newCondition("vegetarian", boolField, "==", vegetarian, nil)
+		parts = append(parts, part)
+	}
+	if f.PriceFilter != "" {
+		operator, value, err := f.price()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &condition{field: "price", op: operator, value: value})
+	}
+	if strings.TrimSpace(f.Filter) != "" {
+		expr, err := ParseExpression(f.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if and, ok := expr.(andExpr); ok {
+			parts = append(parts, and...)
+		} else {
+			parts = append(parts, expr)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return nil, nil
+	case 1:
+		return parts[0], nil
+	}
+	return parts, nil
+}
+
+// Plan returns how the filters run for a listing sorted by sortField, or in
+// any order when it is empty; see NewPlan.
+func (f Filters) Plan(sortField string) (*Plan, error) {
+	expr, err := f.Expression()
+	if err != nil {
+		return nil, err
+	}
+	return NewPlan(expr, sortField), nil
+}
+
+// price splits the price filter into a Firestore operator and a value.
+func (f Filters) price() (string, float64, error) {
+	components := strings.Split(f.PriceFilter, ":")
+	if len(components) != 2 {
+		return "", 0, fmt.Errorf("invalid priceFilter format. Use 'gt', 'eq', or 'lt' with a number")
+	}
+	operator, ok := priceOperators[components[0]]
+	if !ok {
+		return "", 0, fmt.Errorf("invalid priceFilter type. Use 'gt', 'eq', or 'lt'")
+	}
+	value, err := strconv.ParseFloat(components[1], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid price value %q", components[1])
+	}
+	return operator, value, nil
+}
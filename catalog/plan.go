@@ -0,0 +1,255 @@
+package catalog
+
+import (
+	"cloud.google.com/go/firestore"
+)
+
+// Firestore query limits the planner keeps to.
+const (
+	maxDisjunctions = 30
+	maxInValues     = 30
+)
+
+// Plan splits a filter expression into the part Firestore runs and the part
+// checked in memory on the documents Firestore returns.
+type Plan struct {
+	filter firestore.EntityFilter
+	// OrderBy is the field of the range or != conditions Firestore runs.
+	// Firestore needs it as the first order of the query.
+	OrderBy  string
+	residual Expr
+}
+
+// NewPlan runs as much of expr in Firestore as it allows: one field with
+// range or != conditions, a single != condition, in lists of at most 30
+// values and at most 30 disjunctions once the expression is expanded. When
+// the whole expression does not fit, its top-level and conditions are run in
+// Firestore while they fit and the rest is checked in memory. A listing
+// sorted by a field can only run range conditions on that field; sortField
+// is empty when the caller lets the plan pick the order.
+func NewPlan(expr Expr, sortField string) *Plan {
+	plan := &Plan{}
+	if expr == nil {
+		return plan
+	}
+	if orderBy, ok := pushable(expr, sortField); ok {
+		plan.filter, plan.OrderBy = entityFilter(expr), orderBy
+		return plan
+	}
+
+	var pushed, residual andExpr
+	parts, ok := expr.(andExpr)
+	if !ok {
+		parts = andExpr{expr}
+	}
+	for _, part := range parts {
+		if orderBy, ok := pushable(append(pushed[:len(pushed):len(pushed)], part), sortField); ok {
+			pushed = append(pushed, part)
+			plan.OrderBy = orderBy
+		} else {
+			residual = append(residual, part)
+		}
+	}
+	if len(pushed) > 0 {
+		plan.filter = entityFilter(pushed)
+	}
+	switch len(residual) {
+	case 0:
+	case 1:
+		plan.residual = residual[0]
+	default:
+		plan.residual = residual
+	}
+	return plan
+}
+
+// Query adds the part of the plan Firestore runs to a query. The caller adds
+// the OrderBy field first when it orders the query.
+func (p *Plan) Query(query firestore.Query) firestore.Query {
+	if p.filter == nil {
+		return query
+	}
+	return query.WhereEntity(p.filter)
+}
+
+// InMemory reports whether part of the filter is checked in memory, so the
+// query may return documents that do not match.
+func (p *Plan) InMemory() bool {
+	return p.residual != nil
+}
+
+// Matches checks a document returned by the query against the part of the
+// filter Firestore did not run.
+func (p *Plan) Matches(data map[string]interface{}) bool {
+	return p.residual == nil || p.residual.Match(data)
+}
+
+// Fields returns the fields the part of the filter checked in memory reads,
+// which a query limited to some fields has to select.
+func (p *Plan) Fields() []string {
+	return exprFields(p.residual)
+}
+
+// exprFields returns the fields expr reads.
+func exprFields(expr Expr) []string {
+	var fields []string
+	var walk func(expr Expr)
+	walk = func(expr Expr) {
+		switch expr := expr.(type) {
+		case andExpr:
+			for _, part := range expr {
+				walk(part)
+			}
+		case orExpr:
+			for _, part := range expr {
+				walk(part)
+			}
+		case *condition:
+			for _, field := range fields {
+				if field == expr.field {
+					return
+				}
+			}
+			fields = append(fields, expr.field)
+		}
+	}
+	walk(expr)
+	return fields
+}
+
+// pushable reports whether Firestore can run expr, and the field Firestore
+// then needs to order by.
+func pushable(expr Expr, sortField string) (string, bool) {
+	var rangeFields []string
+	notEquals := 0
+	if !checkPushable(expr, true, &rangeFields, &notEquals) {
+		return "", false
+	}
+	if len(rangeFields) > 1 || notEquals > 1 || disjunctions(expr) > maxDisjunctions {
+		return "", false
+	}
+	if len(rangeFields) == 1 && sortField != "" && rangeFields[0] != sortField {
+		return "", false
+	}
+	if len(rangeFields) == 1 {
+		return rangeFields[0], true
+	}
+	return "", true
+}
+
+// checkPushable walks expr collecting its range fields and != conditions.
+// != is only run in Firestore at the top level, outside of any or.
+func checkPushable(expr Expr, topLevel bool, rangeFields *[]string, notEquals *int) bool {
+	switch expr := expr.(type) {
+	case andExpr:
+		for _, part := range expr {
+			if !checkPushable(part, topLevel, rangeFields, notEquals) {
+				return false
+			}
+		}
+	case orExpr:
+		for _, part := range expr {
+			if !checkPushable(part, false, rangeFields, notEquals) {
+				return false
+			}
+		}
+	case *condition:
+		switch expr.op {
+		case "in":
+			return len(expr.values) <= maxInValues
+		case "==":
+			return true
+		case "!=":
+			if !topLevel {
+				return false
+			}
+			*notEquals++
+		}
+		for _, field := range *rangeFields {
+			if field == expr.field {
+				return true
+			}
+		}
+		*rangeFields = append(*rangeFields, expr.field)
+	}
+	return true
+}
+
+// disjunctions counts the disjunctions of expr in disjunctive normal form,
+// where an in list counts as many as it has values.
+func disjunctions(expr Expr) int {
+	switch expr := expr.(type) {
+	case andExpr:
+		count := 1
+		for _, part := range expr {
+			count *= disjunctions(part)
+			if count > maxDisjunctions {
+				return count
+			}
+		}
+		return count
+	case orExpr:
+		count := 0
+		for _, part := range expr {
+			count += disjunctions(part)
+		}
+		return count
+	case *condition:
+		if expr.op == "in" {
+			return len(expr.values)
+		}
+	}
+	return 1
+}
+
+func entityFilter(expr Expr) firestore.EntityFilter {
+	switch expr := expr.(type) {
+	case andExpr:
+		if len(expr) == 1 {
+			return entityFilter(expr[0])
+		}
+		filters := make([]firestore.EntityFilter, len(expr))
+		for i, part := range expr {
+			filters[i] = entityFilter(part)
+		}
+		return firestore.AndFilter{Filters: filters}
+	case orExpr:
+		filters := make([]firestore.EntityFilter, len(expr))
+		for i, part := range expr {
+			filters[i] = entityFilter(part)
+		}
+		return firestore.OrFilter{Filters: filters}
+	case *condition:
+		if expr.op == "in" {
+			return firestore.PropertyFilter{Path: expr.field, Operator: "in", Value: expr.values}
+		}
+		return firestore.PropertyFilter{Path: expr.field, Operator: expr.op, Value: expr.value}
+	}
+	return nil
+}
+
+// without returns expr less its top-level and conditions on field, or nil
+// when nothing is left.
+func without(expr Expr, field string) Expr {
+	if expr == nil {
+		return nil
+	}
+	parts, ok := expr.(andExpr)
+	if !ok {
+		parts = andExpr{expr}
+	}
+	var kept andExpr
+	for _, part := range parts {
+		if c, ok := part.(*condition); ok && c.field == field {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	switch len(kept) {
+	case 0:
+		return nil
+	case 1:
+		return kept[0]
+	}
+	return kept
+}
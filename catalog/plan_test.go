@@ -0,0 +1,202 @@
+package catalog
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// describeFilter writes the filter Firestore runs like describe does.
+func describeFilter(filter firestore.EntityFilter) string {
+	switch filter := filter.(type) {
+	case nil:
+		return ""
+	case firestore.AndFilter:
+		return "(" + describeFilters(filter.Filters, " and ") + ")"
+	case firestore.OrFilter:
+		return "(" + describeFilters(filter.Filters, " or ") + ")"
+	case firestore.PropertyFilter:
+		return fmt.Sprintf("%s %s %s", filter.Path, filter.Operator, describeValue(filter.Value))
+	}
+	return fmt.Sprintf("%T", filter)
+}
+
+func describeFilters(filters []firestore.EntityFilter, separator string) string {
+	texts := make([]string, len(filters))
+	for i, filter := range filters {
+		texts[i] = describeFilter(filter)
+	}
+	return strings.Join(texts, separator)
+}
+
+// inList returns an in condition on itempackagequantity with n values.
+func inList(n int) string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = fmt.Sprint(i + 1)
+	}
+	return "itempackagequantity in (" + strings.Join(values, ", ") + ")"
+}
+
+func TestNewPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		sort     string
+		pushed   string
+		orderBy  string
+		inMemory string
+	}{
+		{
+			name:   "equality runs in Firestore",
+			text:   "brand = A and category = B",
+			pushed: `(brand == "A" and category == "B")`,
+		},
+		{
+			name:    "range on one field runs in Firestore and orders the query",
+			text:    "brand = A and price between 1 and 10",
+			pushed:  `(brand == "A" and price >= 1 and price <= 10)`,
+			orderBy: "price",
+		},
+		{
+			name:    "range on the sort field",
+			text:    "price > 5",
+			sort:    "price",
+			pushed:  "price > 5",
+			orderBy: "price",
+		},
+		{
+			name:     "range on another field than the sort is checked in memory",
+			text:     "brand = A and price > 5",
+			sort:     "weight",
+			pushed:   `brand == "A"`,
+			inMemory: "price > 5",
+		},
+		{
+			name:     "second range field is checked in memory",
+			text:     "price > 5 and weight < 2",
+			pushed:   "price > 5",
+			orderBy:  "price",
+			inMemory: "weight < 2",
+		},
+		{
+			name:     "second != is checked in memory",
+			text:     "brand != A and category != B",
+			pushed:   `brand != "A"`,
+			orderBy:  "brand",
+			inMemory: `category != "B"`,
+		},
+		{
+			name:   "or runs in Firestore",
+			text:   "brand = A or category = B",
+			pushed: `(brand == "A" or category == "B")`,
+		},
+		{
+			name:     "!= under or is checked in memory",
+			text:     "brand = A and (brand != B or category = C)",
+			pushed:   `brand == "A"`,
+			inMemory: `(brand != "B" or category == "C")`,
+		},
+		{
+			name:   "in list of 30 values runs in Firestore",
+			text:   inList(maxInValues),
+			pushed: "itempackagequantity in " + describeValue(listValues(maxInValues)),
+		},
+		{
+			name:     "longer in list is checked in memory",
+			text:     "brand = A and " + inList(maxInValues+1),
+			pushed:   `brand == "A"`,
+			inMemory: "itempackagequantity in " + describeValue(listValues(maxInValues+1)),
+		},
+		{
+			name:     "too many disjunctions are checked in memory",
+			text:     "brand = A and " + inList(6) + " and category in (a, b, c, d, e, f)",
+			pushed:   `(brand == "A" and itempackagequantity in [1 2 3 4 5 6])`,
+			inMemory: `category in ["a" "b" "c" "d" "e" "f"]`,
+		},
+		{
+			name:     "or that does not fit is checked in memory as a whole",
+			text:     "price > 1 or weight > 1",
+			inMemory: "(price > 1 or weight > 1)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expr, err := ParseExpression(test.text)
+			if err != nil {
+				t.Fatalf("ParseExpression(%q) = %v", test.text, err)
+			}
+			plan := NewPlan(expr, test.sort)
+			if got := describeFilter(plan.filter); got != test.pushed {
+				t.Errorf("Firestore runs %s, want %s", got, test.pushed)
+			}
+			if plan.OrderBy != test.orderBy {
+				t.Errorf("OrderBy = %q, want %q", plan.OrderBy, test.orderBy)
+			}
+			if got := describe(plan.residual); got != test.inMemory {
+				t.Errorf("checked in memory: %s, want %s", got, test.inMemory)
+			}
+			if plan.InMemory() != (test.inMemory != "") {
+				t.Errorf("InMemory() = %t", plan.InMemory())
+			}
+		})
+	}
+}
+
+// listValues returns the values of inList(n).
+func listValues(n int) []interface{} {
+	values := make([]interface{}, n)
+	for i := range values {
+		values[i] = float64(i + 1)
+	}
+	return values
+}
+
+func TestNewPlanWithoutFilter(t *testing.T) {
+	plan := NewPlan(nil, "price")
+	if plan.filter != nil || plan.OrderBy != "" || plan.InMemory() || !plan.Matches(map[string]interface{}{}) {
+		t.Errorf("plan of no filter = %+v", plan)
+	}
+}
+
+func TestPlanMatchesAndFields(t *testing.T) {
+	expr, err := ParseExpression("brand = A and price > 5 and (weight < 2 or vegetarian = true) and weight > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := NewPlan(expr, "createdAt")
+	if got, want := plan.Fields(), []string{"price", "weight", "vegetarian"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %v, want %v", got, want)
+	}
+	// Matches only checks the part Firestore does not run
+	if !plan.Matches(map[string]interface{}{"brand": "B", "price": 6.0, "weight": 1.0}) {
+		t.Error("an item passing the in-memory part did not match")
+	}
+	if plan.Matches(map[string]interface{}{"brand": "A", "price": 4.0, "weight": 1.0}) {
+		t.Error("an item failing the in-memory part matched")
+	}
+}
+
+func TestWithout(t *testing.T) {
+	expr, _ := ParseExpression("brand = A and price between 1 and 2 and (brand = B or category = C)")
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"brand", `(price >= 1 and price <= 2 and (brand == "B" or category == "C"))`},
+		{"price", `(brand == "A" and (brand == "B" or category == "C"))`},
+		{"weight", describe(expr)},
+	}
+	for _, test := range tests {
+		if got := describe(without(expr, test.field)); got != test.want {
+			t.Errorf("without %s = %s, want %s", test.field, got, test.want)
+		}
+	}
+	single, _ := ParseExpression("brand = A")
+	if got := without(single, "brand"); got != nil {
+		t.Errorf("without the only condition = %s", describe(got))
+	}
+}
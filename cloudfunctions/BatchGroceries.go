@@ -0,0 +1,394 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/catalog"
+	"github.com/takeoff-capstone/utils"
+)
+
+const (
+	// A batch fits in one transaction, which Firestore limits to 500 writes
+	maxBatchSize        = 500
+	maxBatchRequestSize = 1 << 20
+)
+
+// Item statuses reported by the batch endpoints, besides the change statuses
+// of BulkUpdateGroceryItems.
+const (
+	BatchFound    = "found"
+	BatchNotFound = "notFound"
+	BatchDeleted  = "deleted"
+)
+
+// BatchRequest is the body of the batch endpoints.
+type BatchRequest struct {
+	// IDs are the grocery ids, as strings or numbers
+	IDs []json.Number `json:"ids"`
+	// Patch holds the fields BatchUpdateGroceries sets on every item
+	Patch map[string]interface{} `json:"patch,omitempty"`
+	// Atomic applies an update or delete to every item or to none
+	Atomic bool `json:"atomic"`
+}
+
+// BatchItemResult is the outcome of a batch for one id.
+type BatchItemResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Code and Error say why the item failed
+	Code  apierror.Code          `json:"code,omitempty"`
+	Error string                 `json:"error,omitempty"`
+	Item  map[string]interface{} `json:"item,omitempty"`
+}
+
+// BatchResult is the response of the batch endpoints, with a result per id
+// in the order of the request.
+type BatchResult struct {
+	Atomic    bool              `json:"atomic"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// batchItem is an id of a batch whose document was read.
+type batchItem struct {
+	result *BatchItemResult
+	docRef *firestore.DocumentRef
+	data   map[string]interface{}
+}
+
+// @Summary Get many grocery items
+// @Description Reads the grocery items of up to 500 ids in one Firestore call. Ids that do not exist are reported as notFound.
+// @ID batch-get-groceries
+// @Accept json
+// @Produce json
+// @Param request body BatchRequest true "ids"
+// @Param fields query string false "Comma-separated fields to return; all fields when empty"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} cloudfunctions.BatchResult "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid batch"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/BatchGetGroceries [post]
+// @Router /api/v1/groceries/batch-get [post]
+func BatchGetGroceries(w http.ResponseWriter, r *http.Request) {
+	handleBatch(w, r, func(ctx context.Context, client *firestore.Client, request BatchRequest, result *BatchResult) (int, error) {
+		fields, err := catalog.ParseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			return http.StatusBadRequest, apierror.InvalidField("fields", err.Error())
+		}
+		items, err := readBatch(ctx, client, request.IDs, result)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		for _, item := range items {
+			item.result.Status = BatchFound
+			item.result.Item = catalog.Project(item.data, fields)
+		}
+		return http.StatusOK, nil
+	})
+}
+
+// @Summary Update many grocery items
+// @Description Applies patch, a JSON merge patch as UpdateGrocery takes, to up to 500 grocery items. The patch is validated and every item is merged and audited like UpdateGrocery. A patch setting productname can only be applied to one id, whose new name must not be taken. With atomic true the items are updated in a single transaction, and nothing is changed if any item fails.
+// @ID batch-update-groceries
+// @Accept json
+// @Produce json
+// @Param request body BatchRequest true "ids, patch and atomic"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} cloudfunctions.BatchResult "OK"
+// @Failure 400 {object} cloudfunctions.BatchResult "Bad Request: Invalid batch or patch, or an item failed in atomic mode"
+// @Failure 409 {object} cloudfunctions.BatchResult "Conflict: An item was changed or deleted by another request during an atomic write"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/BatchUpdateGroceries [post]
+// @Router /api/v1/groceries/batch-update [post]
+func BatchUpdateGroceries(w http.ResponseWriter, r *http.Request) {
+	handleBatch(w, r, func(ctx context.Context, client *firestore.Client, request BatchRequest, result *BatchResult) (int, error) {
+		if len(request.Patch) == 0 {
+			return http.StatusBadRequest, apierror.InvalidField("patch", "patch has no fields to change")
+		}
+		// A patch that is invalid on its own fails every item the same way
+		if _, err := checkGroceryPatch(request.Patch); err != nil {
+			return http.StatusBadRequest, err
+		}
+		newName, renames := request.Patch["productname"].(string)
+		if renames && len(request.IDs) > 1 {
+			return http.StatusBadRequest, apierror.InvalidField("productname", "Product names are unique, so a batch can only rename one item")
+		}
+		items, err := readBatch(ctx, client, request.IDs, result)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		// The change rows of BulkUpdateGroceryItems report into a change sheet
+		// result, which is copied back into the batch result at the end
+		changes := make([]ChangeSheetRowResult, len(items))
+		var rows []changeRow
+		for i, item := range items {
+			change := &changes[i]
+			change.Row = i + 1
+			change.ID = item.docRef.ID
+			change.ProductName, _ = item.data["productname"].(string)
+			// Validate against the data read; the document is merged again
+			// when written
+			if err := mergeGroceryUpdate(item.data, request.Patch); err != nil {
+				change.fail(err)
+				continue
+			}
+			if renames && newName != change.ProductName {
+				if taken, err := productNameTaken(ctx, client, newName, item.docRef.ID); err != nil {
+					return http.StatusInternalServerError, err
+				} else if taken {
+					change.fail(apierror.DuplicateProduct(newName))
+					continue
+				}
+			}
+			rows = append(rows, changeRow{result: change, docRef: item.docRef, changes: request.Patch})
+		}
+
+		statusCode := http.StatusOK
+		if request.Atomic {
+			if len(rows) < len(items) || len(items) < len(result.Results) {
+				for _, row := range rows {
+					row.result.Status = ChangeSkipped
+				}
+				statusCode = http.StatusBadRequest
+			} else if err := applyChangesAtomically(ctx, client, rows); err != nil {
+				log.Println("Failed to apply batch update:", err)
+				for _, row := range rows {
+					row.result.fail(err)
+				}
+				statusCode = apierror.From(err).Code.Status()
+			} else {
+				for _, row := range rows {
+					auditChange(row)
+				}
+			}
+		} else {
+			for _, row := range rows {
+				applyChange(ctx, client, row)
+			}
+		}
+
+		for i, item := range items {
+			item.result.Status = changes[i].Status
+			item.result.Code = changes[i].Code
+			item.result.Error = changes[i].Error
+		}
+		return statusCode, nil
+	})
+}
+
+// @Summary Delete many grocery items
+// @Description Deletes up to 500 grocery items with their images, and publishes an audit record for each like DeleteGrocery. With atomic true the items are deleted in a single transaction, and nothing is deleted if any item is missing.
+// @ID batch-delete-groceries
+// @Accept json
+// @Produce json
+// @Param request body BatchRequest true "ids and atomic"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} cloudfunctions.BatchResult "OK"
+// @Failure 400 {object} cloudfunctions.BatchResult "Bad Request: Invalid batch, or an item failed in atomic mode"
+// @Failure 409 {object} cloudfunctions.BatchResult "Conflict: An item was changed or deleted by another request during an atomic write"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/BatchDeleteGroceries [post]
+// @Router /api/v1/groceries/batch-delete [post]
+func BatchDeleteGroceries(w http.ResponseWriter, r *http.Request) {
+	handleBatch(w, r, func(ctx context.Context, client *firestore.Client, request BatchRequest, result *BatchResult) (int, error) {
+		items, err := readBatch(ctx, client, request.IDs, result)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if request.Atomic {
+			if len(items) < len(result.Results) {
+				for _, item := range items {
+					item.result.Status = ChangeSkipped
+				}
+				return http.StatusBadRequest, nil
+			}
+			err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+				// Firestore needs all reads of a transaction before its writes
+				refs := make([]*firestore.DocumentRef, len(items))
+				for i, item := range items {
+					refs[i] = item.docRef
+				}
+				docSnapshots, err := tx.GetAll(refs)
+				if err != nil {
+					return err
+				}
+				for i, item := range items {
+					if !docSnapshots[i].Exists() {
+						return apierror.Conflict(fmt.Sprintf("Grocery item %s was deleted meanwhile", item.docRef.ID))
+					}
+					items[i].data = docSnapshots[i].Data()
+				}
+				for _, item := range items {
+					if err := tx.Delete(item.docRef); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Println("Failed to apply batch delete:", err)
+				for _, item := range items {
+					item.result.fail(err)
+				}
+				return apierror.From(err).Code.Status(), nil
+			}
+			for _, item := range items {
+				item.result.Status = BatchDeleted
+				auditDelete(item)
+			}
+		} else {
+			for _, item := range items {
+				if _, err := item.docRef.Delete(ctx, firestore.Exists); err != nil {
+					log.Printf("Failed to delete grocery item %s: %v", item.docRef.ID, err)
+					item.result.fail(err)
+					continue
+				}
+				item.result.Status = BatchDeleted
+				auditDelete(item)
+			}
+		}
+		return http.StatusOK, nil
+	})
+}
+
+// handleBatch does the request handling the batch endpoints share: CORS,
+// reading and checking the body, and counting the results. run reports the
+// status code, or an error to send instead of the result.
+func handleBatch(w http.ResponseWriter, r *http.Request, run func(context.Context, *firestore.Client, BatchRequest, *BatchResult) (int, error)) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	var request BatchRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apierror.Write(w, r, apierror.Validation("Invalid batch request"))
+		return
+	}
+	if len(request.IDs) == 0 {
+		apierror.Write(w, r, apierror.InvalidField("ids", "ids are required"))
+		return
+	}
+	if len(request.IDs) > maxBatchSize {
+		apierror.Write(w, r, apierror.InvalidField("ids", fmt.Sprintf("Batches are limited to %d ids", maxBatchSize)))
+		return
+	}
+
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	result := BatchResult{Atomic: request.Atomic, Results: make([]BatchItemResult, len(request.IDs))}
+	statusCode, err := run(ctx, client, request, &result)
+	if err != nil {
+		if statusCode == http.StatusInternalServerError {
+			err = apierror.Internal("Failed to read grocery items", err)
+		}
+		apierror.Write(w, r, err)
+		return
+	}
+	for _, item := range result.Results {
+		switch item.Status {
+		case BatchFound, BatchDeleted, ChangeUpdated, ChangeUnchanged:
+			result.Succeeded++
+		case BatchNotFound, ChangeFailed:
+			result.Failed++
+		}
+	}
+	log.Printf("Batch of %d ids done: %d succeeded, %d failed", len(result.Results), result.Succeeded, result.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(result)
+}
+
+// readBatch reads the documents of ids with a single GetAll. Ids that are
+// invalid, repeated or missing are marked as failed in result; the others
+// are returned in request order. An error is only returned when Firestore
+// itself fails.
+func readBatch(ctx context.Context, client *firestore.Client, ids []json.Number, result *BatchResult) ([]batchItem, error) {
+	var items []batchItem
+	var refs []*firestore.DocumentRef
+	listed := make(map[string]bool)
+	for i, number := range ids {
+		id := number.String()
+		itemResult := &result.Results[i]
+		itemResult.ID = id
+		if _, err := strconv.Atoi(id); err != nil {
+			itemResult.fail(apierror.Validation(fmt.Sprintf("invalid id '%s'", id)))
+			continue
+		}
+		if listed[id] {
+			itemResult.fail(apierror.Validation(fmt.Sprintf("id %s is listed more than once", id)))
+			continue
+		}
+		listed[id] = true
+		docRef := client.Collection("Groceries").Doc(id)
+		items = append(items, batchItem{result: itemResult, docRef: docRef})
+		refs = append(refs, docRef)
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	docSnapshots, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grocery items: %v", err)
+	}
+	found := items[:0]
+	for i, item := range items {
+		if !docSnapshots[i].Exists() {
+			item.result.Status = BatchNotFound
+			item.result.Code = apierror.CodeNotFound
+			item.result.Error = fmt.Sprintf("grocery item %s not found", item.docRef.ID)
+			continue
+		}
+		item.data = docSnapshots[i].Data()
+		found = append(found, item)
+	}
+	return found, nil
+}
+
+// auditDelete removes the images of a deleted item, notifies the catalog and
+// publishes the audit record, as DeleteGrocery does. The item is already
+// deleted, so failures are only logged.
+func auditDelete(item batchItem) {
+	deleteGroceryImages(item.data)
+	id, _ := strconv.Atoi(item.docRef.ID)
+	productName, _ := item.data["productname"].(string)
+	if err := publishDeleteAudit(id, productName); err != nil {
+		log.Printf("Failed to publish audit record for %s: %v", item.docRef.ID, err)
+	}
+}
+
+// fail marks an item as failed with the code and message a client may see;
+// the raw error of an internal failure is logged instead.
+func (r *BatchItemResult) fail(err error) {
+	apiErr := apierror.From(err)
+	if apiErr.Code == apierror.CodeInternal {
+		log.Printf("Batch item %s failed: %v", r.ID, err)
+	}
+	r.Status = ChangeFailed
+	r.Code = apiErr.Code
+	r.Error = apiErr.Message
+}
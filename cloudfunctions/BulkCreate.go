@@ -1,137 +1,285 @@
 package cloudfunctions
 
 import (
+	"bufio"
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/google/uuid"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
 	"github.com/takeoff-capstone/common"
+	"github.com/takeoff-capstone/idempotency"
+	"github.com/takeoff-capstone/utils"
 )
 
 const (
 	//projectID       = "capstore-takeoff"
 	bucketName      = "bulk_data_bucket"
 	requiredHeaders = "productname,price,category,weight,brand,itempackagequantity,packageinformation,manufacturer,countryoforigin"
+	// Upper bound for a single bulk upload. The file is streamed straight to
+	// Cloud Storage, so this limits request size rather than memory use.
+	maxBulkUploadSize = 1 << 30
+	// Number of bad lines listed when an NDJSON upload is rejected
+	maxReportedLineErrors = 50
+	// Collection the bulk import function writes to
+	bulkDataCollection = "bulk_data"
 )
 
+// fileValidationError marks an upload that was rejected because of its content
+// rather than because of a storage failure.
+type fileValidationError struct {
+	err error
+}
+
+func (e *fileValidationError) Error() string {
+	return e.err.Error()
+}
+
+func init() {
+	functions.HTTP("BulkUploadGroceryItems", idempotency.Handler("BulkUploadGroceryItems", BulkUploadGroceryItems))
+}
+
 // @Summary Bulk upload grocery items
-// @Description Uploads multiple grocery items from a CSV or JSON file
+// @Description Uploads multiple grocery items from a CSV, JSON, NDJSON or XLSX file, optionally gzip compressed. The file type is detected from its content. A ZIP file holds a manifest (manifest.csv, manifest.json or manifest.ndjson) whose image column names a JPG or PNG file in the archive; the images are stored with their products and thumbnails are generated. Every row becomes a new item of the bulk_data staging collection, not of the catalog; to apply an edited export to the catalog use BulkUpdate. An id column is imported as a field, unless fromExport is set.
 // @ID bulk-upload-grocery-items
 // @Accept multipart/form-data
 // @Produce json
-// @Param file formData file true "CSV or JSON file containing grocery items"
+// @Param file formData file true "CSV, JSON, NDJSON, XLSX or ZIP file containing grocery items, optionally gzip compressed"
+// @Param templateId query string false "ID of a saved column mapping template"
+// @Param sheet query string false "XLSX sheet name or 1-based number, defaults to the first sheet"
+// @Param headerRow query int false "XLSX 1-based header row, detected when omitted"
+// @Param fromExport query bool false "The file was written by ExportGroceries; its id column is dropped"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
 // @Success 201 {object} map[string]interface{} "File URL sent successfully"
-// @Failure 400 {string} string "Bad Request: Please provide a file"
-// @Failure 400 {string} string "Bad Request: Unsupported file type. Only CSV or JSON files are allowed"
-// @Failure 500 {string} string "Internal Server Error"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Please provide a file"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Unsupported file type. Only CSV, JSON, NDJSON, XLSX or ZIP files are allowed, optionally gzip compressed"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
 // @Router /api/bulkUploadGroceryItems [post]
 func BulkUploadGroceryItems(w http.ResponseWriter, r *http.Request) {
-	//ctx := context.Background()
-	// Parse the form data with a max of 10 MB limit for the entire request
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		log.Println("Failed to parse multipart form:", err)
-		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+	job, err := startImport(w, r)
+	if err != nil {
+		apierror.Write(w, r, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"message": "File URL sent successfully", "url": "%s", "importId": "%s"}`, job.FileURL, job.ID)
+}
 
-	// Validate if the request contains a file
-	file, header, err := r.FormFile("file")
+// startImport stores the file uploaded with r, records its import job and
+// publishes it to the import function. It returns the job as recorded.
+func startImport(w http.ResponseWriter, r *http.Request) (*bulkimport.ImportJob, error) {
+	ctx := context.Background()
+	// Read the multipart body as a stream instead of buffering it with
+	// ParseMultipartForm, so large catalog files never sit in memory
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkUploadSize)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Please provide a file", http.StatusBadRequest)
-		return
+		log.Println("Failed to parse multipart form:", err)
+		return nil, apierror.Validation("Failed to parse multipart form")
 	}
-	defer file.Close()
 
-	// Validate file type
-	contentType := header.Header.Get("Content-Type")
-	fmt.Println("Content Type of the File", contentType)
-	if contentType != "text/csv" && contentType != "application/json" {
-		http.Error(w, "Unsupported file type. Only CSV or JSON files are allowed", http.StatusBadRequest)
-		return
+	xlsxOptions := bulkimport.XLSXOptions{Sheet: r.URL.Query().Get("sheet")}
+	if headerRow := r.URL.Query().Get("headerRow"); headerRow != "" {
+		xlsxOptions.HeaderRow, err = strconv.Atoi(headerRow)
+		if err != nil || xlsxOptions.HeaderRow < 1 {
+			return nil, apierror.InvalidField("headerRow", "headerRow must be a positive number")
+		}
 	}
-	var uploadedFileURL string
-	switch contentType {
-	case "text/csv":
-		uploadedFileURL, err = readCSVFile(file, w, header)
+
+	fromExport := false
+	if value := r.URL.Query().Get("fromExport"); value != "" {
+		fromExport, err = strconv.ParseBool(value)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to Process the csv file : %v", err), http.StatusInternalServerError)
-			return
+			return nil, apierror.InvalidField("fromExport", "fromExport must be true or false")
+		}
+	}
 
+	// Load the column mapping template, if the supplier file needs one
+	var template *bulkimport.MappingTemplate
+	templateID := r.URL.Query().Get("templateId")
+	if templateID != "" {
+		template, err = loadMappingTemplate(ctx, templateID)
+		if err == bulkimport.ErrTemplateNotFound {
+			return nil, apierror.InvalidField("templateId", "Mapping template not found")
 		}
-		if uploadedFileURL == "" {
-			// Handle the case where there's an error and the URL is empty for CSV
-			log.Println("CSV processing failed. URL is empty.")
-			http.Error(w, "Failed to process CSV file", http.StatusInternalServerError)
-			return
+		if err != nil {
+			return nil, apierror.Internal("Failed to load mapping template", err)
 		}
+	}
 
-	case "application/json":
-		uploadedFileURL, err = readJSONFile(file, w, header)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, fmt.Sprintf("Failed to Process the JSON file : %v", err), http.StatusInternalServerError)
-			return
+	// Validate if the request contains a file
+	file, err := filePart(reader, "file")
+	if err != nil {
+		log.Println("Failed to read file part:", err)
+		return nil, apierror.InvalidField("file", "Please provide a file")
+	}
+	defer file.Close()
 
+	// Validate file type from the content; the declared Content-Type is only
+	// logged because clients often get it wrong
+	content := bufio.NewReaderSize(file, bulkimport.SniffLength)
+	format, compressed, err := bulkimport.Sniff(content)
+	if err != nil {
+		return nil, apierror.InvalidField("file", err.Error())
+	}
+	log.Printf("Uploaded file has content type %s, detected format %s (gzip: %t)", file.Header.Get("Content-Type"), format, compressed)
+	var validateContent func(io.Reader) error
+	switch format {
+	case bulkimport.FormatCSV:
+		validateContent = func(file io.Reader) error { return readCSVFile(file, template) }
+	case bulkimport.FormatJSON:
+		validateContent = func(file io.Reader) error { return readJSONFile(file, template) }
+	case bulkimport.FormatNDJSON:
+		validateContent = func(file io.Reader) error { return readNDJSONFile(file, template) }
+	case bulkimport.FormatXLSX:
+		validateContent = func(file io.Reader) error { return readXLSXFile(file, xlsxOptions, template) }
+	case bulkimport.FormatZIP:
+		validateContent = func(file io.Reader) error { return readZIPFile(file, template) }
+	}
+	// The stored object keeps its compression; only validation decompresses
+	validate := func(file io.Reader) error {
+		decompressed, err := bulkimport.Decompress(file, compressed)
+		if err != nil {
+			return err
 		}
-		if uploadedFileURL == "" {
-			// Handle the case where there's an error and the URL is empty for JSON
-			log.Println("JSON processing failed. URL is empty.")
-			http.Error(w, "Failed to process JSON file", http.StatusInternalServerError)
-			return
+		return validateContent(decompressed)
+	}
+
+	uploadedFileURL, err := storeFile(ctx, content, file.FileName(), validate)
+	if err != nil {
+		var validationErr *fileValidationError
+		if errors.As(err, &validationErr) {
+			log.Printf("Rejected %s file: %v", format, err)
+			return nil, apierror.InvalidField("file", fmt.Sprintf("Failed to Process the file : %v", err))
 		}
+		return nil, apierror.Internal("Failed to store the file", err)
+	}
 
-	default:
-		http.Error(w, "Unsupported file type. Only CSV or JSON files are allowed", http.StatusBadRequest)
-		return
+	// Record the import before publishing it, so it can be followed and
+	// cancelled from the start
+	job := &bulkimport.ImportJob{FileURL: uploadedFileURL, Format: format, Collection: bulkDataCollection}
+	if err := createImportJob(ctx, job); err != nil {
+		return nil, apierror.Internal("Failed to create import job", err)
 	}
 
 	Bulk_File_Data := map[string]interface{}{
-		"fileURL": uploadedFileURL,
+		"fileURL":  uploadedFileURL,
+		"format":   format,
+		"importId": job.ID,
+	}
+	if compressed {
+		Bulk_File_Data["compressed"] = true
+	}
+	if templateID != "" {
+		Bulk_File_Data["templateId"] = templateID
+	}
+	if fromExport {
+		Bulk_File_Data["fromExport"] = true
+	}
+	if format == bulkimport.FormatXLSX {
+		Bulk_File_Data["sheet"] = xlsxOptions.Sheet
+		Bulk_File_Data["headerRow"] = xlsxOptions.HeaderRow
 	}
 
 	bulk_create_endpoint := "https://us-central1-capstore-takeoff.cloudfunctions.net/download-csv-bulk-upload"
 
 	err = common.PublishToPubSub("Bulk_Create_Topic", "Bulk_Create_Subscription", bulk_create_endpoint, Bulk_File_Data)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to publish audit record to Pub/Sub: %v", err), http.StatusInternalServerError)
 		//ErrorLog(err)
-
-		return
+		return nil, apierror.Internal("Failed to publish audit record to Pub/Sub", err)
 	}
 
 	log.Printf("Message: File URL sent successfully. URL: %s", uploadedFileURL)
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"message": "File URL sent successfully", "url": "%s"}`, uploadedFileURL)
+	return job, nil
 }
 
-func readCSVFile(file multipart.File, w http.ResponseWriter, header *multipart.FileHeader) (string, error) {
-	ctx := context.Background()
+// filePart advances the multipart reader to the file part with the given form
+// name. Other parts before it are skipped.
+func filePart(reader *multipart.Reader, formName string) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == formName && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// loadMappingTemplate reads a saved column mapping template.
+func loadMappingTemplate(ctx context.Context, templateID string) (*bulkimport.MappingTemplate, error) {
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %v", err)
+	}
+	defer client.Close()
 
-	fileContent, err := io.ReadAll(file)
+	return bulkimport.LoadTemplate(ctx, client, templateID)
+}
+
+func createImportJob(ctx context.Context, job *bulkimport.ImportJob) error {
+	client, err := utils.CreateFirestoreClient()
 	if err != nil {
-		log.Printf("Failed to read file content: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to read file content: %v", err), http.StatusInternalServerError)
-		return "", err
+		return fmt.Errorf("failed to create Firestore client: %v", err)
 	}
+	defer client.Close()
 
-	fileReader := strings.NewReader(string(fileContent))
+	return bulkimport.CreateJob(ctx, client, job)
+}
 
-	csvReader := csv.NewReader(fileReader)
+// readCSVFile checks the header row and then reads the remaining rows one at a
+// time, so a malformed file is rejected without loading it into memory. With a
+// mapping template the headers are matched through the template instead of
+// by their exact names.
+func readCSVFile(file io.Reader, template *bulkimport.MappingTemplate) error {
+	csvReader := csv.NewReader(file)
+	csvReader.ReuseRecord = true
 
 	headers, err := csvReader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("file is empty or could not be read")
+	}
 	if err != nil {
 		log.Printf("Failed to read CSV headers: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to read CSV headers: %v", err), http.StatusInternalServerError)
-		return "", err
+		return fmt.Errorf("failed to read CSV headers: %v", err)
+	}
+
+	if err := checkHeaders(headers, template); err != nil {
+		return err
+	}
+	// The header slice is reused by the next Read
+	return readCSVRows(csvReader, append([]string(nil), headers...), template)
+}
+
+// checkHeaders makes sure the header row provides every required field, either
+// directly or through the mapping template.
+func checkHeaders(headers []string, template *bulkimport.MappingTemplate) error {
+	if template != nil {
+		if missing := template.MissingFields(headers); len(missing) > 0 {
+			log.Printf("File does not provide required fields through template %s: %s", template.ID, strings.Join(missing, ","))
+			return fmt.Errorf("file does not provide required fields through template %s: %s", template.ID, strings.Join(missing, ","))
+		}
+		return nil
 	}
 
 	// Trim whitespaces from headers and check for spaces
@@ -139,13 +287,11 @@ func readCSVFile(file multipart.File, w http.ResponseWriter, header *multipart.F
 
 		if strings.TrimSpace(h) == "" {
 			log.Println("CSV file contains an empty header field")
-			//http.Error(w, "CSV file contains an empty header field", http.StatusBadRequest)
-			return "", fmt.Errorf("CSV file contains an empty header field")
+			return fmt.Errorf("CSV file contains an empty header field")
 		}
 		if strings.Contains(h, " ") {
 			log.Printf("CSV file contains a header field with a space: %s", h)
-			//http.Error(w, fmt.Sprintf("CSV file contains a header field with a space: %s", h), http.StatusBadRequest)
-			return "", fmt.Errorf("CSV file contains a header field with a space: %s", h)
+			return fmt.Errorf("CSV file contains a header field with a space: %s", h)
 		}
 	}
 
@@ -167,100 +313,295 @@ func readCSVFile(file multipart.File, w http.ResponseWriter, header *multipart.F
 
 	if len(missingHeaders) > 0 {
 		log.Printf("CSV is missing required headers: %s", strings.Join(missingHeaders, ","))
-		http.Error(w, fmt.Sprintf("CSV is missing required headers: %s", strings.Join(missingHeaders, ",")), http.StatusBadRequest)
-		return "", fmt.Errorf("CSV is missing required headers: %s", strings.Join(missingHeaders, ""))
+		return fmt.Errorf("CSV is missing required headers: %s", strings.Join(missingHeaders, ","))
 	}
+	return nil
+}
 
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		log.Printf("Failed to reset file reader position: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to reset file reader position: %v", err), http.StatusInternalServerError)
-		return "", err
+// readCSVRows reads the rows after the header. The csv reader rejects rows
+// whose field count differs from the header; with a template every row is
+// also run through its transforms.
+func readCSVRows(csvReader *csv.Reader, headers []string, template *bulkimport.MappingTemplate) error {
+	for row := 2; ; row++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("malformed CSV at row %d: %v", row, err)
+		}
+		if err := validateRecord(headers, record, template); err != nil {
+			return fmt.Errorf("row %d: %v", row, err)
+		}
 	}
 
-	fileURL, err := storeFile(ctx, file, header)
+	return nil
+}
+
+// validateRecord runs a row through the mapping template's transforms. Rows of
+// files without a template have nothing to check beyond their shape.
+func validateRecord(headers []string, record []string, template *bulkimport.MappingTemplate) error {
+	if template == nil {
+		return nil
+	}
+	values := make(map[string]interface{}, len(headers))
+	for i, header := range headers {
+		values[header] = record[i]
+	}
+	_, err := template.Apply(values)
+	return err
+}
+
+// readXLSXFile spools the workbook to a temporary file, since XLSX cannot be
+// read as a stream, and then checks the selected sheet the same way as a CSV.
+func readXLSXFile(file io.Reader, options bulkimport.XLSXOptions, template *bulkimport.MappingTemplate) error {
+	path, err := bulkimport.SpoolToTempFile(file, "bulk-*.xlsx")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	sheet, err := bulkimport.OpenXLSX(path, options, template)
 	if err != nil {
-		// Handle the error from storeFile function
-		log.Printf("Failed to store the file: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to store the file: %v", err), http.StatusInternalServerError)
-		return "", err
+		return err
 	}
+	defer sheet.Close()
 
-	return fileURL, nil
+	if err := checkHeaders(sheet.Headers(), template); err != nil {
+		return err
+	}
+	for {
+		record, row, err := sheet.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("malformed XLSX at row %d: %v", row, err)
+		}
+		if err := validateRecord(sheet.Headers(), record, template); err != nil {
+			return fmt.Errorf("row %d: %v", row, err)
+		}
+	}
 }
-func readJSONFile(file multipart.File, w http.ResponseWriter, header *multipart.FileHeader) (string, error) {
-	ctx := context.Background()
-	var groceryItems []map[string]interface{}
 
-	// Decode the JSON data from the file
-	err := json.NewDecoder(file).Decode(&groceryItems)
+// readZIPFile checks an archive of products and images: every manifest row
+// must provide the required fields and name a JPG or PNG image that is in the
+// archive. Problems are reported for all rows, up to maxReportedLineErrors.
+func readZIPFile(file io.Reader, template *bulkimport.MappingTemplate) error {
+	path, err := bulkimport.SpoolToTempFile(file, "bulk-*.zip")
 	if err != nil {
-		return " ", fmt.Errorf("failed to decode JSON: %v", err)
+		return err
 	}
+	defer os.Remove(path)
 
-	requiredFields := []string{"productname", "price", "category", "weight", "brand", "itempackagequantity", "packageinformation", "manufacturer", "countryoforigin"}
-
-	// Check if all required fields are present in each grocery item
-	for _, item := range groceryItems {
+	archive, err := bulkimport.OpenImageArchive(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	requiredFields := strings.Split(requiredHeaders, ",")
+	var rowErrors []string
+	items := 0
+	errTooManyErrors := errors.New("too many errors")
+	err = archive.ReadManifest(func(row bulkimport.ManifestRow) error {
+		if len(rowErrors) >= maxReportedLineErrors {
+			return errTooManyErrors
+		}
+		items++
+		item := row.Item
+		if row.Err == nil && template != nil {
+			item, row.Err = template.Apply(item)
+		}
+		if row.Err != nil {
+			rowErrors = append(rowErrors, fmt.Sprintf("row %d: %v", row.Number, row.Err))
+			return nil
+		}
 		for _, field := range requiredFields {
 			if _, ok := item[field]; !ok {
-				return " ", fmt.Errorf("missing required field '%s' in one or more grocery items", field)
+				rowErrors = append(rowErrors, fmt.Sprintf("row %d: missing required field '%s'", row.Number, field))
+				return nil
 			}
 		}
+		if row.Image == "" {
+			rowErrors = append(rowErrors, fmt.Sprintf("row %d: no image file given", row.Number))
+			return nil
+		}
+		if _, _, err := archive.Image(row.Image); err != nil {
+			rowErrors = append(rowErrors, fmt.Sprintf("row %d: %v", row.Number, err))
+		}
+		return nil
+	})
+	if err != nil && err != errTooManyErrors {
+		return err
+	}
+
+	if len(rowErrors) > 0 {
+		return fmt.Errorf("invalid manifest rows: %s", strings.Join(rowErrors, "; "))
 	}
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		log.Printf("Failed to reset file reader position: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to reset file reader position: %v", err), http.StatusInternalServerError)
-		return " ", err
+	if items == 0 {
+		return fmt.Errorf("manifest is empty")
 	}
+	log.Printf("ZIP file has %d products and %d images", items, archive.ImageCount())
+	return nil
+}
 
-	fileURL, err := storeFile(ctx, file, header)
-	if err != nil {
-		return "", fmt.Errorf("failed to store file: %v", err)
+// readNDJSONFile checks every line of a newline-delimited JSON file. All bad
+// lines are reported, up to maxReportedLineErrors, rather than only the first.
+func readNDJSONFile(file io.Reader, template *bulkimport.MappingTemplate) error {
+	reader := bulkimport.NewNDJSONReader(file)
+	requiredFields := strings.Split(requiredHeaders, ",")
+
+	var lineErrors []string
+	items := 0
+	for len(lineErrors) < maxReportedLineErrors {
+		item, line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *bulkimport.LineError
+		if errors.As(err, &lineErr) {
+			lineErrors = append(lineErrors, lineErr.Error())
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read NDJSON: %v", err)
+		}
+		items++
+
+		if template != nil {
+			if item, err = template.Apply(item); err != nil {
+				lineErrors = append(lineErrors, fmt.Sprintf("line %d: %v", line, err))
+				continue
+			}
+		}
+		for _, field := range requiredFields {
+			if _, ok := item[field]; !ok {
+				lineErrors = append(lineErrors, fmt.Sprintf("line %d: missing required field '%s'", line, field))
+				break
+			}
+		}
 	}
 
-	return fileURL, nil
+	if len(lineErrors) > 0 {
+		return fmt.Errorf("invalid NDJSON lines: %s", strings.Join(lineErrors, "; "))
+	}
+	if items == 0 {
+		return fmt.Errorf("file is empty or could not be read")
+	}
+	return nil
 }
 
-func storeFile(ctx context.Context, file multipart.File, header *multipart.FileHeader) (string, error) {
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		return "", fmt.Errorf("failed to read file content: %v", err)
+// readJSONFile walks the top-level array token by token and decodes one grocery
+// item at a time, checking that each has the required fields once the mapping
+// template, if any, has been applied.
+func readJSONFile(file io.Reader, template *bulkimport.MappingTemplate) error {
+	decoder := json.NewDecoder(file)
+	if err := expectDelim(decoder, '['); err != nil {
+		return fmt.Errorf("failed to decode JSON: %v", err)
 	}
 
-	if len(fileContent) == 0 {
-		return "", fmt.Errorf("file is empty or could not be read")
+	requiredFields := strings.Split(requiredHeaders, ",")
+
+	// Check if all required fields are present in each grocery item
+	for index := 0; decoder.More(); index++ {
+		var item map[string]interface{}
+		if err := decoder.Decode(&item); err != nil {
+			return fmt.Errorf("failed to decode JSON item %d: %v", index, err)
+		}
+		if template != nil {
+			mapped, err := template.Apply(item)
+			if err != nil {
+				return fmt.Errorf("grocery item %d: %v", index, err)
+			}
+			item = mapped
+		}
+		for _, field := range requiredFields {
+			if _, ok := item[field]; !ok {
+				return fmt.Errorf("missing required field '%s' in grocery item %d", field, index)
+			}
+		}
 	}
 
-	fileReader := strings.NewReader(string(fileContent))
+	if err := expectDelim(decoder, ']'); err != nil {
+		return fmt.Errorf("failed to decode JSON: %v", err)
+	}
+	return nil
+}
 
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return fmt.Errorf("file is empty or could not be read")
+	}
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected '%v' but found '%v'", delim, token)
+	}
+	return nil
+}
+
+// storeFile streams the file into the bulk data bucket. Every byte read by
+// validate is teed into the storage object, so the file is checked and uploaded
+// in a single pass; if validation fails the upload is aborted. The object stays
+// private and is returned as a gs:// URL, which the import reads with its
+// service account. Its name is unique, since the URL identifies the import job.
+func storeFile(ctx context.Context, file io.Reader, fileName string, validate func(io.Reader) error) (string, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to create client: %v", err)
 	}
 	defer client.Close()
 
-	fileName := header.Filename
-	uniqueFilename := fmt.Sprintf("%s_%s", time.Now().Format("20060102"), fileName)
+	uniqueFilename := fmt.Sprintf("%s_%s_%s", time.Now().Format("20060102"), uuid.NewString(), fileName)
 	object := client.Bucket(bucketName).Object(uniqueFilename)
-	wc := object.NewWriter(ctx)
 
-	if _, err := io.Copy(wc, fileReader); err != nil {
-		wc.Close()
-		return "", fmt.Errorf("failed to copy file content to Cloud Storage: %v", err)
+	// Cancelling the writer's context discards a partially written object
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := &storageWriter{w: object.NewWriter(writeCtx)}
+
+	if err := validate(io.TeeReader(file, wc)); err != nil {
+		cancel()
+		wc.w.Close()
+		if wc.err != nil {
+			return "", fmt.Errorf("failed to copy file content to Cloud Storage: %v", wc.err)
+		}
+		return "", &fileValidationError{err: err}
 	}
 
-	if err := wc.Close(); err != nil {
-		return "", fmt.Errorf("failed to close Cloud Storage writer: %v", err)
+	// Copy whatever the validator did not need to read
+	if _, err := io.Copy(wc, file); err != nil {
+		cancel()
+		wc.w.Close()
+		return "", fmt.Errorf("failed to copy file content to Cloud Storage: %v", err)
 	}
 
-	if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-		return "", fmt.Errorf("failed to set ACL for Cloud Storage object: %v", err)
+	if err := wc.w.Close(); err != nil {
+		return "", fmt.Errorf("failed to close Cloud Storage writer: %v", err)
 	}
 
-	uploadedFileURL := fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucketName, uniqueFilename)
+	uploadedFileURL := fmt.Sprintf("gs://%s/%s", bucketName, uniqueFilename)
 	return uploadedFileURL, nil
 }
 
+// storageWriter remembers the first write error so that a failed upload is not
+// reported as a problem with the file content.
+type storageWriter struct {
+	w   *storage.Writer
+	err error
+}
+
+func (s *storageWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
 // func triggerTheEvent(uploadedFileURL string, docId int, ctx context.Context, w http.ResponseWriter) {
 // 	c, err := cloudevents.NewClientHTTP()
 // 	if err != nil {
@@ -0,0 +1,480 @@
+package cloudfunctions
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/takeoff-capstone/utils"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Change sheets are small edits, so they are handled in the request like
+	// UpdateGrocery instead of going through the bulk import topic
+	maxChangeSheetSize = 10 << 20
+	maxChangeSheetRows = 5000
+	// Firestore commits a transaction in one request; keep it within the
+	// classic write limit
+	maxAllOrNothingRows = 500
+)
+
+// Row statuses reported by BulkUpdateGroceryItems.
+const (
+	ChangeUpdated   = "updated"
+	ChangeUnchanged = "unchanged"
+	ChangeFailed    = "failed"
+	// ChangeSkipped marks a valid row that was not applied because another
+	// row failed in all-or-nothing mode
+	ChangeSkipped = "skipped"
+)
+
+// ChangeSheetRowResult is the outcome of one change sheet row.
+type ChangeSheetRowResult struct {
+	Row         int    `json:"row"`
+	ID          string `json:"id,omitempty"`
+	ProductName string `json:"productname,omitempty"`
+	Status      string `json:"status"`
+	// Code and Error say why the row failed
+	Code  apierror.Code `json:"code,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// ChangeSheetResult is the response of BulkUpdateGroceryItems.
+type ChangeSheetResult struct {
+	AllOrNothing bool                   `json:"allOrNothing"`
+	Updated      int                    `json:"updated"`
+	Unchanged    int                    `json:"unchanged"`
+	Failed       int                    `json:"failed"`
+	Results      []ChangeSheetRowResult `json:"results"`
+}
+
+// changeRow is a change sheet row that resolved to a document and whose
+// changes passed validation.
+type changeRow struct {
+	result  *ChangeSheetRowResult
+	docRef  *firestore.DocumentRef
+	changes map[string]interface{}
+}
+
+// @Summary Bulk update grocery items from a change sheet
+// @Description Applies a CSV whose first column is `id` or `productname` and whose other columns are the grocery fields to change. Empty cells leave a field unchanged. Every row is merged, validated and audited like UpdateGrocery, and a product name already used by another item, or by an earlier row, fails the row. With allOrNothing=true the sheet is applied in a single transaction, and nothing is changed if any row fails.
+// @ID bulk-update-grocery-items
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "CSV change sheet, optionally gzip compressed"
+// @Param allOrNothing query bool false "Reject the whole sheet if any row fails"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} cloudfunctions.ChangeSheetResult "OK"
+// @Failure 400 {object} cloudfunctions.ChangeSheetResult "Bad Request: Invalid change sheet, or a row failed in all-or-nothing mode"
+// @Failure 409 {object} cloudfunctions.ChangeSheetResult "Conflict: An item was changed or deleted by another request during an atomic write"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/BulkUpdate [post]
+// @Router /api/v1/groceries/bulk-update [post]
+func BulkUpdateGroceryItems(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	allOrNothing := false
+	if value := r.URL.Query().Get("allOrNothing"); value != "" {
+		var err error
+		if allOrNothing, err = strconv.ParseBool(value); err != nil {
+			apierror.Write(w, r, apierror.InvalidField("allOrNothing", "allOrNothing must be true or false"))
+			return
+		}
+	}
+
+	if err := r.ParseMultipartForm(maxChangeSheetSize); err != nil {
+		log.Println("Failed to parse multipart form:", err)
+		apierror.Write(w, r, apierror.Validation("Failed to parse multipart form"))
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("file", "Please provide a file"))
+		return
+	}
+	defer file.Close()
+
+	keyColumn, headers, records, err := readChangeSheet(file)
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("file", err.Error()))
+		return
+	}
+	if allOrNothing && len(records) > maxAllOrNothingRows {
+		apierror.Write(w, r, apierror.Validation(fmt.Sprintf("All-or-nothing change sheets are limited to %d rows", maxAllOrNothingRows)))
+		return
+	}
+	log.Printf("Change sheet with %d rows keyed by %s (all-or-nothing: %t)", len(records), keyColumn, allOrNothing)
+
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	result := ChangeSheetResult{AllOrNothing: allOrNothing, Results: make([]ChangeSheetRowResult, len(records))}
+	rows, err := prepareChanges(ctx, client, keyColumn, headers, records, result.Results)
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to read grocery items", err))
+		return
+	}
+
+	statusCode := http.StatusOK
+	if allOrNothing {
+		if result.countFailed() > 0 {
+			for _, row := range rows {
+				row.result.Status = ChangeSkipped
+			}
+			statusCode = http.StatusBadRequest
+		} else if err := applyChangesAtomically(ctx, client, rows); err != nil {
+			log.Println("Failed to apply change sheet:", err)
+			for _, row := range rows {
+				row.result.fail(err)
+			}
+			statusCode = apierror.From(err).Code.Status()
+		} else {
+			for _, row := range rows {
+				auditChange(row)
+			}
+		}
+	} else {
+		for _, row := range rows {
+			applyChange(ctx, client, row)
+		}
+	}
+
+	for _, row := range result.Results {
+		switch row.Status {
+		case ChangeUpdated:
+			result.Updated++
+		case ChangeUnchanged:
+			result.Unchanged++
+		case ChangeFailed:
+			result.Failed++
+		}
+	}
+	log.Printf("Change sheet done: %d updated, %d unchanged, %d failed", result.Updated, result.Unchanged, result.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(result)
+}
+
+// readChangeSheet reads the CSV and checks its header row. The key column is
+// `id` when present, otherwise `productname`; all other columns must be
+// grocery fields so that a misspelt column is not written as a new field.
+func readChangeSheet(file io.Reader) (string, []string, [][]string, error) {
+	content := bufio.NewReaderSize(file, bulkimport.SniffLength)
+	format, compressed, err := bulkimport.Sniff(content)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if format != bulkimport.FormatCSV {
+		return "", nil, nil, fmt.Errorf("Change sheets must be CSV files")
+	}
+	decompressed, err := bulkimport.Decompress(content, compressed)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	reader := csv.NewReader(decompressed)
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return "", nil, nil, fmt.Errorf("file is empty or could not be read")
+	}
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to read CSV headers: %v", err)
+	}
+
+	keyColumn := ""
+	seen := make(map[string]bool)
+	var unknown []string
+	for i, header := range headers {
+		header = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header, "\ufeff")))
+		headers[i] = header
+		if seen[header] {
+			return "", nil, nil, fmt.Errorf("column '%s' appears more than once", header)
+		}
+		seen[header] = true
+		if header == "id" {
+			keyColumn = header
+		} else if !isGroceryField(header) {
+			unknown = append(unknown, header)
+		}
+	}
+	if keyColumn == "" && seen["productname"] {
+		keyColumn = "productname"
+	}
+	if keyColumn == "" {
+		return "", nil, nil, fmt.Errorf("change sheet needs an 'id' or 'productname' column")
+	}
+	if len(unknown) > 0 {
+		return "", nil, nil, fmt.Errorf("unknown columns: %s", strings.Join(unknown, ","))
+	}
+	if len(headers) < 2 {
+		return "", nil, nil, fmt.Errorf("change sheet has no columns to change")
+	}
+
+	var records [][]string
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("malformed CSV at row %d: %v", row, err)
+		}
+		if len(records) == maxChangeSheetRows {
+			return "", nil, nil, fmt.Errorf("change sheets are limited to %d rows", maxChangeSheetRows)
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return "", nil, nil, fmt.Errorf("change sheet has no rows")
+	}
+	return keyColumn, headers, records, nil
+}
+
+func isGroceryField(field string) bool {
+	for _, f := range bulkimport.GroceryFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareChanges resolves every row to its document and validates the merged
+// result without writing anything. Rows that cannot be applied are marked as
+// failed in results; the others are returned. An error is only returned when
+// Firestore itself fails.
+func prepareChanges(ctx context.Context, client *firestore.Client, keyColumn string, headers []string, records [][]string, results []ChangeSheetRowResult) ([]changeRow, error) {
+	var rows []changeRow
+	changedBy := make(map[string]int)
+	// namedBy is the row that renames an item to each product name
+	namedBy := make(map[string]int)
+	for i, record := range records {
+		result := &results[i]
+		result.Row = i + 2
+
+		changes := make(map[string]interface{})
+		key := ""
+		for j, header := range headers {
+			value := strings.TrimSpace(record[j])
+			if header == keyColumn {
+				key = value
+			} else if value != "" {
+				changes[header] = value
+			}
+		}
+		if keyColumn == "productname" {
+			result.ProductName = key
+		} else {
+			result.ID = key
+		}
+		if key == "" {
+			result.fail(apierror.InvalidField(keyColumn, fmt.Sprintf("%s is empty", keyColumn)))
+			continue
+		}
+
+		docRef, existingData, err := findChangeTarget(ctx, client, keyColumn, key)
+		if err != nil {
+			var targetErr *apierror.Error
+			if !errors.As(err, &targetErr) {
+				return nil, err
+			}
+			result.fail(err)
+			continue
+		}
+		result.ID = docRef.ID
+		result.ProductName, _ = existingData["productname"].(string)
+
+		if previous, ok := changedBy[docRef.ID]; ok {
+			result.fail(apierror.Conflict(fmt.Sprintf("grocery item %s is already changed by row %d", docRef.ID, previous)))
+			continue
+		}
+		changedBy[docRef.ID] = result.Row
+
+		if len(changes) == 0 {
+			result.Status = ChangeUnchanged
+			continue
+		}
+		// Validate against a copy; the document is merged again when written
+		if err := mergeGroceryUpdate(existingData, changes); err != nil {
+			result.fail(err)
+			continue
+		}
+		if newName, ok := changes["productname"].(string); ok && newName != result.ProductName {
+			if previous, ok := namedBy[newName]; ok {
+				result.fail(apierror.Conflict(fmt.Sprintf("row %d already renames an item to '%s'", previous, newName)))
+				continue
+			}
+			if taken, err := productNameTaken(ctx, client, newName, docRef.ID); err != nil {
+				return nil, err
+			} else if taken {
+				result.fail(apierror.DuplicateProduct(newName))
+				continue
+			}
+			namedBy[newName] = result.Row
+		}
+		rows = append(rows, changeRow{result: result, docRef: docRef, changes: changes})
+	}
+	return rows, nil
+}
+
+// findChangeTarget looks up the grocery item a row refers to, by document ID
+// or by product name. A key that does not identify exactly one grocery item
+// gives an *apierror.Error.
+func findChangeTarget(ctx context.Context, client *firestore.Client, keyColumn string, key string) (*firestore.DocumentRef, map[string]interface{}, error) {
+	if keyColumn == "id" {
+		docRef := client.Collection("Groceries").Doc(key)
+		docSnapshot, err := docRef.Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			return nil, nil, apierror.NotFound(fmt.Sprintf("grocery item %s not found", key))
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting document %s: %v", key, err)
+		}
+		return docRef, docSnapshot.Data(), nil
+	}
+
+	iter := client.Collection("Groceries").Where("productname", "==", key).Limit(2).Documents(ctx)
+	defer iter.Stop()
+	var matches []*firestore.DocumentSnapshot
+	for {
+		docSnapshot, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error iterating over query results: %v", err)
+		}
+		matches = append(matches, docSnapshot)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, nil, apierror.NotFound(fmt.Sprintf("no grocery item named '%s'", key))
+	case 1:
+		return matches[0].Ref, matches[0].Data(), nil
+	default:
+		return nil, nil, apierror.Conflict(fmt.Sprintf("more than one grocery item is named '%s'; use the id column", key))
+	}
+}
+
+// applyChange merges one row into the current document, writes it and
+// publishes the audit record, as UpdateGrocery does for a single item.
+func applyChange(ctx context.Context, client *firestore.Client, row changeRow) {
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		return mergeInTransaction(tx, row)
+	})
+	if err != nil {
+		log.Printf("Failed to update row %d: %v", row.result.Row, err)
+		row.result.fail(err)
+		return
+	}
+	row.result.Status = ChangeUpdated
+	auditChange(row)
+}
+
+// applyChangesAtomically writes every row in a single transaction, so either
+// all rows are applied or none are.
+func applyChangesAtomically(ctx context.Context, client *firestore.Client, rows []changeRow) error {
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Firestore needs all reads of a transaction before its writes
+		refs := make([]*firestore.DocumentRef, len(rows))
+		for i, row := range rows {
+			refs[i] = row.docRef
+		}
+		docSnapshots, err := tx.GetAll(refs)
+		if err != nil {
+			return err
+		}
+		for i, row := range rows {
+			if !docSnapshots[i].Exists() {
+				return apierror.Conflict(fmt.Sprintf("row %d: grocery item %s was deleted meanwhile", row.result.Row, row.docRef.ID))
+			}
+			existingData := docSnapshots[i].Data()
+			if err := mergeGroceryUpdate(existingData, row.changes); err != nil {
+				return fmt.Errorf("row %d: %w", row.result.Row, err)
+			}
+			if err := tx.Set(row.docRef, existingData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		row.result.Status = ChangeUpdated
+	}
+	return nil
+}
+
+// mergeInTransaction re-reads the document so the merge is based on its
+// current data rather than what was read while validating.
+func mergeInTransaction(tx *firestore.Transaction, row changeRow) error {
+	docSnapshot, err := tx.Get(row.docRef)
+	if err != nil {
+		return err
+	}
+	existingData := docSnapshot.Data()
+	if err := mergeGroceryUpdate(existingData, row.changes); err != nil {
+		return err
+	}
+	return tx.Set(row.docRef, existingData)
+}
+
+// auditChange publishes the audit record of an updated row. The change is
+// already written, so a failure is only logged.
+func auditChange(row changeRow) {
+	if err := publishUpdateAudit(row.result.ID, row.result.ProductName); err != nil {
+		log.Printf("Failed to publish audit record for %s: %v", row.result.ID, err)
+	}
+}
+
+// fail marks a row as failed with the code and message a client may see;
+// the raw error of an internal failure is logged instead.
+func (r *ChangeSheetRowResult) fail(err error) {
+	apiErr := apierror.From(err)
+	if apiErr.Code == apierror.CodeInternal {
+		log.Printf("Row %d failed: %v", r.Row, err)
+	}
+	r.Status = ChangeFailed
+	r.Code = apiErr.Code
+	r.Error = apiErr.Message
+}
+
+func (r ChangeSheetResult) countFailed() int {
+	failed := 0
+	for _, row := range r.Results {
+		if row.Status == ChangeFailed {
+			failed++
+		}
+	}
+	return failed
+}
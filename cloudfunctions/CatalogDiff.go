@@ -0,0 +1,263 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/catalog"
+	"github.com/takeoff-capstone/snapshot"
+	"github.com/takeoff-capstone/utils"
+)
+
+const (
+	// Upper bound for the files of a diff of uploaded dumps. Both files are
+	// needed at once, so they are parsed up front rather than streamed.
+	maxDiffUploadSize = 256 << 20
+	// Part of the uploaded files held in memory; the rest spills to disk
+	diffUploadMemory = 32 << 20
+)
+
+// errDiffSourceNotFound is wrapped by the errors of sources that do not exist.
+var errDiffSourceNotFound = errors.New("diff source not found")
+
+// diffSourceError means a diff source could not be found or is not usable.
+type diffSourceError struct {
+	message string
+	err     error
+}
+
+func (e *diffSourceError) Error() string {
+	return e.message
+}
+
+func (e *diffSourceError) Unwrap() error {
+	return e.err
+}
+
+// sourceNotFound returns the error of a source that does not exist.
+func sourceNotFound(message string) error {
+	return &diffSourceError{message: message, err: errDiffSourceNotFound}
+}
+
+// @Summary Diff two catalog dumps
+// @Description Compares the Groceries collection between two snapshots, two export files, or either of them and the live collection. A source is "live", "snapshot:<name>", "snapshot:<YYYY-MM-DD>" for the last snapshot taken on or before that day, "export:<exportId>" for the file of an export job, or "upload" for a file posted as multipart form data in the fromFile or toFile part. An uploaded file is a snapshot file or an export file in any export format, such as one downloaded from a synchronous export; uploads are limited to 256 MB in total. The JSON report has a summary with price changes in percent and every added, removed and changed item; format=csv downloads the detail report.
+// @ID catalog-diff
+// @Accept multipart/form-data
+// @Produce json,text/csv
+// @Param from query string true "Older side of the diff"
+// @Param to query string false "Newer side of the diff; defaults to live"
+// @Param fromFile formData file false "Older dump when from is upload"
+// @Param toFile formData file false "Newer dump when to is upload"
+// @Param fields query string false "Comma-separated fields to compare; defaults to the grocery fields"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {object} catalog.DiffReport "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid source"
+// @Failure 404 {object} apierror.Envelope "Not Found: Source not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/catalogDiff [get]
+// @Router /api/catalogDiff [post]
+// @Router /api/v1/catalog-diff [get]
+// @Router /api/v1/catalog-diff [post]
+func CatalogDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = "live"
+	}
+	if from == "" {
+		apierror.Write(w, r, apierror.InvalidField("from", "from is required"))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		apierror.Write(w, r, apierror.InvalidField("format", "Invalid format. Use json or csv."))
+		return
+	}
+	options := catalog.DiffOptions{From: from, To: to}
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				options.Fields = append(options.Fields, field)
+			}
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxDiffUploadSize)
+		if err := r.ParseMultipartForm(diffUploadMemory); err != nil {
+			log.Printf("Failed to parse multipart form: %v", err)
+			apierror.Write(w, r, apierror.Validation("Failed to parse multipart form"))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+	storageClient, err := utils.CreateStorageClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Cloud Storage client", err))
+		return
+	}
+	defer storageClient.Close()
+
+	var sources []catalog.ItemSource
+	defer func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}()
+	for i, name := range []string{from, to} {
+		source, err := openDiffSource(ctx, client, storageClient, r, []string{"fromFile", "toFile"}[i], name)
+		if err != nil {
+			var sourceErr *diffSourceError
+			if errors.Is(err, errDiffSourceNotFound) {
+				apierror.Write(w, r, apierror.NotFound(err.Error()))
+				return
+			}
+			if errors.As(err, &sourceErr) {
+				apierror.Write(w, r, apierror.Validation(sourceErr.message))
+				return
+			}
+			apierror.Write(w, r, apierror.Internal("Failed to open "+name, err))
+			return
+		}
+		sources = append(sources, source)
+	}
+
+	report, err := catalog.Diff(sources[0], sources[1], options)
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to compare catalogs", fmt.Errorf("diff %s and %s: %w", from, to, err)))
+		return
+	}
+	summary := report.Summary
+	log.Printf("Catalog diff %s..%s: %d added, %d removed, %d changed", from, to, summary.Added, summary.Removed, summary.Changed)
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", catalog.DiffReportName(time.Now())))
+		if err := catalog.WriteDiffCSV(w, report); err != nil {
+			log.Printf("Failed to write diff report: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// openDiffSource opens one side of a diff by its name. An uploaded side is read
+// from the form file part.
+func openDiffSource(ctx context.Context, client *firestore.Client, storageClient *storage.Client, r *http.Request, part string, name string) (catalog.ItemSource, error) {
+	kind, value, _ := strings.Cut(name, ":")
+	switch {
+	case name == "live":
+		return catalog.LiveItems(ctx, client), nil
+	case name == "upload":
+		if r.MultipartForm == nil || len(r.MultipartForm.File[part]) == 0 {
+			return nil, &diffSourceError{message: "an upload source needs a file in the " + part + " part of a multipart POST"}
+		}
+		file, err := r.MultipartForm.File[part][0].Open()
+		if err != nil {
+			return nil, err
+		}
+		source, err := catalog.DumpItems(file)
+		if err != nil {
+			file.Close()
+			return nil, &diffSourceError{message: fmt.Sprintf("%s cannot be read: %v", part, err)}
+		}
+		return &closingSource{ItemSource: source, close: file.Close}, nil
+	case kind == "snapshot" && value != "":
+		snapshotName, err := resolveSnapshot(ctx, storageClient, value)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := snapshot.Open(ctx, storageClient, snapshotName)
+		if err == snapshot.ErrSnapshotNotFound {
+			return nil, sourceNotFound("snapshot " + value + " not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return catalog.SnapshotItems(reader), nil
+	case kind == "export" && value != "":
+		job, err := catalog.LoadExportJob(ctx, client, value)
+		if err == catalog.ErrExportNotFound {
+			return nil, sourceNotFound("export " + value + " not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if job.Status != catalog.ExportCompleted {
+			return nil, &diffSourceError{message: fmt.Sprintf("export %s is %s", value, job.Status)}
+		}
+		body, err := storageClient.Bucket(catalog.ExportBucket).Object(job.Object).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil, sourceNotFound("file of export " + value + " not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		source, err := catalog.ExportItems(body)
+		if err != nil {
+			body.Close()
+			return nil, &diffSourceError{message: fmt.Sprintf("export %s cannot be read: %v", value, err)}
+		}
+		return &closingSource{ItemSource: source, close: body.Close}, nil
+	}
+	return nil, &diffSourceError{message: fmt.Sprintf("invalid source %q; use live, snapshot:<name or date>, export:<id> or upload", name)}
+}
+
+// resolveSnapshot turns a date into the name of the last snapshot taken on or
+// before that day. Other values are taken as a snapshot name.
+func resolveSnapshot(ctx context.Context, storageClient *storage.Client, value string) (string, error) {
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return value, nil
+	}
+	snapshots, err := snapshot.List(ctx, storageClient)
+	if err != nil {
+		return "", err
+	}
+	end := day.AddDate(0, 0, 1)
+	for _, info := range snapshots {
+		if info.ReadTime.Before(end) {
+			return info.Name, nil
+		}
+	}
+	return "", sourceNotFound("no snapshot found on or before " + value)
+}
+
+// closingSource also closes the file an item source reads from.
+type closingSource struct {
+	catalog.ItemSource
+	close func() error
+}
+
+func (c *closingSource) Close() error {
+	c.ItemSource.Close()
+	return c.close()
+}
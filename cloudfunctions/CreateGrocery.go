@@ -16,14 +16,17 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/takeoff-capstone/apierror"
 	"github.com/takeoff-capstone/common"
+	"github.com/takeoff-capstone/idempotency"
 	"github.com/takeoff-capstone/utils"
 	"github.com/takeoff-capstone/validations"
 	"google.golang.org/api/iterator"
 )
 
 func init() {
-	functions.HTTP("CreateGrocery", CreateGrocery)
+	// Deployed on its own, without the router and its middleware
+	functions.HTTP("CreateGrocery", idempotency.Handler("CreateGrocery", CreateGrocery))
 }
 
 // @Summary Create a new grocery item
@@ -33,25 +36,39 @@ func init() {
 // @Produce json
 // @Param json-data formData string true "JSON data for the grocery item"
 // @Param image formData file true "Image file for the grocery item"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
 // @Success 201 {object} string "File uploaded successfully"
-// @Failure 400 {object} string "Bad Request: Invalid JSON payload or missing required fields"
-// @Failure 500 {object} string "Internal Server Error"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid JSON payload or missing required fields"
+// @Failure 409 {object} apierror.Envelope "Conflict: DUPLICATE_PRODUCT, another item has the product name"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
 // @Router /CreateGrocery [post]
 func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	// Set CORS headers for the main request..
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	item, err := createGrocery(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"message": "File uploaded successfully", "url": "%s", "id": "%d"}`, item["image"], item["id"])
+}
+
+// createGrocery creates a grocery item from the json-data form field and
+// image of r, and returns the item as written.
+func createGrocery(r *http.Request) (map[string]interface{}, error) {
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		log.Println("Failed to parse multipart form:", err)
-		common.RespondWithError(w, http.StatusBadRequest, "Failed to parse multipart form")
-		return
+		return nil, apierror.Validation("Failed to parse multipart form")
 	}
 	ctx := context.Background()
 	//loggingClient, err := logging.NewClient(ctx, common.ProjectID)
@@ -66,16 +83,18 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	jsonData := r.FormValue("json-data")
 	if jsonData == "" {
 		log.Print("JSON data is required to create grocery item.")
-		common.RespondWithError(w, http.StatusBadRequest, "No 'json-data' field provided in the form")
+		return nil, apierror.InvalidField("json-data", "No 'json-data' field provided in the form")
 	}
 	formData := make(map[string]interface{})
 	if err := json.Unmarshal([]byte(jsonData), &formData); err != nil {
 		log.Println("Failed to unmarshal JSON:", err)
-		common.RespondWithError(w, http.StatusBadRequest, "Invalid JSON payload")
-		return
+		return nil, apierror.Validation("Invalid JSON payload")
 	}
 	documentID := generateUniqueID()
 	formData["id"] = documentID
+	now := time.Now()
+	formData["createdAt"] = now
+	formData["updatedAt"] = now
 
 	requiredKeys := map[string]bool{
 		"productname":         true,
@@ -99,36 +118,33 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	if len(missingFields) > 0 {
 		// Respond with a message listing all missing fields
 		missingFieldsMessage := fmt.Sprintf("Fields ['%s'] are required", strings.Join(missingFields, "', '"))
-		http.Error(w, missingFieldsMessage, http.StatusBadRequest)
-		return
+		details := make([]apierror.FieldError, len(missingFields))
+		for i, field := range missingFields {
+			details[i] = apierror.FieldError{Field: field, Message: "Field is required"}
+		}
+		return nil, apierror.Validation(missingFieldsMessage, details...)
 	}
 	var productName string
 	productNameRaw, ok := formData["productname"]
 	if !ok {
-		http.Error(w, "Product name field is missing", http.StatusBadRequest)
-		return
+		return nil, apierror.InvalidField("productname", "Product name field is missing")
 	}
 
 	productName, ok = productNameRaw.(string)
 	if !ok {
-		http.Error(w, "Invalid type for product name", http.StatusBadRequest)
-		return
+		return nil, apierror.InvalidField("productname", "Invalid type for product name")
 	}
 
 	// Check if the product name already exists in the database
 	if exists, err := checkDuplicateProduct(ctx, productName); err != nil {
-		http.Error(w, fmt.Sprintf("Error checking duplicate product: %v", err), http.StatusInternalServerError)
-		return
+		return nil, apierror.Internal("Error checking duplicate product", err)
 	} else if exists {
 		log.Println("Duplicate product found")
-
-		http.Error(w, "Duplicate product found", http.StatusBadRequest)
-		return
+		return nil, apierror.DuplicateProduct(productName)
 	}
 	priceStr, ok := formData["price"]
 	if !ok {
-		http.Error(w, "Price field is missing", http.StatusBadRequest)
-		return
+		return nil, apierror.InvalidField("price", "Price field is missing")
 	}
 
 	var price string
@@ -145,8 +161,7 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	formData["price"] = validatedPrice
 	itemPackageQuantityStr, ok := formData["itempackagequantity"]
 	if !ok {
-		http.Error(w, "Item package quantity field is missing", http.StatusBadRequest)
-		return
+		return nil, apierror.InvalidField("itempackagequantity", "Item package quantity field is missing")
 	}
 
 	var itemPackageQuans string
@@ -160,8 +175,7 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 
 	validatedItemPackageQuantity, err := validations.ValidateItemPackageQuantity(itemPackageQuans)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, apierror.InvalidField("itempackagequantity", err.Error())
 	}
 
 	formData["itempackagequantity"] = validatedItemPackageQuantity
@@ -170,40 +184,28 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	var uploadedFileURL string
 	if err == http.ErrMissingFile {
 		// no image provided, proceed without image
-		common.RespondWithError(w, http.StatusBadRequest, "Image is required")
 		log.Println("No image file")
-		return
-
+		return nil, apierror.InvalidField("image", "Image is required")
 	} else if err != nil {
 		log.Println("Failed to get image file:", err)
-		common.RespondWithError(w, http.StatusBadRequest, "Failed to get image file")
-		return
+		return nil, apierror.InvalidField("image", "Failed to get image file")
 	} else {
 		fileBytes, err := ioutil.ReadAll(file)
 		filename := header.Filename
 
 		if err != nil {
-			log.Println("Failed to read image file:", err)
-			common.RespondWithError(w, http.StatusInternalServerError, "Failed to read image file")
-			return
-		}
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create client: %v", err), http.StatusInternalServerError)
-			return
+			return nil, apierror.Internal("Failed to read image file", err)
 		}
 		// Determine the format of the image based on its header
 		format := http.DetectContentType(fileBytes)
 		if format != "image/jpeg" && format != "image/png" {
 			log.Println("Unsupported file format. Only JPG or PNG files are allowed")
-			common.RespondWithError(w, http.StatusBadRequest, "Unsupported file format. Only JPG or PNG files are allowed")
-			return
+			return nil, apierror.InvalidField("image", "Unsupported file format. Only JPG or PNG files are allowed")
 		}
 		productNameWithoutSpaces := strings.ReplaceAll(filename, " ", "_")
 		log.Println(format)
 		if _, err := file.Seek(0, io.SeekStart); err != nil {
-			common.RespondWithError(w, http.StatusBadRequest, err.Error())
-			return
+			return nil, apierror.Internal("Failed to read image file", err)
 		}
 		// Create a unique filename for the uploaded file
 		uniqueFilename := fmt.Sprintf("%d_%s", time.Now().UnixNano(), productNameWithoutSpaces)
@@ -215,22 +217,18 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 		wc := object.NewWriter(ctx)
 		// Copy the file content to the Cloud Storage object
 		if _, err := io.Copy(wc, file); err != nil {
-			http.Error(w, "Failed to copy file content to Cloud Storage", http.StatusInternalServerError)
-			return
+			return nil, apierror.Internal("Failed to copy file content to Cloud Storage", err)
 		}
 		// Close the writer to finalize the upload
 		if err := wc.Close(); err != nil {
-			http.Error(w, "Failed to close Cloud Storage writer", http.StatusInternalServerError)
-			return
+			return nil, apierror.Internal("Failed to close Cloud Storage writer", err)
 		}
 		if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-			http.Error(w, "Failed to set ACL for Cloud Storage object", http.StatusInternalServerError)
-			return
+			return nil, apierror.Internal("Failed to set ACL for Cloud Storage object", err)
 		}
 		uploadedFileURL = fmt.Sprintf("https://storage.googleapis.com/%s/%s", common.BucketName, uniqueFilename)
 		if _, err := file.Seek(0, io.SeekStart); err != nil {
-			common.RespondWithError(w, http.StatusBadRequest, err.Error())
-			return
+			return nil, apierror.Internal("Failed to read image file", err)
 		}
 	}
 	thumbnail_data := map[string]interface{}{
@@ -242,15 +240,12 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	//triggerTheEvent(uploadedFileURL, documentID, ctx, w)
 	err = common.PublishToPubSub(common.Thumbnail_Topic, common.Thumbnail_Topic_subscription, common.Thumbnail_Endpoint, thumbnail_data)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to publish audit record to Pub/Sub: %v", err), http.StatusInternalServerError)
-		return
+		return nil, apierror.Internal("Failed to publish audit record to Pub/Sub", err)
 	}
 	formData["image"] = uploadedFileURL
 	if err := saveToFirestore(ctx, documentID, formData); err != nil {
 		log.Println("Failed to save data to Firestore")
-		http.Error(w, "Failed to save data to Firestore", http.StatusInternalServerError)
-		return
-
+		return nil, apierror.Internal("Failed to save data to Firestore", err)
 	}
 	// logger.Log(logging.Entry{
 	// 	Payload: map[string]interface{}{
@@ -261,11 +256,7 @@ func CreateGrocery(w http.ResponseWriter, r *http.Request) {
 	// 	Severity: logging.Info,
 	// })
 	log.Println("Completed processing request")
-	fmt.Println(formData)
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"message": "File uploaded successfully", "url": "%s"}`, uploadedFileURL)
-
+	return formData, nil
 }
 func saveToFirestore(ctx context.Context, documentID int, data map[string]interface{}) error {
 	client, err := utils.CreateFirestoreClient()
@@ -10,59 +10,74 @@ import (
 
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/logging"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/takeoff-capstone/apierror"
 	"github.com/takeoff-capstone/common"
+	"github.com/takeoff-capstone/idempotency"
 	"github.com/takeoff-capstone/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var logClient *logging.Client
 
+func init() {
+	functions.HTTP("DeleteGrocery", idempotency.Handler("DeleteGrocery", DeleteGrocery))
+}
+
 // @Summary Delete a grocery item
 // @Description Delete a grocery item by providing its ID
 // @ID delete-grocery
 // @Param id query integer true "ID of the grocery item to delete"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
 // @Success 200 {object} map[string]interface{} "OK"
-// @Failure 400 {string} string "Bad Request: Invalid ID"
-// @Failure 500 {string} string "Internal Server Error"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid ID"
+// @Failure 404 {object} apierror.Envelope "Not Found: Grocery item not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
 // @Router /DeleteGrocery [delete]
 func DeleteGrocery(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	// Set CORS headers for the main request..
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Extract document ID from the request parameters
+	documentIDStr := r.URL.Query().Get("id")
+	if err := deleteGrocery(documentIDStr); err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"message": "Document Deleted successfully", "documentID": "%s"}`, documentIDStr)
+}
+
+// deleteGrocery deletes the grocery item documentIDStr and its image.
+func deleteGrocery(documentIDStr string) error {
 	ctx := context.Background()
 	if logClient == nil {
 		if err := initLogging(ctx); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to initialize logging: %v", err), http.StatusInternalServerError)
-			return
+			return apierror.Internal("Failed to initialize logging", err)
 		}
 	}
 	logger := logClient.Logger("my-log")
-	// Extract document ID from the request parameters
-	documentIDStr := r.URL.Query().Get("id")
 	if documentIDStr == "" {
-		http.Error(w, "Document ID is required", http.StatusBadRequest)
-		return
+		return apierror.InvalidField("id", "Document ID is required")
 	}
 	client, err := utils.CreateFirestoreClient()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create Firestore client: %v", err), http.StatusInternalServerError)
-		log.Printf("Error creating Firestore client: %v", err)
-
-		return
+		return apierror.Internal("Failed to create Firestore client", err)
 	}
 	defer client.Close()
 	documentID, err := strconv.Atoi(documentIDStr)
 	if err != nil {
-		http.Error(w, "Invalid document ID", http.StatusBadRequest)
 		log.Printf("Error converting document ID to int: %v", err)
-
-		return
+		return apierror.InvalidField("id", "Invalid document ID")
 	}
 	log.Printf("Document ID: %s", documentIDStr)
 
@@ -70,30 +85,22 @@ func DeleteGrocery(w http.ResponseWriter, r *http.Request) {
 
 	// Check if the document exists
 	docSnapshot, err := docRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return apierror.NotFound("Document not found")
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting document: %v", err), http.StatusInternalServerError)
-		log.Printf("Error getting document: %v", err)
-
-		return
+		return apierror.Internal("Error getting document", err)
 	}
 
 	// Read the existing data
 	existingData := docSnapshot.Data()
-	log.Printf("Existing Data: %+v", existingData)
 
 	productName, ok := existingData["productname"].(string)
-	fmt.Println(productName)
 	if !ok {
-		http.Error(w, "Product name not found in existing data", http.StatusInternalServerError)
-		log.Printf("Product name not found in existing data")
-
-		return
+		return apierror.Internal("Product name not found in existing data", fmt.Errorf("grocery %s has no productname", documentIDStr))
 	}
 	if err := DeleteFromFirestore(ctx, documentID, client); err != nil {
-		http.Error(w, "Failed to delete document from Firestore", http.StatusInternalServerError)
-		log.Printf("Failed to delete document from Firestore: %v", err)
-
-		return
+		return apierror.Internal("Failed to delete document from Firestore", err)
 	}
 	log.Printf("Product Name: %s, Found: %t", productName, ok)
 
@@ -108,25 +115,16 @@ func DeleteGrocery(w http.ResponseWriter, r *http.Request) {
 
 		Severity: logging.Info,
 	})
-	auditRecordJSON := map[string]interface{}{
-		"Action":      "Delete",
-		"ID":          documentID,
-		"ProductName": productName,
-		"Timestamp":   time.Now().Format("2006-01-02 03:04:05 PM"),
-	}
 
 	// Publish the audit record to the Pub/Sub topic
 	//err = publishToPubSub("Audit-Topic", auditRecordJSON)
 	log.Println("Audit Published to the Topic")
-	err = common.PublishToPubSub(common.Audit_Topic, common.Audit_Topic_subscription, common.Audit_Endpoint, auditRecordJSON)
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to publish audit record to Pub/Sub: %v", err), http.StatusInternalServerError)
-		return
+	if err := publishDeleteAudit(documentID, productName); err != nil {
+		// The item is already deleted; answering with an error would have
+		// the client retry it
+		log.Printf("Failed to publish audit record for %d: %v", documentID, err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"message": "Document Deleted successfully", "documentID": "%d"}`, documentID)
+	return nil
 }
 
 func DeleteFromFirestore(ctx context.Context, documentID int, client *firestore.Client) error {
@@ -162,6 +160,17 @@ func DeleteFromFirestore(ctx context.Context, documentID int, client *firestore.
 	return nil
 }
 
+// publishDeleteAudit publishes the audit record for a deleted grocery item.
+func publishDeleteAudit(documentID int, productName string) error {
+	auditRecordJSON := map[string]interface{}{
+		"Action":      "Delete",
+		"ID":          documentID,
+		"ProductName": productName,
+		"Timestamp":   time.Now().Format("2006-01-02 03:04:05 PM"),
+	}
+	return common.PublishToPubSub(common.Audit_Topic, common.Audit_Topic_subscription, common.Audit_Endpoint, auditRecordJSON)
+}
+
 func initLogging(ctx context.Context) error {
 	var err error
 	logClient, err = logging.NewClient(ctx, common.ProjectID)
@@ -0,0 +1,222 @@
+package cloudfunctions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/takeoff-capstone/catalog"
+	"google.golang.org/api/iterator"
+)
+
+// Expansions are the related data the read endpoints can inline in an item
+// with the expand parameter, under "expanded".
+var Expansions = map[string]struct {
+	// Fields are the item fields the expansion reads
+	Fields []string
+	expand func(ctx context.Context, client *firestore.Client, items []map[string]interface{}) ([]interface{}, error)
+}{
+	// The audit records of the item, one per change
+	"revisions": {Fields: []string{"id"}, expand: expandRevisions},
+	// The other items of the item's brand
+	"brand": {Fields: []string{"brand"}, expand: expandBrands},
+}
+
+// maxBrandItems is the number of items of a brand read to list its
+// categories and manufacturers.
+const maxBrandItems = 500
+
+// RevisionSummary is the revisions expansion of an item.
+type RevisionSummary struct {
+	Count int64 `json:"count"`
+}
+
+// BrandDetails is the brand expansion of an item.
+type BrandDetails struct {
+	Name          string   `json:"name"`
+	ItemCount     int64    `json:"itemCount"`
+	Categories    []string `json:"categories"`
+	Manufacturers []string `json:"manufacturers"`
+	// Partial is set when the brand has more items than were read for its
+	// categories and manufacturers, which may then leave some out
+	Partial bool `json:"partial,omitempty"`
+}
+
+// parseExpand reads a comma-separated expand parameter.
+func parseExpand(text string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := Expansions[name]; !ok {
+			supported := make([]string, 0, len(Expansions))
+			for name := range Expansions {
+				supported = append(supported, name)
+			}
+			sort.Strings(supported)
+			return nil, fmt.Errorf("cannot expand %q; expansions are %s", name, strings.Join(supported, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// expansionFields returns the item fields the expansions read.
+func expansionFields(names []string) []string {
+	var fields []string
+	for _, name := range names {
+		fields = append(fields, Expansions[name].Fields...)
+	}
+	return fields
+}
+
+// projectedFields returns the fields of an item a response keeps: fields and
+// the expansions, or nil for all of them.
+func projectedFields(fields []string, expand []string) []string {
+	if fields == nil || len(expand) == 0 {
+		return fields
+	}
+	return append(fields[:len(fields):len(fields)], "expanded")
+}
+
+// expandItems adds the named expansions to each item, under "expanded".
+func expandItems(ctx context.Context, client *firestore.Client, items []map[string]interface{}, names []string) error {
+	if len(names) == 0 || len(items) == 0 {
+		return nil
+	}
+	expanded := make([]map[string]interface{}, len(items))
+	for i := range items {
+		expanded[i] = make(map[string]interface{}, len(names))
+	}
+	for _, name := range names {
+		values, err := Expansions[name].expand(ctx, client, items)
+		if err != nil {
+			return fmt.Errorf("failed to expand %s: %v", name, err)
+		}
+		for i, value := range values {
+			expanded[i][name] = value
+		}
+	}
+	for i, item := range items {
+		item["expanded"] = expanded[i]
+	}
+	return nil
+}
+
+// expandRevisions counts the audit records of each item with an aggregation
+// query. The handlers record the id as a string or as a number, so both are
+// counted.
+func expandRevisions(ctx context.Context, client *firestore.Client, items []map[string]interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		id, ok := itemID(item)
+		if !ok {
+			continue
+		}
+		count, err := countDocuments(ctx, client.Collection("Audit_Logs").Where("ID", "in", []interface{}{strconv.FormatInt(id, 10), id}))
+		if err != nil {
+			return nil, err
+		}
+		values[i] = RevisionSummary{Count: count}
+	}
+	return values, nil
+}
+
+// expandBrands describes the brand of each item from the items of its brand
+// in Firestore, so it agrees with the page. Each brand of the page is counted
+// with an aggregation query, and its categories and manufacturers are taken
+// from its first maxBrandItems items, selecting only those fields.
+func expandBrands(ctx context.Context, client *firestore.Client, items []map[string]interface{}) ([]interface{}, error) {
+	brands := make(map[string]*BrandDetails)
+	for _, item := range items {
+		name, _ := item["brand"].(string)
+		if strings.TrimSpace(name) == "" || brands[name] != nil {
+			continue
+		}
+		brand, err := describeBrand(ctx, client, name)
+		if err != nil {
+			return nil, err
+		}
+		brands[name] = brand
+	}
+
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		name, _ := item["brand"].(string)
+		if brand, ok := brands[name]; ok {
+			values[i] = brand
+		}
+	}
+	return values, nil
+}
+
+// describeBrand reads the details of the brand called name.
+func describeBrand(ctx context.Context, client *firestore.Client, name string) (*BrandDetails, error) {
+	query := client.Collection(catalog.Collection).Where("brand", "==", name)
+	count, err := countDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	brand := &BrandDetails{Name: strings.TrimSpace(name), ItemCount: count, Categories: []string{}, Manufacturers: []string{}}
+	categories := make(map[string]bool)
+	manufacturers := make(map[string]bool)
+
+	docs := query.Select("category", "manufacturer").Limit(maxBrandItems).Documents(ctx)
+	defer docs.Stop()
+	read := 0
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		read++
+		data := doc.Data()
+		if value, _ := data["category"].(string); value != "" && !categories[value] {
+			categories[value] = true
+			brand.Categories = append(brand.Categories, value)
+		}
+		if value, _ := data["manufacturer"].(string); value != "" && !manufacturers[value] {
+			manufacturers[value] = true
+			brand.Manufacturers = append(brand.Manufacturers, value)
+		}
+	}
+	brand.Partial = int64(read) < count
+	sort.Strings(brand.Categories)
+	sort.Strings(brand.Manufacturers)
+	return brand, nil
+}
+
+// countDocuments counts the documents matching query.
+func countDocuments(ctx context.Context, query firestore.Query) (int64, error) {
+	results, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := results["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("count missing from aggregation result")
+	}
+	return value.GetIntegerValue(), nil
+}
+
+// itemID returns the numeric id field of an item.
+func itemID(item map[string]interface{}) (int64, bool) {
+	switch id := item["id"].(type) {
+	case int64:
+		return id, true
+	case int:
+		return int64(id), true
+	case float64:
+		return int64(id), true
+	}
+	return 0, false
+}
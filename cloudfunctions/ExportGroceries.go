@@ -0,0 +1,191 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/takeoff-capstone/catalog"
+	"github.com/takeoff-capstone/common"
+	"github.com/takeoff-capstone/utils"
+)
+
+// Exports of more items than this are written to storage by an export job
+// instead of being streamed in the response
+const maxSyncExportRows = 5000
+
+// @Summary Export groceries
+// @Description Exports every grocery matching the ViewAllGroceries filters as CSV, JSON, NDJSON or XLSX. The columns are the bulk import headers led by the document ID, so the file can be edited and applied again through BulkUpdate, which matches rows by the id column. BulkCreate does not return an export to the catalog: it adds every row as a new item of the bulk_data staging collection, and drops the id column only when called with fromExport=true. Exports of more than 5000 items, or any export with async=true, run as a job that writes the file to storage; the response then carries the job ID to poll for the download link.
+// @ID export-groceries
+// @Produce text/csv,application/json,application/x-ndjson,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param format query string false "csv (default), json, ndjson or xlsx"
+// @Param productname query string false "Filter by product name"
+// @Param priceFilter query string false "Price filter format: 'gt:100', 'eq:50', 'lt:99.5'"
+// @Param category query string false "Filter by category"
+// @Param brand query string false "Filter by brand"
+// @Param manufacturer query string false "Filter by manufacturer"
+// @Param countryoforigin query string false "Filter by country of origin"
+// @Param vegetarian query bool false "Filter by vegetarian flag"
+// @Param filter query string false "Filter expression, as for ViewAllGroceries"
+// @Param async query bool false "Always run the export as a job"
+// @Success 200 {file} file "The export file"
+// @Success 202 {object} catalog.ExportJob "Accepted: export job created"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid format or filter"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/ExportGroceries [get]
+// @Router /api/v1/groceries/export [get]
+func ExportGroceries(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = bulkimport.FormatCSV
+	}
+	if !catalog.ValidExportFormat(format) {
+		apierror.Write(w, r, apierror.InvalidField("format", "Invalid format. Use csv, json, ndjson or xlsx."))
+		return
+	}
+	filters, err := catalog.ParseFilters(r.URL.Query())
+	if err != nil {
+		apierror.Write(w, r, apierror.Validation(err.Error()))
+		return
+	}
+	async := false
+	if value := r.URL.Query().Get("async"); value != "" {
+		async, err = strconv.ParseBool(value)
+		if err != nil {
+			apierror.Write(w, r, apierror.InvalidField("async", "async must be true or false"))
+			return
+		}
+	}
+
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	// An export above the synchronous limit runs as a job whatever its
+	// exact size, so counting in memory can stop past it
+	count, exact, err := catalog.Count(ctx, client, filters, "", maxSyncExportRows)
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to count groceries", err))
+		return
+	}
+	log.Printf("Export of %d groceries as %s requested with filters %+v", count, format, filters)
+
+	if async || !exact || count > maxSyncExportRows {
+		job := &catalog.ExportJob{Format: format, Filters: filters}
+		if exact {
+			job.Expected = count
+		}
+		if err := catalog.CreateExportJob(ctx, client, job); err != nil {
+			apierror.Write(w, r, apierror.Internal("Failed to create export job", err))
+			return
+		}
+		err = common.PublishToPubSub(common.Export_Topic, common.Export_Topic_subscription, common.Export_Endpoint, map[string]interface{}{"exportId": job.ID})
+		if err != nil {
+			apierror.Write(w, r, apierror.Internal("Failed to start export job", fmt.Errorf("publish export job %s: %w", job.ID, err)))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/exports?id="+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	w.Header().Set("Content-Type", catalog.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", catalog.ExportFileName(format, time.Now())))
+	rows, err := catalog.Export(ctx, client, filters, format, w)
+	if err != nil {
+		// The status line is gone once rows were streamed; the client sees a
+		// truncated file
+		log.Printf("Export failed after %d rows: %v", rows, err)
+		if rows == 0 {
+			w.Header().Del("Content-Disposition")
+			apierror.Write(w, r, apierror.Internal("Failed to export groceries", err))
+		}
+		return
+	}
+	log.Printf("Exported %d groceries as %s", rows, format)
+}
+
+// @Summary Get an export job
+// @Description Returns the status of an asynchronous export and, once it completed, a signed link to download the file from. The file is not public and the link expires after 15 minutes; read the job again for a new one.
+// @ID get-export-job
+// @Produce json
+// @Param id query string true "ID of the export job"
+// @Success 200 {object} catalog.ExportJob "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Export ID is required"
+// @Failure 404 {object} apierror.Envelope "Not Found: Export job not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/exports [get]
+func GetExportJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	exportID := r.URL.Query().Get("id")
+	if exportID == "" {
+		apierror.Write(w, r, apierror.InvalidField("id", "Export ID is required"))
+		return
+	}
+	writeExportJob(w, r, exportID)
+}
+
+// writeExportJob writes the export job exportID, with a link to its file
+// once it completed.
+func writeExportJob(w http.ResponseWriter, r *http.Request, exportID string) {
+	ctx := context.Background()
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	job, err := catalog.LoadExportJob(ctx, client, exportID)
+	if err == catalog.ErrExportNotFound {
+		apierror.Write(w, r, apierror.NotFound("Export job not found"))
+		return
+	}
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to load export job", fmt.Errorf("export job %s: %w", exportID, err)))
+		return
+	}
+	storageClient, err := utils.CreateStorageClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create storage client", err))
+		return
+	}
+	defer storageClient.Close()
+	if err := job.SignDownloadURL(storageClient); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create download link", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,256 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/utils"
+)
+
+// The v1 API serves groceries and imports as resources under /api/v1: the
+// resource as JSON on success, 201 with a Location for a created grocery, 202
+// for an accepted import, 204 for a deletion, and the error envelope for
+// every failure. The older routes run the v1 handlers, or, where their
+// success responses differ, the functions the v1 handlers are built on. The
+// other v1 routes run the handlers of the older routes, with the IDs of
+// export jobs and mapping templates in the path rather than the query.
+
+// writeJSON writes a v1 response.
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+// @Summary Create a grocery item
+// @Description Creates a grocery item from the json-data form field and image, as CreateGrocery does, and returns it.
+// @ID create-grocery-v1
+// @Accept mpfd
+// @Produce json
+// @Param json-data formData string true "JSON data for the grocery item"
+// @Param image formData file true "Image file for the grocery item"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 201 {object} map[string]interface{} "Created; Location holds the item's URL"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid JSON payload or missing required fields"
+// @Failure 409 {object} apierror.Envelope "Conflict: DUPLICATE_PRODUCT, another item has the product name"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/groceries [post]
+func CreateGroceryV1(w http.ResponseWriter, r *http.Request) {
+	item, err := createGrocery(r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/groceries/%d", item["id"]))
+	writeJSON(w, http.StatusCreated, item)
+}
+
+// @Summary Update a grocery item
+// @Description Applies a JSON merge patch to a grocery item, as UpdateGrocery does, and returns the updated item. The patch is an application/merge-patch+json body, or the json-data form field of a multipart request that also replaces the image.
+// @ID update-grocery-v1
+// @Accept json
+// @Accept mpfd
+// @Produce json
+// @Param id path int true "ID of the grocery item"
+// @Param json-data formData string false "JSON merge patch of the grocery item"
+// @Param image formData file false "Image file replacing the grocery item's image"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} map[string]interface{} "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid patch"
+// @Failure 404 {object} apierror.Envelope "Not Found: Grocery item not found"
+// @Failure 409 {object} apierror.Envelope "Conflict: DUPLICATE_PRODUCT, another item has the product name"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/groceries/{id} [patch]
+func UpdateGroceryV1(w http.ResponseWriter, r *http.Request, id string) {
+	item, err := updateGrocery(r, id)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+// @Summary Delete a grocery item
+// @Description Deletes a grocery item and its image, as DeleteGrocery does.
+// @ID delete-grocery-v1
+// @Param id path int true "ID of the grocery item"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 204 "No Content"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid ID"
+// @Failure 404 {object} apierror.Envelope "Not Found: Grocery item not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/groceries/{id} [delete]
+func DeleteGroceryV1(w http.ResponseWriter, r *http.Request, id string) {
+	if err := deleteGrocery(id); err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Start a bulk import
+// @Description Uploads a file of grocery items to import, as BulkUploadGroceryItems does, and returns the import job, which runs in the background.
+// @ID create-import-v1
+// @Accept mpfd
+// @Produce json
+// @Param file formData file true "CSV, NDJSON, XLSX or ZIP file, optionally gzip compressed"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 202 {object} bulkimport.ImportJob "Accepted; Location holds the job's URL"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid file"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/imports [post]
+func CreateImportV1(w http.ResponseWriter, r *http.Request) {
+	job, err := startImport(w, r)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/imports/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// @Summary Get a bulk import
+// @ID get-import-v1
+// @Produce json
+// @Param id path string true "ID of the import job"
+// @Success 200 {object} bulkimport.ImportJob "OK"
+// @Failure 404 {object} apierror.Envelope "Not Found: Import job not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/imports/{id} [get]
+func GetImportV1(w http.ResponseWriter, r *http.Request, id string) {
+	writeImportJob(w, r, id, loadImportJob)
+}
+
+// @Summary Cancel a bulk import
+// @ID cancel-import-v1
+// @Produce json
+// @Param id path string true "ID of the import job"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} bulkimport.ImportJob "OK"
+// @Failure 404 {object} apierror.Envelope "Not Found: Import job not found"
+// @Failure 409 {object} apierror.Envelope "Conflict: The import cannot be cancelled"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/imports/{id}/cancel [post]
+func CancelImportV1(w http.ResponseWriter, r *http.Request, id string) {
+	writeImportJob(w, r, id, cancelImportJob)
+}
+
+// @Summary Roll back a bulk import
+// @ID rollback-import-v1
+// @Produce json
+// @Param id path string true "ID of the import job"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} bulkimport.ImportJob "OK"
+// @Failure 404 {object} apierror.Envelope "Not Found: Import job not found"
+// @Failure 409 {object} apierror.Envelope "Conflict: The import is still running"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/imports/{id}/rollback [post]
+func RollbackImportV1(w http.ResponseWriter, r *http.Request, id string) {
+	writeImportJob(w, r, id, rollbackImportJob)
+}
+
+const (
+	defaultAuditPageSize = 20
+	maxAuditPageSize     = 100
+)
+
+// AuditPage is a page of audit records.
+type AuditPage struct {
+	Items         []map[string]interface{} `json:"items"`
+	NextPageToken string                   `json:"nextPageToken,omitempty"`
+}
+
+// @Summary List audit records
+// @Description Lists the audit records of grocery changes a page at a time, optionally only those of one grocery item.
+// @ID list-audit-v1
+// @Produce json
+// @Param groceryId query int false "ID of the grocery item whose records to list"
+// @Param pageSize query int false "Number of records per page, at most 100; defaults to 20"
+// @Param pageToken query string false "nextPageToken of the previous page"
+// @Success 200 {object} AuditPage "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid groceryId or pageSize"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/audit [get]
+func ListAuditV1(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	query := r.URL.Query()
+
+	pageSize := defaultAuditPageSize
+	if text := query.Get("pageSize"); text != "" {
+		size, err := strconv.Atoi(text)
+		if err != nil || size < 1 || size > maxAuditPageSize {
+			apierror.Write(w, r, apierror.InvalidField("pageSize", "pageSize must be a number from 1 to 100"))
+			return
+		}
+		pageSize = size
+	}
+
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	audit := client.Collection("Audit_Logs").Query
+	if text := query.Get("groceryId"); text != "" {
+		id, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			apierror.Write(w, r, apierror.InvalidField("groceryId", "Invalid groceryId"))
+			return
+		}
+		// Updates record the ID as a string, deletions as a number
+		audit = audit.Where("ID", "in", []interface{}{text, id})
+	}
+	audit = audit.OrderBy(firestore.DocumentID, firestore.Asc)
+	if token := query.Get("pageToken"); token != "" {
+		audit = audit.StartAfter(token)
+	}
+
+	docs, err := audit.Limit(pageSize + 1).Documents(ctx).GetAll()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to list audit records", err))
+		return
+	}
+	page := AuditPage{Items: []map[string]interface{}{}}
+	if len(docs) > pageSize {
+		docs = docs[:pageSize]
+		page.NextPageToken = docs[pageSize-1].Ref.ID
+	}
+	for _, docSnapshot := range docs {
+		record := docSnapshot.Data()
+		record["auditId"] = docSnapshot.Ref.ID
+		page.Items = append(page.Items, record)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// @Summary Get an export job
+// @Description Returns the status of an asynchronous export, as GetExportJob does.
+// @ID get-export-v1
+// @Produce json
+// @Param id path string true "ID of the export job"
+// @Success 200 {object} catalog.ExportJob "OK"
+// @Failure 404 {object} apierror.Envelope "Not Found: Export job not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/exports/{id} [get]
+func GetExportV1(w http.ResponseWriter, r *http.Request, id string) {
+	writeExportJob(w, r, id)
+}
+
+// @Summary Get a column mapping template
+// @ID get-mapping-template-v1
+// @Produce json
+// @Param id path string true "ID of the mapping template"
+// @Success 200 {object} bulkimport.MappingTemplate "OK"
+// @Failure 404 {object} apierror.Envelope "Not Found: Mapping template not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/mapping-templates/{id} [get]
+func GetMappingTemplateV1(w http.ResponseWriter, r *http.Request, id string) {
+	writeMappingTemplate(w, r, id)
+}
@@ -0,0 +1,174 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/takeoff-capstone/common"
+	"github.com/takeoff-capstone/utils"
+)
+
+// @Summary Get a bulk import job
+// @Description Returns the status, checkpoint and statistics of a bulk import
+// @ID get-import-job
+// @Produce json
+// @Param id query string true "ID of the import job"
+// @Success 200 {object} bulkimport.ImportJob "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Import ID is required"
+// @Failure 404 {object} apierror.Envelope "Not Found: Import job not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/imports [get]
+func GetImportJob(w http.ResponseWriter, r *http.Request) {
+	handleImportJob(w, r, http.MethodGet, GetImportV1)
+}
+
+// loadImportJob reads an import job.
+func loadImportJob(ctx context.Context, id string) (*bulkimport.ImportJob, error) {
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %v", err)
+	}
+	defer client.Close()
+	return bulkimport.LoadJob(ctx, client, id)
+}
+
+// @Summary Cancel a bulk import job
+// @Description Stops a pending or running import. A running import stops at its next checkpoint; rows it already wrote stay until the import is rolled back.
+// @ID cancel-import-job
+// @Produce json
+// @Param id query string true "ID of the import job"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} bulkimport.ImportJob "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Import ID is required"
+// @Failure 404 {object} apierror.Envelope "Not Found: Import job not found"
+// @Failure 409 {object} apierror.Envelope "Conflict: The import cannot be cancelled"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/imports/cancel [post]
+func CancelImportJob(w http.ResponseWriter, r *http.Request) {
+	handleImportJob(w, r, http.MethodPost, CancelImportV1)
+}
+
+// cancelImportJob asks a pending or running import to stop.
+func cancelImportJob(ctx context.Context, id string) (*bulkimport.ImportJob, error) {
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %v", err)
+	}
+	defer client.Close()
+	job, err := bulkimport.RequestCancel(ctx, client, id)
+	if err == nil {
+		log.Printf("Import %s is %s", id, job.Status)
+	}
+	return job, err
+}
+
+// @Summary Roll back a bulk import job
+// @Description Deletes every document a finished, failed or cancelled import wrote, together with the images a ZIP import stored. A running import has to be cancelled first. Rolling back again resumes a rollback that did not finish.
+// @ID rollback-import-job
+// @Produce json
+// @Param id query string true "ID of the import job"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} bulkimport.ImportJob "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Import ID is required"
+// @Failure 404 {object} apierror.Envelope "Not Found: Import job not found"
+// @Failure 409 {object} apierror.Envelope "Conflict: The import is still running"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/imports/rollback [post]
+func RollbackImportJob(w http.ResponseWriter, r *http.Request) {
+	handleImportJob(w, r, http.MethodPost, RollbackImportV1)
+}
+
+// rollbackImportJob deletes the documents an import wrote.
+func rollbackImportJob(ctx context.Context, id string) (*bulkimport.ImportJob, error) {
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %v", err)
+	}
+	defer client.Close()
+
+	job, err := bulkimport.LoadJob(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	// Only images a ZIP import stored belong to it; an image URL in a CSV
+	// row may point at another product's image
+	var beforeDelete func(map[string]interface{})
+	if job.Format == bulkimport.FormatZIP {
+		beforeDelete = deleteGroceryImages
+	}
+
+	job, err = bulkimport.Rollback(ctx, client, id, beforeDelete)
+	if err == bulkimport.ErrJobFinished {
+		// Rolled back before; report the job as it is
+		return job, nil
+	}
+	if err == nil {
+		log.Printf("Import %s rolled back, %d documents deleted", id, job.Deleted)
+	}
+	return job, err
+}
+
+// deleteGroceryImages removes the image and thumbnail of a document that is
+// being rolled back or deleted. Failures are only logged so that the caller
+// goes on.
+func deleteGroceryImages(data map[string]interface{}) {
+	ctx := context.Background()
+	if imageURL, ok := data["image"].(string); ok && imageURL != "" {
+		if err := common.DeleteImageFromStorage(ctx, imageURL, common.BucketName); err != nil {
+			log.Println("Failed to delete image file:", err)
+		}
+	}
+	if thumbnailURL, ok := data["thumbnailURL"].(string); ok && thumbnailURL != "" {
+		if err := common.DeleteImageFromStorage(ctx, thumbnailURL, common.ThumbnailBucketName); err != nil {
+			log.Println("Failed to delete thumbnail file:", err)
+		}
+	}
+}
+
+// handleImportJob serves the older import job routes: CORS, and the id
+// parameter, which the v1 routes take from the path.
+func handleImportJob(w http.ResponseWriter, r *http.Request, method string, handler func(http.ResponseWriter, *http.Request, string)) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", method)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	handler(w, r, r.URL.Query().Get("id"))
+}
+
+// writeImportJob runs action on an import job and writes the job, mapping job
+// errors to status codes.
+func writeImportJob(w http.ResponseWriter, r *http.Request, importID string, action func(context.Context, string) (*bulkimport.ImportJob, error)) {
+	ctx := context.Background()
+	if importID == "" {
+		apierror.Write(w, r, apierror.InvalidField("id", "Import ID is required"))
+		return
+	}
+
+	job, err := action(ctx, importID)
+	var stateErr *bulkimport.JobStateError
+	switch {
+	case err == bulkimport.ErrJobNotFound:
+		apierror.Write(w, r, apierror.NotFound("Import job not found"))
+		return
+	case errors.As(err, &stateErr):
+		apierror.Write(w, r, apierror.Conflict(stateErr.Error()))
+		return
+	case err != nil:
+		apierror.Write(w, r, apierror.Internal("Failed to process import job", fmt.Errorf("import job %s: %w", importID, err)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
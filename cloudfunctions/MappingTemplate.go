@@ -0,0 +1,261 @@
+package cloudfunctions
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
+	"github.com/takeoff-capstone/utils"
+)
+
+// @Summary Create a column mapping template
+// @Description Save a mapping from supplier file columns to grocery fields, with optional transforms
+// @ID create-mapping-template
+// @Accept json
+// @Produce json
+// @Param template body bulkimport.MappingTemplate true "Mapping template"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 201 {object} bulkimport.MappingTemplate "Created"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid template"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/MappingTemplates [post]
+// @Router /api/v1/mapping-templates [post]
+func CreateMappingTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	var template bulkimport.MappingTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		log.Println("Failed to decode mapping template:", err)
+		apierror.Write(w, r, apierror.Validation("Invalid JSON payload"))
+		return
+	}
+	// IDs are always assigned by the server
+	template.ID = ""
+	if err := template.Validate(); err != nil {
+		apierror.Write(w, r, apierror.Validation(err.Error()))
+		return
+	}
+
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	if err := bulkimport.SaveTemplate(ctx, client, &template); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to save mapping template", err))
+		return
+	}
+	log.Printf("Mapping template %s saved", template.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+// @Summary Get a column mapping template
+// @Description Retrieve a saved mapping template by its ID
+// @ID get-mapping-template
+// @Produce json
+// @Param id query string true "ID of the mapping template"
+// @Success 200 {object} bulkimport.MappingTemplate "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Template ID is required"
+// @Failure 404 {object} apierror.Envelope "Not Found: Mapping template not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/MappingTemplates [get]
+func GetMappingTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	templateID := r.URL.Query().Get("id")
+	if templateID == "" {
+		apierror.Write(w, r, apierror.InvalidField("id", "Template ID is required"))
+		return
+	}
+	writeMappingTemplate(w, r, templateID)
+}
+
+// writeMappingTemplate writes the saved mapping template templateID.
+func writeMappingTemplate(w http.ResponseWriter, r *http.Request, templateID string) {
+	ctx := context.Background()
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	template, err := bulkimport.LoadTemplate(ctx, client, templateID)
+	if err == bulkimport.ErrTemplateNotFound {
+		apierror.Write(w, r, apierror.NotFound("Mapping template not found"))
+		return
+	}
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to load mapping template", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// @Summary Suggest a column mapping
+// @Description Suggest a mapping template from the headers of a sample CSV, JSON, NDJSON, XLSX or ZIP file. The result can be edited and saved with CreateMappingTemplate.
+// @ID suggest-mapping
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "Sample CSV, JSON, NDJSON, XLSX or ZIP file, optionally gzip compressed"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} bulkimport.MappingSuggestion "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Please provide a file"
+// @Router /api/SuggestMapping [post]
+// @Router /api/v1/mapping-suggestions [post]
+func SuggestMapping(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		apierror.Write(w, r, apierror.Validation("Failed to parse multipart form"))
+		return
+	}
+	file, err := filePart(reader, "file")
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("file", "Please provide a file"))
+		return
+	}
+	defer file.Close()
+
+	headers, err := sampleHeaders(file)
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("file", err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bulkimport.Suggest(headers))
+}
+
+// sampleHeaders returns the header row of a CSV or XLSX file, or the keys of
+// the first item of a JSON or NDJSON file or of a ZIP file's manifest. Only the
+// start of a text file is read.
+func sampleHeaders(file io.Reader) ([]string, error) {
+	sniffed := bufio.NewReaderSize(file, bulkimport.SniffLength)
+	format, compressed, err := bulkimport.Sniff(sniffed)
+	if err != nil {
+		return nil, err
+	}
+	content, err := bulkimport.Decompress(sniffed, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case bulkimport.FormatCSV:
+		headers, err := csv.NewReader(content).Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV headers: %v", err)
+		}
+		return headers, nil
+	case bulkimport.FormatJSON:
+		decoder := json.NewDecoder(content)
+		if err := expectDelim(decoder, '['); err != nil {
+			return nil, fmt.Errorf("failed to decode JSON: %v", err)
+		}
+		var item map[string]interface{}
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("failed to decode JSON item 0: %v", err)
+		}
+		return itemKeys(item), nil
+	case bulkimport.FormatNDJSON:
+		item, _, err := bulkimport.NewNDJSONReader(content).Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode NDJSON: %v", err)
+		}
+		return itemKeys(item), nil
+	case bulkimport.FormatXLSX:
+		path, err := bulkimport.SpoolToTempFile(content, "sample-*.xlsx")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(path)
+		sheet, err := bulkimport.OpenXLSX(path, bulkimport.XLSXOptions{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer sheet.Close()
+		return sheet.Headers(), nil
+	case bulkimport.FormatZIP:
+		path, err := bulkimport.SpoolToTempFile(content, "sample-*.zip")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(path)
+		archive, err := bulkimport.OpenImageArchive(path)
+		if err != nil {
+			return nil, err
+		}
+		defer archive.Close()
+		// Only the first product of the manifest is needed
+		var headers []string
+		errFound := errors.New("found")
+		err = archive.ReadManifest(func(row bulkimport.ManifestRow) error {
+			if row.Err != nil {
+				return row.Err
+			}
+			headers = itemKeys(row.Item)
+			return errFound
+		})
+		if err != nil && err != errFound {
+			return nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+		if headers == nil {
+			return nil, fmt.Errorf("manifest is empty")
+		}
+		return headers, nil
+	}
+	return nil, fmt.Errorf("Unsupported file type. Only CSV, JSON, NDJSON, XLSX or ZIP files are allowed")
+}
+
+func itemKeys(item map[string]interface{}) []string {
+	keys := make([]string, 0, len(item))
+	for key := range item {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
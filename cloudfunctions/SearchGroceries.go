@@ -0,0 +1,83 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/search"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// @Summary Search groceries
+// @Description Full-text search over product name, brand, manufacturer, category and package information. Words are matched by stem and by prefix, every word must match, and results are ranked by relevance with product name matches weighing most. Served by the search service, a single instance holding the index in memory, which a Firestore listener keeps in sync with every write.
+// @ID search-groceries
+// @Produce json
+// @Param q query string true "Search text, e.g. 'basm' or 'brown rice'"
+// @Param limit query int false "Number of results, at most 100; defaults to 20"
+// @Param offset query int false "Number of results to skip"
+// @Success 200 {object} map[string]interface{} "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Search text is required"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/SearchGroceries [get]
+// @Router /api/v1/search [get]
+func SearchGroceries(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		apierror.Write(w, r, apierror.InvalidField("q", "Search text is required"))
+		return
+	}
+	limit, ok := queryInt(r, "limit", defaultSearchLimit)
+	if !ok || limit < 1 || limit > maxSearchLimit {
+		apierror.Write(w, r, apierror.InvalidField("limit", "limit must be between 1 and 100"))
+		return
+	}
+	offset, ok := queryInt(r, "offset", 0)
+	if !ok || offset < 0 {
+		apierror.Write(w, r, apierror.InvalidField("offset", "offset must be a positive number"))
+		return
+	}
+
+	groceries := search.Default()
+	if err := groceries.Ready(ctx); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to load search index", err))
+		return
+	}
+	hits, total := groceries.Index.Search(query, limit, offset)
+
+	response := map[string]interface{}{
+		"query":   query,
+		"total":   total,
+		"results": hits,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// queryInt reads an integer query parameter, returning def when it is absent.
+func queryInt(r *http.Request, name string, def int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	number, err := strconv.Atoi(value)
+	return number, err == nil
+}
@@ -0,0 +1,38 @@
+package cloudfunctions
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/takeoff-capstone/search"
+)
+
+func init() {
+	functions.HTTP("SearchService", SearchService)
+	// The search service loads the catalog as it starts, so its first
+	// request does not wait for it
+	if os.Getenv("FUNCTION_TARGET") == "SearchService" {
+		go func() {
+			if err := search.Default().Ready(context.Background()); err != nil {
+				log.Printf("Failed to load search index: %v", err)
+			}
+		}()
+	}
+}
+
+// SearchService serves SearchGroceries at /search and SuggestGroceries at
+// /suggest. It is deployed as a single instance that holds the search index
+// for every caller, so the catalog is loaded and followed there only, not in
+// each instance of the other functions.
+func SearchService(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "suggest":
+		SuggestGroceries(w, r)
+	default:
+		SearchGroceries(w, r)
+	}
+}
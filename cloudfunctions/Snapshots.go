@@ -0,0 +1,152 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/snapshot"
+	"github.com/takeoff-capstone/utils"
+)
+
+// RestoreRequest is the body of a restore request.
+type RestoreRequest struct {
+	Snapshot string `json:"snapshot"`
+	// Collection defaults to Groceries
+	Collection string `json:"collection,omitempty"`
+	// IDs restores only these documents instead of the whole collection
+	IDs []string `json:"ids,omitempty"`
+	// DryRun defaults to true; the changes are only applied with false
+	DryRun *bool `json:"dryRun,omitempty"`
+}
+
+// @Summary List catalog snapshots
+// @Description Lists the stored snapshots of the Groceries and Audit_Logs collections, newest first
+// @ID list-snapshots
+// @Produce json
+// @Success 200 {array} snapshot.Info "OK"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/snapshots [get]
+// @Router /api/v1/snapshots [get]
+func ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	storageClient, err := utils.CreateStorageClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Cloud Storage client", err))
+		return
+	}
+	defer storageClient.Close()
+
+	snapshots, err := snapshot.List(ctx, storageClient)
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to list snapshots", err))
+		return
+	}
+	if snapshots == nil {
+		snapshots = []snapshot.Info{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// @Summary Restore from a catalog snapshot
+// @Description Rebuilds a collection, or selected documents of it, from a snapshot. Documents are put back as they were in the snapshot and documents missing from it are deleted. By default this is a dry run that only returns the diff; send dryRun false to apply it.
+// @ID restore-snapshot
+// @Accept json
+// @Produce json
+// @Param request body RestoreRequest true "Snapshot, collection, optional ids and dryRun"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
+// @Success 200 {object} snapshot.RestoreResult "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Snapshot name is required"
+// @Failure 404 {object} apierror.Envelope "Not Found: Snapshot not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/snapshots/restore [post]
+// @Router /api/v1/snapshots/restore [post]
+func RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	var request RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		apierror.Write(w, r, apierror.Validation("Invalid restore request"))
+		return
+	}
+	if request.Snapshot == "" {
+		apierror.Write(w, r, apierror.InvalidField("snapshot", "Snapshot name is required"))
+		return
+	}
+	options := snapshot.RestoreOptions{Collection: request.Collection, IDs: request.IDs, DryRun: true}
+	if options.Collection == "" {
+		options.Collection = "Groceries"
+	}
+	if request.DryRun != nil {
+		options.DryRun = *request.DryRun
+	}
+
+	storageClient, err := utils.CreateStorageClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Cloud Storage client", err))
+		return
+	}
+	defer storageClient.Close()
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+		return
+	}
+	defer client.Close()
+
+	reader, err := snapshot.Open(ctx, storageClient, request.Snapshot)
+	if err == snapshot.ErrSnapshotNotFound {
+		apierror.Write(w, r, apierror.NotFound("Snapshot not found"))
+		return
+	}
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to open snapshot", fmt.Errorf("snapshot %s: %w", request.Snapshot, err)))
+		return
+	}
+	defer reader.Close()
+
+	if !reader.Header.Contains(options.Collection) {
+		apierror.Write(w, r, apierror.InvalidField("collection", "Snapshot does not contain collection "+options.Collection))
+		return
+	}
+
+	result, err := snapshot.Restore(ctx, client, reader, options)
+	if result == nil {
+		apierror.Write(w, r, apierror.Internal("Failed to restore snapshot", fmt.Errorf("snapshot %s: %w", request.Snapshot, err)))
+		return
+	}
+	statusCode := http.StatusOK
+	if err != nil {
+		// Some writes failed; the result says how many
+		log.Printf("Restore of %s from %s incomplete: %v", options.Collection, request.Snapshot, err)
+		statusCode = http.StatusInternalServerError
+	} else if !options.DryRun {
+		log.Printf("Restored %s from %s: %d created, %d updated, %d deleted", options.Collection, request.Snapshot, result.Created, result.Updated, result.Deleted)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(result)
+}
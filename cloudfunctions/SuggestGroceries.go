@@ -0,0 +1,75 @@
+package cloudfunctions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/search"
+)
+
+const (
+	defaultSuggestLimit = 5
+	maxSuggestLimit     = 20
+)
+
+// @Summary Suggest groceries
+// @Description Type-ahead suggestions for the search box. Returns the product names, brands and categories with a word starting with the prefix, ranked by popularity (number of items with the value) or recency (last write of an item with the value). Suggestions come from the search service, a single instance holding an index that a Firestore listener keeps in sync with every write, of any instance or import; asOf is the time the index was last brought up to date.
+// @ID suggest-groceries
+// @Produce json
+// @Param prefix query string true "Text typed so far, e.g. 'bas'"
+// @Param limit query int false "Number of suggestions of each kind, at most 20; defaults to 5"
+// @Param rank query string false "popularity (default) or recency"
+// @Success 200 {object} map[string]interface{} "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Prefix is required"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/SuggestGroceries [get]
+// @Router /api/v1/suggestions [get]
+func SuggestGroceries(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ctx := context.Background()
+
+	prefix := strings.TrimSpace(r.URL.Query().Get("prefix"))
+	if prefix == "" {
+		apierror.Write(w, r, apierror.InvalidField("prefix", "Prefix is required"))
+		return
+	}
+	limit, ok := queryInt(r, "limit", defaultSuggestLimit)
+	if !ok || limit < 1 || limit > maxSuggestLimit {
+		apierror.Write(w, r, apierror.InvalidField("limit", "limit must be between 1 and 20"))
+		return
+	}
+	rank := r.URL.Query().Get("rank")
+	if rank == "" {
+		rank = search.RankPopularity
+	}
+	if !search.ValidRank(rank) {
+		apierror.Write(w, r, apierror.InvalidField("rank", "rank must be popularity or recency"))
+		return
+	}
+
+	groceries := search.Default()
+	if err := groceries.Ready(ctx); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to load search index", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"prefix":      prefix,
+		"rank":        rank,
+		"asOf":        groceries.AsOf(),
+		"suggestions": groceries.Suggester.Suggest(prefix, limit, rank),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -3,44 +3,61 @@ package cloudfunctions
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/bulkimport"
 	"github.com/takeoff-capstone/common"
+	"github.com/takeoff-capstone/idempotency"
 	"github.com/takeoff-capstone/utils"
+	"github.com/takeoff-capstone/validations"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	Logger *logging.Logger
 )
 
+func init() {
+	functions.HTTP("UpdateGrocery", idempotency.Handler("UpdateGrocery", UpdateGrocery))
+}
+
 // @Summary Update a grocery item
-// @Description Update a grocery item by providing its ID and new data
+// @Description Update a grocery item by providing its ID and new data. The changes are a JSON merge patch (RFC 7396), sent in the json-data form field or as an application/merge-patch+json body: a field set to null is removed, any other field is replaced. id, createdAt, updatedAt, image and thumbnailURL cannot be changed, unknown fields are rejected, required fields cannot be removed or left missing, and changed values are checked: price and item package quantity are numbers, sent as such or as numeric text, vegetarian is a boolean and text fields cannot be empty. Values the patch does not change are not checked, so items stored before this validation can still be updated.
 // @ID update-grocery
 // @Accept json
+// @Accept mpfd
 // @Produce json
 // @Param id query string true "ID of the grocery item to update"
-// @Param json-data formData string true "JSON data containing updated information"
-// @Param image formData file false "Image file for the grocery item"
+// @Param json-data formData string true "JSON merge patch of the grocery item"
+// @Param image formData file false "Image file replacing the grocery item's image; the old image and thumbnail are deleted in the background once the update is saved"
+// @Param Idempotency-Key header string false "Key under which the response is replayed to a retry, by default for 24 hours; reusing it for another request fails with 422"
 // @Success 201 {object} map[string]interface{} "OK"
-// @Failure 400 {string} string "Bad Request: Invalid ID or missing JSON data"
-// @Failure 404 {string} string "Not Found: Grocery item not found"
-// @Failure 500 {string} string "Internal Server Error"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid ID or missing JSON data"
+// @Failure 404 {object} apierror.Envelope "Not Found: Grocery item not found"
+// @Failure 409 {object} apierror.Envelope "Conflict: DUPLICATE_PRODUCT, another item has the product name"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
 // @Router /UpdateGrocery [patch]
 func UpdateGrocery(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST,UPDATE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -48,41 +65,61 @@ func UpdateGrocery(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for the main request..
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	// InitLogger(ctx)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		log.Println("Failed to parse multipart form:", err)
-		common.RespondWithError(w, http.StatusBadRequest, "Failed to parse multipart form")
+	documentID := r.URL.Query().Get("id")
+	if _, err := updateGrocery(r, documentID); err != nil {
+		apierror.Write(w, r, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"message": "Document updated successfully", "documentID": "%s"}`, documentID)
+}
+
+// updateGrocery applies the merge patch of r to the grocery item documentID,
+// and returns the item as written.
+func updateGrocery(r *http.Request, documentID string) (map[string]interface{}, error) {
+	ctx := context.Background()
+	// InitLogger(ctx)
+	// A merge patch can also be sent as the request body, without an image
+	mergePatch := strings.HasPrefix(r.Header.Get("Content-Type"), mergePatchContentType)
+	if !mergePatch {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			log.Println("Failed to parse multipart form:", err)
+			return nil, apierror.Validation("Failed to parse multipart form")
+		}
+	}
 	//InfoLog("UpdateGrocery Function started ")
 	log.Println("UpdateGrocery Function started ")
-	documentID := r.URL.Query().Get("id")
 	if documentID == "" {
 		//ErrorLog(errors.New("Grocery ID is required"))
 
-		http.Error(w, "Grocery ID is required", http.StatusBadRequest)
-		return
+		return nil, apierror.InvalidField("id", "Grocery ID is required")
 	}
 	jsonData := r.FormValue("json-data")
+	if mergePatch {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			return nil, apierror.Validation("Failed to read request body")
+		}
+		jsonData = string(body)
+	}
 	if jsonData == "" {
 		log.Print("JSON data is required to create grocery item.")
-		common.RespondWithError(w, http.StatusBadRequest, "No 'json-data' field provided in the form")
+		return nil, apierror.InvalidField("json-data", "No 'json-data' field provided in the form")
 	}
 	formData := make(map[string]interface{})
 	if err := json.Unmarshal([]byte(jsonData), &formData); err != nil {
 		log.Println("Failed to unmarshal JSON:", err)
 		//ErrorLog(err)
 
-		common.RespondWithError(w, http.StatusBadRequest, "Invalid JSON payload")
-		return
+		return nil, apierror.Validation("Invalid JSON payload")
 	}
 
 	client, err := utils.CreateFirestoreClient()
 	if err != nil {
 		//ErrorLog(err)
 
-		http.Error(w, fmt.Sprintf("Failed to create Firestore client: %v", err), http.StatusInternalServerError)
-		return
+		return nil, apierror.Internal("Failed to create Firestore client", err)
 	}
 	defer client.Close()
 
@@ -90,94 +127,85 @@ func UpdateGrocery(w http.ResponseWriter, r *http.Request) {
 
 	// Check if the document exists
 	docSnapshot, err := docRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, apierror.NotFound("Document not found")
+	}
 	if err != nil {
 
-		http.Error(w, fmt.Sprintf("Error getting document: %v", err), http.StatusInternalServerError)
 		//ErrorLog(err)
 
-		return
+		return nil, apierror.Internal("Error getting document", err)
 	}
 
 	if !docSnapshot.Exists() {
-		http.Error(w, "Document not found", http.StatusNotFound)
 		//ErrorLog(err)
 
-		return
+		return nil, apierror.NotFound("Document not found")
 	}
 
 	// Unmarshal existing data from the Firestore document
 	var existingData map[string]interface{}
 	if err := docSnapshot.DataTo(&existingData); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to unmarshal existing document data: %v", err), http.StatusInternalServerError)
 		//ErrorLog(err)
 
-		return
+		return nil, apierror.Internal("Failed to unmarshal existing document data", err)
 	}
+	// Check the patch against the existing data before an image is uploaded;
+	// it is merged again into the data current when it is written
+	productName, ok := existingData["productname"].(string)
+	if !ok {
+		return nil, apierror.Internal("Product name not found in existing data", fmt.Errorf("grocery %s has no productname", documentID))
+	}
+	if newName, ok := formData["productname"].(string); ok && newName != productName {
+		if taken, err := productNameTaken(ctx, client, newName, documentID); err != nil {
+			return nil, apierror.Internal("Error checking duplicate product", err)
+		} else if taken {
+			log.Println("Duplicate product found")
+			return nil, apierror.DuplicateProduct(newName)
+		}
+	}
+	if err := mergeGroceryUpdate(existingData, formData); err != nil {
+		return nil, err
+	}
+
+	// imageURL is set when a new image is uploaded
 	var imageURL string
 	file, header, err := r.FormFile("image")
+	if mergePatch {
+		err = http.ErrMissingFile
+	}
 	if err == http.ErrMissingFile {
 		// no image provided, proceed without image
 		log.Println("No image file")
 	} else if err != nil {
 
 		log.Println("Failed to get image file:", err)
-		common.RespondWithError(w, http.StatusBadRequest, "Failed to get image file")
 		//ErrorLog(err)
 
-		return
+		return nil, apierror.InvalidField("image", "Failed to get image file")
 	} else {
 		storageClient, err := utils.CreateStorageClient()
 		if err != nil {
 			//ErrorLog(err)
 
-			http.Error(w, fmt.Sprintf("Failed to create client: %v", err), http.StatusInternalServerError)
-			return
+			return nil, apierror.Internal("Failed to create client", err)
 		}
 		fileBytes, err := ioutil.ReadAll(file)
 		filename := header.Filename
 		format := http.DetectContentType(fileBytes)
 		if format != "image/jpeg" && format != "image/png" {
 			log.Println("Unsupported file format. Only JPG or PNG files are allowed")
-			common.RespondWithError(w, http.StatusBadRequest, "Unsupported file format. Only JPG or PNG files are allowed")
 
-			return
+			return nil, apierror.InvalidField("image", "Unsupported file format. Only JPG or PNG files are allowed")
 		}
 		productNameWithoutSpaces := strings.ReplaceAll(filename, " ", "_")
 
-		if imageURLInterface, ok := existingData["image"]; ok && imageURLInterface != nil {
-			// Attempt to type assert the value to a string
-			if imageURLString, isString := imageURLInterface.(string); isString {
-				// The value stored in imageURLString is a string type
-				imageURL = imageURLString
-			} else {
-				http.Error(w, "Image URL is not a string", http.StatusInternalServerError)
-			
-
-				return
-			}
-		} else {
-			// Handle case if "image" key does not exist or is nil
-			http.Error(w, "Image URL not found in document data", http.StatusNotFound)
-			//ErrorLog(err)
-
-			return
-		}
-		err = common.DeleteImageFromStorage(ctx, imageURL, common.BucketName)
-		if err != nil {
-			log.Println("Failed to delete image file:", err)
-			common.RespondWithError(w, http.StatusInternalServerError, "Failed to read image file")
-			//ErrorLog(err)
-
-			return
-		}
-
 		// Determine the format of the image based on its header
 
 		if _, err := file.Seek(0, io.SeekStart); err != nil {
-			common.RespondWithError(w, http.StatusBadRequest, err.Error())
 			//ErrorLog(err)
 
-			return
+			return nil, apierror.Internal("Failed to read image file", err)
 		}
 		// Create a unique filename for the uploaded file
 		uniqueFilename := fmt.Sprintf("%d_%s", time.Now().UnixNano(), productNameWithoutSpaces)
@@ -189,37 +217,76 @@ func UpdateGrocery(w http.ResponseWriter, r *http.Request) {
 		wc := object.NewWriter(ctx)
 		// Copy the file content to the Cloud Storage object
 		if _, err := io.Copy(wc, file); err != nil {
-			http.Error(w, "Failed to copy file content to Cloud Storage", http.StatusInternalServerError)
 			//ErrorLog(err)
 
-			return
+			return nil, apierror.Internal("Failed to copy file content to Cloud Storage", err)
 		}
 		// Close the writer to finalize the upload
 		if err := wc.Close(); err != nil {
-			http.Error(w, "Failed to close Cloud Storage writer", http.StatusInternalServerError)
 			//ErrorLog(err)
 
-			return
+			return nil, apierror.Internal("Failed to close Cloud Storage writer", err)
 		}
 		if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-			http.Error(w, "Failed to set ACL for Cloud Storage object", http.StatusInternalServerError)
 			//ErrorLog(err)
+			if err := object.Delete(ctx); err != nil {
+				log.Println("Failed to delete unused image file:", err)
+			}
 
-			return
+			return nil, apierror.Internal("Failed to set ACL for Cloud Storage object", err)
 		}
-		uploadedFileURL := fmt.Sprintf("https://storage.googleapis.com/%s/%s", common.BucketName, uniqueFilename)
-		if _, err := file.Seek(0, io.SeekStart); err != nil {
-			common.RespondWithError(w, http.StatusBadRequest, err.Error())
-			//ErrorLog(err)
-
-			return
+		imageURL = fmt.Sprintf("https://storage.googleapis.com/%s/%s", common.BucketName, uniqueFilename)
+	}
+	// Update the Firestore document with the merged data. The transaction
+	// merges into the document as it is when written, so the image replaced
+	// is the one a concurrent update may just have set, and none is orphaned.
+	// The old image and thumbnail are only deleted once the document points
+	// at the new image, so a failed update keeps the old one, and then by
+	// image-cleanup, which Pub/Sub retries.
+	var oldImageURL, oldThumbnailURL string
+	var written map[string]interface{}
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnapshot, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		currentData := docSnapshot.Data()
+		if err := mergeGroceryUpdate(currentData, formData); err != nil {
+			return err
+		}
+		oldImageURL, oldThumbnailURL = "", ""
+		if imageURL != "" {
+			oldImageURL, _ = currentData["image"].(string)
+			oldThumbnailURL, _ = currentData["thumbnailURL"].(string)
+			currentData["image"] = imageURL
+			// The thumbnail of the new image is added when it has been generated
+			delete(currentData, "thumbnailURL")
 		}
+		written = currentData
+		return tx.Set(docRef, currentData)
+	})
+	if err != nil {
+		//ErrorLog(err)
+		if imageURL != "" {
+			// The item keeps its old image; the new one is not used
+			if err := common.DeleteImageFromStorage(ctx, imageURL, common.BucketName); err != nil {
+				log.Println("Failed to delete unused image file:", err)
+			}
+		}
+		var apiErr *apierror.Error
+		switch {
+		case status.Code(err) == codes.NotFound:
+			return nil, apierror.NotFound("Document not found")
+		case errors.As(err, &apiErr):
+			return nil, apiErr
+		default:
+			return nil, apierror.Internal("Failed to update document", err)
+		}
+	}
+	if imageURL != "" {
 		id, _ := strconv.Atoi(documentID)
-
-		fmt.Println(uploadedFileURL)
-		existingData["image"] = uploadedFileURL
 		thumbnail_data := map[string]interface{}{
-			"fileURL": uploadedFileURL,
+			"fileURL": imageURL,
 			"ID":      id,
 			// Add more audit information as needed
 		}
@@ -227,58 +294,211 @@ func UpdateGrocery(w http.ResponseWriter, r *http.Request) {
 		//Publish the Thumbnail record to the Pub/Sub topic
 		//InfoLog("Thumbnail Published to the Thumbnail_topic successfully")
 		log.Println("Thumbnail Published to the Thumbnail_topic successfully")
-		err = common.PublishToPubSub(common.Thumbnail_Topic, common.Thumbnail_Topic_subscription, common.Thumbnail_Endpoint, thumbnail_data)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to publish audit record to Pub/Sub: %v", err), http.StatusInternalServerError)
-			//ErrorLog(err)
+		if err := common.PublishToPubSub(common.Thumbnail_Topic, common.Thumbnail_Topic_subscription, common.Thumbnail_Endpoint, thumbnail_data); err != nil {
+			// The update is already written; only the thumbnail is missing
+			log.Printf("Failed to publish thumbnail record for %s: %v", documentID, err)
+		}
+		if err := publishImageCleanup(documentID, oldImageURL, oldThumbnailURL); err != nil {
+			// The update is already written; only the old images are left
+			log.Printf("Failed to publish cleanup of the replaced images of %s: %v", documentID, err)
+		}
+	}
+
+	// Publish the audit record to the Pub/Sub topic
+	//	err = publishToPubSubAudit_Subscription("Audit-Topic", auditRecordJSON)
+	//InfoLog("Audit Published to the Audit_topic successfully")
+	log.Println("Audit Published to the Audit_topic successfully")
+	if err := publishUpdateAudit(documentID, productName); err != nil {
+		// The update is already written; answering with an error would have
+		// the client retry it
+		log.Printf("Failed to publish audit record for %s: %v", documentID, err)
+	}
+	//InfoLog("UpdateGrocery Function completed successfully")
+	log.Println("UpdateGrocery Function completed successfully")
+	return written, nil
+}
 
-			return
+// mergePatchContentType is the media type of a JSON merge patch (RFC 7396).
+const mergePatchContentType = "application/merge-patch+json"
+
+// immutableGroceryFields are set by the handlers rather than by a client: the
+// id and timestamps, and the image URLs, which change with an image upload.
+var immutableGroceryFields = map[string]bool{
+	"id":           true,
+	"createdAt":    true,
+	"updatedAt":    true,
+	"image":        true,
+	"thumbnailURL": true,
+}
+
+// mergeGroceryUpdate applies changes to the existing document data as a JSON
+// merge patch (RFC 7396): a field set to null is removed, any other value
+// replaces the field. Only grocery fields can be changed, and only optional
+// ones removed. The changed values are checked with checkGroceryPatch and the
+// required fields have to be present; the values an update leaves alone are
+// not checked again, so items stored before the checks existed can still be
+// updated. Nothing is merged unless the result is valid.
+func mergeGroceryUpdate(existingData map[string]interface{}, changes map[string]interface{}) error {
+	validated, err := checkGroceryPatch(changes)
+	if err != nil {
+		return err
+	}
+	for _, key := range bulkimport.RequiredFields {
+		if _, changed := validated[key]; !changed && existingData[key] == nil {
+			return apierror.InvalidField(key, fmt.Sprintf("Field '%s' is required", key))
 		}
+	}
 
+	// Only merge once every field is known to be valid
+	for key, value := range validated {
+		if value == nil {
+			delete(existingData, key)
+		} else {
+			existingData[key] = value
+		}
 	}
-	productName, ok := existingData["productname"].(string)
-	if !ok {
-		http.Error(w, "Product name not found in existing data", http.StatusInternalServerError)
+	existingData["updatedAt"] = time.Now()
+	return nil
+}
 
-		return
+// checkGroceryPatch checks the fields of a patch on their own: they have to be
+// grocery fields a client may set, single values, and required fields are
+// not removed. Price, item package quantity and vegetarian sent as text are
+// converted, so the patch is returned with the values to store.
+func checkGroceryPatch(changes map[string]interface{}) (map[string]interface{}, error) {
+	validated := make(map[string]interface{}, len(changes))
+	var unknown []string
+	for key, value := range changes {
+		if immutableGroceryFields[key] {
+			return nil, apierror.InvalidField(key, fmt.Sprintf("Field '%s' cannot be changed", key))
+		}
+		if !isGroceryField(key) {
+			unknown = append(unknown, key)
+			continue
+		}
+		if value == nil {
+			if isRequiredGroceryField(key) {
+				return nil, apierror.InvalidField(key, fmt.Sprintf("Field '%s' is required and cannot be removed", key))
+			}
+			validated[key] = nil
+			continue
+		}
+		value, err := groceryValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+		validated[key] = value
 	}
-	// Merge the existing data with the new data from the form
-	for key, value := range formData {
-		existingData[key] = value
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		details := make([]apierror.FieldError, len(unknown))
+		for i, key := range unknown {
+			details[i] = apierror.FieldError{Field: key, Message: "Unknown field"}
+		}
+		return nil, apierror.Validation(fmt.Sprintf("Unknown fields: %s", strings.Join(unknown, ", ")), details...)
 	}
+	return validated, nil
+}
 
-	// Update the Firestore document with the merged data
-	_, err = docRef.Set(ctx, existingData)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update document: %v", err), http.StatusInternalServerError)
-		//ErrorLog(err)
+// groceryValue checks one changed grocery field and returns the value to
+// store.
+func groceryValue(key string, value interface{}) (interface{}, error) {
+	switch value.(type) {
+	case string, float64, int, int64, bool:
+	default:
+		return nil, apierror.InvalidField(key, fmt.Sprintf("Field '%s' must be a single value", key))
+	}
+	text := fmt.Sprintf("%v", value)
+	switch key {
+	case "price":
+		if _, ok := value.(bool); ok {
+			return nil, apierror.InvalidField(key, "Price must be a number")
+		}
+		price, err := validations.ValidatePrice(text)
+		if err != nil {
+			return nil, apierror.InvalidField(key, err.Error())
+		}
+		return price, nil
+	case "itempackagequantity":
+		if _, ok := value.(bool); ok {
+			return nil, apierror.InvalidField(key, "Item package quantity must be a number")
+		}
+		quantity, err := validations.ValidateItemPackageQuantity(text)
+		if err != nil {
+			return nil, apierror.InvalidField(key, err.Error())
+		}
+		return quantity, nil
+	case "weight":
+		// Weight is kept as it is sent, a number or text like "500g"
+		if _, ok := value.(bool); ok {
+			return nil, apierror.InvalidField(key, "Weight must be a number or text")
+		}
+		return value, nil
+	case "vegetarian":
+		vegetarian, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, apierror.InvalidField(key, "Vegetarian must be true or false")
+		}
+		return vegetarian, nil
+	}
+	if _, ok := value.(string); !ok {
+		return nil, apierror.InvalidField(key, fmt.Sprintf("Field '%s' must be text", key))
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, apierror.InvalidField(key, fmt.Sprintf("Field '%s' cannot be empty", key))
+	}
+	return value, nil
+}
 
-		return
+func isRequiredGroceryField(field string) bool {
+	for _, f := range bulkimport.RequiredFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// publishImageCleanup has the image and thumbnail an update replaced deleted
+// in the background, by image-cleanup.
+func publishImageCleanup(documentID string, imageURL string, thumbnailURL string) error {
+	if imageURL == "" && thumbnailURL == "" {
+		return nil
 	}
+	cleanup := map[string]interface{}{
+		"id":           documentID,
+		"image":        imageURL,
+		"thumbnailURL": thumbnailURL,
+	}
+	return common.PublishToPubSub(common.ImageCleanup_Topic, common.ImageCleanup_Topic_subscription, common.ImageCleanup_Endpoint, cleanup)
+}
+
+// productNameTaken reports whether a grocery item other than id is named
+// productName, which CreateGrocery does not allow either.
+func productNameTaken(ctx context.Context, client *firestore.Client, productName string, id string) (bool, error) {
+	iter := client.Collection("Groceries").Where("productname", "==", productName).Limit(2).Documents(ctx)
+	defer iter.Stop()
+	for {
+		docSnapshot, err := iter.Next()
+		if err == iterator.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error iterating over query results: %v", err)
+		}
+		if docSnapshot.Ref.ID != id {
+			return true, nil
+		}
+	}
+}
 
+// publishUpdateAudit publishes the audit record for an updated grocery item.
+func publishUpdateAudit(documentID string, productName string) error {
 	auditRecordJSON := map[string]interface{}{
 		"Action":      "Update",
 		"ID":          documentID,
 		"ProductName": productName,
 		"Timestamp":   time.Now().Format("2006-01-02 03:04:05 PM"),
 	}
-
-	// Publish the audit record to the Pub/Sub topic
-	//	err = publishToPubSubAudit_Subscription("Audit-Topic", auditRecordJSON)
-	//InfoLog("Audit Published to the Audit_topic successfully")
-	log.Println("Audit Published to the Audit_topic successfully")
-	err = common.PublishToPubSub(common.Audit_Topic, common.Audit_Topic_subscription, common.Audit_Endpoint, auditRecordJSON)
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to publish audit record to Pub/Sub: %v", err), http.StatusInternalServerError)
-		//ErrorLog(err)
-
-		return
-	}
-	//InfoLog("UpdateGrocery Function completed successfully")
-	log.Println("UpdateGrocery Function completed successfully")
-
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"message": "Document updated successfully", "documentID": "%s"}`, documentID)
+	return common.PublishToPubSub(common.Audit_Topic, common.Audit_Topic_subscription, common.Audit_Endpoint, auditRecordJSON)
 }
@@ -0,0 +1,142 @@
+package cloudfunctions
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/takeoff-capstone/apierror"
+)
+
+func existingGrocery() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                  1001,
+		"productname":         "Whole Milk",
+		"price":               2.49,
+		"category":            "Dairy",
+		"weight":              1000.0,
+		"brand":               "Farmhouse",
+		"itempackagequantity": 1,
+		"packageinformation":  "Bottle",
+		"manufacturer":        "Farmhouse Dairies",
+		"countryoforigin":     "Ireland",
+		"vegetarian":          true,
+		"image":               "https://storage.googleapis.com/bucket/milk.png",
+	}
+}
+
+// Until change sheets reused the merge, UpdateGrocery stored every value as
+// sent. These cases are the values it now rejects or converts.
+func TestMergeGroceryUpdateValidatesChangedValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]interface{}
+		field   string
+	}{
+		{"price as text", map[string]interface{}{"price": "cheap"}, "price"},
+		{"negative price", map[string]interface{}{"price": -1}, "price"},
+		{"quantity as text", map[string]interface{}{"itempackagequantity": "six"}, "itempackagequantity"},
+		{"negative quantity", map[string]interface{}{"itempackagequantity": -2}, "itempackagequantity"},
+		{"empty product name", map[string]interface{}{"productname": "  "}, "productname"},
+		{"weight as a boolean", map[string]interface{}{"weight": true}, "weight"},
+		{"brand as a number", map[string]interface{}{"brand": 7}, "brand"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			existing := existingGrocery()
+			err := mergeGroceryUpdate(existing, test.changes)
+			var apiErr *apierror.Error
+			if !errors.As(err, &apiErr) || apiErr.Code != apierror.CodeValidationFailed {
+				t.Fatalf("mergeGroceryUpdate() = %v, want a validation error", err)
+			}
+			if len(apiErr.Details) == 0 || apiErr.Details[0].Field != test.field {
+				t.Errorf("details = %v, want field %s", apiErr.Details, test.field)
+			}
+			if existing[test.field] != existingGrocery()[test.field] {
+				t.Errorf("%s = %v after a rejected update", test.field, existing[test.field])
+			}
+		})
+	}
+}
+
+func TestMergeGroceryUpdateStoresNumbers(t *testing.T) {
+	existing := existingGrocery()
+	changes := map[string]interface{}{"price": "3.75", "itempackagequantity": "6"}
+	if err := mergeGroceryUpdate(existing, changes); err != nil {
+		t.Fatalf("mergeGroceryUpdate() = %v", err)
+	}
+	if existing["price"] != 3.75 {
+		t.Errorf("price = %#v, want 3.75", existing["price"])
+	}
+	if existing["itempackagequantity"] != 6 {
+		t.Errorf("itempackagequantity = %#v, want 6", existing["itempackagequantity"])
+	}
+}
+
+func TestMergeGroceryUpdateIsAllOrNothing(t *testing.T) {
+	existing := existingGrocery()
+	changes := map[string]interface{}{"brand": "Meadow", "price": "free"}
+	if err := mergeGroceryUpdate(existing, changes); err == nil {
+		t.Fatal("mergeGroceryUpdate() accepted an invalid price")
+	}
+	if existing["brand"] != "Farmhouse" {
+		t.Errorf("brand = %v, want the valid change left unmerged", existing["brand"])
+	}
+}
+
+func TestMergeGroceryUpdateKeepsStoredValues(t *testing.T) {
+	// Imported items kept their cells as text, and older items may have
+	// empty fields; an update that leaves them alone still applies
+	existing := existingGrocery()
+	existing["weight"] = "1 litre"
+	existing["vegetarian"] = "yes"
+	existing["packageinformation"] = ""
+	if err := mergeGroceryUpdate(existing, map[string]interface{}{"brand": "Meadow"}); err != nil {
+		t.Fatalf("mergeGroceryUpdate() = %v", err)
+	}
+	if existing["brand"] != "Meadow" || existing["weight"] != "1 litre" || existing["vegetarian"] != "yes" {
+		t.Errorf("brand = %v, weight = %#v, vegetarian = %#v", existing["brand"], existing["weight"], existing["vegetarian"])
+	}
+
+	// A weight is stored as sent
+	if err := mergeGroceryUpdate(existing, map[string]interface{}{"weight": "500g"}); err != nil || existing["weight"] != "500g" {
+		t.Errorf("mergeGroceryUpdate() = %v, weight = %#v", err, existing["weight"])
+	}
+}
+
+func TestMergeGroceryUpdateNeedsRequiredFields(t *testing.T) {
+	existing := existingGrocery()
+	delete(existing, "countryoforigin")
+	err := mergeGroceryUpdate(existing, map[string]interface{}{"brand": "Meadow"})
+	var apiErr *apierror.Error
+	if !errors.As(err, &apiErr) || len(apiErr.Details) == 0 || apiErr.Details[0].Field != "countryoforigin" {
+		t.Fatalf("mergeGroceryUpdate() = %v, want the missing field rejected", err)
+	}
+	if existing["brand"] != "Farmhouse" {
+		t.Errorf("brand = %v after a rejected update", existing["brand"])
+	}
+
+	// The patch can add the missing field
+	if err := mergeGroceryUpdate(existing, map[string]interface{}{"countryoforigin": "Ireland"}); err != nil {
+		t.Errorf("mergeGroceryUpdate() adding the field = %v", err)
+	}
+}
+
+func TestCheckGroceryPatch(t *testing.T) {
+	validated, err := checkGroceryPatch(map[string]interface{}{"price": "1.5", "vegetarian": nil})
+	if err != nil {
+		t.Fatalf("checkGroceryPatch() = %v", err)
+	}
+	if validated["price"] != 1.5 || validated["vegetarian"] != nil {
+		t.Errorf("validated = %#v", validated)
+	}
+	for _, changes := range []map[string]interface{}{
+		{"id": "2"},
+		{"colour": "red"},
+		{"brand": nil},
+		{"category": []interface{}{"Dairy"}},
+	} {
+		if _, err := checkGroceryPatch(changes); err == nil {
+			t.Errorf("checkGroceryPatch(%v) accepted the patch", changes)
+		}
+	}
+}
@@ -2,21 +2,53 @@ package cloudfunctions
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/catalog"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// GroceryPage is a page of the grocery listing.
+type GroceryPage struct {
+	Items []map[string]interface{} `json:"items"`
+	// NextPageToken and PrevPageToken are empty when there is no such page
+	NextPageToken string `json:"nextPageToken"`
+	PrevPageToken string `json:"prevPageToken"`
+	// TotalCount is the number of items matching the filters, given with
+	// includeTotal
+	TotalCount *int64 `json:"totalCount,omitempty"`
+	// TotalCountIsLowerBound is set when part of the filter is checked in
+	// memory and more items matched than were scanned for the total
+	TotalCountIsLowerBound bool `json:"totalCountIsLowerBound,omitempty"`
+	// FilteredInMemory is set when part of the filter was checked here rather
+	// than by Firestore; a page may then hold fewer items and still have a
+	// next page
+	FilteredInMemory bool            `json:"filteredInMemory"`
+	Facets           *catalog.Facets `json:"facets,omitempty"`
+}
+
 const (
 	//projectID = "capstore-takeoff"
-	pageSize = 4 // Define your page size here
+	defaultPageSize = 4
+	maxPageSize     = 100
+	// Most documents read for a page when part of the filter is checked in
+	// memory
+	maxScannedPerPage = 500
+	// Most documents read for the total in that case
+	maxScannedForTotal = 10000
+	// Most documents read to count the facet values
+	maxScannedForFacets = 10000
+
+	defaultFacetLimit = 20
+	maxFacetLimit     = 100
 )
 
 // @Summary View all groceries
@@ -24,17 +56,31 @@ const (
 // @ID view-all-groceries
 // @Accept json
 // @Produce json
-// @Param pageToken query string false "Page token for cursor-based pagination"
+// @Param pageToken query string false "nextPageToken or prevPageToken of a page, only valid with the filters and sort of that page"
+// @Param pageSize query int false "Number of items per page, at most 100; defaults to 4"
+// @Param includeTotal query bool false "Add the number of items matching the filters, and having the sort field, as totalCount. When part of the filter is checked in memory only the first 10000 items are scanned; if there are more, totalCount counts the matches among them and totalCountIsLowerBound is set"
+// @Param sort query string false "Sort field: id (default), price, productname, createdAt or weight; '-price' or 'price:desc' sorts in descending order. Items without the field are left out"
 // @Param productname query string false "Filter by product name"
-// @Param priceFilter query string false "Price filter format: 'gt:100', 'eq:50', 'lt:200'"
+// @Param priceFilter query string false "Price filter format: 'gt:100', 'eq:50', 'lt:99.5'"
 // @Param category query string false "Filter by category"
-// @Success 200 {object} map[string]interface{} "OK"
+// @Param brand query string false "Filter by brand"
+// @Param manufacturer query string false "Filter by manufacturer"
+// @Param countryoforigin query string false "Filter by country of origin"
+// @Param vegetarian query bool false "Filter by vegetarian flag"
+// @Param filter query string false "Filter expression, combined with the other filters by and, e.g. category in ('Dairy', 'Bakery') and price between 1.5 and 10 or vegetarian = true and createdAt >= 2024-01-01. Fields: productname, category, brand, manufacturer, countryoforigin, packageinformation, price, weight, itempackagequantity, vegetarian, createdAt, updatedAt"
+// @Param fields query string false "Comma-separated fields to return, e.g. 'productname,price,thumbnailURL'; all fields when empty"
+// @Param expand query string false "Comma-separated related data to add to each item under 'expanded': revisions (number of audit records) or brand (item count, categories and manufacturers of the items with exactly this brand; partial when it has over 500 items)"
+// @Param facets query bool false "Add facet counts for category, brand, manufacturer, country of origin, vegetarian and price, each computed with every filter but its own. The counts are taken from Firestore with the page: price buckets and vegetarian with aggregation queries, the other fields from the matching items, of which at most 10000 are read; facets.isLowerBound is set when there were more"
+// @Param priceBuckets query string false "Price bucket bounds for the price facet, e.g. '5,10,20'; defaults to '10,25,50,100'"
+// @Param facetLimit query int false "Number of values given for each facet, at most 100; defaults to 20"
+// @Success 200 {object} GroceryPage "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid filter or page token"
 // @Router /ViewAllGroceries [get]
 func ViewAllGroceries(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -42,143 +88,249 @@ func ViewAllGroceries(w http.ResponseWriter, r *http.Request) {
 
 	// Set CORS headers for the main request.
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	ListGroceriesV1(w, r)
+}
 
+// @Summary List groceries
+// @Description Lists groceries a page at a time, with the filters, sort, fields, expand and facets of ViewAllGroceries.
+// @ID list-groceries-v1
+// @Produce json
+// @Param pageToken query string false "nextPageToken or prevPageToken of a page"
+// @Param pageSize query int false "Number of items per page, at most 100; defaults to 4"
+// @Success 200 {object} GroceryPage "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid filter or page token"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/groceries [get]
+func ListGroceriesV1(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	client, err := firestore.NewClient(ctx, "capstore-takeoff")
 	if err != nil {
 		log.Printf("Failed to create Firestore client: %v\n", err)
 
-		http.Error(w, fmt.Sprintf("Failed to create Firestore client: %v", err), http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
 		return
 	}
 	defer client.Close()
 
 	// Get the page token from the query parameter
 	pageToken := r.URL.Query().Get("pageToken")
-	productname := r.URL.Query().Get("productname")
-	priceFilter := r.URL.Query().Get("priceFilter") // Format: "gt:100", "eq:50", "lt:200"
-	category := r.URL.Query().Get("category")
-	// var filters []firestore.Query
-	log.Printf("Received request with parameters - pageToken: %s, productname: %s, priceFilter: %s, category: %s\n", pageToken, productname, priceFilter, category)
-
-	// Set up the initial query with a page size
-	query := client.Collection("Groceries").OrderBy("id", firestore.Asc).Limit(pageSize)
-	priceFilterQuery := client.Collection("Groceries").OrderBy("price", firestore.Asc).Limit(pageSize)
-	if productname != "" {
-		query = query.Where("productname", "==", productname)
-		log.Printf("Added productname filter: %s\n", productname)
-
-	}
-	if priceFilter != "" {
-		components := strings.Split(priceFilter, ":")
-		if len(components) != 2 {
-			log.Printf("Invalid priceFilter format. Use 'gt', 'eq', or 'lt' with a number.\n")
-
-			http.Error(w, "Invalid priceFilter format. Use 'gt', 'eq', or 'lt' with a number.", http.StatusBadRequest)
+	filters, err := catalog.ParseFilters(r.URL.Query())
+	if err != nil {
+		log.Printf("Invalid filters: %v\n", err)
+		apierror.Write(w, r, apierror.Validation(err.Error()))
+		return
+	}
+	sortParam := r.URL.Query().Get("sort")
+	sort, err := catalog.ParseSort(sortParam)
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("sort", err.Error()))
+		return
+	}
+	sortField := ""
+	if sortParam != "" {
+		sortField = sort.Field
+	}
+	plan, err := filters.Plan(sortField)
+	if err != nil {
+		apierror.Write(w, r, apierror.Validation(err.Error()))
+		return
+	}
+	if sortParam == "" && plan.OrderBy != "" {
+		// Firestore needs the field of a range filter as the first order
+		sort = catalog.Sort{Field: plan.OrderBy}
+	}
+	log.Printf("Received request with parameters - pageToken: %s, filters: %+v, sort: %s, in memory: %t\n", pageToken, filters, sort, plan.InMemory())
+
+	fields, err := catalog.ParseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("fields", err.Error()))
+		return
+	}
+	expand, err := parseExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("expand", err.Error()))
+		return
+	}
+	size, ok := queryInt(r, "pageSize", defaultPageSize)
+	if !ok || size < 1 || size > maxPageSize {
+		apierror.Write(w, r, apierror.InvalidField("pageSize", "pageSize must be between 1 and 100"))
+		return
+	}
+
+	var cursor catalog.Cursor
+	if pageToken != "" {
+		cursor, err = catalog.DecodeCursor(pageToken, sort, filters)
+		if err != nil {
+			log.Printf("Invalid pageToken provided: %v\n", err)
+			apierror.Write(w, r, apierror.InvalidField("pageToken", fmt.Sprintf("Invalid pageToken provided: %v", err)))
 			return
 		}
-		filterType := components[0]
-		priceValue, err := strconv.Atoi(components[1])
-		if err != nil {
-			log.Printf("Invalid price value provided: %v\n", err)
+		log.Printf("Using pageToken for cursor-based pagination: %s\n", pageToken)
+	}
 
-			http.Error(w, "Invalid price value provided.", http.StatusBadRequest)
-			return
+	// Set up the query, ordered by the sort field then by id. The previous
+	// page is read backwards from the first item of the current one.
+	desc := sort.Desc != cursor.Before
+	direction := firestore.Asc
+	if desc {
+		direction = firestore.Desc
+	}
+	query := plan.Query(client.Collection(catalog.Collection).Query).OrderBy(sort.Field, direction)
+	if sort.Field != "id" {
+		query = query.OrderBy("id", direction)
+	}
+	// A query limited to some fields still reads the sort keys the page
+	// tokens are made of and the fields checked here
+	if selected := catalog.SelectFields(fields, append(append([]string{sort.Field, "id"}, plan.Fields()...), expansionFields(expand)...)...); selected != nil {
+		query = query.Select(selected...)
+	}
+	if cursor.Inclusive {
+		query = query.StartAt(cursor.Keys...)
+	} else if cursor.Keys != nil {
+		query = query.StartAfter(cursor.Keys...)
+	}
+	groceries, lastDoc, more, err := readPage(ctx, query, plan, size)
+	if status.Code(err) == codes.FailedPrecondition {
+		// A composite index is missing from Infrastructure/Firestore; the
+		// request is fine, the deployment is not
+		apierror.Write(w, r, apierror.Internal("No index serves the query of these filters and sort", err))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to iterate over groceries: %v\n", err)
+
+		apierror.Write(w, r, apierror.Internal("Failed to iterate over groceries", err))
+		return
+	}
+
+	// The tokens point after the last item and before the first one. A page
+	// read backwards is put back in order, and the page it came from is next.
+	page := GroceryPage{Items: groceries, FilteredInMemory: plan.InMemory()}
+	next := catalog.Cursor{Sort: sort.String(), Filter: catalog.FilterHash(filters)}
+	prev := catalog.Cursor{Sort: sort.String(), Filter: catalog.FilterHash(filters), Before: true}
+	var nextFrom, prevFrom map[string]interface{}
+	if cursor.Before {
+		for i, j := 0, len(groceries)-1; i < j; i, j = i+1, j-1 {
+			groceries[i], groceries[j] = groceries[j], groceries[i]
 		}
-		switch filterType {
-		case "gt":
-			query = priceFilterQuery.Where("price", ">", priceValue)
-			log.Printf("Added price filter: price > %d\n", priceValue)
-		case "eq":
-			query = priceFilterQuery.Where("price", "==", priceValue)
-			log.Printf("Added price filter: price == %d\n", priceValue)
-		case "lt":
-			query = priceFilterQuery.Where("price", "<", priceValue)
-			log.Printf("Added price filter: price < %d\n", priceValue)
-		default:
-			log.Printf("Invalid priceFilter type. Use 'gt', 'eq', or 'lt'.\n")
-			http.Error(w, "Invalid priceFilter type. Use 'gt', 'eq', or 'lt'.", http.StatusBadRequest)
-			return
+		if len(groceries) > 0 {
+			nextFrom = groceries[len(groceries)-1]
+		} else {
+			next.Keys, next.Inclusive = cursor.Keys, true
+		}
+		if more {
+			prevFrom = lastDoc
+		}
+	} else {
+		if more {
+			nextFrom = lastDoc
+		}
+		if len(groceries) > 0 && cursor.Keys != nil {
+			prevFrom = groceries[0]
+		} else if cursor.Keys != nil {
+			prev.Keys, prev.Inclusive = cursor.Keys, !cursor.Inclusive
 		}
 	}
+	if page.NextPageToken, err = encodePageToken(next, nextFrom, sort); err == nil {
+		page.PrevPageToken, err = encodePageToken(prev, prevFrom, sort)
+	}
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to make page tokens", err))
+		return
+	}
 
-	if category != "" {
-		query = query.Where("category", "==", category)
-		log.Printf("Added category filter: %s\n", category)
+	if err := expandItems(ctx, client, groceries, expand); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to expand groceries", err))
+		return
+	}
+	for i, grocery := range groceries {
+		groceries[i] = catalog.Project(grocery, projectedFields(fields, expand))
 	}
 
-	// If a page token is provided, use it for cursor-based pagination
-	if pageToken != "" {
-		decodedToken, err := base64.StdEncoding.DecodeString(pageToken)
+	if includeTotal, _ := strconv.ParseBool(r.URL.Query().Get("includeTotal")); includeTotal {
+		total, exact, err := catalog.Count(ctx, client, filters, sort.Field, maxScannedForTotal)
 		if err != nil {
-			log.Printf("Invalid pageToken provided: %v\n", err)
-			http.Error(w, fmt.Sprintf("Invalid pageToken provided: %v", err), http.StatusBadRequest)
+			apierror.Write(w, r, apierror.Internal("Failed to count groceries", err))
 			return
 		}
-
-		tokenString := string(decodedToken)
-
-		// Convert the string token to int64
-		cursorInt, err := strconv.ParseInt(tokenString, 10, 64)
+		page.TotalCount = &total
+		page.TotalCountIsLowerBound = !exact
+	}
+	if wantFacets, _ := strconv.ParseBool(r.URL.Query().Get("facets")); wantFacets {
+		bounds, err := catalog.ParsePriceBuckets(r.URL.Query().Get("priceBuckets"))
+		if err != nil {
+			apierror.Write(w, r, apierror.InvalidField("priceBuckets", err.Error()))
+			return
+		}
+		limit, ok := queryInt(r, "facetLimit", defaultFacetLimit)
+		if !ok || limit < 1 || limit > maxFacetLimit {
+			apierror.Write(w, r, apierror.InvalidField("facetLimit", "facetLimit must be between 1 and 100"))
+			return
+		}
+		facets, err := catalog.CountFacets(ctx, client, filters, bounds, limit, maxScannedForFacets)
 		if err != nil {
-			log.Printf("Error converting token to int64: %v\n", err)
-			http.Error(w, fmt.Sprintf("Error converting token to int64: %v", err), http.StatusInternalServerError)
+			apierror.Write(w, r, apierror.Internal("Failed to count facets", err))
 			return
 		}
+		page.Facets = &facets
+	}
 
-		// Use the int64 cursor for the query StartAfter
-		query = query.StartAfter(cursorInt)
-		log.Printf("Using pageToken for cursor-based pagination: %s\n", pageToken)
+	// Encode response as JSON and set content type
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to encode groceries", err))
+		return
 	}
-	// Fetch documents based on the query
-	docs := query.Documents(ctx)
-	var groceries []map[string]interface{}
+}
 
-	// Iterate through fetched documents
+// readPage reads up to size matching items from query. lastDoc is the last
+// document read, which the next page starts after; more is set when the query
+// may have more matching items.
+func readPage(ctx context.Context, query firestore.Query, plan *catalog.Plan, size int) (groceries []map[string]interface{}, lastDoc map[string]interface{}, more bool, err error) {
+	limit := size
+	if plan.InMemory() {
+		// Part of the filter is checked here, so a page may take reading
+		// more documents than it returns
+		limit = maxScannedPerPage
+	}
+	docs := query.Limit(limit).Documents(ctx)
+	defer docs.Stop()
+	groceries = []map[string]interface{}{}
+	scanned := 0
 	for {
 		doc, err := docs.Next()
 		if err == iterator.Done {
-			break
+			return groceries, lastDoc, scanned == limit, nil
 		}
 		if err != nil {
-			log.Printf("Failed to iterate over groceries: %v\n", err)
-
-			http.Error(w, fmt.Sprintf("Failed to iterate over groceries: %v", err), http.StatusInternalServerError)
-			return
+			return nil, nil, false, err
 		}
+		scanned++
 		grocery := doc.Data()
+		lastDoc = grocery
+		if !plan.Matches(grocery) {
+			continue
+		}
 		groceries = append(groceries, grocery)
-	}
-	fmt.Println("Fetched groceries:", groceries)
-	// Get the last document for the next page token
-	nextPageToken := ""
-	if len(groceries) == pageSize {
-		lastDoc := groceries[len(groceries)-1]
-		lastDocID, ok := lastDoc["id"].(int64) // Assuming "id" is an int field
-		if !ok {
-			http.Error(w, "Failed to convert lastDocID to int", http.StatusInternalServerError)
-			return
+		if len(groceries) == size {
+			return groceries, lastDoc, true, nil
 		}
-		// Convert integer ID to string and encode it
-		idString := fmt.Sprintf("%d", lastDocID)
-		nextPageToken = base64.StdEncoding.EncodeToString([]byte(idString))
 	}
+}
 
-	// Prepare the URL for the next page with the nextPageToken as a query parameter
-	//	nextPageURL := fmt.Sprintf("https://us-central1-capstore-takeoff.cloudfunctions.net/ViewAllGroceryNoPagination?pageToken=%s", nextPageToken)
-	//nextPageURL := fmt.Sprintf("http://localhost:8084/api/ViewAllGroceries?pageToken=%s", nextPageToken)
-
-	// Prepare the response with groceries, nextPageToken, and nextPageURL
-	response := map[string]interface{}{
-		"groceries":      groceries,
-		"nextPageToken":  nextPageToken,
-		"pageTokenParam": "pageToken",
+// encodePageToken returns the token of a cursor at the sort keys of from, or
+// at the keys the cursor already has when from is nil. It is empty when there
+// are no keys to continue from.
+func encodePageToken(cursor catalog.Cursor, from map[string]interface{}, sort catalog.Sort) (string, error) {
+	if from != nil {
+		keys, err := catalog.CursorKeys(from, sort)
+		if err != nil {
+			return "", err
+		}
+		cursor.Keys = keys
 	}
-
-	// Encode response as JSON and set content type
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to encode groceries: %v", err), http.StatusInternalServerError)
-		return
+	if cursor.Keys == nil {
+		return "", nil
 	}
+	return catalog.EncodeCursor(cursor)
 }
@@ -9,6 +9,11 @@ import (
 	"strconv"
 
 	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/catalog"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -21,28 +26,43 @@ const (
 // @Accept json
 // @Produce json
 // @Param id query int true "ID of the grocery item to retrieve"
+// @Param fields query string false "Comma-separated fields to return, e.g. 'productname,price,thumbnailURL'; all fields when empty"
+// @Param expand query string false "Comma-separated related data to add under 'expanded': revisions (number of audit records) or brand (item count, categories and manufacturers of the items with exactly this brand; partial when it has over 500 items)"
 // @Success 200 {object} map[string]interface{} "OK"
-// @Failure 400 {string} string "Bad Request: Invalid ID"
-// @Failure 404 {string} string "Not Found: Grocery item not found"
-// @Failure 500 {string} string "Internal Server Error"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid ID, fields or expand"
+// @Failure 404 {object} apierror.Envelope "Not Found: Grocery item not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
 // @Router /api/GetGroceryByID [get]
 func GetGroceryByID(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	// Set CORS headers for the main request..
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	GetGroceryV1(w, r, r.URL.Query().Get("id"))
+}
 
-	// Parse the grocery ID from the URL parameter
-	groceryID := r.URL.Query().Get("id")
+// @Summary Get a grocery item
+// @Description Returns a grocery item, with the fields and expand parameters of GetGroceryByID.
+// @ID get-grocery-v1
+// @Produce json
+// @Param id path int true "ID of the grocery item"
+// @Param fields query string false "Comma-separated fields to return; all fields when empty"
+// @Param expand query string false "Comma-separated related data to add under 'expanded': revisions or brand"
+// @Success 200 {object} map[string]interface{} "OK"
+// @Failure 400 {object} apierror.Envelope "Bad Request: Invalid ID, fields or expand"
+// @Failure 404 {object} apierror.Envelope "Not Found: Grocery item not found"
+// @Failure 500 {object} apierror.Envelope "Internal Server Error"
+// @Router /api/v1/groceries/{id} [get]
+func GetGroceryV1(w http.ResponseWriter, r *http.Request, groceryID string) {
+	ctx := context.Background()
 	if groceryID == "" {
-		http.Error(w, "Grocery ID is required", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.InvalidField("id", "Grocery ID is required"))
 		log.Println("Grocery ID is required")
 		return
 	}
@@ -50,45 +70,79 @@ func GetGroceryByID(w http.ResponseWriter, r *http.Request) {
 	// Convert the groceryID to an integer
 	id, err := strconv.Atoi(groceryID)
 	if err != nil {
-		http.Error(w, "Invalid Grocery ID", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.InvalidField("id", "Invalid Grocery ID"))
 		log.Printf("Invalid Grocery ID: %v", err)
 		return
 	}
 
+	fields, err := catalog.ParseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("fields", err.Error()))
+		return
+	}
+	expand, err := parseExpand(r.URL.Query().Get("expand"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidField("expand", err.Error()))
+		return
+	}
+
 	// Log debug information
 	log.Printf("Fetching grocery data for ID: %d", id)
 
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to retrieve grocery data", err))
+		log.Printf("Failed to create Firestore client: %v", err)
+		return
+	}
+	defer client.Close()
+
 	// Retrieve the grocery data from Firestore
-	groceryData, err := getGroceryData(ctx, id)
+	groceryData, err := getGroceryData(ctx, client, id, catalog.SelectFields(fields, expansionFields(expand)...))
+	if status.Code(err) == codes.NotFound {
+		apierror.Write(w, r, apierror.NotFound("Grocery item not found"))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to retrieve grocery data", http.StatusInternalServerError)
+		apierror.Write(w, r, apierror.Internal("Failed to retrieve grocery data", err))
 		log.Printf("Failed to retrieve grocery data: %v", err)
 		return
 	}
-
-	// Log debug information
-	log.Printf("Retrieved grocery data: %v", groceryData)
+	if err := expandItems(ctx, client, []map[string]interface{}{groceryData}, expand); err != nil {
+		apierror.Write(w, r, apierror.Internal("Failed to expand grocery data", err))
+		log.Printf("Failed to expand grocery data: %v", err)
+		return
+	}
+	groceryData = catalog.Project(groceryData, projectedFields(fields, expand))
 
 	// Return the grocery data as JSON response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(groceryData)
 }
 
-func getGroceryData(ctx context.Context, id int) (map[string]interface{}, error) {
-	client, err := firestore.NewClient(ctx, projectID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Firestore client: %v", err)
-	}
-	defer client.Close()
-
+// getGroceryData reads a grocery item, limited to fields unless they are nil.
+func getGroceryData(ctx context.Context, client *firestore.Client, id int, fields []string) (map[string]interface{}, error) {
 	doc := strconv.Itoa(id)
 
 	// Log debug information
 	log.Printf("Fetching Firestore document for ID: %s", doc)
 
-	snapshot, err := client.Collection("Groceries").Doc(doc).Get(ctx)
+	docRef := client.Collection("Groceries").Doc(doc)
+	var snapshot *firestore.DocumentSnapshot
+	var err error
+	if fields == nil {
+		snapshot, err = docRef.Get(ctx)
+	} else {
+		// A document read cannot leave out fields, so a query selects them
+		docs := client.Collection("Groceries").Where(firestore.DocumentID, "==", docRef).Select(fields...).Documents(ctx)
+		defer docs.Stop()
+		snapshot, err = docs.Next()
+		if err == iterator.Done {
+			err = status.Errorf(codes.NotFound, "no grocery with id %s", doc)
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get document from Firestore: %v", err)
+		return nil, fmt.Errorf("failed to get document from Firestore: %w", err)
 	}
 
 	// Extract data from Firestore document snapshot
@@ -97,8 +151,5 @@ func getGroceryData(ctx context.Context, id int) (map[string]interface{}, error)
 		return nil, fmt.Errorf("failed to convert Firestore data: %v", err)
 	}
 
-	// Log debug information
-	log.Printf("Fetched data from Firestore: %v", data)
-
 	return data, nil
 }
@@ -2,8 +2,10 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 )
@@ -14,7 +16,6 @@ import (
 
 func DeleteImageFromStorage(ctx context.Context, imageURL string, bucket_name string) error {
 	objectName := getImageObjectNameFromURL(imageURL)
-	fmt.Println(objectName)
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create Cloud Storage client: %v", err)
@@ -23,11 +24,35 @@ func DeleteImageFromStorage(ctx context.Context, imageURL string, bucket_name st
 
 	err = client.Bucket(bucket_name).Object(objectName).Delete(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to delete object from Cloud Storage: %v", err)
+		return fmt.Errorf("failed to delete object from Cloud Storage: %w", err)
 	}
 
 	return nil
 }
+
+// DeleteImageWithRetries deletes an image like DeleteImageFromStorage, trying
+// up to attempts times with a doubling wait in between. An image that is
+// already gone counts as deleted.
+func DeleteImageWithRetries(ctx context.Context, imageURL string, bucket_name string, attempts int) error {
+	wait := time.Second
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = DeleteImageFromStorage(ctx, imageURL, bucket_name)
+		if err == nil || errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		if attempt < attempts {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wait *= 2
+		}
+	}
+	return err
+}
+
 func getImageObjectNameFromURL(imageURL string) string {
 	// Extract the object name from the image URL
 	parts := strings.Split(imageURL, "/")
@@ -54,7 +54,8 @@ func PublishToPubSub(topicName string, Subscription_Name string, EndPoint string
 			Topic:       topic,
 			AckDeadline: 10 * time.Second,
 			PushConfig: pubsub.PushConfig{
-				Endpoint: EndPoint,
+				Endpoint:             EndPoint,
+				AuthenticationMethod: &pubsub.OIDCToken{ServiceAccountEmail: PushServiceAccount, Audience: PushAudience},
 				Wrapper: &pubsub.NoWrapper{
 					WriteMetadata: false,
 				},
@@ -1,7 +1,5 @@
 package common
 
-import "net/http"
-
 const (
 	ProjectID                    = "capstore-takeoff"
 	BucketName                   = "groceries_images"
@@ -9,6 +7,14 @@ const (
 	Thumbnail_Topic_subscription = "Thumbnail_Subscription"
 	Thumbnail_Topic              = "Thumbnail_topic"
 	Thumbnail_Endpoint           = "https://us-central1-capstore-takeoff.cloudfunctions.net/thumbnail-generation"
+	ThumbnailBucketName          = "thumbnail_images_bucket"
+	// PushServiceAccount signs the OIDC tokens of push subscriptions, which
+	// the internal endpoints check; it is the account Infrastructure/PubSub
+	// pushes as and Infrastructure/CloudFunctions lets invoke them
+	PushServiceAccount = "pubsub-pushsubscription@capstore-takeoff.iam.gserviceaccount.com"
+	// PushAudience is the audience of those tokens, push_audience in
+	// Infrastructure, which the endpoints read from PUSH_AUDIENCE
+	PushAudience = "capstore-takeoff-push"
 )
 
 const (
@@ -17,14 +23,23 @@ const (
 	Audit_Endpoint           = "https://us-central1-capstore-takeoff.cloudfunctions.net/auditlog-generation"
 )
 
+const (
+	Export_Topic              = "Export_Topic"
+	Export_Topic_subscription = "Export_Subscription"
+	Export_Endpoint           = "https://us-central1-capstore-takeoff.cloudfunctions.net/export-generation"
+)
+
+// The image and thumbnail an update replaced are deleted by image-cleanup,
+// which Pub/Sub retries until it succeeds
+const (
+	ImageCleanup_Topic              = "Image_Cleanup_Topic"
+	ImageCleanup_Topic_subscription = "Image_Cleanup_Subscription"
+	ImageCleanup_Endpoint           = "https://us-central1-capstore-takeoff.cloudfunctions.net/image-cleanup"
+)
+
 type PubSubMessage struct {
 	Action      string `json:"action"`
 	ID          string `json:"id"`
 	ProductName string `json:"product_name"`
 	Timestamp   string `json:"timestamp"`
 }
-
-func RespondWithError(w http.ResponseWriter, statusCode int, message string) {
-	w.WriteHeader(statusCode)
-	w.Write([]byte(message))
-}
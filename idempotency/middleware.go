@@ -0,0 +1,362 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/utils"
+)
+
+const (
+	// Header carries the idempotency key of a request.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set on a response replayed for a retry.
+	ReplayedHeader = "Idempotent-Replayed"
+	// ClientIDHeader optionally names the client installation sending a
+	// request, so that its keys are not shared with other clients.
+	ClientIDHeader = "X-Client-ID"
+
+	maxKeyLength = 255
+	// Request bodies up to this size are hashed in memory; a larger body,
+	// such as a bulk upload, is hashed as it is copied to a temporary file
+	maxBufferedBody = 1 << 20
+	// Larger responses do not fit in a Firestore document; the key is given
+	// up instead, and a retry runs the request again
+	maxStoredResponse = 512 << 10
+)
+
+// Handler makes POST, PATCH and DELETE requests to next that carry an
+// Idempotency-Key header safe to retry. The first response with a key,
+// unless it is a server error, is stored with its headers and replayed for
+// a retry with the same method, path, query and body. The key sent with
+// another request is rejected with 422, and a retry while the first request
+// runs with 409.
+//
+// Keys are scoped by route, the name of the function or route, and by the
+// X-Client-ID header when a client sends one. The scope does not depend on
+// the address of the client, so a retry from another network still gets the
+// stored response.
+func Handler(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		switch r.Method {
+		case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		default:
+			key = ""
+		}
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			apierror.Write(w, r, apierror.Validation(fmt.Sprintf("%s is limited to %d characters", Header, maxKeyLength)))
+			return
+		}
+		ctx := context.Background()
+
+		body, err := readBody(r)
+		if err != nil {
+			log.Printf("Failed to read request body: %v", err)
+			apierror.Write(w, r, apierror.Validation("Failed to read request body"))
+			return
+		}
+		defer body.Close()
+		fingerprint, err := requestFingerprint(r, body)
+		if err != nil {
+			apierror.Write(w, r, apierror.Internal("Failed to read request body", err))
+			return
+		}
+		r.Body = io.NopCloser(body)
+		scope := requestScope(route, r)
+
+		client, err := utils.CreateFirestoreClient()
+		if err != nil {
+			apierror.Write(w, r, apierror.Internal("Failed to create Firestore client", err))
+			return
+		}
+		defer client.Close()
+
+		replay, err := Begin(ctx, client, scope, key, fingerprint)
+		switch {
+		case err == ErrKeyReused:
+			apierror.Write(w, r, apierror.New(apierror.CodeIdempotencyKeyReused, err.Error()))
+			return
+		case err == ErrInProgress:
+			apierror.Write(w, r, apierror.Conflict(err.Error()))
+			return
+		case err != nil:
+			apierror.Write(w, r, apierror.Internal("Failed to check idempotency key", err))
+			return
+		case replay != nil:
+			log.Printf("Replaying response for idempotency key %s", key)
+			writeReplay(w, replay)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		statusCode := recorder.status()
+		if statusCode >= http.StatusInternalServerError || recorder.overflow {
+			if err := Release(ctx, client, scope, key); err != nil {
+				log.Printf("Failed to release idempotency key %s: %v", key, err)
+			}
+			return
+		}
+		response := Response{
+			StatusCode: statusCode,
+			Header:     recorder.sentHeader(),
+			Body:       recorder.body.Bytes(),
+		}
+		if err := Finish(ctx, client, scope, key, fingerprint, response, TTL()); err != nil {
+			log.Printf("Failed to store response for idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+// writeReplay sends a stored response again, with its headers but for the
+// request ID, which the retry has its own of.
+func writeReplay(w http.ResponseWriter, replay *Record) {
+	for name, values := range replay.Header {
+		if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(apierror.RequestIDHeader) {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	if replay.Header == nil && replay.ContentType != "" {
+		w.Header().Set("Content-Type", replay.ContentType)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(replay.StatusCode)
+	w.Write(replay.Body)
+}
+
+// Middleware applies Handler to the routes of a gin router, each scoped by
+// its method and route pattern.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writer := c.Writer
+		route := c.Request.Method + " " + c.FullPath()
+		Handler(route, func(w http.ResponseWriter, r *http.Request) {
+			c.Request = r
+			if w != http.ResponseWriter(writer) {
+				c.Writer = &ginWriter{ResponseWriter: writer, w: w}
+			}
+			c.Next()
+			c.Writer = writer
+		})(writer, c.Request)
+		// Stop here when Handler answered without running the route
+		c.Abort()
+	}
+}
+
+// ginWriter sends what the route writes through the responseRecorder of
+// Handler.
+type ginWriter struct {
+	gin.ResponseWriter
+	w http.ResponseWriter
+}
+
+func (w *ginWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *ginWriter) WriteHeader(statusCode int) {
+	w.w.WriteHeader(statusCode)
+}
+
+func (w *ginWriter) Write(data []byte) (int, error) {
+	return w.w.Write(data)
+}
+
+func (w *ginWriter) WriteString(s string) (int, error) {
+	return w.w.Write([]byte(s))
+}
+
+// responseRecorder keeps a copy of the response as it is written.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+	overflow   bool
+}
+
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseRecorder) record(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > maxStoredResponse {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(data)
+}
+
+// status returns the status code sent, 200 when the handler wrote nothing.
+func (w *responseRecorder) status() int {
+	if w.statusCode == 0 {
+		return http.StatusOK
+	}
+	return w.statusCode
+}
+
+// sentHeader returns the headers as they were when the response started.
+func (w *responseRecorder) sentHeader() http.Header {
+	if w.header == nil {
+		return w.Header().Clone()
+	}
+	return w.header
+}
+
+// requestBody is a request body that can be read again after it was hashed.
+type requestBody interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// memoryBody is a request body held in memory.
+type memoryBody struct {
+	*bytes.Reader
+}
+
+func (memoryBody) Close() error {
+	return nil
+}
+
+// spooledBody is a request body kept in a temporary file, which is removed
+// when the body is closed.
+type spooledBody struct {
+	*os.File
+}
+
+func (b spooledBody) Close() error {
+	b.File.Close()
+	return os.Remove(b.Name())
+}
+
+// readBody reads the body of r so that it can be hashed and then read again
+// by the handler: in memory up to maxBufferedBody, and beyond that from a
+// temporary file, so that a large upload is not held in memory twice.
+func readBody(r *http.Request) (requestBody, error) {
+	defer r.Body.Close()
+	var buffer bytes.Buffer
+	if r.ContentLength <= maxBufferedBody {
+		if _, err := io.CopyN(&buffer, r.Body, maxBufferedBody+1); err == io.EOF {
+			return memoryBody{bytes.NewReader(buffer.Bytes())}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.CreateTemp("", "idempotency-body-*")
+	if err != nil {
+		return nil, err
+	}
+	body := spooledBody{file}
+	if _, err := io.Copy(file, io.MultiReader(&buffer, r.Body)); err != nil {
+		body.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// requestScope identifies the route of a request and, when it sends
+// X-Client-ID, the client.
+func requestScope(route string, r *http.Request) string {
+	client := r.Header.Get(ClientIDHeader)
+	if client == "" {
+		return route
+	}
+	sum := sha256.Sum256([]byte(client))
+	return route + " " + hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint hashes what identifies a request: its method, path,
+// query and body. A multipart body is hashed by its parts, since a client
+// sending it again picks a new boundary. The body is read as a stream and
+// left at its start.
+func requestFingerprint(r *http.Request, body io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+
+	hashed := false
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		hashed = hashParts(hash, multipart.NewReader(body, params["boundary"])) == nil
+		if !hashed {
+			// Not valid multipart; hash the bytes as they are
+			hash.Reset()
+			fmt.Fprintf(hash, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return "", err
+			}
+		}
+	}
+	if !hashed {
+		fmt.Fprintf(hash, "%s\n", mediaType)
+		if _, err := io.Copy(hash, body); err != nil {
+			return "", err
+		}
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashParts(hash io.Writer, reader *multipart.Reader) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%q %q\n", part.FormName(), part.FileName())
+		size, err := io.Copy(hash, part)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "\n%d\n", size)
+	}
+}
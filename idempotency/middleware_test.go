@@ -0,0 +1,169 @@
+package idempotency
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func multipartRequest(t *testing.T, boundary string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.SetBoundary(boundary); err != nil {
+		t.Fatal(err)
+	}
+	writer.WriteField("json-data", `{"productName":"Milk"}`)
+	writer.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/CreateGrocery", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func fingerprintOf(t *testing.T, r *http.Request) string {
+	t.Helper()
+	body, err := readBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	fingerprint, err := requestFingerprint(r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fingerprint
+}
+
+func TestFingerprintIgnoresMultipartBoundary(t *testing.T) {
+	first := fingerprintOf(t, multipartRequest(t, "first-boundary"))
+	second := fingerprintOf(t, multipartRequest(t, "second-boundary"))
+	if first != second {
+		t.Errorf("fingerprints differ by boundary: %s and %s", first, second)
+	}
+
+	other := httptest.NewRequest(http.MethodPost, "/api/CreateGrocery", strings.NewReader(`{"productName":"Bread"}`))
+	if fingerprintOf(t, other) == first {
+		t.Error("fingerprint of another body is the same")
+	}
+}
+
+func TestReadBodySpoolsLargeBodies(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), maxBufferedBody+10)
+	r := httptest.NewRequest(http.MethodPost, "/api/BulkCreate", bytes.NewReader(data))
+	r.ContentLength = -1
+	body, err := readBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spooled, ok := body.(spooledBody)
+	if !ok {
+		t.Fatalf("readBody() = %T, want a body over the limit in a file", body)
+	}
+	fingerprint, err := requestFingerprint(r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("body read again has %d bytes, want %d", len(read), len(data))
+	}
+	body.Close()
+	if _, err := os.Stat(spooled.Name()); !os.IsNotExist(err) {
+		t.Errorf("temporary file left after Close: %v", err)
+	}
+
+	// The whole body is hashed, not only the part kept in memory
+	changed := append(bytes.Repeat([]byte("x"), maxBufferedBody+9), 'y')
+	other := httptest.NewRequest(http.MethodPost, "/api/BulkCreate", bytes.NewReader(changed))
+	if fingerprintOf(t, other) == fingerprint {
+		t.Error("bodies differing past the limit have the same fingerprint")
+	}
+}
+
+func TestRequestScope(t *testing.T) {
+	request := func(clientID string, forwarded string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/CreateGrocery", nil)
+		if clientID != "" {
+			r.Header.Set(ClientIDHeader, clientID)
+		}
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return r
+	}
+
+	if requestScope("CreateGrocery", request("", "10.0.0.1")) != requestScope("CreateGrocery", request("", "10.0.0.2")) {
+		t.Error("a client switching networks gets another scope")
+	}
+	if requestScope("CreateGrocery", request("phone-a", "")) == requestScope("CreateGrocery", request("phone-b", "")) {
+		t.Error("clients with other IDs share a scope")
+	}
+	if requestScope("CreateGrocery", request("phone-a", "")) == requestScope("UpdateGrocery", request("phone-a", "")) {
+		t.Error("routes share a scope")
+	}
+}
+
+func TestMiddlewareRunsRequestsWithoutKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.POST("/api/CreateGrocery", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Writer.Header().Set("Location", "/api/v1/groceries/1")
+		c.Writer.WriteHeader(http.StatusCreated)
+		c.Writer.Write(body)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/CreateGrocery", strings.NewReader("data")))
+	if w.Code != http.StatusCreated || w.Body.String() != "data" || w.Header().Get("Location") == "" {
+		t.Errorf("response = %d %q %v, want the route's", w.Code, w.Body.String(), w.Header())
+	}
+}
+
+func TestResponseRecorderKeepsSentHeaders(t *testing.T) {
+	recorder := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	recorder.Header().Set("Location", "/api/v1/groceries/1")
+	recorder.Write([]byte("{}"))
+	recorder.Header().Set("X-Late", "ignored")
+
+	if recorder.status() != http.StatusOK {
+		t.Errorf("status() = %d, want 200", recorder.status())
+	}
+	header := recorder.sentHeader()
+	if header.Get("Location") != "/api/v1/groceries/1" || header.Get("X-Late") != "" {
+		t.Errorf("sentHeader() = %v", header)
+	}
+	if recorder.body.String() != "{}" {
+		t.Errorf("body = %q", recorder.body.String())
+	}
+}
+
+func TestWriteReplayKeepsRequestID(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "retry")
+	writeReplay(w, &Record{
+		StatusCode: http.StatusCreated,
+		Header:     map[string][]string{"Location": {"/api/v1/groceries/1"}, "X-Request-Id": {"first"}},
+		Body:       []byte("{}"),
+	})
+	if w.Code != http.StatusCreated || w.Body.String() != "{}" {
+		t.Errorf("response = %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Request-ID"); got != "retry" {
+		t.Errorf("X-Request-ID = %q, want the retry's", got)
+	}
+	if w.Header().Get("Location") == "" || w.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("headers = %v", w.Header())
+	}
+}
@@ -0,0 +1,155 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Collection holds a record per idempotency key.
+const Collection = "Idempotency_Keys"
+
+const (
+	// DefaultTTL is how long a response is replayed when IDEMPOTENCY_TTL is
+	// not set.
+	DefaultTTL = 24 * time.Hour
+	// pendingTimeout is how long a request holds its key before a retry may
+	// run again, in case the first one never finished
+	pendingTimeout = 10 * time.Minute
+)
+
+// Record states.
+const (
+	statePending = "pending"
+	stateDone    = "done"
+)
+
+var (
+	// ErrKeyReused is returned for a key sent again with another request.
+	ErrKeyReused = errors.New("idempotency key was used for another request")
+	// ErrInProgress is returned while the first request with a key runs.
+	ErrInProgress = errors.New("a request with this idempotency key is in progress")
+)
+
+// Record is the stored outcome of the first request with a key. A Firestore
+// TTL policy on expiresAt can remove expired records; until then they are
+// ignored.
+type Record struct {
+	Key         string              `firestore:"key"`
+	Scope       string              `firestore:"scope"`
+	Fingerprint string              `firestore:"fingerprint"`
+	State       string              `firestore:"state"`
+	StatusCode  int                 `firestore:"statusCode,omitempty"`
+	Header      map[string][]string `firestore:"header,omitempty"`
+	// ContentType is set instead of Header on records stored before headers were
+	ContentType string    `firestore:"contentType,omitempty"`
+	Body        []byte    `firestore:"body,omitempty"`
+	CreatedAt   time.Time `firestore:"createdAt"`
+	ExpiresAt   time.Time `firestore:"expiresAt"`
+}
+
+// Response is a response to store for a key.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// TTL returns how long responses are replayed: IDEMPOTENCY_TTL, a duration
+// such as "24h", or DefaultTTL.
+func TTL() time.Duration {
+	value := os.Getenv("IDEMPOTENCY_TTL")
+	if value == "" {
+		return DefaultTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("Invalid IDEMPOTENCY_TTL %q; using %s", value, DefaultTTL)
+		return DefaultTTL
+	}
+	return ttl
+}
+
+func recordRef(client *firestore.Client, scope string, key string) *firestore.DocumentRef {
+	// Keys are chosen by clients and may hold characters document IDs cannot
+	sum := sha256.Sum256([]byte(scope + "\n" + key))
+	return client.Collection(Collection).Doc(hex.EncodeToString(sum[:]))
+}
+
+// Begin claims key, within scope, for a request with the given fingerprint.
+// It returns the record to replay when the request was already answered, or
+// nil when the caller should run the request and then call Finish or
+// Release.
+func Begin(ctx context.Context, client *firestore.Client, scope string, key string, fingerprint string) (*Record, error) {
+	ref := recordRef(client, scope, key)
+	var replay *Record
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		replay = nil
+		now := time.Now()
+		docSnapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			var record Record
+			if err := docSnapshot.DataTo(&record); err != nil {
+				return err
+			}
+			if record.ExpiresAt.After(now) {
+				if record.Fingerprint != fingerprint {
+					return ErrKeyReused
+				}
+				if record.State == statePending {
+					return ErrInProgress
+				}
+				replay = &record
+				return nil
+			}
+		}
+		return tx.Set(ref, Record{
+			Key:         key,
+			Scope:       scope,
+			Fingerprint: fingerprint,
+			State:       statePending,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(pendingTimeout),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+// Finish stores the response of the request that claimed key, to be
+// replayed for ttl.
+func Finish(ctx context.Context, client *firestore.Client, scope string, key string, fingerprint string, response Response, ttl time.Duration) error {
+	now := time.Now()
+	_, err := recordRef(client, scope, key).Set(ctx, Record{
+		Key:         key,
+		Scope:       scope,
+		Fingerprint: fingerprint,
+		State:       stateDone,
+		StatusCode:  response.StatusCode,
+		Header:      response.Header,
+		Body:        response.Body,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	})
+	return err
+}
+
+// Release gives up key, so that a retry runs the request again.
+func Release(ctx context.Context, client *firestore.Client, scope string, key string) error {
+	_, err := recordRef(client, scope, key).Delete(ctx)
+	return err
+}
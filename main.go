@@ -1,14 +1,21 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"     // sw
 	ginSwagger "github.com/swaggo/gin-swagger" // gin-swagger middleware
+	"github.com/takeoff-capstone/apierror"
 	"github.com/takeoff-capstone/async_functions"
 	"github.com/takeoff-capstone/cloudfunctions"
 	_ "github.com/takeoff-capstone/docs"
+	"github.com/takeoff-capstone/idempotency"
+	"github.com/takeoff-capstone/pushauth"
 )
 
 // @title Grocery API
@@ -16,6 +23,8 @@ import (
 // @description API for managing groceries
 // @BasePath /api
 func main() {
+	legacyDeprecation = configDate("LEGACY_DEPRECATION_DATE")
+	legacySunset = configDate("LEGACY_SUNSET_DATE")
 
 	// Create a new Gin router
 	r := gin.Default()
@@ -23,9 +32,10 @@ func main() {
 	// Enable CORS
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key, X-Client-ID, X-Request-ID")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Location")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -34,6 +44,12 @@ func main() {
 
 		c.Next()
 	})
+	// Give every request an ID, returned in the X-Request-ID header and in
+	// error responses
+	r.Use(apierror.Middleware())
+	// Replay the response of a retried POST, PATCH or DELETE that carries an
+	// Idempotency-Key header
+	r.Use(idempotency.Middleware())
 
 	// Define the endpoint for creating a user
 	// Define the endpoint for creating a user
@@ -45,7 +61,7 @@ func main() {
 	// @Param data body cloudfunctions.GroceryData true "Grocery data"
 	// @Success 200 {object} cloudfunctions.Grocery "OK"
 	// @Router /api/CreateGrocery [post]
-	r.POST("/api/CreateGrocery", func(c *gin.Context) {
+	r.POST("/api/CreateGrocery", deprecated("/api/v1/groceries"), func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -53,7 +69,7 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		cloudfunctions.CreateGrocery(res, req)
 	})
-	r.PATCH("/api/UpdateGrocery", func(c *gin.Context) {
+	r.PATCH("/api/UpdateGrocery", deprecated("/api/v1/groceries/{id}"), func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -61,7 +77,7 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		cloudfunctions.UpdateGrocery(res, req)
 	})
-	r.DELETE("/api/DeleteGrocery", func(c *gin.Context) {
+	r.DELETE("/api/DeleteGrocery", deprecated("/api/v1/groceries/{id}"), func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -69,7 +85,7 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		cloudfunctions.DeleteGrocery(res, req)
 	})
-	r.GET("/api/GetGroceryByID", func(c *gin.Context) {
+	r.GET("/api/GetGroceryByID", deprecated("/api/v1/groceries/{id}"), func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -77,7 +93,7 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		cloudfunctions.GetGroceryByID(res, req)
 	})
-	r.GET("/api/ViewAllGroceries", func(c *gin.Context) {
+	r.GET("/api/ViewAllGroceries", deprecated("/api/v1/groceries"), func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -85,7 +101,7 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		cloudfunctions.ViewAllGroceries(res, req)
 	})
-	r.POST("/api/BulkCreate", func(c *gin.Context) {
+	r.POST("/api/BulkCreate", deprecated("/api/v1/imports"), func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -93,7 +109,316 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		cloudfunctions.BulkUploadGroceryItems(res, req)
 	})
-	r.POST("/api/downloadcsv", func(c *gin.Context) {
+	r.POST("/api/BulkUpdate", deprecated("/api/v1/groceries/bulk-update"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BulkUpdateGroceryItems(res, req)
+	})
+	r.POST("/api/BatchGetGroceries", deprecated("/api/v1/groceries/batch-get"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BatchGetGroceries(res, req)
+	})
+	r.POST("/api/BatchUpdateGroceries", deprecated("/api/v1/groceries/batch-update"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BatchUpdateGroceries(res, req)
+	})
+	r.POST("/api/BatchDeleteGroceries", deprecated("/api/v1/groceries/batch-delete"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BatchDeleteGroceries(res, req)
+	})
+	r.POST("/api/MappingTemplates", deprecated("/api/v1/mapping-templates"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CreateMappingTemplate(res, req)
+	})
+	r.GET("/api/MappingTemplates", deprecated("/api/v1/mapping-templates/{id}"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetMappingTemplate(res, req)
+	})
+	r.POST("/api/SuggestMapping", deprecated("/api/v1/mapping-suggestions"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.SuggestMapping(res, req)
+	})
+	r.GET("/api/imports", deprecated("/api/v1/imports/{id}"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetImportJob(res, req)
+	})
+	r.POST("/api/imports/cancel", deprecated("/api/v1/imports/{id}/cancel"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CancelImportJob(res, req)
+	})
+	r.POST("/api/imports/rollback", deprecated("/api/v1/imports/{id}/rollback"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.RollbackImportJob(res, req)
+	})
+	r.GET("/api/ExportGroceries", deprecated("/api/v1/groceries/export"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.ExportGroceries(res, req)
+	})
+	r.GET("/api/exports", deprecated("/api/v1/exports/{id}"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetExportJob(res, req)
+	})
+	r.GET("/api/snapshots", deprecated("/api/v1/snapshots"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.ListSnapshots(res, req)
+	})
+	r.POST("/api/snapshots/restore", deprecated("/api/v1/snapshots/restore"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.RestoreSnapshot(res, req)
+	})
+	r.GET("/api/catalogDiff", deprecated("/api/v1/catalog-diff"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CatalogDiff(res, req)
+	})
+	r.POST("/api/catalogDiff", deprecated("/api/v1/catalog-diff"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CatalogDiff(res, req)
+	})
+	r.GET("/api/SearchGroceries", deprecated("/api/v1/search"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.SearchGroceries(res, req)
+	})
+	r.GET("/api/SuggestGroceries", deprecated("/api/v1/suggestions"), func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.SuggestGroceries(res, req)
+	})
+
+	// The public API; the routes above are kept for older clients until the
+	// sunset date
+	v1 := r.Group("/api/v1")
+	v1.POST("/groceries", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CreateGroceryV1(res, req)
+	})
+	v1.GET("/groceries", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.ListGroceriesV1(res, req)
+	})
+	v1.GET("/groceries/:id", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetGroceryV1(res, req, c.Param("id"))
+	})
+	v1.PATCH("/groceries/:id", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.UpdateGroceryV1(res, req, c.Param("id"))
+	})
+	v1.DELETE("/groceries/:id", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.DeleteGroceryV1(res, req, c.Param("id"))
+	})
+	v1.POST("/imports", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CreateImportV1(res, req)
+	})
+	v1.GET("/imports/:id", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetImportV1(res, req, c.Param("id"))
+	})
+	v1.POST("/imports/:id/cancel", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CancelImportV1(res, req, c.Param("id"))
+	})
+	v1.POST("/imports/:id/rollback", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.RollbackImportV1(res, req, c.Param("id"))
+	})
+	v1.GET("/audit", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.ListAuditV1(res, req)
+	})
+	v1.POST("/groceries/bulk-update", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BulkUpdateGroceryItems(res, req)
+	})
+	v1.POST("/groceries/batch-get", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BatchGetGroceries(res, req)
+	})
+	v1.POST("/groceries/batch-update", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BatchUpdateGroceries(res, req)
+	})
+	v1.POST("/groceries/batch-delete", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.BatchDeleteGroceries(res, req)
+	})
+	v1.GET("/groceries/export", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.ExportGroceries(res, req)
+	})
+	v1.GET("/exports/:id", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetExportV1(res, req, c.Param("id"))
+	})
+	v1.POST("/mapping-templates", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CreateMappingTemplate(res, req)
+	})
+	v1.GET("/mapping-templates/:id", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.GetMappingTemplateV1(res, req, c.Param("id"))
+	})
+	v1.POST("/mapping-suggestions", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.SuggestMapping(res, req)
+	})
+	v1.GET("/snapshots", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.ListSnapshots(res, req)
+	})
+	v1.POST("/snapshots/restore", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.RestoreSnapshot(res, req)
+	})
+	v1.GET("/catalog-diff", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CatalogDiff(res, req)
+	})
+	v1.POST("/catalog-diff", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.CatalogDiff(res, req)
+	})
+	v1.GET("/search", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.SearchGroceries(res, req)
+	})
+	v1.GET("/suggestions", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		cloudfunctions.SuggestGroceries(res, req)
+	})
+
+	// Internal endpoints, called by Pub/Sub, Eventarc and Cloud Scheduler with
+	// an OIDC token; other callers are turned away
+	internal := r.Group("/api", pushauth.Middleware())
+	internal.POST("/downloadcsv", func(c *gin.Context) {
 		//Convert gin Context to http.ResponseWriter and *http.Request
 		req := c.Request
 		res := c.Writer
@@ -101,6 +426,34 @@ func main() {
 		//Call your CreateGrocery function passing http.ResponseWriter and *http.Request
 		async_functions.DownloadCSV(res, req)
 	})
+	internal.POST("/importFromStorage", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		async_functions.ImportFromStorage(res, req)
+	})
+	internal.POST("/exportGeneration", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		async_functions.GenerateExport(res, req)
+	})
+	internal.POST("/snapshotGeneration", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		async_functions.TakeSnapshot(res, req)
+	})
+	internal.POST("/imageCleanup", func(c *gin.Context) {
+		//Convert gin Context to http.ResponseWriter and *http.Request
+		req := c.Request
+		res := c.Writer
+
+		async_functions.DeleteReplacedImages(res, req)
+	})
 	//Swagger UI handler
 	// url := httpSwagger.URL("/swagger/doc.json")
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
@@ -116,3 +469,38 @@ func main() {
 	r.Run(":8084")
 
 }
+
+// legacyDeprecation is when the RPC-style routes were deprecated in favour
+// of /api/v1, and legacySunset when they are to be removed. main reads them
+// from LEGACY_DEPRECATION_DATE and LEGACY_SUNSET_DATE, dates such as
+// "2027-04-30"; a date that is not set leaves its header out.
+var legacyDeprecation, legacySunset time.Time
+
+// configDate reads the date in the environment variable name.
+func configDate(name string) time.Time {
+	value := os.Getenv(name)
+	if value == "" {
+		log.Printf("%s is not set; deprecated routes are sent without it", name)
+		return time.Time{}
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return date
+}
+
+// deprecated marks the responses of a route as deprecated, with the route
+// that replaces it as the successor version.
+func deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !legacyDeprecation.IsZero() {
+			c.Writer.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecation.Unix()))
+		}
+		if !legacySunset.IsZero() {
+			c.Writer.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		}
+		c.Writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		c.Next()
+	}
+}
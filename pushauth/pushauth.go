@@ -0,0 +1,68 @@
+// Package pushauth checks that a request to an internal endpoint was pushed
+// by Pub/Sub, Eventarc or Cloud Scheduler: each sends a Google-signed OIDC
+// token for the service account the subscription or job runs as.
+package pushauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/common"
+	"google.golang.org/api/idtoken"
+)
+
+// validate checks a token; tests replace it.
+var validate = idtoken.Validate
+
+// Verify checks the bearer token of r. The token has to be meant for
+// PUSH_AUDIENCE, the audience the subscriptions and jobs are given, and it
+// has to be for the PUSH_SERVICE_ACCOUNT service account. The URL of r is not
+// used as the audience, since behind gin or the Cloud Functions frontend it
+// is not the URL the token was made for.
+func Verify(r *http.Request) *apierror.Error {
+	audience := os.Getenv("PUSH_AUDIENCE")
+	if audience == "" {
+		return apierror.Internal("Push audience is not configured", errors.New("PUSH_AUDIENCE is not set"))
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return apierror.New(apierror.CodeUnauthenticated, "A bearer token is required")
+	}
+	payload, err := validate(context.Background(), token, audience)
+	if err != nil {
+		log.Printf("Rejected push token: %v", err)
+		return apierror.New(apierror.CodeUnauthenticated, "Invalid bearer token")
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || email != serviceAccount() {
+		log.Printf("Rejected push token for %q", email)
+		return apierror.New(apierror.CodePermissionDenied, "The token's account may not call this endpoint")
+	}
+	return nil
+}
+
+// Middleware rejects the requests Verify does not accept.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := Verify(c.Request); err != nil {
+			apierror.Write(c.Writer, c.Request, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func serviceAccount() string {
+	if value := os.Getenv("PUSH_SERVICE_ACCOUNT"); value != "" {
+		return value
+	}
+	return common.PushServiceAccount
+}
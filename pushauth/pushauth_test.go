@@ -0,0 +1,65 @@
+package pushauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/takeoff-capstone/apierror"
+	"github.com/takeoff-capstone/common"
+	"google.golang.org/api/idtoken"
+)
+
+func TestVerify(t *testing.T) {
+	var gotAudience string
+	validate = func(ctx context.Context, token string, audience string) (*idtoken.Payload, error) {
+		gotAudience = audience
+		switch token {
+		case "push":
+			return &idtoken.Payload{Claims: map[string]interface{}{"email": common.PushServiceAccount, "email_verified": true}}, nil
+		case "other":
+			return &idtoken.Payload{Claims: map[string]interface{}{"email": "someone@example.com", "email_verified": true}}, nil
+		}
+		return nil, errors.New("invalid token")
+	}
+	defer func() { validate = idtoken.Validate }()
+	t.Setenv("PUSH_AUDIENCE", "internal")
+
+	tests := []struct {
+		authorization string
+		want          apierror.Code
+	}{
+		{"Bearer push", ""},
+		{"", apierror.CodeUnauthenticated},
+		{"Basic push", apierror.CodeUnauthenticated},
+		{"Bearer forged", apierror.CodeUnauthenticated},
+		{"Bearer other", apierror.CodePermissionDenied},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "https://api.example.com/api/downloadcsv", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		err := Verify(r)
+		var got apierror.Code
+		if err != nil {
+			got = err.Code
+		}
+		if got != test.want {
+			t.Errorf("Verify(%q) = %q, want %q", test.authorization, got, test.want)
+		}
+	}
+	if gotAudience != "internal" {
+		t.Errorf("audience = %q, want PUSH_AUDIENCE", gotAudience)
+	}
+
+	// Without PUSH_AUDIENCE no token is accepted
+	t.Setenv("PUSH_AUDIENCE", "")
+	r := httptest.NewRequest(http.MethodPost, "/api/downloadcsv", nil)
+	r.Header.Set("Authorization", "Bearer push")
+	if err := Verify(r); err == nil || err.Code != apierror.CodeInternal {
+		t.Errorf("Verify() without PUSH_AUDIENCE = %v, want an internal error", err)
+	}
+}
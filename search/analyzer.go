@@ -0,0 +1,81 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Words too common in product text to help ranking.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "the": true, "of": true, "with": true,
+	"for": true, "in": true, "on": true, "to": true, "or": true, "by": true,
+}
+
+// Tokenize splits text into lowercase words of letters and digits. Anything
+// else separates words, so "Basmati-Rice 5kg" gives basmati, rice and 5kg.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Stem reduces an English word to a stem with a few suffix rules, so that
+// plurals and simple verb forms meet: "berries" and "berry" give "berri",
+// "chopped" and "chopping" give "chop". Stems are only compared with each
+// other and need not be words. Short words and words with digits are kept.
+func Stem(word string) string {
+	if len(word) <= 3 || strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+		return word
+	}
+	switch {
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		word = word[:len(word)-3] + "i"
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "xes"), strings.HasSuffix(word, "zes"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		word = word[:len(word)-1]
+	}
+	for _, suffix := range []string{"ing", "ed"} {
+		stem := strings.TrimSuffix(word, suffix)
+		if stem != word && len(stem) >= 3 && hasVowel(stem) {
+			word = undouble(stem)
+			break
+		}
+	}
+	if strings.HasSuffix(word, "y") && len(word) > 3 && !isVowel(rune(word[len(word)-2])) {
+		word = word[:len(word)-1] + "i"
+	}
+	return word
+}
+
+// Analyze tokenizes text, drops stop words and stems what is left.
+func Analyze(text string) []string {
+	var terms []string
+	for _, word := range Tokenize(text) {
+		if stopWords[word] {
+			continue
+		}
+		terms = append(terms, Stem(word))
+	}
+	return terms
+}
+
+func hasVowel(word string) bool {
+	return strings.IndexFunc(word, isVowel) >= 0
+}
+
+func isVowel(r rune) bool {
+	return strings.ContainsRune("aeiouy", r)
+}
+
+// undouble drops the last letter of a stem that ends in a doubled consonant
+// other than l, s or z: "chopp" becomes "chop", "roll" stays.
+func undouble(stem string) string {
+	n := len(stem)
+	if n >= 2 && stem[n-1] == stem[n-2] && !isVowel(rune(stem[n-1])) && !strings.ContainsRune("lsz", rune(stem[n-1])) {
+		return stem[:n-1]
+	}
+	return stem
+}
@@ -0,0 +1,217 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/takeoff-capstone/catalog"
+	"github.com/takeoff-capstone/utils"
+)
+
+const (
+	// A listener that stopped is started again after a pause that doubles up
+	// to the maximum
+	minRelistenDelay = time.Second
+	maxRelistenDelay = time.Minute
+)
+
+// Record is a grocery item and when it was last written.
+type Record struct {
+	Data    map[string]interface{}
+	Updated time.Time
+}
+
+// Target is an in-memory view of the catalog that a Catalog keeps in sync.
+type Target interface {
+	Put(id string, record Record)
+	Delete(id string)
+	Reset(records map[string]Record)
+}
+
+// Update is what a listener saw of the collection at ReadTime. A full update
+// holds every item; otherwise Records are the items written and Deleted the
+// items removed since the previous update.
+type Update struct {
+	ReadTime time.Time
+	Full     bool
+	Records  map[string]Record
+	Deleted  []string
+}
+
+// Listener streams updates of the collection to apply until ctx ends or the
+// stream fails. Its first update is a full one.
+type Listener func(ctx context.Context, apply func(Update)) error
+
+// Catalog keeps its targets in sync with the Groceries collection through a
+// Firestore listener, so that they see every write: those of the handlers of
+// every instance as well as imports, restores and rollbacks.
+type Catalog struct {
+	// Index is the full-text index of the catalog.
+	Index *Index
+	// Suggester gives the type-ahead suggestions of the catalog.
+	Suggester *Suggester
+
+	targets []Target
+	listen  Listener
+
+	mu        sync.Mutex
+	listening bool
+	// synced is closed once the first full update has been applied, and
+	// failed when a listener stops, after which it is replaced
+	synced   chan struct{}
+	failed   chan struct{}
+	readTime time.Time
+	err      error
+}
+
+var (
+	defaultCatalog *Catalog
+	defaultOnce    sync.Once
+)
+
+// Default returns the catalog of this process, fed by a listener on the
+// Groceries collection. Only the search service uses it: loading the catalog
+// reads the whole collection, which is done once there rather than in every
+// instance that lists groceries.
+func Default() *Catalog {
+	defaultOnce.Do(func() {
+		defaultCatalog = NewCatalog(listenGroceries)
+	})
+	return defaultCatalog
+}
+
+// NewCatalog returns a catalog that fills its targets with what listen
+// streams.
+func NewCatalog(listen Listener) *Catalog {
+	c := &Catalog{Index: NewIndex(), Suggester: NewSuggester(), listen: listen, synced: make(chan struct{}), failed: make(chan struct{})}
+	c.targets = []Target{c.Index, c.Suggester}
+	return c
+}
+
+// Ready starts the listener on first use and waits until the catalog has been
+// loaded once, or the listener failed before that. Afterwards it returns at
+// once; the catalog is as of AsOf.
+func (c *Catalog) Ready(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.listening {
+		c.listening = true
+		go c.run()
+	}
+	failed := c.failed
+	c.mu.Unlock()
+
+	select {
+	case <-c.synced:
+		return nil
+	case <-failed:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AsOf returns the read time of the last update applied. While the listener
+// is connected the catalog trails the collection by the listener's delivery
+// delay only; when it is not, AsOf tells how old the catalog is.
+func (c *Catalog) AsOf() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readTime
+}
+
+// Each calls fn for every item of the index and returns the read time the
+// items are as of. No update is applied meanwhile, so all of them are as of
+// that time.
+func (c *Catalog) Each(fn func(id string, data map[string]interface{})) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Index.Each(fn)
+	return c.readTime
+}
+
+// run keeps the listener going for the life of the process.
+func (c *Catalog) run() {
+	delay := minRelistenDelay
+	for {
+		started := time.Now()
+		err := c.listen(context.Background(), c.Apply)
+		log.Printf("Catalog listener stopped: %v", err)
+		c.mu.Lock()
+		c.err = err
+		close(c.failed)
+		c.failed = make(chan struct{})
+		c.mu.Unlock()
+
+		if time.Since(started) > maxRelistenDelay {
+			delay = minRelistenDelay
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, maxRelistenDelay)
+	}
+}
+
+// Apply brings the targets up to date with an update.
+func (c *Catalog) Apply(update Update) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if update.Full {
+		for _, target := range c.targets {
+			target.Reset(update.Records)
+		}
+		log.Printf("Catalog loaded with %d items as of %v", len(update.Records), update.ReadTime)
+	} else {
+		for id, record := range update.Records {
+			for _, target := range c.targets {
+				target.Put(id, record)
+			}
+		}
+		for _, id := range update.Deleted {
+			for _, target := range c.targets {
+				target.Delete(id)
+			}
+		}
+	}
+	c.readTime = update.ReadTime
+	c.err = nil
+	select {
+	case <-c.synced:
+	default:
+		if update.Full {
+			close(c.synced)
+		}
+	}
+}
+
+// listenGroceries streams the changes of the Groceries collection. The first
+// snapshot of a listener holds every document.
+func listenGroceries(ctx context.Context, apply func(Update)) error {
+	client, err := utils.CreateFirestoreClient()
+	if err != nil {
+		return fmt.Errorf("failed to create Firestore client: %v", err)
+	}
+	defer client.Close()
+
+	snapshots := client.Collection(catalog.Collection).Snapshots(ctx)
+	defer snapshots.Stop()
+	for full := true; ; full = false {
+		querySnapshot, err := snapshots.Next()
+		if err != nil {
+			return fmt.Errorf("failed to listen to groceries: %v", err)
+		}
+		update := Update{ReadTime: querySnapshot.ReadTime, Full: full, Records: make(map[string]Record, len(querySnapshot.Changes))}
+		for _, change := range querySnapshot.Changes {
+			if change.Kind == firestore.DocumentRemoved {
+				update.Deleted = append(update.Deleted, change.Doc.Ref.ID)
+				continue
+			}
+			update.Records[change.Doc.Ref.ID] = Record{Data: change.Doc.Data(), Updated: change.Doc.UpdateTime}
+		}
+		apply(update)
+	}
+}
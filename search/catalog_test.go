@@ -0,0 +1,64 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func grocery(name string) Record {
+	return Record{Data: map[string]interface{}{"productname": name, "brand": "Farmhouse", "category": "Dairy"}}
+}
+
+func TestCatalogAppliesListenerUpdates(t *testing.T) {
+	readTime := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	updates := make(chan Update, 2)
+	updates <- Update{ReadTime: readTime, Full: true, Records: map[string]Record{"1": grocery("Whole Milk"), "2": grocery("Butter")}}
+	c := NewCatalog(func(ctx context.Context, apply func(Update)) error {
+		for update := range updates {
+			apply(update)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Ready(ctx); err != nil {
+		t.Fatalf("Ready() = %v", err)
+	}
+	if c.Index.Len() != 2 || !c.AsOf().Equal(readTime) {
+		t.Fatalf("after the full update: %d items as of %v", c.Index.Len(), c.AsOf())
+	}
+
+	// An incremental update, as any writer's change arrives
+	later := readTime.Add(time.Second)
+	updates <- Update{ReadTime: later, Records: map[string]Record{"3": grocery("Cheddar")}, Deleted: []string{"2"}}
+	close(updates)
+	deadline := time.Now().Add(time.Second)
+	for !c.AsOf().Equal(later) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c.Index.Len() != 2 {
+		t.Errorf("index has %d items, want 2", c.Index.Len())
+	}
+	if hits, _ := c.Index.Search("butter", 10, 0); len(hits) != 0 {
+		t.Errorf("deleted item is still found: %v", hits)
+	}
+	if hits, _ := c.Index.Search("cheddar", 10, 0); len(hits) != 1 {
+		t.Errorf("created item is not found: %v", hits)
+	}
+}
+
+func TestCatalogReadyFailsWithListener(t *testing.T) {
+	failure := errors.New("permission denied")
+	c := NewCatalog(func(ctx context.Context, apply func(Update)) error {
+		return failure
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Ready(ctx); !errors.Is(err, failure) {
+		t.Errorf("Ready() = %v, want the listener's error", err)
+	}
+}
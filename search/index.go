@@ -0,0 +1,325 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Field is an indexed grocery field and the weight of a match in it.
+type Field struct {
+	Name  string
+	Boost float64
+}
+
+// Fields are the grocery fields the index searches.
+var Fields = []Field{
+	{"productname", 3},
+	{"brand", 2},
+	{"category", 1.5},
+	{"manufacturer", 1},
+	{"packageinformation", 0.5},
+}
+
+const (
+	// BM25 parameters
+	k1 = 1.2
+	b  = 0.75
+	// A word reached through prefix matching scores less than the word typed
+	// in full
+	prefixWeight = 0.7
+	// Longest list of words a prefix expands to
+	maxPrefixExpansion = 64
+)
+
+// Hit is one search result.
+type Hit struct {
+	ID    string                 `json:"id"`
+	Score float64                `json:"score"`
+	Data  map[string]interface{} `json:"grocery"`
+}
+
+type document struct {
+	data map[string]interface{}
+	// term frequencies and length of each field
+	terms   map[string][]int
+	lengths []int
+	// distinct words, for the prefix word list
+	words []string
+}
+
+// Index is an in-memory inverted index over the grocery fields. It is safe
+// for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[string]*document
+	postings map[string]map[string]bool // term -> document IDs
+	// words maps every indexed word to its stem, with a count of the
+	// documents using it, for prefix matching
+	words       map[string]string
+	wordCounts  map[string]int
+	sortedWords []string
+	totalLength []int
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	index := &Index{}
+	index.reset()
+	return index
+}
+
+func (x *Index) reset() {
+	x.docs = make(map[string]*document)
+	x.postings = make(map[string]map[string]bool)
+	x.words = make(map[string]string)
+	x.wordCounts = make(map[string]int)
+	x.sortedWords = nil
+	x.totalLength = make([]int, len(Fields))
+}
+
+// Len returns the number of indexed documents.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Each calls fn with every indexed item. The index is locked for reading
+// meanwhile, so fn must not change it.
+func (x *Index) Each(fn func(id string, data map[string]interface{})) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for id, doc := range x.docs {
+		fn(id, doc.data)
+	}
+}
+
+// Put indexes a grocery item, replacing an earlier version of it.
+func (x *Index) Put(id string, record Record) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+	x.add(id, record.Data)
+}
+
+// Delete removes a grocery item from the index.
+func (x *Index) Delete(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+}
+
+// Reset replaces the whole content of the index.
+func (x *Index) Reset(records map[string]Record) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.reset()
+	for id, record := range records {
+		x.add(id, record.Data)
+	}
+}
+
+func (x *Index) add(id string, data map[string]interface{}) {
+	doc := &document{data: data, terms: make(map[string][]int), lengths: make([]int, len(Fields))}
+	seenWords := make(map[string]bool)
+	for i, field := range Fields {
+		text, _ := data[field.Name].(string)
+		for _, word := range Tokenize(text) {
+			if stopWords[word] {
+				continue
+			}
+			term := Stem(word)
+			if doc.terms[term] == nil {
+				doc.terms[term] = make([]int, len(Fields))
+			}
+			doc.terms[term][i]++
+			doc.lengths[i]++
+			seenWords[word] = true
+		}
+		x.totalLength[i] += doc.lengths[i]
+	}
+	for term := range doc.terms {
+		if x.postings[term] == nil {
+			x.postings[term] = make(map[string]bool)
+		}
+		x.postings[term][id] = true
+	}
+	for word := range seenWords {
+		doc.words = append(doc.words, word)
+		if x.wordCounts[word] == 0 {
+			x.words[word] = Stem(word)
+			x.sortedWords = nil
+		}
+		x.wordCounts[word]++
+	}
+	x.docs[id] = doc
+}
+
+func (x *Index) remove(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	delete(x.docs, id)
+	for i := range Fields {
+		x.totalLength[i] -= doc.lengths[i]
+	}
+	for term := range doc.terms {
+		delete(x.postings[term], id)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	for _, word := range doc.words {
+		x.wordCounts[word]--
+		if x.wordCounts[word] <= 0 {
+			delete(x.wordCounts, word)
+			delete(x.words, word)
+			x.sortedWords = nil
+		}
+	}
+}
+
+// Search returns the items matching every word of the query, best first, and
+// the total number of matches. Each query word matches the words with the
+// same stem and, with a lower score, the words it is a prefix of, so "basm"
+// finds basmati rice.
+func (x *Index) Search(query string, limit, offset int) ([]Hit, int) {
+	words := Tokenize(query)
+	x.mu.Lock()
+	if x.sortedWords == nil {
+		x.sortWords()
+	}
+	x.mu.Unlock()
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	scores := make(map[string]float64)
+	matched := 0
+	for _, word := range words {
+		if stopWords[word] && len(words) > 1 {
+			continue
+		}
+		termScores := x.wordScores(word)
+		if matched == 0 {
+			scores = termScores
+		} else {
+			// Every word must match
+			for id, score := range scores {
+				if termScore, ok := termScores[id]; ok {
+					scores[id] = score + termScore
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+		matched++
+		if len(scores) == 0 {
+			break
+		}
+	}
+	if matched == 0 {
+		return []Hit{}, 0
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, Hit{ID: id, Score: math.Round(score*1000) / 1000, Data: x.docs[id].data})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	total := len(hits)
+	if offset >= total {
+		return []Hit{}, total
+	}
+	hits = hits[offset:]
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, total
+}
+
+// wordScores scores every document a query word matches, keeping the best
+// score over the terms the word expands to.
+func (x *Index) wordScores(word string) map[string]float64 {
+	terms := map[string]float64{Stem(word): 1}
+	for _, expansion := range x.prefixTerms(word) {
+		if _, ok := terms[expansion]; !ok {
+			terms[expansion] = prefixWeight
+		}
+	}
+
+	scores := make(map[string]float64)
+	for term, weight := range terms {
+		ids := x.postings[term]
+		if len(ids) == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(len(x.docs))-float64(len(ids))+0.5)/(float64(len(ids))+0.5))
+		for id := range ids {
+			score := weight * idf * x.termWeight(x.docs[id], term)
+			if score > scores[id] {
+				scores[id] = score
+			}
+		}
+	}
+	return scores
+}
+
+// termWeight is the BM25 term frequency part, summed over the fields with
+// their boosts and normalised by field length.
+func (x *Index) termWeight(doc *document, term string) float64 {
+	frequencies := doc.terms[term]
+	weighted := 0.0
+	for i, field := range Fields {
+		if frequencies[i] == 0 {
+			continue
+		}
+		average := float64(x.totalLength[i]) / float64(len(x.docs))
+		if average == 0 {
+			average = 1
+		}
+		weighted += field.Boost * float64(frequencies[i]) / (1 - b + b*float64(doc.lengths[i])/average)
+	}
+	return weighted / (k1 + weighted)
+}
+
+// prefixTerms returns the stems of the indexed words that start with prefix.
+// Called with the read lock held.
+func (x *Index) prefixTerms(prefix string) []string {
+	words := x.sortedWords
+	if words == nil {
+		// Changed since the search sorted them; scan the words instead
+		var terms []string
+		for word, stem := range x.words {
+			if strings.HasPrefix(word, prefix) && len(terms) < maxPrefixExpansion {
+				terms = append(terms, stem)
+			}
+		}
+		return terms
+	}
+	start := sort.SearchStrings(words, prefix)
+	var terms []string
+	for i := start; i < len(words) && strings.HasPrefix(words[i], prefix); i++ {
+		if len(terms) == maxPrefixExpansion {
+			break
+		}
+		terms = append(terms, x.words[words[i]])
+	}
+	return terms
+}
+
+// sortWords rebuilds the sorted word list. Called with the write lock held.
+func (x *Index) sortWords() {
+	x.sortedWords = make([]string, 0, len(x.words))
+	for word := range x.words {
+		x.sortedWords = append(x.sortedWords, word)
+	}
+	sort.Strings(x.sortedWords)
+}
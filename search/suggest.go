@@ -0,0 +1,348 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SuggestFields are the grocery fields suggestions are taken from.
+var SuggestFields = []string{"productname", "brand", "category"}
+
+// Orders of suggestions.
+const (
+	// RankPopularity puts first the values carried by the most items
+	RankPopularity = "popularity"
+	// RankRecency puts first the values of the most recently written items
+	RankRecency = "recency"
+)
+
+// Suggestion is one completion of a prefix.
+type Suggestion struct {
+	Text string `json:"text"`
+	// Count is the number of items with this value
+	Count   int       `json:"count"`
+	Updated time.Time `json:"updatedAt"`
+}
+
+const (
+	// Suggestions that took scanning more keys than this are cached until
+	// the next change, so the short prefixes typed first stay fast
+	cacheScanThreshold = 1000
+	maxCachedPrefixes  = 1024
+)
+
+// suggestValue is a distinct value of a field, keyed by its normalized form.
+type suggestValue struct {
+	// text is the value as the most recently written item spells it
+	text   string
+	items  map[string]time.Time
+	count  int
+	latest time.Time
+}
+
+// suggestKey is a value from one of its words on, so a prefix can match any
+// word of it: "brown rice" has the keys "brown rice" and "rice".
+type suggestKey struct {
+	key   string
+	value *suggestValue
+	// normalized is the key of value in the values of its field
+	normalized string
+}
+
+type suggestField struct {
+	values map[string]*suggestValue
+	// keys is kept sorted so a prefix is found by binary search
+	keys []suggestKey
+}
+
+type suggestDoc struct {
+	// normalized value of each field, empty when the item has none
+	values  []string
+	updated time.Time
+}
+
+type suggestCacheKey struct {
+	prefix string
+	limit  int
+	rank   string
+}
+
+// Suggester completes prefixes to the product names, brands and categories of
+// the catalog. It is safe for concurrent use.
+type Suggester struct {
+	mu     sync.RWMutex
+	fields []*suggestField
+	docs   map[string]suggestDoc
+
+	cacheMu sync.Mutex
+	cache   map[suggestCacheKey]map[string][]Suggestion
+}
+
+// NewSuggester returns an empty suggester.
+func NewSuggester() *Suggester {
+	s := &Suggester{}
+	s.reset()
+	return s
+}
+
+func (s *Suggester) reset() {
+	s.fields = make([]*suggestField, len(SuggestFields))
+	for i := range s.fields {
+		s.fields[i] = &suggestField{values: make(map[string]*suggestValue)}
+	}
+	s.docs = make(map[string]suggestDoc)
+	s.clearCache()
+}
+
+func (s *Suggester) clearCache() {
+	s.cacheMu.Lock()
+	s.cache = make(map[suggestCacheKey]map[string][]Suggestion)
+	s.cacheMu.Unlock()
+}
+
+// ValidRank reports whether rank is an order Suggest supports.
+func ValidRank(rank string) bool {
+	return rank == RankPopularity || rank == RankRecency
+}
+
+// Put adds the values of a grocery item, replacing an earlier version of it.
+func (s *Suggester) Put(id string, record Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	s.add(id, record, true)
+	s.clearCache()
+}
+
+// Delete removes the values of a grocery item.
+func (s *Suggester) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	s.clearCache()
+}
+
+// Reset replaces the whole content of the suggester.
+func (s *Suggester) Reset(records map[string]Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	for id, record := range records {
+		s.add(id, record, false)
+	}
+	for _, field := range s.fields {
+		sort.Slice(field.keys, func(i, j int) bool {
+			return keyLess(field.keys[i], field.keys[j])
+		})
+	}
+}
+
+// add records the values of an item. With insert false the keys are only
+// appended, for Reset to sort them once at the end.
+func (s *Suggester) add(id string, record Record, insert bool) {
+	doc := suggestDoc{values: make([]string, len(SuggestFields)), updated: record.Updated}
+	for i, name := range SuggestFields {
+		text, _ := record.Data[name].(string)
+		text = strings.TrimSpace(text)
+		normalized := normalizeSuggestion(text)
+		if normalized == "" {
+			continue
+		}
+		doc.values[i] = normalized
+
+		field := s.fields[i]
+		value, ok := field.values[normalized]
+		if !ok {
+			value = &suggestValue{items: make(map[string]time.Time)}
+			field.values[normalized] = value
+			for _, key := range suggestionKeys(normalized, value) {
+				if insert {
+					field.insertKey(key)
+				} else {
+					field.keys = append(field.keys, key)
+				}
+			}
+		}
+		value.items[id] = record.Updated
+		value.count = len(value.items)
+		if value.text == "" || !record.Updated.Before(value.latest) {
+			value.text = text
+			value.latest = record.Updated
+		}
+	}
+	s.docs[id] = doc
+}
+
+func (s *Suggester) remove(id string) {
+	doc, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	delete(s.docs, id)
+	for i, normalized := range doc.values {
+		if normalized == "" {
+			continue
+		}
+		field := s.fields[i]
+		value := field.values[normalized]
+		delete(value.items, id)
+		value.count = len(value.items)
+		if value.count == 0 {
+			delete(field.values, normalized)
+			for _, key := range suggestionKeys(normalized, value) {
+				field.deleteKey(key)
+			}
+			continue
+		}
+		if !doc.updated.Before(value.latest) {
+			value.latest = time.Time{}
+			for _, updated := range value.items {
+				if updated.After(value.latest) {
+					value.latest = updated
+				}
+			}
+		}
+	}
+}
+
+// Suggest returns, for each suggestion field, at most limit values with a
+// word starting with prefix, in the given rank order. Ties are broken by the
+// other order, then values starting with the prefix come first.
+func (s *Suggester) Suggest(prefix string, limit int, rank string) map[string][]Suggestion {
+	prefix = normalizeSuggestion(prefix)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cacheKey := suggestCacheKey{prefix, limit, rank}
+	s.cacheMu.Lock()
+	cached, ok := s.cache[cacheKey]
+	s.cacheMu.Unlock()
+	if ok {
+		return cached
+	}
+
+	suggestions := make(map[string][]Suggestion, len(SuggestFields))
+	scanned := 0
+	for i, name := range SuggestFields {
+		var n int
+		suggestions[name], n = s.fields[i].suggest(prefix, limit, rank)
+		scanned += n
+	}
+	if scanned > cacheScanThreshold {
+		s.cacheMu.Lock()
+		if len(s.cache) >= maxCachedPrefixes {
+			s.cache = make(map[suggestCacheKey]map[string][]Suggestion)
+		}
+		s.cache[cacheKey] = suggestions
+		s.cacheMu.Unlock()
+	}
+	return suggestions
+}
+
+// suggest returns the best values matching prefix and the number of keys
+// scanned to find them.
+func (f *suggestField) suggest(prefix string, limit int, rank string) ([]Suggestion, int) {
+	if prefix == "" {
+		return []Suggestion{}, 0
+	}
+	// Short prefixes match much of the catalog, so rather than sorting every
+	// match only the best limit matches are kept, in order
+	best := make([]suggestMatch, 0, limit+1)
+	start := sort.Search(len(f.keys), func(i int) bool { return f.keys[i].key >= prefix })
+	i := start
+	for ; i < len(f.keys) && strings.HasPrefix(f.keys[i].key, prefix); i++ {
+		key := f.keys[i]
+		m := suggestMatch{key.value, strings.HasPrefix(key.normalized, prefix)}
+		if len(best) == limit && !m.before(best[limit-1], rank) {
+			continue
+		}
+		// A value matches once per word starting with the prefix
+		duplicate := false
+		for _, kept := range best {
+			if kept.value == m.value {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		at := sort.Search(len(best), func(j int) bool { return m.before(best[j], rank) })
+		best = append(best, suggestMatch{})
+		copy(best[at+1:], best[at:])
+		best[at] = m
+		if len(best) > limit {
+			best = best[:limit]
+		}
+	}
+
+	suggestions := make([]Suggestion, len(best))
+	for i, m := range best {
+		suggestions[i] = Suggestion{Text: m.value.text, Count: m.value.count, Updated: m.value.latest}
+	}
+	return suggestions, i - start
+}
+
+type suggestMatch struct {
+	value *suggestValue
+	// leading is set when the value itself starts with the prefix
+	leading bool
+}
+
+// before reports whether m ranks before other.
+func (m suggestMatch) before(other suggestMatch, rank string) bool {
+	a, b := m.value, other.value
+	byCount := a.count != b.count
+	byTime := !a.latest.Equal(b.latest)
+	switch {
+	case rank == RankRecency && byTime:
+		return a.latest.After(b.latest)
+	case byCount:
+		return a.count > b.count
+	case byTime:
+		return a.latest.After(b.latest)
+	case m.leading != other.leading:
+		return m.leading
+	}
+	return a.text < b.text
+}
+
+func (f *suggestField) insertKey(key suggestKey) {
+	i := sort.Search(len(f.keys), func(i int) bool { return !keyLess(f.keys[i], key) })
+	f.keys = append(f.keys, suggestKey{})
+	copy(f.keys[i+1:], f.keys[i:])
+	f.keys[i] = key
+}
+
+func (f *suggestField) deleteKey(key suggestKey) {
+	i := sort.Search(len(f.keys), func(i int) bool { return !keyLess(f.keys[i], key) })
+	if i < len(f.keys) && f.keys[i] == key {
+		f.keys = append(f.keys[:i], f.keys[i+1:]...)
+	}
+}
+
+func keyLess(a, b suggestKey) bool {
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.normalized < b.normalized
+}
+
+// normalizeSuggestion lowercases text and keeps its words separated by single
+// spaces, so "Brown  Rice" and "brown-rice" are the same value.
+func normalizeSuggestion(text string) string {
+	return strings.Join(Tokenize(text), " ")
+}
+
+// suggestionKeys returns the keys of a value, one per word.
+func suggestionKeys(normalized string, value *suggestValue) []suggestKey {
+	keys := []suggestKey{{normalized, value, normalized}}
+	for i := 0; i < len(normalized); i++ {
+		if normalized[i] == ' ' {
+			keys = append(keys, suggestKey{normalized[i+1:], value, normalized})
+		}
+	}
+	return keys
+}
@@ -0,0 +1,87 @@
+package search
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Words the benchmark catalog is made of.
+var benchmarkWords = []string{
+	"basmati", "rice", "brown", "whole", "milk", "butter", "cheddar", "cheese", "organic", "banana",
+	"bread", "sourdough", "olive", "oil", "extra", "virgin", "pasta", "penne", "tomato", "sauce",
+	"greek", "yogurt", "honey", "almond", "oat", "granola", "coffee", "beans", "green", "tea",
+}
+
+// benchmarkSuggester returns a suggester over n items with the value mix of a
+// real catalog: many product names, fewer brands and a handful of categories.
+func benchmarkSuggester(n int) *Suggester {
+	random := rand.New(rand.NewSource(1))
+	word := func() string { return benchmarkWords[random.Intn(len(benchmarkWords))] }
+	updated := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	records := make(map[string]Record, n)
+	for i := 0; i < n; i++ {
+		records[strconv.Itoa(i)] = Record{
+			Data: map[string]interface{}{
+				"productname": fmt.Sprintf("%s %s %s %d", word(), word(), word(), i%5000),
+				"brand":       fmt.Sprintf("%s %d", word(), i%300),
+				"category":    word(),
+			},
+			Updated: updated.Add(time.Duration(i) * time.Second),
+		}
+	}
+	s := NewSuggester()
+	s.Reset(records)
+	return s
+}
+
+// BenchmarkSuggest measures type-ahead over a catalog of 100,000 items, which
+// has to stay in the single-digit milliseconds. The cache is cleared before
+// every call, as a write does, so each one finds its matches anew.
+func BenchmarkSuggest(b *testing.B) {
+	s := benchmarkSuggester(100000)
+	for _, prefix := range []string{"b", "ba", "bas", "organic m", "zz"} {
+		for _, rank := range []string{RankPopularity, RankRecency} {
+			b.Run(prefix+"/"+rank, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s.clearCache()
+					s.Suggest(prefix, 5, rank)
+				}
+			})
+		}
+	}
+}
+
+func TestSuggestRanks(t *testing.T) {
+	first := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	s := NewSuggester()
+	s.Reset(map[string]Record{
+		"1": {Data: map[string]interface{}{"productname": "Basmati Rice"}, Updated: first},
+		"2": {Data: map[string]interface{}{"productname": "Basmati Rice"}, Updated: first},
+		"3": {Data: map[string]interface{}{"productname": "Brown Basmati"}, Updated: first.Add(time.Hour)},
+	})
+
+	names := func(suggestions []Suggestion) []string {
+		result := []string{}
+		for _, suggestion := range suggestions {
+			result = append(result, suggestion.Text)
+		}
+		return result
+	}
+	if got := names(s.Suggest("bas", 5, RankPopularity)["productname"]); fmt.Sprint(got) != "[Basmati Rice Brown Basmati]" {
+		t.Errorf("by popularity = %v", got)
+	}
+	if got := names(s.Suggest("bas", 5, RankRecency)["productname"]); fmt.Sprint(got) != "[Brown Basmati Basmati Rice]" {
+		t.Errorf("by recency = %v", got)
+	}
+	if got := s.Suggest("rice", 5, RankPopularity)["productname"]; len(got) != 1 || got[0].Count != 2 {
+		t.Errorf("matching a later word = %+v", got)
+	}
+
+	s.Delete("3")
+	if got := names(s.Suggest("bas", 5, RankRecency)["productname"]); fmt.Sprint(got) != "[Basmati Rice]" {
+		t.Errorf("after a delete = %v", got)
+	}
+}
@@ -0,0 +1,145 @@
+package snapshot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Document values are written as plain JSON where JSON keeps their Firestore
+// type. The others are wrapped in a single-key object:
+//
+//	{"$time": "2024-01-02T15:04:05.999Z"}  timestamp
+//	{"$bytes": "aGVsbG8="}                 bytes
+//	{"$ref": "Groceries/abc"}              document reference
+//	{"$float": "NaN"}                      NaN and infinities
+//
+// Integers are written as JSON integers and floats always carry a decimal
+// point or exponent, so a price of 12.0 reads back as a float.
+const (
+	timeKey  = "$time"
+	bytesKey = "$bytes"
+	refKey   = "$ref"
+	floatKey = "$float"
+)
+
+// encodeData converts a document's data to its snapshot form.
+func encodeData(data map[string]interface{}) (map[string]interface{}, error) {
+	encoded := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		v, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", key, err)
+		}
+		encoded[key] = v
+	}
+	return encoded, nil
+}
+
+func encodeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool:
+		return v, nil
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return map[string]interface{}{floatKey: strconv.FormatFloat(v, 'g', -1, 64)}, nil
+		}
+		text := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		return json.Number(text), nil
+	case time.Time:
+		return map[string]interface{}{timeKey: v.UTC().Format(time.RFC3339Nano)}, nil
+	case []byte:
+		return map[string]interface{}{bytesKey: base64.StdEncoding.EncodeToString(v)}, nil
+	case *firestore.DocumentRef:
+		return map[string]interface{}{refKey: relativePath(v)}, nil
+	case []interface{}:
+		encoded := make([]interface{}, len(v))
+		for i, element := range v {
+			e, err := encodeValue(element)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = e
+		}
+		return encoded, nil
+	case map[string]interface{}:
+		return encodeData(v)
+	}
+	return nil, fmt.Errorf("unsupported value type %T", value)
+}
+
+// relativePath returns the path of a document below the database root.
+func relativePath(ref *firestore.DocumentRef) string {
+	if i := strings.Index(ref.Path, "/documents/"); i >= 0 {
+		return ref.Path[i+len("/documents/"):]
+	}
+	return ref.Path
+}
+
+// decodeData converts snapshot data, read with json.Decoder.UseNumber, back to
+// the values Firestore stores. References are resolved against client, which
+// may be nil when the data is only compared.
+func decodeData(data map[string]interface{}, client *firestore.Client) (map[string]interface{}, error) {
+	decoded := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		v, err := decodeValue(value, client)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", key, err)
+		}
+		decoded[key] = v
+	}
+	return decoded, nil
+}
+
+func decodeValue(value interface{}, client *firestore.Client) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if strings.ContainsAny(string(v), ".eE") {
+			return v.Float64()
+		}
+		return v.Int64()
+	case []interface{}:
+		decoded := make([]interface{}, len(v))
+		for i, element := range v {
+			d, err := decodeValue(element, client)
+			if err != nil {
+				return nil, err
+			}
+			decoded[i] = d
+		}
+		return decoded, nil
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return decodeData(v, client)
+		}
+		for key, wrapped := range v {
+			text, isText := wrapped.(string)
+			switch {
+			case key == timeKey && isText:
+				return time.Parse(time.RFC3339Nano, text)
+			case key == bytesKey && isText:
+				return base64.StdEncoding.DecodeString(text)
+			case key == floatKey && isText:
+				return strconv.ParseFloat(text, 64)
+			case key == refKey && isText:
+				if client == nil {
+					return text, nil
+				}
+				return client.Doc(text), nil
+			}
+		}
+		return decodeData(v, client)
+	}
+	return value, nil
+}
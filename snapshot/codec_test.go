@@ -0,0 +1,154 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTrip encodes data, writes it as JSON and decodes it the way Reader
+// does.
+func roundTrip(t *testing.T, data map[string]interface{}) (map[string]interface{}, string) {
+	t.Helper()
+	encoded, err := encodeData(data)
+	if err != nil {
+		t.Fatalf("encodeData() = %v", err)
+	}
+	text, err := json.Marshal(encoded)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+	var read map[string]interface{}
+	if err := decoder.Decode(&read); err != nil {
+		t.Fatalf("decoding %s: %v", text, err)
+	}
+	decoded, err := decodeData(read, nil)
+	if err != nil {
+		t.Fatalf("decodeData(%s) = %v", text, err)
+	}
+	return decoded, string(text)
+}
+
+func TestCodecKeepsFirestoreTypes(t *testing.T) {
+	created := time.Date(2026, 10, 19, 8, 30, 15, 123456789, time.UTC)
+	data := map[string]interface{}{
+		"productname":         "Whole Milk",
+		"vegetarian":          true,
+		"discontinued":        nil,
+		"itempackagequantity": int64(6),
+		"price":               12.0,
+		"weight":              0.5,
+		"createdAt":           created,
+		"barcode":             []byte{0x01, 0x02, 0xff},
+		"tags":                []interface{}{"dairy", int64(1), 2.5},
+		"nutrition":           map[string]interface{}{"fat": 3.5, "servings": int64(4)},
+	}
+	decoded, text := roundTrip(t, data)
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("round trip through %s\ngot  %#v\nwant %#v", text, decoded, data)
+	}
+	if !strings.Contains(text, `"price":12.0`) {
+		t.Errorf("a whole float is not written with a decimal point: %s", text)
+	}
+}
+
+func TestCodecSpecialFloats(t *testing.T) {
+	decoded, text := roundTrip(t, map[string]interface{}{
+		"nan":  math.NaN(),
+		"up":   math.Inf(1),
+		"down": math.Inf(-1),
+	})
+	if value, _ := decoded["nan"].(float64); !math.IsNaN(value) {
+		t.Errorf("nan = %v from %s", decoded["nan"], text)
+	}
+	if decoded["up"] != math.Inf(1) || decoded["down"] != math.Inf(-1) {
+		t.Errorf("infinities = %v, %v from %s", decoded["up"], decoded["down"], text)
+	}
+}
+
+func TestCodecLeavesOrdinaryMapsAlone(t *testing.T) {
+	// Single-key maps that are not wrappers, or whose wrapper value is not
+	// text, stay maps
+	data := map[string]interface{}{
+		"a": map[string]interface{}{"$time": int64(5)},
+		"b": map[string]interface{}{"label": "x"},
+	}
+	decoded, text := roundTrip(t, data)
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("round trip through %s = %#v", text, decoded)
+	}
+}
+
+func TestCodecReferenceWithoutClient(t *testing.T) {
+	decoded, err := decodeData(map[string]interface{}{"supplier": map[string]interface{}{refKey: "Suppliers/acme"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded["supplier"] != "Suppliers/acme" {
+		t.Errorf("supplier = %#v, want the document path", decoded["supplier"])
+	}
+}
+
+func TestCodecRejectsUnsupportedValues(t *testing.T) {
+	if _, err := encodeData(map[string]interface{}{"price": int32(5)}); err == nil {
+		t.Error("encodeData accepted an int32")
+	}
+}
+
+// gzipLines compresses NDJSON lines as a snapshot file.
+func gzipLines(lines ...string) io.Reader {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	gz.Close()
+	return &buf
+}
+
+func TestReaderReadsDocuments(t *testing.T) {
+	reader, err := NewReader(gzipLines(
+		`{"snapshot":{"version":1,"name":"20261019T080000Z","readTime":"2026-10-19T08:00:00Z","collections":["Groceries"]}}`,
+		`{"collection":"Groceries","id":"1001","data":{"price":2.0,"quantity":6}}`,
+	))
+	if err != nil {
+		t.Fatalf("NewReader() = %v", err)
+	}
+	defer reader.Close()
+	if reader.Header.Name != "20261019T080000Z" || !reader.Header.Contains("Groceries") || reader.Header.Contains("Audit_Logs") {
+		t.Errorf("header = %+v", reader.Header)
+	}
+
+	doc, err := reader.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	data, err := doc.Decode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.ID != "1001" || data["price"] != 2.0 || data["quantity"] != int64(6) {
+		t.Errorf("document %s = %#v", doc.ID, data)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() after the last document = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderChecksHeader(t *testing.T) {
+	for name, content := range map[string]io.Reader{
+		"not gzip":        strings.NewReader(`{"snapshot":{"version":1}}`),
+		"no header":       gzipLines(`{"collection":"Groceries","id":"1","data":{}}`),
+		"unknown version": gzipLines(`{"snapshot":{"version":2,"name":"x"}}`),
+	} {
+		if _, err := NewReader(content); err == nil {
+			t.Errorf("%s: NewReader() accepted the file", name)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// Restore actions.
+const (
+	RestoreCreate = "create"
+	RestoreUpdate = "update"
+	RestoreDelete = "delete"
+)
+
+// The restore report lists at most this many changes; the counts are always
+// complete
+const maxReportedChanges = 1000
+
+// RestoreOptions selects what a restore rebuilds.
+type RestoreOptions struct {
+	Collection string
+	// IDs restores only these documents. When empty the whole collection is
+	// rebuilt, which deletes documents created after the snapshot.
+	IDs []string
+	// DryRun only reports what the restore would change.
+	DryRun bool
+}
+
+// Change is what a restore does to one document. Fields lists the fields an
+// update changes.
+type Change struct {
+	ID     string   `json:"id"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// RestoreResult is the diff between a snapshot and the live collection and,
+// unless it was a dry run, what was applied.
+type RestoreResult struct {
+	Snapshot   string   `json:"snapshot"`
+	Collection string   `json:"collection"`
+	DryRun     bool     `json:"dryRun"`
+	Created    int      `json:"created"`
+	Updated    int      `json:"updated"`
+	Deleted    int      `json:"deleted"`
+	Unchanged  int      `json:"unchanged"`
+	Failed     int      `json:"failed,omitempty"`
+	Changes    []Change `json:"changes"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	// every change, of which Changes is the reported part
+	all []Change
+}
+
+func (r *RestoreResult) add(change Change) {
+	switch change.Action {
+	case RestoreCreate:
+		r.Created++
+	case RestoreUpdate:
+		r.Updated++
+	case RestoreDelete:
+		r.Deleted++
+	}
+	r.all = append(r.all, change)
+	if len(r.Changes) < maxReportedChanges {
+		r.Changes = append(r.Changes, change)
+	} else {
+		r.Truncated = true
+	}
+}
+
+// Restore brings the collection, or the selected documents of it, back to
+// their state in the snapshot: documents are created or overwritten with
+// their snapshot data, and documents missing from the snapshot are deleted.
+func Restore(ctx context.Context, client *firestore.Client, reader *Reader, options RestoreOptions) (*RestoreResult, error) {
+	if !reader.Header.Contains(options.Collection) {
+		return nil, fmt.Errorf("snapshot %s does not contain %s", reader.Header.Name, options.Collection)
+	}
+	result := &RestoreResult{Snapshot: reader.Header.Name, Collection: options.Collection, DryRun: options.DryRun, Changes: []Change{}}
+
+	var selected map[string]bool
+	if len(options.IDs) > 0 {
+		selected = make(map[string]bool, len(options.IDs))
+		for _, id := range options.IDs {
+			selected[id] = true
+		}
+	}
+	saved, err := readCollection(reader, options.Collection, selected)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare the live documents with the snapshot
+	collection := client.Collection(options.Collection)
+	pending := make(map[string]bool, len(saved))
+	for id := range saved {
+		pending[id] = true
+	}
+	err = liveDocuments(ctx, client, collection, options.IDs, func(doc *firestore.DocumentSnapshot) error {
+		id := doc.Ref.ID
+		savedDoc, ok := saved[id]
+		if !ok {
+			result.add(Change{ID: id, Action: RestoreDelete})
+			return nil
+		}
+		delete(pending, id)
+		live, err := encodeData(doc.Data())
+		if err != nil {
+			return fmt.Errorf("document %s: %v", id, err)
+		}
+		if fields := changedFields(live, savedDoc.Data); len(fields) > 0 {
+			result.add(Change{ID: id, Action: RestoreUpdate, Fields: fields})
+		} else {
+			result.Unchanged++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sortedKeys(pending) {
+		result.add(Change{ID: id, Action: RestoreCreate})
+	}
+	if options.DryRun || result.Created+result.Updated+result.Deleted == 0 {
+		return result, nil
+	}
+	return result, apply(ctx, client, collection, saved, result)
+}
+
+// readCollection collects the snapshot documents of one collection, or only
+// the selected ones.
+func readCollection(reader *Reader, collection string, selected map[string]bool) (map[string]*Document, error) {
+	saved := make(map[string]*Document)
+	for {
+		doc, err := reader.Next()
+		if err == io.EOF {
+			return saved, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc.Collection == collection && (selected == nil || selected[doc.ID]) {
+			saved[doc.ID] = doc
+		}
+	}
+}
+
+// liveDocuments calls fn for every existing document of the collection, or of
+// the given IDs.
+func liveDocuments(ctx context.Context, client *firestore.Client, collection *firestore.CollectionRef, ids []string, fn func(*firestore.DocumentSnapshot) error) error {
+	if len(ids) > 0 {
+		refs := make([]*firestore.DocumentRef, len(ids))
+		for i, id := range ids {
+			refs[i] = collection.Doc(id)
+		}
+		docs, err := client.GetAll(ctx, refs)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", collection.ID, err)
+		}
+		for _, doc := range docs {
+			if !doc.Exists() {
+				continue
+			}
+			if err := fn(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	docs := collection.Documents(ctx)
+	defer docs.Stop()
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", collection.ID, err)
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+}
+
+// apply writes the changes of the result through a BulkWriter.
+func apply(ctx context.Context, client *firestore.Client, collection *firestore.CollectionRef, saved map[string]*Document, result *RestoreResult) error {
+	writer := client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	for _, change := range result.all {
+		docRef := collection.Doc(change.ID)
+		var job *firestore.BulkWriterJob
+		var err error
+		if change.Action == RestoreDelete {
+			job, err = writer.Delete(docRef)
+		} else {
+			data, decodeErr := saved[change.ID].Decode(client)
+			if decodeErr != nil {
+				writer.End()
+				return fmt.Errorf("document %s: %v", change.ID, decodeErr)
+			}
+			job, err = writer.Set(docRef, data)
+		}
+		if err != nil {
+			writer.End()
+			return fmt.Errorf("failed to queue %s of %s: %v", change.Action, change.ID, err)
+		}
+		jobs = append(jobs, job)
+	}
+	writer.End()
+
+	var firstErr error
+	for i, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			result.Failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to %s %s: %v", result.all[i].Action, result.all[i].ID, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// changedFields returns the sorted names of the fields that differ between
+// two documents in encoded form.
+func changedFields(a, b map[string]interface{}) []string {
+	var fields []string
+	for key, value := range a {
+		other, ok := b[key]
+		if !ok || !sameValue(value, other) {
+			fields = append(fields, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			fields = append(fields, key)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// sameValue compares encoded values by their JSON text, which is canonical
+// for them since map keys are sorted and numbers keep their written form.
+func sameValue(a, b interface{}) bool {
+	textA, errA := json.Marshal(a)
+	textB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(textA) == string(textB)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,84 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Retention says which snapshots to keep. A snapshot is kept if it is one of
+// the KeepLast newest, or the newest snapshot of one of the Daily most recent
+// days, Weekly most recent weeks or Monthly most recent months that have a
+// snapshot. Everything else is deleted.
+type Retention struct {
+	KeepLast int `json:"keepLast"`
+	Daily    int `json:"daily"`
+	Weekly   int `json:"weekly"`
+	Monthly  int `json:"monthly"`
+}
+
+// DefaultRetention keeps a week of daily snapshots, a month of weekly ones and
+// half a year of monthly ones.
+var DefaultRetention = Retention{KeepLast: 3, Daily: 7, Weekly: 4, Monthly: 6}
+
+// Expired returns the snapshots the policy does not keep. snapshots must be
+// sorted newest first, as List returns them. The newest snapshot is always
+// kept.
+func (p Retention) Expired(snapshots []Info) []Info {
+	keep := make(map[string]bool)
+	for i := 0; i < len(snapshots) && i < max(p.KeepLast, 1); i++ {
+		keep[snapshots[i].Name] = true
+	}
+	for _, period := range []struct {
+		count int
+		key   func(time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	} {
+		seen := make(map[string]bool)
+		for _, info := range snapshots {
+			key := period.key(info.ReadTime.UTC())
+			if seen[key] {
+				continue
+			}
+			if len(seen) == period.count {
+				break
+			}
+			seen[key] = true
+			keep[info.Name] = true
+		}
+	}
+
+	var expired []Info
+	for _, info := range snapshots {
+		if !keep[info.Name] {
+			expired = append(expired, info)
+		}
+	}
+	return expired
+}
+
+// Prune deletes the stored snapshots the policy does not keep and returns
+// them.
+func Prune(ctx context.Context, storageClient *storage.Client, policy Retention) ([]Info, error) {
+	snapshots, err := List(ctx, storageClient)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []Info
+	for _, info := range policy.Expired(snapshots) {
+		err := storageClient.Bucket(Bucket).Object(info.Object).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return deleted, fmt.Errorf("failed to delete snapshot %s: %v", info.Name, err)
+		}
+		deleted = append(deleted, info)
+	}
+	return deleted, nil
+}
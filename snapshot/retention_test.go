@@ -0,0 +1,114 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// snapshotsAt returns snapshot infos for the read times, newest first as List
+// returns them.
+func snapshotsAt(times ...string) []Info {
+	infos := make([]Info, len(times))
+	for i, value := range times {
+		readTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			panic(err)
+		}
+		infos[i] = Info{Name: readTime.UTC().Format(nameLayout), ReadTime: readTime}
+	}
+	return infos
+}
+
+func names(infos []Info) []string {
+	result := []string{}
+	for _, info := range infos {
+		result = append(result, info.Name)
+	}
+	return result
+}
+
+func TestRetentionExpired(t *testing.T) {
+	// Two snapshots a day, newest first, from Monday 19 October 2026 back to
+	// Saturday 26 September 2026
+	var times []string
+	for day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC); !day.Before(time.Date(2026, 9, 26, 0, 0, 0, 0, time.UTC)); day = day.AddDate(0, 0, -1) {
+		times = append(times, day.Add(18*time.Hour).Format(time.RFC3339), day.Add(6*time.Hour).Format(time.RFC3339))
+	}
+	snapshots := snapshotsAt(times...)
+
+	tests := []struct {
+		name   string
+		policy Retention
+		kept   []string
+	}{
+		{
+			name:   "keep last",
+			policy: Retention{KeepLast: 3},
+			kept:   []string{"20261019T180000Z", "20261019T060000Z", "20261018T180000Z"},
+		},
+		{
+			name:   "daily keeps the newest of each day",
+			policy: Retention{Daily: 3},
+			kept:   []string{"20261019T180000Z", "20261018T180000Z", "20261017T180000Z"},
+		},
+		{
+			// ISO weeks start on Monday, so the Monday snapshots are a week
+			// of their own
+			name:   "weekly keeps the newest of each ISO week",
+			policy: Retention{Weekly: 3},
+			kept:   []string{"20261019T180000Z", "20261018T180000Z", "20261011T180000Z"},
+		},
+		{
+			name:   "monthly keeps the newest of each month",
+			policy: Retention{Monthly: 2},
+			kept:   []string{"20261019T180000Z", "20260930T180000Z"},
+		},
+		{
+			name:   "periods overlap",
+			policy: Retention{KeepLast: 2, Daily: 2, Monthly: 2},
+			kept:   []string{"20261019T180000Z", "20261019T060000Z", "20261018T180000Z", "20260930T180000Z"},
+		},
+		{
+			name:   "the newest snapshot is always kept",
+			policy: Retention{},
+			kept:   []string{"20261019T180000Z"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expired := test.policy.Expired(snapshots)
+			expiredSet := make(map[string]bool, len(expired))
+			for _, info := range expired {
+				expiredSet[info.Name] = true
+			}
+			var kept []string
+			for _, info := range snapshots {
+				if !expiredSet[info.Name] {
+					kept = append(kept, info.Name)
+				}
+			}
+			if !reflect.DeepEqual(kept, test.kept) {
+				t.Errorf("kept %v, want %v", kept, test.kept)
+			}
+			if len(kept)+len(expired) != len(snapshots) {
+				t.Errorf("%d kept and %d expired of %d snapshots", len(kept), len(expired), len(snapshots))
+			}
+		})
+	}
+}
+
+func TestRetentionExpiredUsesUTC(t *testing.T) {
+	// 23:30 in New York on 18 October is already 19 October in UTC
+	snapshots := snapshotsAt("2026-10-19T06:00:00Z", "2026-10-18T23:30:00-04:00", "2026-10-18T20:00:00Z")
+	expired := Retention{Daily: 2}.Expired(snapshots)
+	if got, want := names(expired), []string{"20261019T033000Z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expired %v, want %v", got, want)
+	}
+}
+
+func TestRetentionExpiredWithoutSnapshots(t *testing.T) {
+	if expired := DefaultRetention.Expired(nil); len(expired) != 0 {
+		t.Errorf("expired %v of no snapshots", names(expired))
+	}
+}
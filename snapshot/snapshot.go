@@ -0,0 +1,297 @@
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// Bucket holds the snapshots, under Prefix.
+	Bucket = "catalog_snapshots_bucket"
+	Prefix = "snapshots/"
+
+	formatVersion = 1
+	extension     = ".ndjson.gz"
+	// nameLayout is the layout of a snapshot name, its read time in UTC
+	nameLayout = "20060102T150405Z"
+	// Firestore serves reads at a past read time for an hour. A dump stops
+	// with ErrReadTimeExpired a little before that rather than fail midway
+	// with a less helpful error.
+	readTimeWindow = time.Hour - 5*time.Minute
+)
+
+// Collections are the collections a snapshot contains.
+var Collections = []string{"Groceries", "Audit_Logs"}
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// ErrReadTimeExpired means a dump could not be read within Firestore's
+// read-time window, because the collections are too large to be read in it.
+var ErrReadTimeExpired = errors.New("snapshot could not be read within the one-hour read-time window of Firestore")
+
+// A snapshot is a gzip-compressed NDJSON file. The first line is its Header,
+// every other line one Document.
+type Header struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	ReadTime    time.Time `json:"readTime"`
+	Collections []string  `json:"collections"`
+}
+
+// Contains reports whether the snapshot has the collection.
+func (h Header) Contains(collection string) bool {
+	for _, c := range h.Collections {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// Document is one document of a snapshot. Data is in the encoded form
+// described in codec.go; image and thumbnail URLs are kept as they were, but
+// the files they point to are not part of the snapshot.
+type Document struct {
+	Collection string                 `json:"collection"`
+	ID         string                 `json:"id"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// Decode returns the document's data as Firestore values.
+func (d *Document) Decode(client *firestore.Client) (map[string]interface{}, error) {
+	return decodeData(d.Data, client)
+}
+
+// Info describes a stored snapshot.
+type Info struct {
+	Name     string         `json:"name"`
+	Object   string         `json:"object"`
+	ReadTime time.Time      `json:"readTime"`
+	Size     int64          `json:"size"`
+	Counts   map[string]int `json:"counts,omitempty"`
+}
+
+// ObjectName returns the storage object of the snapshot with the given name.
+func ObjectName(name string) string {
+	return Prefix + name + extension
+}
+
+// Write dumps the header's collections as they were at its ReadTime to w.
+// Reading every collection at the same read time makes the dump consistent
+// across them even while the catalog changes. ReadTime must be a whole second
+// within the point-in-time read window of the database, and the whole dump
+// has to be read before it closes, or ErrReadTimeExpired is returned.
+func Write(ctx context.Context, client *firestore.Client, w io.Writer, header Header) (map[string]int, error) {
+	gz := gzip.NewWriter(w)
+	out := bufio.NewWriter(gz)
+	encoder := json.NewEncoder(out)
+	header.Version = formatVersion
+	if err := encoder.Encode(map[string]interface{}{"snapshot": header}); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(header.Collections))
+	for _, collection := range header.Collections {
+		docs := client.Collection(collection).WithReadOptions(firestore.ReadTime(header.ReadTime)).Documents(ctx)
+		for {
+			if time.Since(header.ReadTime) > readTimeWindow {
+				docs.Stop()
+				return counts, ErrReadTimeExpired
+			}
+			doc, err := docs.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				docs.Stop()
+				return counts, fmt.Errorf("failed to read %s: %v", collection, err)
+			}
+			data, err := encodeData(doc.Data())
+			if err != nil {
+				docs.Stop()
+				return counts, fmt.Errorf("document %s/%s: %v", collection, doc.Ref.ID, err)
+			}
+			if err := encoder.Encode(Document{Collection: collection, ID: doc.Ref.ID, Data: data}); err != nil {
+				docs.Stop()
+				return counts, err
+			}
+			counts[collection]++
+		}
+		docs.Stop()
+	}
+
+	if err := out.Flush(); err != nil {
+		return counts, err
+	}
+	return counts, gz.Close()
+}
+
+// Take writes a snapshot of Collections to the snapshot bucket. The snapshot
+// is read as of the last whole second before now.
+func Take(ctx context.Context, client *firestore.Client, storageClient *storage.Client, now time.Time) (*Info, error) {
+	readTime := now.UTC().Add(-time.Second).Truncate(time.Second)
+	header := Header{Name: readTime.Format(nameLayout), ReadTime: readTime, Collections: Collections}
+	info := &Info{Name: header.Name, Object: ObjectName(header.Name), ReadTime: readTime}
+
+	object := storageClient.Bucket(Bucket).Object(info.Object)
+	// Cancelling the upload's context discards a dump that failed halfway,
+	// where closing the writer would store it
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := object.NewWriter(uploadCtx)
+	wc.ContentType = "application/x-ndjson"
+	wc.ContentEncoding = "gzip"
+	counts, err := Write(ctx, client, wc, header)
+	if err != nil {
+		cancel()
+		wc.Close()
+		return nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close Cloud Storage writer: %v", err)
+	}
+
+	// The counts are only known once the dump is written
+	metadata := map[string]string{"readTime": readTime.Format(time.RFC3339)}
+	for collection, count := range counts {
+		metadata["count_"+collection] = strconv.Itoa(count)
+	}
+	attrs, err := object.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record snapshot counts: %v", err)
+	}
+	info.Size = attrs.Size
+	info.Counts = counts
+	return info, nil
+}
+
+// List returns the stored snapshots, newest first.
+func List(ctx context.Context, storageClient *storage.Client) ([]Info, error) {
+	var snapshots []Info
+	objects := storageClient.Bucket(Bucket).Objects(ctx, &storage.Query{Prefix: Prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots: %v", err)
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(attrs.Name, Prefix), extension)
+		readTime, err := time.Parse(nameLayout, name)
+		if err != nil || !strings.HasSuffix(attrs.Name, extension) {
+			continue
+		}
+		info := Info{Name: name, Object: attrs.Name, ReadTime: readTime, Size: attrs.Size}
+		for key, value := range attrs.Metadata {
+			if collection := strings.TrimPrefix(key, "count_"); collection != key {
+				if count, err := strconv.Atoi(value); err == nil {
+					if info.Counts == nil {
+						info.Counts = make(map[string]int)
+					}
+					info.Counts[collection] = count
+				}
+			}
+		}
+		snapshots = append(snapshots, info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ReadTime.After(snapshots[j].ReadTime)
+	})
+	return snapshots, nil
+}
+
+// Reader reads the documents of a snapshot in the order they were written.
+type Reader struct {
+	Header  Header
+	body    io.Closer
+	gz      *gzip.Reader
+	decoder *json.Decoder
+}
+
+// NewReader reads a snapshot from r and checks its header.
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot is not gzip-compressed: %v", err)
+	}
+	reader, err := NewUncompressedReader(gz)
+	if err != nil {
+		gz.Close()
+		return nil, err
+	}
+	reader.gz = gz
+	return reader, nil
+}
+
+// NewUncompressedReader reads a snapshot whose compression was already
+// undone.
+func NewUncompressedReader(r io.Reader) (*Reader, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var first struct {
+		Snapshot *Header `json:"snapshot"`
+	}
+	if err := decoder.Decode(&first); err != nil || first.Snapshot == nil {
+		return nil, fmt.Errorf("snapshot header is missing")
+	}
+	if first.Snapshot.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", first.Snapshot.Version)
+	}
+	return &Reader{Header: *first.Snapshot, decoder: decoder}, nil
+}
+
+// Open opens the stored snapshot with the given name.
+func Open(ctx context.Context, storageClient *storage.Client, name string) (*Reader, error) {
+	// Read the stored bytes as they are; the reader undoes the compression
+	body, err := storageClient.Bucket(Bucket).Object(ObjectName(name)).ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %v", err)
+	}
+	reader, err := NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	reader.body = body
+	return reader, nil
+}
+
+// Next returns the next document, or io.EOF after the last one.
+func (r *Reader) Next() (*Document, error) {
+	var doc Document
+	if err := r.decoder.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read snapshot document: %v", err)
+	}
+	return &doc, nil
+}
+
+// Close releases the snapshot.
+func (r *Reader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}